@@ -56,6 +56,42 @@ func (h *AdminAPI) HandleRequest(handlerKey, param, body string, uad *sec.UserAu
 		}
 		cr, _ := h.Database.UpsertUsers(usersToUpdate)
 		return MarshalJSON[res.CoggedResponse](cr, uad), nil
+
+	case "GET schemas":
+		return MarshalJSON[res.PayloadSchemasResponse](res.PayloadSchemasResponseFromRegistry(), uad), nil
+
+	case "PUT schema":
+		r := &req.PayloadSchemaRequest{}
+		if berr := req.BindToRequest[req.PayloadSchemaRequest](body, r, ud); berr != nil {
+			return "", &APIError{Info: berr.Error(), StatusCode: 400}
+		}
+		if err := h.Database.UpsertPayloadSchema(&r.PayloadSchema); err != nil {
+			return MarshalJSON[res.PayloadSchemasResponse](res.PayloadSchemasResponseFromError(err.Error()), uad), nil
+		}
+		return MarshalJSON[res.PayloadSchemasResponse](res.PayloadSchemasResponseFromRegistry(), uad), nil
+
+	case "POST vectors":
+		r := &req.VectorCheckRequest{}
+		if berr := req.BindToRequest[req.VectorCheckRequest](body, r, ud); berr != nil {
+			return "", &APIError{Info: berr.Error(), StatusCode: 400}
+		}
+		return MarshalJSON[res.VectorCheckResponse](h.Database.CheckVectors(r.Type, r.Reembed), uad), nil
+
+	case "POST blobs":
+		r := &req.BlobGCRequest{}
+		if berr := req.BindToRequest[req.BlobGCRequest](body, r, ud); berr != nil {
+			return "", &APIError{Info: berr.Error(), StatusCode: 400}
+		}
+		return MarshalJSON[res.BlobGCResponse](h.Database.CollectBlobGarbage(r.DryRun), uad), nil
+
+	case "DELETE schema":
+		if param == "" {
+			return "", &APIError{Info: "missing type", StatusCode: 400}
+		}
+		if err := h.Database.DeletePayloadSchema(param); err != nil {
+			return MarshalJSON[res.PayloadSchemasResponse](res.PayloadSchemasResponseFromError(err.Error()), uad), nil
+		}
+		return MarshalJSON[res.PayloadSchemasResponse](res.PayloadSchemasResponseFromRegistry(), uad), nil
 	}
 	return "", &APIError{Info: "not found", StatusCode: 404}
 }
@@ -0,0 +1,155 @@
+package api
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	res "cogged/responses"
+	sec "cogged/security"
+	svc "cogged/services"
+	state "cogged/state"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// MAX_BLOB_JSON_BODY caps the JSON body of the blob routes that take one, which
+// ServeHTTP leaves unread for this route group.
+const MAX_BLOB_JSON_BODY = 4096
+
+// BlobAPI streams the content a node's b refers to in and out of the blob store. Its
+// requests and responses are not JSON documents, so ServeHTTP passes it the request and
+// response unread and unwritten (see StreamHandler).
+type BlobAPI struct {
+	Configuration *svc.Config
+	Database      *svc.DB
+}
+
+func NewBlobAPI(config *svc.Config, db *svc.DB) *BlobAPI {
+	a := &BlobAPI{
+		Configuration: config,
+		Database:      db,
+	}
+	return a
+}
+
+// contentDigestSHA256 gives the hex SHA-256 in an RFC 9530 Content-Digest header, such as
+// "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:", or "" if it has none.
+func contentDigestSHA256(header string) (string, error) {
+	for _, d := range strings.Split(header, ",") {
+		v, ok := strings.CutPrefix(strings.TrimSpace(d), "sha-256=")
+		if !ok {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.Trim(v, ":"))
+		if err != nil || len(b) != 32 || !strings.HasPrefix(v, ":") || !strings.HasSuffix(v, ":") {
+			return "", &APIError{Info: "bad sha-256 in Content-Digest", StatusCode: http.StatusBadRequest}
+		}
+		return hex.EncodeToString(b), nil
+	}
+	return "", nil
+}
+
+func (h *BlobAPI) maxSize() int64 {
+	if h.Database.Blobs == nil {
+		return 0
+	}
+	return h.Database.Blobs.MaxSize
+}
+
+func (h *BlobAPI) HandleStream(handlerKey, param string, w http.ResponseWriter, r *http.Request, uad *sec.UserAuthData) (string, error) {
+	if h.Database == nil || h.Database.Blobs == nil {
+		return "", &APIError{Info: "blob storage is not configured", StatusCode: http.StatusNotFound}
+	}
+	ud := req.UnpackData{UAD: uad}
+
+	switch handlerKey {
+
+	case "PUT data":
+		tn := cm.AuthzDataUnpackADString(param, *uad, "w")
+		if tn == nil {
+			return "", &APIError{Info: "invalid node ID", StatusCode: http.StatusBadRequest}
+		}
+		if r.ContentLength > h.maxSize() {
+			return "", blobAPIError(&http.MaxBytesError{Limit: h.maxSize()})
+		}
+		sum, err := contentDigestSHA256(r.Header.Get("Content-Digest"))
+		if err != nil {
+			return "", err
+		}
+		br, err := h.Database.PutNodeBlob(tn.Uid, http.MaxBytesReader(w, r.Body, h.maxSize()), sum)
+		if err != nil {
+			return "", blobAPIError(err)
+		}
+		return MarshalJSON[res.BlobResponse](br, uad), nil
+
+	case "GET data", "HEAD data":
+		tn := cm.AuthzDataUnpackADString(param, *uad, "r")
+		if tn == nil {
+			return "", &APIError{Info: "invalid node ID", StatusCode: http.StatusBadRequest}
+		}
+		f, info, err := h.Database.OpenNodeBlob(tn.Uid, uad, state.UsmUserAllowedSgis(uad.Uid))
+		if err != nil {
+			return "", blobAPIError(err)
+		}
+		defer f.Close()
+		sum, _ := hex.DecodeString(info.SHA256)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "private")
+		w.Header().Set("ETag", `"`+info.SHA256+`"`)
+		// a digest of the whole blob, which a range request only gets part of
+		w.Header().Set("Repr-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum)+":")
+		http.ServeContent(w, r, "", info.ModTime, f)
+		return "", nil
+
+	case "POST upload":
+		tn := cm.AuthzDataUnpackADString(param, *uad, "w")
+		if tn == nil {
+			return "", &APIError{Info: "invalid node ID", StatusCode: http.StatusBadRequest}
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_BLOB_JSON_BODY))
+		if err != nil {
+			return "", &APIError{Info: "bad request body", StatusCode: http.StatusBadRequest}
+		}
+		br := &req.BlobUploadRequest{}
+		if berr := req.BindToRequest[req.BlobUploadRequest](string(body), br, ud); berr != nil {
+			return "", &APIError{Info: berr.Error(), StatusCode: http.StatusBadRequest}
+		}
+		ur, err := h.Database.StartBlobUpload(tn.Uid, uad.Uid, br.Size, br.SHA256)
+		if err != nil {
+			return "", blobAPIError(err)
+		}
+		return MarshalJSON[res.BlobUploadResponse](ur, uad), nil
+
+	case "GET uploads", "HEAD uploads":
+		ur, err := h.Database.BlobUploadStatus(param, uad.Uid)
+		if err != nil {
+			return "", blobAPIError(err)
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(ur.Offset, 10))
+		return MarshalJSON[res.BlobUploadResponse](ur, uad), nil
+
+	case "PATCH uploads":
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			return "", &APIError{Info: "Upload-Offset header must give the offset the chunk starts at", StatusCode: http.StatusBadRequest}
+		}
+		ur, err := h.Database.AppendBlobUpload(param, uad.Uid, offset, http.MaxBytesReader(w, r.Body, h.maxSize()))
+		if err != nil {
+			return "", blobAPIError(err)
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(ur.Offset, 10))
+		return MarshalJSON[res.BlobUploadResponse](ur, uad), nil
+
+	case "DELETE uploads":
+		ur, err := h.Database.AbortBlobUpload(param, uad.Uid)
+		if err != nil {
+			return "", blobAPIError(err)
+		}
+		return MarshalJSON[res.BlobUploadResponse](ur, uad), nil
+	}
+	return "", &APIError{Info: "not found", StatusCode: http.StatusNotFound}
+}
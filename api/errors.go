@@ -1,5 +1,13 @@
 package api
 
+import (
+	"cogged/log"
+	svc "cogged/services"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
 type APIError struct {
 	Info       string
 	StatusCode int
@@ -8,3 +16,41 @@ type APIError struct {
 func (e APIError) Error() string {
 	return e.Info
 }
+
+// policyAPIError turns a policy or topology constraint violation reported by the services
+// layer into a 400. Any other error gives nil, and is reported as usual in the response.
+func policyAPIError(err error) *APIError {
+	if perr, ok := err.(svc.PolicyError); ok {
+		return &APIError{Info: perr.Error(), StatusCode: 400}
+	}
+	return nil
+}
+
+// blobAPIError turns an error from a blob operation into the APIError to respond with: the
+// status for the kind of BlobError, 413 for a body over the size limit, 400 for a policy
+// violation, and 500 for anything else.
+func blobAPIError(err error) *APIError {
+	var be svc.BlobError
+	var mbe *http.MaxBytesError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &be):
+		status := map[int]int{
+			svc.BLOB_ERR_NOT_FOUND: http.StatusNotFound,
+			svc.BLOB_ERR_TOO_LARGE: http.StatusRequestEntityTooLarge,
+			svc.BLOB_ERR_CONFLICT:  http.StatusConflict,
+		}[be.Kind]
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+		return &APIError{Info: be.Error(), StatusCode: status}
+	case errors.As(err, &mbe):
+		return &APIError{Info: fmt.Sprintf("blob is larger than %d bytes", mbe.Limit), StatusCode: http.StatusRequestEntityTooLarge}
+	}
+	if aerr := policyAPIError(err); aerr != nil {
+		return aerr
+	}
+	log.Error("blob operation", err)
+	return &APIError{Info: "blob operation failed", StatusCode: http.StatusInternalServerError}
+}
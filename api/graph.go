@@ -7,17 +7,20 @@ import (
 	sec "cogged/security"
 	svc "cogged/services"
 	state "cogged/state"
+	"strings"
 )
 
 type GraphAPI struct {
 	Configuration *svc.Config
 	Database      *svc.DB
+	Policies      svc.PermissionPolicies
 }
 
 func NewGraphAPI(config *svc.Config, db *svc.DB) *GraphAPI {
 	a := &GraphAPI{
 		Configuration: config,
 		Database:      db,
+		Policies:      svc.LoadPermissionPolicies(config),
 	}
 	return a
 }
@@ -37,6 +40,24 @@ func (h *GraphAPI) HandleRequest(handlerKey, param, body string, uad *sec.UserAu
 		cr := h.Database.QueryWithOptions(r, svc.NODENODE, uad, state.UsmUserAllowedSgis(uid))
 		return MarshalJSON[res.CoggedResponse](cr, uad), nil
 
+	case "POST path":
+		ud.RequiredPermissions = "r"
+		r := &req.PathRequest{}
+		if berr := req.BindToRequest[req.PathRequest](body, r, ud); berr != nil {
+			return "", &APIError{Info: berr.Error(), StatusCode: 400}
+		}
+		pr := h.Database.QueryShortestPaths(r, uad, state.UsmUserAllowedSgis(uid))
+		return MarshalJSON[res.PathResponse](pr, uad), nil
+
+	case "POST search":
+		ud.RequiredPermissions = "r"
+		r := &req.SearchRequest{}
+		if berr := req.BindToRequest[req.SearchRequest](body, r, ud); berr != nil {
+			return "", &APIError{Info: berr.Error(), StatusCode: 400}
+		}
+		cr := h.Database.Search(r, uad, state.UsmUserAllowedSgis(uid))
+		return MarshalJSON[res.CoggedResponse](cr, uad), nil
+
 	case "GET sharedwith":
 		ud.RequiredPermissions = "s"
 		tn := cm.AuthzDataUnpackADString(param, *ud.UAD, ud.RequiredPermissions)
@@ -54,7 +75,10 @@ func (h *GraphAPI) HandleRequest(handlerKey, param, body string, uad *sec.UserAu
 		if berr := req.BindToRequest[req.UpdateNodesRequest](body, r, ud); berr != nil {
 			return "", &APIError{Info: berr.Error(), StatusCode: 400}
 		}
-		cr, _ := h.Database.UpsertNodes(r.Nodes)
+		cr, err := h.Database.UpsertNodes(r.Nodes)
+		if aerr := policyAPIError(err); aerr != nil {
+			return "", aerr
+		}
 		return MarshalJSON[res.CoggedResponse](cr, uad), nil
 
 	case "PUT nodes":
@@ -81,6 +105,7 @@ func (h *GraphAPI) HandleRequest(handlerKey, param, body string, uad *sec.UserAu
 		newnodes := *r.Nodes
 		newEdges := make(cm.NodePtrDictionary)
 		nodesLinkedFromOtherNewNodes := make(map[string]bool)
+		linkingNewNode := make(map[string]*cm.GraphNode)
 
 		nodeOwnerUid := uid
 
@@ -99,9 +124,15 @@ func (h *GraphAPI) HandleRequest(handlerKey, param, body string, uad *sec.UserAu
 					// Only allow one level of depth for OutEdges, i.e. no multilevel nested edges
 					(*nOE)[i] = cm.NewGraphNodeJustUID(edgeUid)
 					nodesLinkedFromOtherNewNodes[edgeUid] = true
+					if _, ok := linkingNewNode[edgeUid]; !ok {
+						linkingNewNode[edgeUid] = n
+					}
 				}
 			}
 		}
+		if perr := applyNewNodePolicies(h.Policies, newnodes, linkingNewNode, tn); perr != nil {
+			return "", &APIError{Info: perr.Error(), StatusCode: 400}
+		}
 
 		atLeastOneNewNodeIsChildOfExistingNode := false
 
@@ -123,7 +154,16 @@ func (h *GraphAPI) HandleRequest(handlerKey, param, body string, uad *sec.UserAu
 			newnodes = append(newnodes, e)
 		}
 
-		cr, _ := h.Database.UpsertNodes(&newnodes)
+		var cr *res.CoggedResponse
+		var err error
+		if r.Upsert != "" {
+			cr, err = h.Database.UpsertNodesByID(&newnodes, r.Upsert, nodeOwnerUid)
+		} else {
+			cr, err = h.Database.UpsertNodes(&newnodes)
+		}
+		if aerr := policyAPIError(err); aerr != nil {
+			return "", aerr
+		}
 		return MarshalJSON[res.CoggedResponse](cr, uad), nil
 
 	case "PUT edges":
@@ -132,7 +172,10 @@ func (h *GraphAPI) HandleRequest(handlerKey, param, body string, uad *sec.UserAu
 		if berr := req.BindToRequest[req.EdgesRequest](body, &r, ud); berr != nil {
 			return "", &APIError{Info: berr.Error(), StatusCode: 400}
 		}
-		cr, _ := h.Database.AddNodeEdges(r.SubjectIds, r.IncomingIds, r.OutgoingIds)
+		cr, err := h.Database.AddNodeEdges(r.SubjectIds, r.IncomingIds, r.OutgoingIds)
+		if aerr := policyAPIError(err); aerr != nil {
+			return "", aerr
+		}
 		return MarshalJSON[res.CoggedResponse](cr, uad), nil
 
 	case "PATCH edges":
@@ -144,7 +187,115 @@ func (h *GraphAPI) HandleRequest(handlerKey, param, body string, uad *sec.UserAu
 		cr, _ := h.Database.RemoveNodeEdges(r.SubjectIds, r.IncomingIds, r.OutgoingIds)
 		return MarshalJSON[res.CoggedResponse](cr, uad), nil
 
+	case "POST transfer":
+		//note: ownership of every node is checked in TransferNodesRequest.AuthzDataUnpack()
+		r := req.TransferNodesRequest{}
+		if berr := req.BindToRequest[req.TransferNodesRequest](body, &r, ud); berr != nil {
+			return "", &APIError{Info: berr.Error(), StatusCode: 400}
+		}
+		if *r.NewOwner.Role == sec.SYS_ROLE {
+			return "", &APIError{Info: "user not found", StatusCode: 404}
+		}
+
+		cr, err := h.Database.TransferNodeOwnership(*r.UnpackedNodes, r.NewOwner.Uid, r.Depth, r.KeepShare)
+		if err == nil && r.KeepShare {
+			allowListPreviousOwners(*r.UnpackedNodes, cr.ResultNodes, r.NewOwner.Uid)
+		}
+		return MarshalJSON[res.CoggedResponse](cr, uad), nil
+
+	case "PATCH permissions":
+		//note: ownership of every node is checked in SubgraphPermsRequest.AuthzDataUnpack()
+		r := req.SubgraphPermsRequest{}
+		if berr := req.BindToRequest[req.SubgraphPermsRequest](body, &r, ud); berr != nil {
+			return "", &APIError{Info: berr.Error(), StatusCode: 400}
+		}
+		newSgi := ""
+		if r.ResetSgi {
+			newSgi = sec.GenerateSgi()
+		}
+
+		pr, err := h.Database.UpdateSubgraphPermissions(*r.UnpackedNodes, r.Depth, r.Perms, newSgi, r.DryRun)
+		if err == nil && !r.DryRun {
+			updateShareeAllowLists(pr.Sharees)
+		}
+		return MarshalJSON[res.SubgraphPermsResponse](pr, uad), nil
+
 	}
 
 	return "", &APIError{Info: "not found", StatusCode: 404}
 }
+
+// updateShareeAllowLists brings sharees' session allowlists in line with a share group
+// change, so a sharee neither keeps reading a node moved out of the share group they were
+// granted nor has to list their shared nodes again to pick up the new one.
+func updateShareeAllowLists(changes []*res.ShareeAccessChange) {
+	for _, sc := range changes {
+		if len(sc.SgisGranted) > 0 {
+			state.UsmUserAllowlistSgi(sc.User.Uid, strings.Join(sc.SgisGranted, ",")+",")
+		}
+		if len(sc.SgisRevoked) > 0 {
+			state.UsmUserRevokeSgi(sc.User.Uid, strings.Join(sc.SgisRevoked, ",")+",")
+		}
+	}
+}
+
+// allowListPreviousOwners grants each previous owner the share group of every root they
+// gave away in a keep_share transfer, as PUT /user/share does for a new sharee, so the
+// share edge is usable straight away. transferred carries the roots' new owner, which is
+// what makes them count as shared rather than owned.
+func allowListPreviousOwners(roots, transferred []*cm.GraphNode, newOwnerUid string) {
+	byUid := make(map[string]*cm.GraphNode)
+	for _, n := range transferred {
+		byUid[n.Uid] = n
+	}
+	for _, root := range roots {
+		if root.Owner == nil || root.Owner.Uid == newOwnerUid {
+			continue
+		}
+		if n, ok := byUid[svc.SanitiseUID(root.Uid)]; ok {
+			AllowListSharedSgis(root.Owner.Uid, []*cm.GraphNode{n})
+		}
+	}
+}
+
+// applyNewNodePolicies applies the permission policies to the nodes of a PUT /graph/nodes.
+// A node is created under the new node that links to it (the first, if several do), so
+// that node is its parent for an inheriting policy, and gets its own bits first. Every
+// other node, like the one attached to parent when every new node is linked from another,
+// is created under the existing parent.
+func applyNewNodePolicies(pp svc.PermissionPolicies, newnodes []*cm.GraphNode, linkingNewNode map[string]*cm.GraphNode, parent *cm.GraphNode) error {
+	attached := false
+	for _, n := range newnodes {
+		if _, ok := linkingNewNode[n.Uid]; !ok {
+			attached = true
+		}
+	}
+	if !attached && len(newnodes) > 0 {
+		delete(linkingNewNode, newnodes[0].Uid)
+	}
+
+	done := make(map[string]bool)
+	var apply func(n *cm.GraphNode, visiting map[string]bool) error
+	apply = func(n *cm.GraphNode, visiting map[string]bool) error {
+		if done[n.Uid] {
+			return nil
+		}
+		p := parent
+		// a cycle among the new nodes falls back to the existing parent where it closes
+		if from, ok := linkingNewNode[n.Uid]; ok && !visiting[from.Uid] {
+			visiting[n.Uid] = true
+			if err := apply(from, visiting); err != nil {
+				return err
+			}
+			p = from
+		}
+		done[n.Uid] = true
+		return pp.ApplyToNewNode(n, p)
+	}
+	for _, n := range newnodes {
+		if err := apply(n, make(map[string]bool)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
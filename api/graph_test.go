@@ -0,0 +1,65 @@
+package api
+
+import (
+	"testing"
+
+	cm "cogged/models"
+	svc "cogged/services"
+)
+
+// Two levels created at once under an inheriting policy: the grandchild inherits from the
+// new node that links to it, which itself inherits from the existing parent.
+func TestApplyNewNodePoliciesInheritsFromLinkingNewNode(t *testing.T) {
+	pp, err := svc.NewPermissionPolicies(&svc.Config{
+		"policy.perms.folder.inherit": "true",
+		"policy.perms.folder.default": "r",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tr, f := true, false
+	parent := cm.NewGraphNodeJustUID("0x1")
+	parent.PermRead, parent.PermWrite = &tr, &tr
+
+	ty := "folder"
+	grandchild := cm.NewGraphNodeJustUID("$b")
+	grandchild.Type = &ty
+	child := cm.NewGraphNodeJustUID("$a")
+	child.Type, child.PermWrite = &ty, &f
+	child.OutEdges = &[]*cm.GraphNode{cm.NewGraphNodeJustUID("$b")}
+
+	// the grandchild comes first, so its parent has to be worked out before it
+	newnodes := []*cm.GraphNode{grandchild, child}
+	if err := applyNewNodePolicies(pp, newnodes, map[string]*cm.GraphNode{"$b": child}, parent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !*child.PermRead || *child.PermWrite {
+		t.Errorf("the child should inherit r from the existing parent and keep its own w=false")
+	}
+	if !*grandchild.PermRead || *grandchild.PermWrite {
+		t.Errorf("the grandchild should inherit from the child, not the existing parent")
+	}
+}
+
+// When every new node is linked from another, the first is attached to the existing
+// parent, so it inherits from there and the cycle does not recurse forever.
+func TestApplyNewNodePoliciesCycle(t *testing.T) {
+	pp, _ := svc.NewPermissionPolicies(&svc.Config{"policy.perms.folder.inherit": "true"})
+	tr := true
+	parent := cm.NewGraphNodeJustUID("0x1")
+	parent.PermShare = &tr
+
+	ty := "folder"
+	a, b := cm.NewGraphNodeJustUID("$a"), cm.NewGraphNodeJustUID("$b")
+	a.Type, b.Type = &ty, &ty
+	b.PermRead = &tr
+	if err := applyNewNodePolicies(pp, []*cm.GraphNode{a, b}, map[string]*cm.GraphNode{"$a": b, "$b": a}, parent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !*a.PermShare || *a.PermRead {
+		t.Errorf("the attached node should inherit from the existing parent")
+	}
+	if !*b.PermShare || !*b.PermRead {
+		t.Errorf("the node it links to should inherit from it, keeping its own bits")
+	}
+}
@@ -5,8 +5,17 @@ package api
 
 import (
 	sec "cogged/security"
+	"net/http"
 )
 
 type Handler interface {
 	HandleRequest(handlerKey, param, body string, uad *sec.UserAuthData) (string, error)
 }
+
+// StreamHandler is implemented by route groups whose bodies are not JSON documents, such
+// as blob uploads and downloads. ServeHTTP does not check the content type or read the body
+// for them. HandleStream returns JSON for ServeHTTP to send as usual, or "" once it has
+// written the response itself.
+type StreamHandler interface {
+	HandleStream(handlerKey, param string, w http.ResponseWriter, r *http.Request, uad *sec.UserAuthData) (string, error)
+}
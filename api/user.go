@@ -12,12 +12,14 @@ import (
 type UserAPI struct {
 	Configuration *svc.Config
 	Database      *svc.DB
+	Policies      svc.PermissionPolicies
 }
 
 func NewUserAPI(config *svc.Config, db *svc.DB) *UserAPI {
 	a := &UserAPI{
 		Configuration: config,
 		Database:      db,
+		Policies:      svc.LoadPermissionPolicies(config),
 	}
 	return a
 }
@@ -38,7 +40,7 @@ func UpdateAllowListSharedSgis(allow bool, uid string, nl []*cm.GraphNode) {
 		if owner != nil && owner.Uid == uid {
 			continue
 		}
-		if *node.PermRead && node.Sgi != nil {
+		if node.PermRead != nil && *node.PermRead && node.Sgi != nil {
 			sgiSet[*node.Sgi] = true
 		}
 	}
@@ -69,6 +71,9 @@ func (h *UserAPI) HandleRequest(handlerKey, param, body string, uad *sec.UserAut
 		if berr := req.BindToRequest[req.UserNodeRequest](body, &r, ud); berr != nil {
 			return "", &APIError{Info: berr.Error(), StatusCode: 400}
 		}
+		if perr := h.Policies.ApplyToNewNode(r.Node, nil); perr != nil {
+			return "", &APIError{Info: perr.Error(), StatusCode: 400}
+		}
 		ts := sec.GenerateSgi()
 		r.Node.Sgi = &ts
 		cr, _ := h.Database.UpsertUserNode(r.Node, uid)
@@ -0,0 +1,23 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	sec "cogged/security"
+	svc "cogged/services"
+)
+
+// A permission policy violation is rejected with a 400 before anything reaches the DB
+// (the handler here has none).
+func TestPutUserNodeRejectsPolicyViolation(t *testing.T) {
+	conf := &svc.Config{"policy.perms.doc.ceiling": "r"}
+	h := NewUserAPI(conf, nil)
+	uad := &sec.UserAuthData{Uid: "0x1", Role: "user"}
+
+	_, err := h.HandleRequest("PUT node", "", `{"node":{"uid":"$n","ty":"doc","r":true,"w":true}}`, uad)
+	aerr, ok := err.(*APIError)
+	if !ok || aerr.StatusCode != 400 || !strings.Contains(aerr.Info, "may not have permission 'w'") {
+		t.Errorf("expected a 400 naming the disallowed bit, got %v", err)
+	}
+}
@@ -202,6 +202,36 @@ func (c *CoggedApiClient) AdminUsersPatch(ur *req.UsersRequest) (*res.CoggedResp
 	return r, err
 }
 
+func (c *CoggedApiClient) AdminSchemasGet() (*res.PayloadSchemasResponse, error) {
+	r := &res.PayloadSchemasResponse{}
+	var err error
+	var respBody string
+	if respBody, err = c.makeHttpRequest("GET", "admin", "schemas", "", nil); err == nil {
+		err = bindToResponse[res.PayloadSchemasResponse](respBody, r)
+	}
+	return r, err
+}
+
+func (c *CoggedApiClient) AdminSchemaPut(psr *req.PayloadSchemaRequest) (*res.PayloadSchemasResponse, error) {
+	r := &res.PayloadSchemasResponse{}
+	var err error
+	var respBody string
+	if respBody, err = c.makeHttpRequest("PUT", "admin", "schema", "", psr); err == nil {
+		err = bindToResponse[res.PayloadSchemasResponse](respBody, r)
+	}
+	return r, err
+}
+
+func (c *CoggedApiClient) AdminSchemaDelete(ty string) (*res.PayloadSchemasResponse, error) {
+	r := &res.PayloadSchemasResponse{}
+	var err error
+	var respBody string
+	if respBody, err = c.makeHttpRequest("DELETE", "admin", "schema", ty, nil); err == nil {
+		err = bindToResponse[res.PayloadSchemasResponse](respBody, r)
+	}
+	return r, err
+}
+
 func (c *CoggedApiClient) GraphNodesPost(qr *req.QueryRequest) (*res.CoggedResponse, error) {
 	r := &res.CoggedResponse{}
 	var err error
@@ -262,6 +292,46 @@ func (c *CoggedApiClient) GraphEdgesPatch(er *req.EdgesRequest) (*res.CoggedResp
 	return r, err
 }
 
+func (c *CoggedApiClient) GraphTransferPost(tnr *req.TransferNodesRequest) (*res.CoggedResponse, error) {
+	r := &res.CoggedResponse{}
+	var err error
+	var respBody string
+	if respBody, err = c.makeHttpRequest("POST", "graph", "transfer", "", tnr); err == nil {
+		err = bindToResponse[res.CoggedResponse](respBody, r)
+	}
+	return r, err
+}
+
+func (c *CoggedApiClient) GraphPermissionsPatch(spr *req.SubgraphPermsRequest) (*res.SubgraphPermsResponse, error) {
+	r := &res.SubgraphPermsResponse{}
+	var err error
+	var respBody string
+	if respBody, err = c.makeHttpRequest("PATCH", "graph", "permissions", "", spr); err == nil {
+		err = bindToResponse[res.SubgraphPermsResponse](respBody, r)
+	}
+	return r, err
+}
+
+func (c *CoggedApiClient) GraphPathPost(pr *req.PathRequest) (*res.PathResponse, error) {
+	r := &res.PathResponse{}
+	var err error
+	var respBody string
+	if respBody, err = c.makeHttpRequest("POST", "graph", "path", "", pr); err == nil {
+		err = bindToResponse[res.PathResponse](respBody, r)
+	}
+	return r, err
+}
+
+func (c *CoggedApiClient) GraphSearchPost(sr *req.SearchRequest) (*res.CoggedResponse, error) {
+	r := &res.CoggedResponse{}
+	var err error
+	var respBody string
+	if respBody, err = c.makeHttpRequest("POST", "graph", "search", "", sr); err == nil {
+		err = bindToResponse[res.CoggedResponse](respBody, r)
+	}
+	return r, err
+}
+
 func (c *CoggedApiClient) HealthStatusGet() (*map[string]string, error) {
 	r := &map[string]string{}
 	var err error
@@ -1,5 +1,10 @@
 import type {
   AuthzData,
+  BlobGCRequest,
+  BlobGCResponse,
+  BlobResponse,
+  BlobUploadRequest,
+  BlobUploadResponse,
   ClientConfig,
   CoggedResponseCN,
   CoggedResponseCU,
@@ -11,13 +16,23 @@ import type {
   EdgesRequest,
   LoginRequest,
   NodeScope,
+  PathRequest,
+  PathResponse,
+  PayloadSchema,
+  PayloadSchemasResponse,
   QueryRequest,
+  SearchRequest,
   ShareNodesRequest,
+  SubgraphPermsRequest,
+  SubgraphPermsResponse,
   TokenResponse,
+  TransferNodesRequest,
   UpdateNodesRequest,
   UserNodeRequest,
   UserResponse,
   UsersRequest,
+  VectorCheckRequest,
+  VectorCheckResponse,
 } from "./types.js";
 
 export interface CoggedClientOptions {
@@ -40,7 +55,7 @@ export class CoggedApiError extends Error {
   }
 }
 
-type HttpMethod = "GET" | "POST" | "PUT" | "PATCH" | "DELETE";
+type HttpMethod = "GET" | "HEAD" | "POST" | "PUT" | "PATCH" | "DELETE";
 
 /**
  * A thin, typed client for the Cogged API. Types come from the backend's
@@ -72,16 +87,30 @@ export class CoggedClient {
   }
 
   private async request<T>(method: HttpMethod, path: string, body?: unknown): Promise<T> {
-    // The server requires Content-Type: application/json on every request (even GETs).
-    const headers: Record<string, string> = { "Content-Type": "application/json" };
+    // The server requires Content-Type: application/json on every request (even GETs),
+    // except on the /blob routes.
+    const res = await this.send(
+      method,
+      path,
+      { "Content-Type": "application/json" },
+      body === undefined ? undefined : JSON.stringify(body),
+    );
+    return this.parse<T>(res);
+  }
+
+  private async send(
+    method: HttpMethod,
+    path: string,
+    headers: Record<string, string>,
+    body?: BodyInit,
+  ): Promise<Response> {
     if (this.token) {
       headers["Authorization"] = `Bearer ${this.token}`;
     }
-    const res = await this.fetchImpl(this.baseUrl + path, {
-      method,
-      headers,
-      body: body === undefined ? undefined : JSON.stringify(body),
-    });
+    return this.fetchImpl(this.baseUrl + path, { method, headers, body });
+  }
+
+  private async parse<T>(res: Response): Promise<T> {
     const text = await res.text();
     if (!res.ok) {
       throw new CoggedApiError(res.status, text.trim() || res.statusText);
@@ -136,6 +165,80 @@ export class CoggedClient {
     return this.request<CoggedResponseEmpty>("PATCH", "/admin/users", req);
   }
 
+  /** List the payload schemas registered per node type. */
+  listSchemas(): Promise<PayloadSchemasResponse> {
+    return this.request<PayloadSchemasResponse>("GET", "/admin/schemas");
+  }
+
+  /** Register (or replace) the payload schema for schema.ty. */
+  putSchema(schema: PayloadSchema): Promise<PayloadSchemasResponse> {
+    return this.request<PayloadSchemasResponse>("PUT", "/admin/schema", schema);
+  }
+
+  deleteSchema(ty: string): Promise<PayloadSchemasResponse> {
+    return this.request<PayloadSchemasResponse>("DELETE", `/admin/schema/${encodeURIComponent(ty)}`);
+  }
+
+  /** Check every stored vec (or those of req.ty) against its type's vec_dim; reembed replaces the invalid ones. */
+  checkVectors(req: VectorCheckRequest = {}): Promise<VectorCheckResponse> {
+    return this.request<VectorCheckResponse>("POST", "/admin/vectors", req);
+  }
+
+  /** Delete the blobs no node refers to any more, and expired uploads; dry_run only counts them. */
+  collectBlobGarbage(req: BlobGCRequest = {}): Promise<BlobGCResponse> {
+    return this.request<BlobGCResponse>("POST", "/admin/blobs", req);
+  }
+
+  // --- blobs ---
+
+  /**
+   * Upload data as the node's blob, setting its `b` to a "blob:sha256:..." reference
+   * (requires 'w'). `digest`, an RFC 9530 Content-Digest value, makes the server reject
+   * data that does not match it.
+   */
+  async putBlob(node: AuthzData, data: BodyInit, digest?: string): Promise<BlobResponse> {
+    const headers: Record<string, string> = { "Content-Type": "application/octet-stream" };
+    if (digest) {
+      headers["Content-Digest"] = digest;
+    }
+    const res = await this.send("PUT", `/blob/data/${encodeURIComponent(node)}`, headers, data);
+    return this.parse<BlobResponse>(res);
+  }
+
+  /**
+   * Download the node's blob (requires 'r'). The Response is returned unread, so the body
+   * can be streamed; pass a `range` such as "bytes=0-1023" to get part of it.
+   */
+  async getBlob(node: AuthzData, range?: string): Promise<Response> {
+    const headers: Record<string, string> = range ? { Range: range } : {};
+    const res = await this.send("GET", `/blob/data/${encodeURIComponent(node)}`, headers);
+    if (!res.ok) {
+      await this.parse(res);
+    }
+    return res;
+  }
+
+  /** Start a resumable upload of req.size bytes hashing to req.sha256 for the node (requires 'w'). */
+  startUpload(node: AuthzData, req: BlobUploadRequest): Promise<BlobUploadResponse> {
+    return this.request<BlobUploadResponse>("POST", `/blob/upload/${encodeURIComponent(node)}`, req);
+  }
+
+  /** How far an upload has got: resume it by sending the next chunk at `offset`. */
+  uploadStatus(uploadId: string): Promise<BlobUploadResponse> {
+    return this.request<BlobUploadResponse>("GET", `/blob/uploads/${encodeURIComponent(uploadId)}`);
+  }
+
+  /** Send the chunk of an upload starting at offset. The last chunk's response carries `blob`. */
+  async uploadChunk(uploadId: string, offset: number, chunk: BodyInit): Promise<BlobUploadResponse> {
+    const headers = { "Content-Type": "application/offset+octet-stream", "Upload-Offset": String(offset) };
+    const res = await this.send("PATCH", `/blob/uploads/${encodeURIComponent(uploadId)}`, headers, chunk);
+    return this.parse<BlobUploadResponse>(res);
+  }
+
+  abortUpload(uploadId: string): Promise<BlobUploadResponse> {
+    return this.request<BlobUploadResponse>("DELETE", `/blob/uploads/${encodeURIComponent(uploadId)}`);
+  }
+
   // --- graph ---
 
   /** Query nodes by traversing node→node edges from the given root ids. */
@@ -166,6 +269,35 @@ export class CoggedClient {
     return this.request<CoggedResponseEmpty>("PATCH", "/graph/edges", req);
   }
 
+  /** Hand nodes you own (optionally with their owned subgraph) to another user. */
+  transferNodes(req: TransferNodesRequest): Promise<CoggedResponseRN> {
+    return this.request<CoggedResponseRN>("POST", "/graph/transfer", req);
+  }
+
+  /**
+   * Apply a permission mask and/or a new share group to nodes you own and their owned
+   * subgraph. Set dry_run to see the affected node count and sharee impact first.
+   */
+  updatePermissions(req: SubgraphPermsRequest): Promise<SubgraphPermsResponse> {
+    return this.request<SubgraphPermsResponse>("PATCH", "/graph/permissions", req);
+  }
+
+  /**
+   * Find the shortest path(s) from one node to another, passing only through nodes the
+   * caller can read. An empty list means they are not connected.
+   */
+  findPaths(req: PathRequest): Promise<PathResponse> {
+    return this.request<PathResponse>("POST", "/graph/path", req);
+  }
+
+  /**
+   * Search the text of every node the caller can read, best match first, without needing
+   * a root node. Page through the matches with first/offset.
+   */
+  search(req: SearchRequest): Promise<CoggedResponseRN> {
+    return this.request<CoggedResponseRN>("POST", "/graph/search", req);
+  }
+
   // --- user ---
 
   /** Create a node owned by, and linked to, the requesting user. */
@@ -4,6 +4,157 @@
  */
 
 export interface paths {
+    "/admin/blobs": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        get?: never;
+        put?: never;
+        /** @description garbage-collect the blob store (superuser role required). Deletes every blob no node's b refers to that was stored longer ago than the blob.gcgrace setting, and every resumable upload older than blob.uploadexpiry. */
+        post: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path?: never;
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/json": components["schemas"]["BlobGCRequest"];
+                };
+            };
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["BlobGCResponse"];
+                    };
+                };
+            };
+        };
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/admin/schema": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        get?: never;
+        /** @description register the payload schema for a node type, replacing any existing schema for that type (superuser role required). Node creates and updates are checked against it from then on; existing nodes are not re-checked. */
+        put: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path?: never;
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/json": components["schemas"]["PayloadSchema"];
+                };
+            };
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["PayloadSchemasResponse"];
+                    };
+                };
+            };
+        };
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/admin/schema/{ty}": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        get?: never;
+        put?: never;
+        post?: never;
+        /** @description remove the payload schema for a node type, leaving nodes of that type unconstrained (superuser role required) */
+        delete: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path: {
+                    /** @description the node type whose schema is removed */
+                    ty: string;
+                };
+                cookie?: never;
+            };
+            requestBody?: never;
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["PayloadSchemasResponse"];
+                    };
+                };
+            };
+        };
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/admin/schemas": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** @description list the registered payload schemas (superuser role required) */
+        get: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path?: never;
+                cookie?: never;
+            };
+            requestBody?: never;
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["PayloadSchemasResponse"];
+                    };
+                };
+            };
+        };
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
     "/admin/user": {
         parameters: {
             query?: never;
@@ -82,6 +233,45 @@ export interface paths {
         };
         trace?: never;
     };
+    "/admin/vectors": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        get?: never;
+        put?: never;
+        /** @description check the stored vec of every node, or of every node of one type, against its type's payload schema, reporting those with the wrong number of dimensions or none that parse (superuser role required). With reembed, each invalid vec is replaced by the server's embedding of the node's text. */
+        post: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path?: never;
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/json": components["schemas"]["VectorCheckRequest"];
+                };
+            };
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["VectorCheckResponse"];
+                    };
+                };
+            };
+        };
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
     "/auth/check": {
         parameters: {
             query?: never;
@@ -261,6 +451,204 @@ export interface paths {
         patch?: never;
         trace?: never;
     };
+    "/blob/data/{ad}": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** @description download the blob the node's b refers to (requires read 'r' permission on the node). Any Content-Type is accepted on this route. Range requests and If-None-Match are supported; the ETag is the blob's SHA-256 in hex, and the Repr-Digest header carries the SHA-256 of the whole blob. */
+        get: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path: {
+                    /** @description The AuthzData of the node whose blob is downloaded */
+                    ad: components["schemas"]["AuthzData"];
+                };
+                cookie?: never;
+            };
+            requestBody?: never;
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/octet-stream": string;
+                    };
+                };
+            };
+        };
+        /** @description upload the request body, streamed, as a blob and set the node's b to refer to it as "blob:sha256:<hex>" (requires write 'w' permission on the node). Any Content-Type is accepted. The body may be at most the blob.maxsize setting. With an RFC 9530 Content-Digest header carrying a sha-256, content that does not match it is rejected and nothing is stored. The node's payload schema, if any, must allow b to be set. */
+        put: {
+            parameters: {
+                query?: never;
+                header: {
+                    /** @description optional digest of the body, e.g. "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:" */
+                    "Content-Digest"?: string;
+                };
+                path: {
+                    /** @description The AuthzData of the node the blob is for */
+                    ad: components["schemas"]["AuthzData"];
+                };
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/octet-stream": string;
+                };
+            };
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["BlobResponse"];
+                    };
+                };
+            };
+        };
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/blob/upload/{ad}": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        get?: never;
+        put?: never;
+        /** @description start a resumable upload of a blob for the node (requires write 'w' permission on the node). Send the content in one or more chunks with PATCH /blob/uploads/{upload_id}; the chunk that completes it checks the content against sha256 and sets the node's b to refer to the blob. */
+        post: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path: {
+                    /** @description The AuthzData of the node the blob is for */
+                    ad: components["schemas"]["AuthzData"];
+                };
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/json": components["schemas"]["BlobUploadRequest"];
+                };
+            };
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["BlobUploadResponse"];
+                    };
+                };
+            };
+        };
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/blob/uploads/{upload_id}": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        /** @description report how much of a resumable upload has arrived, to resume it from there. Only the user who started the upload can see it. The offset is also sent in the Upload-Offset header. */
+        get: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path: {
+                    /** @description the upload_id returned when the upload was started */
+                    upload_id: string;
+                };
+                cookie?: never;
+            };
+            requestBody?: never;
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["BlobUploadResponse"];
+                    };
+                };
+            };
+        };
+        put?: never;
+        post?: never;
+        /** @description abandon a resumable upload and delete what has arrived of it */
+        delete: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path: {
+                    /** @description the upload_id returned when the upload was started */
+                    upload_id: string;
+                };
+                cookie?: never;
+            };
+            requestBody?: never;
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["BlobUploadResponse"];
+                    };
+                };
+            };
+        };
+        options?: never;
+        head?: never;
+        /** @description append the request body, streamed, to a resumable upload. The Upload-Offset header must equal the upload's current offset, and the chunk may not take it past its size. A failed chunk is discarded whole, so the upload can be resumed from the offset GET reports. The chunk that completes the upload stores the blob and sets the node's b to refer to it; if the content does not match the upload's sha256, the upload is deleted and must be started again. */
+        patch: {
+            parameters: {
+                query?: never;
+                header: {
+                    /** @description the offset, in bytes, the chunk starts at */
+                    "Upload-Offset": number;
+                };
+                path: {
+                    /** @description the upload_id returned when the upload was started */
+                    upload_id: string;
+                };
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/octet-stream": string;
+                };
+            };
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["BlobUploadResponse"];
+                    };
+                };
+            };
+        };
+        trace?: never;
+    };
     "/graph/edges": {
         parameters: {
             query?: never;
@@ -361,7 +749,129 @@ export interface paths {
         delete?: never;
         options?: never;
         head?: never;
-        /** @description bulk update predicates of existing GraphNodes */
+        /** @description bulk update predicates of existing GraphNodes. A predicate left out of a node is unchanged. One sent as `null`, or listed in the node's `unset`, is deleted from it, as in a JSON Merge Patch. */
+        patch: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path?: never;
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/json": components["schemas"]["UpdateNodesRequest"];
+                };
+            };
+            responses: {
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["CoggedResponseEmpty"];
+                    };
+                };
+            };
+        };
+        trace?: never;
+    };
+    "/graph/nodes/{ad}": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        get?: never;
+        /** @description bulk create new GraphNodes, or with `upsert`, create or update them by `id` and `ty` */
+        put: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path: {
+                    /** @description The new nodes will be a subgraph linked by an edge from this root node, specified by the AuthzData */
+                    ad: components["schemas"]["AuthzData"];
+                };
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/json": components["schemas"]["CreateNodesRequest"];
+                };
+            };
+            responses: {
+                /** @description created_nodes is keyed by the $placeholder uids supplied in the request (e.g. "$placeholder1"), each value carrying the new node's uid and AuthzData. */
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["CoggedResponseCN"];
+                    };
+                };
+            };
+        };
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/graph/path": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        get?: never;
+        put?: never;
+        /** @description find the shortest path(s) of edges from one GraphNode to another. The caller must be able to read both nodes, and a path is only found through nodes the caller can read, so a route through an unreadable node is neither returned nor revealed. Edges are unweighted; every hop counts as 1. */
+        post: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path?: never;
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/json": components["schemas"]["PathRequest"];
+                };
+            };
+            responses: {
+                /** @description paths, shortest first. An empty list means the nodes are not connected within max_depth (by nodes the caller can read). */
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["PathResponse"];
+                    };
+                };
+            };
+        };
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
+    "/graph/permissions": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        get?: never;
+        put?: never;
+        post?: never;
+        delete?: never;
+        options?: never;
+        head?: never;
+        /** @description Apply a permission mask and/or a new share group to GraphNodes and, with depth > 0, to the subgraph below each of them owned by the same user (the walk stops at nodes owned by anyone else). The caller must own every node listed (or be a sys user). With dry_run, nothing is written and the response only reports how many nodes would change and which sharees would gain or lose read access. */
         patch: {
             parameters: {
                 query?: never;
@@ -371,23 +881,24 @@ export interface paths {
             };
             requestBody?: {
                 content: {
-                    "application/json": components["schemas"]["UpdateNodesRequest"];
+                    "application/json": components["schemas"]["SubgraphPermsRequest"];
                 };
             };
             responses: {
+                /** @description the updated nodes carry fresh AuthzData reflecting their new permissions and share group; AuthzData issued before the change is stale */
                 200: {
                     headers: {
                         [name: string]: unknown;
                     };
                     content: {
-                        "application/json": components["schemas"]["CoggedResponseEmpty"];
+                        "application/json": components["schemas"]["SubgraphPermsResponse"];
                     };
                 };
             };
         };
         trace?: never;
     };
-    "/graph/nodes/{ad}": {
+    "/graph/search": {
         parameters: {
             query?: never;
             header?: never;
@@ -395,35 +906,36 @@ export interface paths {
             cookie?: never;
         };
         get?: never;
-        /** @description bulk create new GraphNodes */
-        put: {
+        put?: never;
+        /**
+         * @description search the text of every GraphNode the caller can read - their own nodes and those shared with them - without needing a root node. Matches are ranked by how many of the search words they contain, best first, then by most recently modified. Only the first 1000 readable matches are ranked.
+         *
+         *     With "similar" or "geo" it is a hybrid search: the readable nodes are ranked by each signal asked for - the text, the similarity of their `vec` to a query vector, and the nearness of their `g` to a point - and the rankings are fused into one by reciprocal-rank fusion or by weighted scores (see "fusion"). Each node comes back with its combined "score", and its "similarity" and "distance_m" where it has them. The read permissions and filters apply to every signal. Each signal contributes its best 100 nodes, or as many as the requested page reaches.
+         */
+        post: {
             parameters: {
                 query?: never;
                 header?: never;
-                path: {
-                    /** @description The new nodes will be a subgraph linked by an edge from this root node, specified by the AuthzData */
-                    ad: components["schemas"]["AuthzData"];
-                };
+                path?: never;
                 cookie?: never;
             };
             requestBody?: {
                 content: {
-                    "application/json": components["schemas"]["CreateNodesRequest"];
+                    "application/json": components["schemas"]["SearchRequest"];
                 };
             };
             responses: {
-                /** @description created_nodes is keyed by the $placeholder uids supplied in the request (e.g. "$placeholder1"), each value carrying the new node's uid and AuthzData. */
+                /** @description the requested page of matches, best first */
                 200: {
                     headers: {
                         [name: string]: unknown;
                     };
                     content: {
-                        "application/json": components["schemas"]["CoggedResponseCN"];
+                        "application/json": components["schemas"]["CoggedResponseRN"];
                     };
                 };
             };
         };
-        post?: never;
         delete?: never;
         options?: never;
         head?: never;
@@ -468,6 +980,46 @@ export interface paths {
         patch?: never;
         trace?: never;
     };
+    "/graph/transfer": {
+        parameters: {
+            query?: never;
+            header?: never;
+            path?: never;
+            cookie?: never;
+        };
+        get?: never;
+        put?: never;
+        /** @description Transfer ownership of GraphNodes to another user. The caller must own every node listed (or be a sys user); share permissions are not enough. With depth > 0, the out-edge subgraph below each node is transferred too, but only while it is owned by the same user. */
+        post: {
+            parameters: {
+                query?: never;
+                header?: never;
+                path?: never;
+                cookie?: never;
+            };
+            requestBody?: {
+                content: {
+                    "application/json": components["schemas"]["TransferNodesRequest"];
+                };
+            };
+            responses: {
+                /** @description the transferred nodes, listed under their new owner */
+                200: {
+                    headers: {
+                        [name: string]: unknown;
+                    };
+                    content: {
+                        "application/json": components["schemas"]["CoggedResponseRN"];
+                    };
+                };
+            };
+        };
+        delete?: never;
+        options?: never;
+        head?: never;
+        patch?: never;
+        trace?: never;
+    };
     "/health/status": {
         parameters: {
             query?: never;
@@ -733,6 +1285,28 @@ export interface paths {
 export type webhooks = Record<string, never>;
 export interface components {
     schemas: {
+        /** @description One row of an aggregate query. Without group_by there is a single row covering every matching node. */
+        AggregateGroup: {
+            /**
+             * @description the group_by field values this row covers; absent without group_by
+             * @example {
+             *       "s3": "open"
+             *     }
+             */
+            group?: {
+                [key: string]: string;
+            };
+            /**
+             * @description the figures for the row, keyed "count" for the node count and "<fn>_<field>" for the rest, e.g. "sum_n1". Min and max of t1/t2 are date-time strings, everything else is a number. A figure with nothing to aggregate over is left out.
+             * @example {
+             *       "count": 4,
+             *       "sum_n1": 17.5
+             *     }
+             */
+            values?: {
+                [key: string]: unknown;
+            };
+        };
         /**
          * @description AuthzData is a field that looks like this:
          *     `MHgxLnVzZXI.qfbxnKX605d64nlDRjfs4qthDJA5dOdunSgBIhoBu3E`
@@ -750,6 +1324,68 @@ export interface components {
          * @example MHgxMjMuMHhmMzhhNy5ydw.qfbxnKX605d64nlDRjfs4qthDJA5dOdunSgBIhoBu3E
          */
         AuthzData: string;
+        BlobGCRequest: {
+            /** @description count what would be deleted without deleting anything */
+            dry_run?: boolean;
+        };
+        BlobGCResponse: {
+            dry_run?: boolean;
+            /** @description number of distinct blobs some node's b refers to */
+            referenced?: number;
+            /** @description number of unreferenced blobs deleted (or, for a dry run, that would be) */
+            deleted?: number;
+            /** @description total size of the deleted blobs */
+            freed_bytes?: number;
+            /** @description number of unreferenced blobs kept as they are within the grace period */
+            kept?: number;
+            /** @description number of expired resumable uploads deleted */
+            expired_uploads?: number;
+            /**
+             * Format: date-time
+             * @example 2021-03-14T05:18:32.8247882Z
+             */
+            timestamp?: string;
+            error?: string;
+        };
+        BlobResponse: {
+            /**
+             * @description the reference the node's b now holds
+             * @example blob:sha256:5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef
+             */
+            b?: string;
+            /** @description SHA-256 of the blob's content, in hex */
+            sha256?: string;
+            /** @description size of the blob in bytes */
+            size?: number;
+            /**
+             * Format: date-time
+             * @example 2021-03-14T05:18:32.8247882Z
+             */
+            timestamp?: string;
+        };
+        BlobUploadRequest: {
+            /** @description the size of the whole blob in bytes */
+            size: number;
+            /** @description SHA-256 of the whole blob's content, in hex */
+            sha256: string;
+        };
+        BlobUploadResponse: {
+            upload_id?: string;
+            /** @description how many bytes have arrived; the next chunk starts here */
+            offset?: number;
+            size?: number;
+            /**
+             * Format: date-time
+             * @description when the unfinished upload will be deleted
+             */
+            expires?: string;
+            blob?: components["schemas"]["BlobResponse"];
+            /**
+             * Format: date-time
+             * @example 2021-03-14T05:18:32.8247882Z
+             */
+            timestamp?: string;
+        };
         CoggedResponseEmpty: {
             /** @example  */
             error?: string;
@@ -765,6 +1401,16 @@ export interface components {
             created_nodes?: {
                 [key: string]: components["schemas"]["NodeEdgeData"];
             };
+            /**
+             * @description only for an upsert. Whether each node was created or updated, keyed as created_nodes is, which also holds the nodes that were updated.
+             * @example {
+             *       "$placeholder1": "created",
+             *       "$placeholder2": "updated"
+             *     }
+             */
+            upserted?: {
+                [key: string]: "created" | "updated";
+            };
             /**
              * Format: date-time
              * @example 2021-03-14T05:18:32.8247882Z
@@ -784,6 +1430,16 @@ export interface components {
         };
         CoggedResponseRN: {
             result_nodes?: components["schemas"]["GraphNode"][];
+            /** @description only for a query with "aggregate", which returns these in place of result_nodes */
+            aggregates?: components["schemas"]["AggregateGroup"][];
+            /** @description only for a query with "cluster", which returns these in place of result_nodes, biggest first. Absent when no node matched. */
+            clusters?: components["schemas"]["GeoCluster"][];
+            /** @description set when a query with "first" has more results after this page */
+            has_more?: boolean;
+            /** @description Opaque, signed cursor for the page after this one, to pass back as "cursor" with the same query. Only present when has_more is set. It is only valid for the user it was issued to. */
+            next_cursor?: string;
+            /** @description Opaque, signed token for the point in time a paginated query was read at. Pass it back as "snapshot" with the later pages so they are read at the same point, unaffected by concurrent writes. It is only valid for the user it was issued to, and only for a limited time (5 minutes by default). */
+            snapshot?: string;
             /**
              * Format: date-time
              * @example 2021-03-14T05:18:32.8247882Z
@@ -808,6 +1464,11 @@ export interface components {
              *     A $placeholder used in a node's "e" (out-edges) must also appear as the uid of a node in the same request. An edge naming a placeholder that nothing defines is rejected: Dgraph would create a node for it with no owner, share group or permission bits, which the caller could never read back. Edges to nodes that already exist use their real 0xNN uid and are unaffected. Null entries in "nodes" or in an "e" array are rejected with 400.
              */
             nodes?: components["schemas"]["GraphNodeNew"][];
+            /**
+             * @description Create each node unless it is the same as an existing one, which is updated instead, so an import can safely be run again. With "parent", that is a node with the same `id` and `ty` the parent node links to, and the nodes in the request cannot link to each other. With "owner", it is a node with the same `id` and `ty` that the user owns. Every node needs an `id` and a `ty`, and no two can share both. An updated node gets the payload and edges sent, and keeps its owner, share group and permissions. The whole request is written in one transaction, or not at all (400) if a node matches more than one existing node, matches another user's node, or would repeat an `id` the server requires to be unique.
+             * @enum {string}
+             */
+            upsert?: "parent" | "owner";
         };
         CreateUserRequest: {
             /**
@@ -844,22 +1505,56 @@ export interface components {
             /** @description AuthzData identifiers that specify the GraphNodes that will be the target of incoming edges (from all nodes listed in incoming_ids) or where outgoing edges will be created from to link nodes listed in outgoing_ids. */
             subject_ids?: components["schemas"]["AuthzData"][];
         };
-        /** @description User-defined geolocation field, stored in the `g` predicate as GeoJSON. The `g` predicate is geo-indexed: use the "geo" block on QueryRequest to find nodes within a radius of a point. */
+        /** @description One cell of a cluster query. */
+        GeoCluster: {
+            /**
+             * @description the geohash of the cell
+             * @example r3gx2
+             */
+            geohash?: string;
+            /**
+             * @description how many of the matching nodes lie in the cell
+             * @example 42
+             */
+            count?: number;
+            /** @description the mean position of the cell's nodes, for placing the cluster marker */
+            centroid?: components["schemas"]["GeoPosition"];
+            /**
+             * @description the cell's [west, south, east, north], for zooming in on it
+             * @example [
+             *       151.171875,
+             *       -33.880615234375,
+             *       151.21582031250003,
+             *       -33.837890625
+             *     ]
+             */
+            bbox?: number[];
+        };
+        /** @description User-defined geolocation field, stored in the `g` predicate as a GeoJSON geometry: a Point, LineString, Polygon or MultiPolygon. The `g` predicate is geo-indexed: use the "geo" block on QueryRequest to find nodes near a point, or within, containing or intersecting an area. Writes are validated: every position must be in range, a LineString needs at least 2 positions, and each Polygon ring at least 4, ending where it starts. A geometry holds at most 10000 positions. */
         Geoloc: {
             /**
-             * @description [longitude, latitude] - LONGITUDE FIRST, per GeoJSON. Longitude ranges over -180..180 and latitude over -90..90, so getting the order wrong silently places the point elsewhere (or is rejected by a geo query when the latitude exceeds 90).
+             * @description The GeoJSON coordinates for the type: a position for a Point, a list of positions for a LineString, a list of rings (each a list of positions, the outer boundary first and then any holes) for a Polygon, and a list of polygons for a MultiPolygon. A position is [longitude, latitude] - LONGITUDE FIRST, per GeoJSON. Longitude ranges over -180..180 and latitude over -90..90, so getting the order wrong places the point elsewhere or is rejected when the latitude exceeds 90.
              * @example [
              *       151.2153,
              *       -33.8568
              *     ]
              */
-            coordinates: number[];
+            coordinates: components["schemas"]["GeoPosition"] | components["schemas"]["GeoPosition"][] | components["schemas"]["GeoPosition"][][] | components["schemas"]["GeoPosition"][][][];
             /**
-             * @description GeoJSON geometry type. Cogged stores points, so this is "Point".
+             * @description GeoJSON geometry type.
              * @example Point
+             * @enum {string}
              */
-            type: string;
+            type: "Point" | "LineString" | "Polygon" | "MultiPolygon";
         };
+        /**
+         * @description A GeoJSON position, [longitude, latitude] - LONGITUDE FIRST.
+         * @example [
+         *       151.2153,
+         *       -33.8568
+         *     ]
+         */
+        GeoPosition: number[];
         GraphNode: {
             ad?: components["schemas"]["AuthzData"];
             /**
@@ -901,12 +1596,12 @@ export interface components {
              */
             sgi?: string;
             /**
-             * @description user-defined field that can contain arbitrary text data for the node
+             * @description user-defined field that can contain arbitrary text data for the node. It may instead hold a reference, "blob:sha256:<hex>", to binary content in the blob store, which only the server writes (see PUT /blob/data/{ad}); a b starting "blob:" sent by a client is rejected.
              * @example YgThiWf5zVVbrZynndqwMljuyxI=
              */
             b?: string;
             /**
-             * @description Embedding for vector-similarity search: a string-encoded float array, e.g. "[0.1,0.2,0.3]", stored in the hnsw-indexed float32vector `vec` predicate. Search over it with QueryRequest.similar.
+             * @description Embedding for vector-similarity search: a string-encoded float array, e.g. "[0.1,0.2,0.3]", stored in the hnsw-indexed float32vector `vec` predicate. Search over it with QueryRequest.similar. When the server has an embedder configured, a node written with any of its configured text fields and no vec has its vec filled in from them. It cannot be all zeros, and must have the vec_dim of the payload schema of the node's ty where that sets one. It can be read back by naming it in select (whoever can read the node can read it) but cannot be used in filters or order_by.
              * @example [0.12, -0.03, 0.88]
              */
             vec?: string;
@@ -984,6 +1679,37 @@ export interface components {
              * @example account
              */
             ty?: string;
+            /**
+             * @description only in query results that set with_depth. The fewest edges from a root node to this node along the traversal; 0 for the root nodes. It is ignored if sent in an update.
+             * @example 2
+             */
+            readonly depth?: number;
+            /**
+             * Format: double
+             * @description only in the results of a nearest geo search. How far the node's `g` is from the search point in metres, to the centimetre; 0 for an area holding the point. It is ignored if sent in an update.
+             * @example 92.31
+             */
+            readonly distance_m?: number;
+            /**
+             * Format: double
+             * @description only in the results of a similarity search. The cosine similarity of the node's `vec` to the query vector, from -1 to 1, most similar highest. It is ignored if sent in an update.
+             * @example 0.87
+             */
+            readonly similarity?: number;
+            /**
+             * Format: double
+             * @description only in the results of a hybrid search. The node's combined score, highest best. It is ignored if sent in an update.
+             * @example 0.0325
+             */
+            readonly score?: number;
+            /**
+             * @description only in an update. The predicates to delete from the node, in the same transaction as the predicates it sets. Sending one of them as an explicit `null` unsets it too. A predicate cannot be both set and unset, a slot the node's payload schema requires cannot be unset, and only the node's owner can unset `p`.
+             * @example [
+             *       "t2",
+             *       "g"
+             *     ]
+             */
+            unset?: ("id" | "p" | "s1" | "s2" | "s3" | "s4" | "b" | "vec" | "n1" | "n2" | "t1" | "t2" | "g")[];
         };
         GraphNodeNew: {
             /**
@@ -1016,12 +1742,12 @@ export interface components {
             /** @description Other users (aside from the owner or system user) can share this node with other users */
             s?: boolean;
             /**
-             * @description user-defined field that can contain arbitrary text data for the node
+             * @description user-defined field that can contain arbitrary text data for the node. It may instead hold a reference, "blob:sha256:<hex>", to binary content in the blob store, which only the server writes (see PUT /blob/data/{ad}); a b starting "blob:" sent by a client is rejected.
              * @example YgThiWf5zVVbrZynndqwMljuyxI=
              */
             b?: string;
             /**
-             * @description Embedding for vector-similarity search: a string-encoded float array, e.g. "[0.1,0.2,0.3]", stored in the hnsw-indexed float32vector `vec` predicate. Search over it with QueryRequest.similar.
+             * @description Embedding for vector-similarity search: a string-encoded float array, e.g. "[0.1,0.2,0.3]", stored in the hnsw-indexed float32vector `vec` predicate. Search over it with QueryRequest.similar. When the server has an embedder configured, a node written with any of its configured text fields and no vec has its vec filled in from them. It cannot be all zeros, and must have the vec_dim of the payload schema of the node's ty where that sets one. It can be read back by naming it in select (whoever can read the node can read it) but cannot be used in filters or order_by.
              * @example [0.12, -0.03, 0.88]
              */
             vec?: string;
@@ -1227,11 +1953,79 @@ export interface components {
             /** @example $placeholder2 */
             uid: string;
         };
+        NodePath: {
+            /** @description the nodes along the path, in order from the "from" node to the "to" node */
+            nodes?: components["schemas"]["GraphNode"][];
+            /** @description number of edges in the path */
+            hops?: number;
+        };
+        /** @description one key of a query's order_by */
+        OrderKey: {
+            /**
+             * @description the predicate to sort by, one of c, m, t1 and t2
+             * @example t1
+             */
+            field: string;
+            /** @description sort this key descending instead of ascending */
+            desc?: boolean;
+        };
         /** @description Object containing UID (0xNN) of GraphNode owner */
         Owner: {
             /** @example 0x1234 */
             uid: string;
         };
+        PathRequest: {
+            from: components["schemas"]["AuthzData"];
+            to: components["schemas"]["AuthzData"];
+            /** @description the most edges a path may have. 0 or unset means the server maximum. */
+            max_depth?: number;
+            /** @description how many paths to return, shortest first (default 1) */
+            num_paths?: number;
+            /** @description if set, paths may only pass through nodes with one of these `ty` values. The from and to nodes do not have to match. */
+            types?: string[];
+            /**
+             * @description which way edges may be followed, as for QueryRequest
+             * @enum {string}
+             */
+            direction?: "out" | "in" | "both";
+            /** @description GraphNode fields to include for each node on a path, as for QueryRequest */
+            select?: string[];
+        };
+        PathResponse: {
+            paths?: components["schemas"]["NodePath"][];
+            /**
+             * Format: date-time
+             * @example 2021-03-14T05:18:32.8247882Z
+             */
+            timestamp?: string;
+            error?: string;
+        };
+        /** @description declares which payload slots a node of type `ty` may set and what they may hold. A slot with no entry in `slots` may not be set at all. */
+        PayloadSchema: {
+            /** @description the node type this schema applies to */
+            ty: string;
+            /** @description rules keyed by slot name (s1, s2, s3, s4, b, n1, n2, t1, t2) */
+            slots: {
+                [key: string]: components["schemas"]["SlotRule"];
+            };
+            /** @description if true, a node can neither be changed to nor from this type after it has been created */
+            fixed_type?: boolean;
+            /** @description if set, the number of dimensions a node of this type's vec must have. Nodes stored before it was set are not re-checked; POST /admin/vectors finds them. */
+            vec_dim?: number;
+        };
+        PayloadSchemasResponse: {
+            schemas?: components["schemas"]["PayloadSchema"][];
+            error?: string;
+        };
+        /** @description node permission bits to set; a bit left out is not changed */
+        PermissionMask: {
+            r?: boolean;
+            w?: boolean;
+            o?: boolean;
+            i?: boolean;
+            d?: boolean;
+            s?: boolean;
+        };
         QueryRequest: {
             /**
              * @description Traversal depth (recurse outwards from GraphNodes specified by root-ids). The depth value limits how many levels of outbound edges are traversed in the recursive search.
@@ -1275,52 +2069,142 @@ export interface components {
              */
             offset?: number;
             /**
-             * @description Pagination cursor: return results after this node uid in the ordering. Cheaper than offset for deep paging. Used together with first.
+             * @description Pagination cursor: return results after this node uid in the ordering. Only pages correctly in uid order, i.e. without order_by; prefer cursor. Used together with first.
              * @example 0x2a3f
              */
             after?: string;
-            /**
-             * @description An indexed GraphNode predicate to order results by (e.g. c or m). When unset, results follow Dgraph's default uid order. Field names that are not allowed are ignored, with two exceptions that are rejected outright. "p" is owner-private and restricted to sys role callers; "g" is a geo predicate and is not sortable at all (see the "field" property of QueryRequestClause).
-             * @example c
-             */
-            order_by?: string;
-            /** @description Order descending instead of ascending; only applies when order_by is set. */
+            /** @description Pagination cursor: the next_cursor of the previous page, to carry on after it under any order_by. Send the same query with it, including order_by; it cannot be combined with offset or after, or used with similar. */
+            cursor?: string;
+            /** @description The snapshot returned with the first page of a paginated query. Later pages sent with it are read at the same point in time as the first, so nodes written meanwhile are neither skipped nor repeated. An expired snapshot is rejected with an error, after which paging must start again. */
+            snapshot?: string;
+            /** @description The keys to order results by, most significant first: either a single field name (sorted ascending, or descending with order_desc) or a list of up to 3 keys, each with its own direction. Only the indexed datetime predicates (c, m, t1, t2) are sortable. When unset, results follow Dgraph's default uid order. A sorted query leaves out nodes without a value for every key, so that each page can be continued from its last node. Field names that are not allowed are ignored, with two exceptions that are rejected outright. "p" is owner-private and restricted to sys role callers; "g" is a geo predicate and is not sortable at all (see the "field" property of QueryRequestClause). */
+            order_by?: string | components["schemas"]["OrderKey"][];
+            /** @description Order descending instead of ascending; only applies when order_by is a single key. */
             order_desc?: boolean;
             similar?: components["schemas"]["QuerySimilarity"];
             geo?: components["schemas"]["QueryGeo"];
+            traverse_filter?: components["schemas"]["QueryRequestClause"];
+            /** @description set "depth" on each result node of a root_ids traversal, the fewest edges from a root to that node along the walk */
+            with_depth?: boolean;
+            /**
+             * @description Which way a root_ids traversal follows "e" edges. "out" (the default) follows edges from each node to the nodes it links to; "in" follows them backwards to the nodes that link to it, e.g. to find every container of a node; "both" does both. Only POST /graph/nodes accepts "in" and "both". Every node reached is still filtered by the caller's read permissions.
+             * @example in
+             * @enum {string}
+             */
+            direction?: "out" | "in" | "both";
+            /**
+             * @description Return shape for a root_ids traversal. "flat" (the default) lists every node reached in result_nodes. "tree" returns only the roots, with the nodes reached from each nested under "e" and carrying the selected fields at every level. A node appears in full once, at the shallowest level; any other edge into it, including one that closes a cycle, is a stub with only uid, owner, permissions and ad. Only POST /graph/nodes accepts "tree", and it cannot be combined with first, offset, after or order_by.
+             * @example tree
+             * @enum {string}
+             */
+            shape?: "flat" | "tree";
+            aggregate?: components["schemas"]["QueryAggregate"];
+            cluster?: components["schemas"]["QueryCluster"];
+        };
+        /** @description Return aggregates over the nodes a query matches instead of the nodes themselves. They are computed after filters and the caller's read permissions are applied, so they only cover nodes the caller may read. Cannot be combined with first, offset, after, with_depth or shape "tree". */
+        QueryAggregate: {
+            /** @description count the matching nodes */
+            count?: boolean;
+            /**
+             * @description fields to total, from n1 and n2
+             * @example [
+             *       "n1"
+             *     ]
+             */
+            sum?: string[];
+            /** @description fields to find the least value of, from n1, n2, t1 and t2 */
+            min?: string[];
+            /**
+             * @description fields to find the greatest value of, from n1, n2, t1 and t2
+             * @example [
+             *       "t1"
+             *     ]
+             */
+            max?: string[];
+            /** @description fields to average, from n1 and n2 */
+            avg?: string[];
+            /**
+             * @description split the figures into one row per distinct combination of these fields, from ty, s3 and s4. Nodes without a value for a group_by field are left out.
+             * @example [
+             *       "s3"
+             *     ]
+             */
+            group_by?: string[];
+        };
+        /** @description Count the nodes a query matches into map clusters instead of returning the nodes: the readable nodes whose `g` lies inside "bbox" and that pass filters are grouped by geohash cell, and each cell comes back with its count and the centroid of its nodes. A line or area is placed at the mean of its positions. Like the request-level "geo" block it replaces the root function, so root_ids and depth are ignored. Set exactly one of zoom and precision. Only POST /graph/nodes accepts it, and it cannot be combined with similar, geo, aggregate, first, offset, after, cursor, order_by, with_depth or shape "tree". At most 100000 nodes are counted; a box holding more is rejected. */
+        QueryCluster: {
+            /**
+             * @description the area to cluster, [west, south, east, north] in degrees. A box with west greater than east crosses the antimeridian.
+             * @example [
+             *       150.5,
+             *       -34.2,
+             *       151.5,
+             *       -33.5
+             *     ]
+             */
+            bbox: number[];
+            /**
+             * @description the map's zoom level, from 0 (the whole world in one tile) to 22. Picks cells a quarter of a map tile across or smaller.
+             * @example 10
+             */
+            zoom?: number;
+            /**
+             * @description the geohash length of the cells, from 1 (about 5000 km across) to 9 (about 5 m), in place of zoom.
+             * @example 5
+             */
+            precision?: number;
         };
         /**
-         * @description Geo radius search: matches nodes whose `g` point lies within "distance" metres of "point", using the geo index on the `g` predicate.
+         * @description Geo search on the `g` predicate, using its geo index. "mode" picks the test:
+         *     - near (the default): nodes whose `g` lies within "distance" metres of "point".
+         *     - within: nodes whose `g` lies inside "shape", a Polygon or MultiPolygon.
+         *     - contains: nodes whose `g` is an area containing "point", or "shape" (a Polygon or MultiPolygon) when no point is given.
+         *     - intersects: nodes whose `g` crosses or overlaps "shape", a Polygon or MultiPolygon.
+         *     - nearest: the nodes nearest to "point", nearest first, each with its distance_m. "distance", if given, is how far out to look. It pages with first (default 10) and offset, up to the nearest 999 nodes, and cannot be combined with cursor, after, order_by or aggregate. It is only for the request-level block and only on POST /graph/nodes.
+         *     Fields the mode does not take must be left unset.
          *
-         *     Used in two places. As the request-level "geo" block it replaces the root function, so root_ids and depth are ignored; filters and select still apply and results are still scoped by the caller's read permissions, and it cannot be combined with "similar". As the "geo" property of a QueryRequestClause it is one filter term among others, so it composes with and/or and with a root_ids traversal. Both may appear in one request, which intersects the two radii.
+         *     Used in two places. As the request-level "geo" block it replaces the root function, so root_ids and depth are ignored; filters and select still apply and results are still scoped by the caller's read permissions, and it cannot be combined with "similar". As the "geo" property of a QueryRequestClause it is one filter term among others, so it composes with and/or and with a root_ids traversal. Both may appear in one request, which intersects the two tests.
          *
-         *     This is a containment test, NOT a nearest-neighbour search. Dgraph returns geo matches in uid order, cannot sort by distance (ordering by a geo predicate is rejected: "Value of type: geo isn't sortable") and does not return the computed distance. Combining this with "first" therefore returns an arbitrary N of the nodes inside the radius, NOT the N nearest. A caller who needs nearest-first must retrieve the whole radius and sort client-side.
+         *     Dgraph returns geo matches in uid order, cannot sort by distance (ordering by a geo predicate is rejected: "Value of type: geo isn't sortable") and does not return the computed distance. A near search is therefore a containment test, NOT a nearest-neighbour search: combining it with "first" returns an arbitrary N of the nodes inside the radius, NOT the N nearest. Use nearest for that: the server ranks the readable nodes around the point by distance, so nodes the caller cannot read never take a place in the ranking.
          */
         QueryGeo: {
             /**
-             * @description Centre of the search as [longitude, latitude] - LONGITUDE FIRST, matching GeoJSON and the order stored in a node's `g` predicate. Longitude must be between -180 and 180, latitude between -90 and 90; a request outside those ranges is rejected (which also catches the two being swapped).
+             * @description The geo test to apply. Defaults to near.
+             * @example near
+             * @enum {string}
+             */
+            mode?: "near" | "within" | "contains" | "intersects" | "nearest";
+            /**
+             * @description For near and nearest, the centre of the search; for contains, the point the node's area must hold. [longitude, latitude] - LONGITUDE FIRST, matching GeoJSON and the order stored in a node's `g` predicate. Longitude must be between -180 and 180, latitude between -90 and 90; a request outside those ranges is rejected (which also catches the two being swapped).
              * @example [
              *       151.2153,
              *       -33.8568
              *     ]
              */
-            point: number[];
+            point?: number[];
             /**
              * Format: float
-             * @description Search radius in metres. Must be greater than 0 and at most 20100000 (past roughly half the Earth's circumference every point matches).
+             * @description For near, the search radius in metres. Must be greater than 0 and at most 20100000 (past roughly half the Earth's circumference every point matches). For nearest, an optional limit on how far out to look, defaulting to the whole globe.
              * @example 5000
              */
-            distance: number;
+            distance?: number;
+            /** @description For within, contains and intersects, the area to test against, a Polygon or MultiPolygon. It is validated as a node's `g` is. */
+            shape?: components["schemas"]["Geoloc"];
         };
-        /** @description Vector-similarity search: returns the nodes nearest to a query vector using the hnsw index on the `vec` predicate, instead of a uid/root traversal. Results are still scoped by the caller's read permissions and any filters/select. */
+        /** @description Vector-similarity search: returns the top_k readable nodes most similar to a query vector, most similar first, each with its "similarity". With root_ids only the nodes a traversal from them reaches are searched (depth, direction and traverse_filter apply as usual), which is how to search within one project's subtree; without, the whole database is searched through the hnsw index on the `vec` predicate. Either way the results are scoped by the caller's read permissions and filters before top_k is counted, so a caller gets top_k results whenever that many readable nodes have a `vec`. first and offset page through the top_k; it cannot be combined with geo, cluster, root_query, cursor, after, order_by, aggregate or with_depth. Takes one of vector or text. */
         QuerySimilarity: {
             /**
              * @description The query embedding as a string-encoded float array, e.g. "[0.1,0.2,0.3]" (same format as a node's `vec`).
              * @example [0.12, -0.03, 0.88]
              */
-            vector: string;
+            vector?: string;
+            /**
+             * @description Plain text to search for instead of a vector, embedded by the server's configured embedder (the one that fills in `vec` from a node's text fields). Rejected when the server has no embedder configured.
+             * @example oat milk latte
+             */
+            text?: string;
             /**
-             * @description How many nearest neighbours to retrieve (before read filtering). Defaults to 10, capped at 1000.
+             * @description How many of the most similar readable nodes to return. Defaults to 10, capped at 1000.
              * @example 10
              */
             top_k?: number;
@@ -1350,7 +2234,7 @@ export interface components {
              *
              *     "p" holds owner-private data and is not returned to other users, so filtering on it is restricted to sys role callers: a non-admin request naming "p" in any clause (including nested and/or clauses) is rejected with the error "field 'p' is private and cannot be used in filters or order_by", rather than being run. This prevents the value being inferred from which nodes a filter matches.
              *
-             *     "g" is absent from this list on purpose: no filter op can express a geo predicate, so naming it here is rejected. To filter by proximity, set the "geo" property on this clause instead (or the request-level "geo" block for a standalone radius search). "g" is still valid in "select".
+             *     "g" is absent from this list on purpose: no filter op can express a geo predicate, so naming it here is rejected. To filter by location, set the "geo" property on this clause instead (or the request-level "geo" block for a standalone geo search). "g" is still valid in "select".
              * @example id
              */
             field?: string;
@@ -1362,6 +2246,15 @@ export interface components {
              *     - lt (less than)
              *     - ge (greater than or equal to)
              *     - le (less than or equal to)
+             *     - in (equals any of "vals")
+             *     - between (from the first of "vals" to the second, inclusive)
+             *     - exists (the node has a value for the field)
+             *     - owner (the node is owned by the user whose AuthzData is "val"; no field)
+             *     - anyofterms / allofterms (any or all of the words in "val"; id, s1, s2)
+             *     - anyoftext / alloftext (as the above, with stemming and stop words; s1, s2)
+             *     - match (fuzzy, within "match_distance" edits of "val"; id, s1)
+             *
+             *     "in", "between" and "exists" need a field, and the rules on "p" and "g" under "field" apply to them as to any other op.
              * @example eq
              */
             op?: string;
@@ -1372,9 +2265,23 @@ export interface components {
              */
             val?: string;
             /**
-             * @description When set, this clause is a radius test on the `g` predicate instead of a field/op/val comparison, so proximity can be combined with ordinary filters using and/or and applied to a root_ids traversal - which the request-level "geo" block cannot do, since that replaces the query root. field, op and val must be left unset on a geo clause; setting both is rejected rather than silently ignored.
+             * @description the values for "in" (at most 100) or the lower and upper bound for "between"
+             * @example [
+             *       "Task",
+             *       "Note"
+             *     ]
+             */
+            vals?: string[];
+            /**
+             * @description how many edits away from "val" a "match" may be, default 2, at most 8
+             * @example 2
+             */
+            match_distance?: number;
+            not?: components["schemas"]["QueryRequestClauseNested"];
+            /**
+             * @description When set, this clause is a geo test on the `g` predicate instead of a field/op/val comparison, so location can be combined with ordinary filters using and/or and applied to a root_ids traversal - which the request-level "geo" block cannot do, since that replaces the query root. field, op and val must be left unset on a geo clause; setting both is rejected rather than silently ignored.
              *
-             *     The same caveats apply as for the request-level block: it is a containment test, not nearest-first. Both may be used in one request, which intersects the two radii.
+             *     The same caveats apply as for the request-level block: near is a containment test, not nearest-first, and mode nearest is rejected here. Both may be used in one request, which intersects the two tests.
              */
             geo?: components["schemas"]["QueryGeo"];
         };
@@ -1399,7 +2306,7 @@ export interface components {
              *
              *     "p" holds owner-private data and is not returned to other users, so filtering on it is restricted to sys role callers: a non-admin request naming "p" in any clause (including nested and/or clauses) is rejected with the error "field 'p' is private and cannot be used in filters or order_by", rather than being run. This prevents the value being inferred from which nodes a filter matches.
              *
-             *     "g" is absent from this list on purpose: no filter op can express a geo predicate, so naming it here is rejected. To filter by proximity, set the "geo" property on this clause instead (or the request-level "geo" block for a standalone radius search). "g" is still valid in "select".
+             *     "g" is absent from this list on purpose: no filter op can express a geo predicate, so naming it here is rejected. To filter by location, set the "geo" property on this clause instead (or the request-level "geo" block for a standalone geo search). "g" is still valid in "select".
              * @example id
              */
             field?: string;
@@ -1411,6 +2318,15 @@ export interface components {
              *     - lt (less than)
              *     - ge (greater than or equal to)
              *     - le (less than or equal to)
+             *     - in (equals any of "vals")
+             *     - between (from the first of "vals" to the second, inclusive)
+             *     - exists (the node has a value for the field)
+             *     - owner (the node is owned by the user whose AuthzData is "val"; no field)
+             *     - anyofterms / allofterms (any or all of the words in "val"; id, s1, s2)
+             *     - anyoftext / alloftext (as the above, with stemming and stop words; s1, s2)
+             *     - match (fuzzy, within "match_distance" edits of "val"; id, s1)
+             *
+             *     "in", "between" and "exists" need a field, and the rules on "p" and "g" under "field" apply to them as to any other op.
              * @example eq
              */
             op?: string;
@@ -1421,11 +2337,100 @@ export interface components {
              */
             val?: string;
             /**
-             * @description When set, this clause is a radius test on the `g` predicate instead of a field/op/val comparison, so proximity can be combined with ordinary filters using and/or and applied to a root_ids traversal - which the request-level "geo" block cannot do, since that replaces the query root. field, op and val must be left unset on a geo clause; setting both is rejected rather than silently ignored.
+             * @description the values for "in" (at most 100) or the lower and upper bound for "between"
+             * @example [
+             *       "Task",
+             *       "Note"
+             *     ]
+             */
+            vals?: string[];
+            /**
+             * @description how many edits away from "val" a "match" may be, default 2, at most 8
+             * @example 2
+             */
+            match_distance?: number;
+            not?: components["schemas"]["QueryRequestClauseNested"];
+            /**
+             * @description When set, this clause is a geo test on the `g` predicate instead of a field/op/val comparison, so location can be combined with ordinary filters using and/or and applied to a root_ids traversal - which the request-level "geo" block cannot do, since that replaces the query root. field, op and val must be left unset on a geo clause; setting both is rejected rather than silently ignored.
              *
-             *     The same caveats apply as for the request-level block: it is a containment test, not nearest-first. Both may be used in one request, which intersects the two radii.
+             *     The same caveats apply as for the request-level block: near is a containment test, not nearest-first, and mode nearest is rejected here. Both may be used in one request, which intersects the two tests.
+             */
+            geo?: components["schemas"]["QueryGeo"];
+        };
+        SearchRequest: {
+            /**
+             * @description what to search for, at most 200 characters
+             * @example invoice march
+             */
+            text?: string;
+            /**
+             * @description "terms" (the default) matches any of the words in text; "text" does too, after stemming and dropping stop words, so "invoices" finds "invoice"; "fuzzy" matches values within two edits of the whole of text.
+             * @example terms
+             * @enum {string}
+             */
+            mode?: "terms" | "text" | "fuzzy";
+            /**
+             * @description the fields to search. By default every field indexed for the mode - id, s1 and s2 for terms, s1 and s2 for text, id and s1 for fuzzy.
+             * @example [
+             *       "s1"
+             *     ]
+             */
+            fields?: string[];
+            filters?: components["schemas"]["QueryRequestClause"];
+            /**
+             * @description GraphNode fields to include for each match, as for QueryRequest
+             * @example [
+             *       "ty",
+             *       "s1"
+             *     ]
+             */
+            select?: string[];
+            /**
+             * @description how many matches to return, 1 to 100, default 20
+             * @example 20
+             */
+            first?: number;
+            /**
+             * @description how many of the best matches to skip
+             * @example 0
              */
+            offset?: number;
+            similar?: components["schemas"]["QuerySimilarity"];
             geo?: components["schemas"]["QueryGeo"];
+            fusion?: components["schemas"]["SearchFusion"];
+        };
+        /** @description How a hybrid search (one with "similar" or "geo") combines its rankings. In a hybrid search "text" is optional, top_k in "similar" does not apply, and "geo" ranks by nearness to its point, so its mode must be nearest or unset. */
+        SearchFusion: {
+            /**
+             * @description "rrf" (the default), reciprocal-rank fusion: a node scores the sum, over the rankings it is in, of weight / (k + its rank there, counted from 1). "weighted": a node scores the sum of weight times its score in each ranking, scaled to between 0 and 1 across that ranking.
+             * @example rrf
+             * @enum {string}
+             */
+            method?: "rrf" | "weighted";
+            /**
+             * @description the rrf constant, default 60. A bigger k narrows the lead of the top ranks.
+             * @example 60
+             */
+            k?: number;
+            weights?: components["schemas"]["SearchWeights"];
+        };
+        /** @description how much each signal counts in the combined score, each 1 by default. A weight of 0 leaves its signal out. */
+        SearchWeights: {
+            /**
+             * Format: double
+             * @example 1
+             */
+            text?: number;
+            /**
+             * Format: double
+             * @example 2
+             */
+            vector?: number;
+            /**
+             * Format: double
+             * @example 0.5
+             */
+            geo?: number;
         };
         ShareNodesRequest: {
             /** @description AuthzData identifiers that specify which GraphNodes will be shared with users listed in the users field of the request */
@@ -1433,6 +2438,87 @@ export interface components {
             /** @description AuthzData identifiers that specify which users will be granted access to the GraphNodes  listed in the "nodes" field of the request */
             users: components["schemas"]["AuthzData"][];
         };
+        ShareeAccessChange: {
+            user?: components["schemas"]["GraphUserDTO"];
+            /** @description number of affected nodes the user can read after the change but could not before */
+            gained?: number;
+            /** @description number of affected nodes the user could read before the change but cannot after */
+            lost?: number;
+        };
+        /** @description constraints on one payload slot. pattern, enum and max_length apply to string slots (s1-s4, b), min and max to number slots (n1, n2) and json_schema to b only. Time slots (t1, t2) can only be required. */
+        SlotRule: {
+            /** @description the slot must be set when a node of this type is created */
+            required?: boolean;
+            /** @description regular expression the whole value must match */
+            pattern?: string;
+            enum?: string[];
+            /** @description maximum length in characters */
+            max_length?: number;
+            min?: number;
+            max?: number;
+            /** @description JSON Schema the value of b must satisfy once parsed as JSON. Supported keywords: type, properties, required, additionalProperties (boolean), items, enum, minimum, maximum, minLength, maxLength, pattern, minItems, maxItems. */
+            json_schema?: {
+                [key: string]: unknown;
+            };
+        };
+        SubgraphPermsRequest: {
+            /** @description AuthzData identifiers of the GraphNodes to update. The caller must own every one of them. */
+            nodes: components["schemas"]["AuthzData"][];
+            /** @description how many levels of out-edges below each node to follow. Descendants are only updated while they are owned by the same user as the node above them. */
+            depth?: number;
+            perms?: components["schemas"]["PermissionMask"];
+            /** @description move every affected node into one new share group */
+            reset_sgi?: boolean;
+            /** @description report what would change without writing anything */
+            dry_run?: boolean;
+        };
+        SubgraphPermsResponse: {
+            dry_run?: boolean;
+            /** @description number of nodes the change applies to */
+            affected_nodes?: number;
+            /** @description the updated nodes (not sent for a dry run) */
+            result_nodes?: components["schemas"]["GraphNode"][];
+            /** @description users the nodes are shared with whose read access changes */
+            sharees?: components["schemas"]["ShareeAccessChange"][];
+            /**
+             * Format: date-time
+             * @example 2021-03-14T05:18:32.8247882Z
+             */
+            timestamp?: string;
+            error?: string;
+        };
+        InvalidVector: {
+            uid?: string;
+            ty?: string;
+            /** @description the number of dimensions the vec has, if it parses */
+            dims?: number;
+            /** @description why the vec is invalid */
+            reason?: string;
+            /** @description the vec was replaced by a fresh embedding of the node's text */
+            reembedded?: boolean;
+        };
+        VectorCheckRequest: {
+            /** @description only check the nodes of this type */
+            ty?: string;
+            /** @description replace each invalid vec with the server's embedding of the node's configured embed fields, where it has text in them. Rejected when the server has no embedder configured. */
+            reembed?: boolean;
+        };
+        VectorCheckResponse: {
+            /** @description number of nodes with a vec that were checked */
+            checked?: number;
+            /** @description number of nodes whose vec is invalid */
+            invalid_count?: number;
+            /** @description the invalid vectors, up to the first 1000 */
+            invalid?: components["schemas"]["InvalidVector"][];
+            /** @description number of invalid vectors replaced */
+            reembedded?: number;
+            /**
+             * Format: date-time
+             * @example 2021-03-14T05:18:32.8247882Z
+             */
+            timestamp?: string;
+            error?: string;
+        };
         TokenResponse: {
             /**
              * @description expiry time in seconds for auth token
@@ -1445,8 +2531,17 @@ export interface components {
              */
             token?: string;
         };
+        TransferNodesRequest: {
+            /** @description AuthzData identifiers of the GraphNodes to transfer. The caller must own every one of them. */
+            nodes: components["schemas"]["AuthzData"][];
+            user: components["schemas"]["AuthzData"];
+            /** @description how many levels of out-edges below each node to follow. Descendants are only transferred while they are owned by the same user as the node above them; the walk stops at a node owned by anyone else. */
+            depth?: number;
+            /** @description leave each previous owner with a share edge to the transferred root nodes */
+            keep_share?: boolean;
+        };
         UpdateNodesRequest: {
-            /** @description GraphNode data for existing nodes in the Cogged database, which will be updated. Each node must have a UID, owner and permissions matching the data in its AuthzData field. This is to prevent tampering and spoofing requests to update nodes that the requesting user does not have access to or permissions for.  Nested nodes via the edges property are not allowed. */
+            /** @description GraphNode data for existing nodes in the Cogged database, which will be updated. Each node must have a UID, owner and permissions matching the data in its AuthzData field. This is to prevent tampering and spoofing requests to update nodes that the requesting user does not have access to or permissions for.  Nested nodes via the edges property are not allowed. A predicate sent as `null` is unset (see GraphNode `unset`). */
             nodes: components["schemas"]["GraphNode"][];
         };
         UserNodeRequest: {
@@ -16,11 +16,27 @@ export type CreateUserRequest = Schemas["CreateUserRequest"];
 export type UsersRequest = Schemas["UsersRequest"];
 export type QueryRequest = Schemas["QueryRequest"];
 export type QueryRequestClause = Schemas["QueryRequestClause"];
+export type QueryAggregate = Schemas["QueryAggregate"];
+export type OrderKey = Schemas["OrderKey"];
+export type QueryGeo = Schemas["QueryGeo"];
+export type QueryCluster = Schemas["QueryCluster"];
 export type UpdateNodesRequest = Schemas["UpdateNodesRequest"];
 export type CreateNodesRequest = Schemas["CreateNodesRequest"];
 export type EdgesRequest = Schemas["EdgesRequest"];
 export type UserNodeRequest = Schemas["UserNodeRequest"];
 export type ShareNodesRequest = Schemas["ShareNodesRequest"];
+export type TransferNodesRequest = Schemas["TransferNodesRequest"];
+export type SubgraphPermsRequest = Schemas["SubgraphPermsRequest"];
+export type PermissionMask = Schemas["PermissionMask"];
+export type PathRequest = Schemas["PathRequest"];
+export type SearchRequest = Schemas["SearchRequest"];
+export type SearchFusion = Schemas["SearchFusion"];
+export type SearchWeights = Schemas["SearchWeights"];
+export type PayloadSchema = Schemas["PayloadSchema"];
+export type SlotRule = Schemas["SlotRule"];
+export type VectorCheckRequest = Schemas["VectorCheckRequest"];
+export type BlobUploadRequest = Schemas["BlobUploadRequest"];
+export type BlobGCRequest = Schemas["BlobGCRequest"];
 
 // --- response DTOs ---
 export type TokenResponse = Schemas["TokenResponse"];
@@ -29,6 +45,18 @@ export type ClientConfig = Schemas["ClientConfig"];
 export type CoggedResponseRN = Schemas["CoggedResponseRN"];
 export type CoggedResponseRU = Schemas["CoggedResponseRU"];
 export type CoggedResponseEmpty = Schemas["CoggedResponseEmpty"];
+export type SubgraphPermsResponse = Schemas["SubgraphPermsResponse"];
+export type ShareeAccessChange = Schemas["ShareeAccessChange"];
+export type PayloadSchemasResponse = Schemas["PayloadSchemasResponse"];
+export type PathResponse = Schemas["PathResponse"];
+export type NodePath = Schemas["NodePath"];
+export type AggregateGroup = Schemas["AggregateGroup"];
+export type GeoCluster = Schemas["GeoCluster"];
+export type VectorCheckResponse = Schemas["VectorCheckResponse"];
+export type InvalidVector = Schemas["InvalidVector"];
+export type BlobResponse = Schemas["BlobResponse"];
+export type BlobUploadResponse = Schemas["BlobUploadResponse"];
+export type BlobGCResponse = Schemas["BlobGCResponse"];
 
 /** A created node as returned in created_nodes (uid, owner, permissions, AuthzData). */
 export type NodeEdgeData = Schemas["NodeEdgeData"];
@@ -52,6 +80,7 @@ export type CoggedResponseCU = Schemas["CoggedResponseCU"];
 export type GraphNode = Schemas["GraphNode"];
 export type GraphNodeNew = Schemas["GraphNodeNew"];
 export type GraphUser = Schemas["GraphUserDTO"];
+export type Geoloc = Schemas["Geoloc"];
 
 /** The scope for POST /user/nodes/{scope}. */
 export type NodeScope = "own" | "shared";
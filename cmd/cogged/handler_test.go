@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -98,6 +99,36 @@ func TestServeHTTPAdminRouteWithNilAuthIsDeniedNotPanic(t *testing.T) {
 	}
 }
 
+// A streamed route group takes any content type, but still needs a valid token.
+func TestServeHTTPStreamGroupSkipsJSONCheck(t *testing.T) {
+	stream := Set{"blob": true}
+	h := newGatingHandler(Set{}, Set{})
+	h.streamList = &stream
+	r := httptest.NewRequest("PUT", "/blob/data/x", nil)
+	r.Header.Set("Content-Type", "application/octet-stream")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated blob upload: got %d, want 401", rr.Code)
+	}
+}
+
+func TestServeHTTPBlobRouteWithoutStore(t *testing.T) {
+	key := testSecret(t)
+	h := newAuthHandler(key, 600)
+	stream := Set{"blob": true}
+	h.streamList = &stream
+	uid, tid := "0xu7", "tok-blob"
+	state.UsmAddTokenId(uid, tid)
+	r := httptest.NewRequest("GET", "/blob/data/x", nil)
+	r.Header.Set("Authorization", bearer(uid, "user", tid, time.Now().Unix(), key))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("blob route with no blob store: got %d, want 404", rr.Code)
+	}
+}
+
 // --- authentication path (full token validation via /auth/check) ---
 
 func TestServeHTTPAuthValidToken(t *testing.T) {
@@ -111,6 +142,23 @@ func TestServeHTTPAuthValidToken(t *testing.T) {
 	}
 }
 
+// A JSON body over the configured cap is refused before it reaches a handler.
+func TestServeHTTPBodyTooLarge(t *testing.T) {
+	key := testSecret(t)
+	h := newAuthHandler(key, 600)
+	h.maxBody = 16
+	uid, tid := "0xu8", "tok-body"
+	state.UsmAddTokenId(uid, tid)
+	r := httptest.NewRequest("POST", "/auth/check", strings.NewReader(`{"pad":"`+strings.Repeat("x", 32)+`"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", bearer(uid, "user", tid, time.Now().Unix(), key))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body: got %d, want 413", rr.Code)
+	}
+}
+
 func TestServeHTTPAuthTamperedToken(t *testing.T) {
 	key := testSecret(t)
 	h := newAuthHandler(key, 600)
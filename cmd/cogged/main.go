@@ -21,14 +21,25 @@ import (
 
 type Set map[string]bool
 
+// DEFAULT_MAX_BODY caps the JSON body of a request when the config sets no
+// "listen.maxbody".
+const DEFAULT_MAX_BODY int64 = 10 << 20
+
 type DefaultHandler struct {
 	health    api.HealthAPI
 	auth      api.AuthAPI
 	admin     api.AdminAPI
 	graph     api.GraphAPI
 	user      api.UserAPI
+	blob      api.BlobAPI
 	allowList *Set
 	adminList *Set
+	// streamList holds the route groups served by a StreamHandler, whose requests are
+	// passed on without their content type being checked or their body read.
+	streamList *Set
+	// maxBody caps the JSON body of the other route groups, in bytes; 0 means
+	// DEFAULT_MAX_BODY.
+	maxBody int64
 }
 
 func (h *DefaultHandler) ErrorResponse(code int, message string, w http.ResponseWriter, r *http.Request) {
@@ -57,18 +68,23 @@ func (h *DefaultHandler) checkTokenId(userid, tokenId string) bool {
 	return state.UsmCheckTokenId(userid, tokenId)
 }
 
+func (h *DefaultHandler) isStreamGroup(routeGroup string) bool {
+	return h.streamList != nil && (*h.streamList)[routeGroup]
+}
+
 func (h *DefaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// validate content type is JSON
+	path := strings.TrimSpace(r.URL.Path)
+	routeParts := strings.Split(path, "/")
+	numParts := len(routeParts)
+	streaming := numParts > 1 && h.isStreamGroup(routeParts[1])
+
+	// validate content type is JSON, except for streamed route groups, which take any
 	ctype := r.Header["Content-Type"]
-	if len(ctype) != 1 || !strings.HasPrefix(ctype[0], "application/json") {
+	if !streaming && (len(ctype) != 1 || !strings.HasPrefix(ctype[0], "application/json")) {
 		h.ErrorResponse(http.StatusUnsupportedMediaType, "only JSON accepted", w, r)
 		return
 	}
 
-	path := strings.TrimSpace(r.URL.Path)
-	routeParts := strings.Split(path, "/")
-	numParts := len(routeParts)
-
 	// validate route is of one of the following formats:
 	// /routegroup/endpoint
 	// /routegroup/endpoint/:param
@@ -127,12 +143,6 @@ func (h *DefaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		reqBodyString := ""
-		if r.Body != nil {
-			bodybytes, _ := io.ReadAll(r.Body)
-			reqBodyString = string(bodybytes)
-		}
-
 		var handlerResponseStr string
 		var handlerErr error
 
@@ -143,6 +153,39 @@ func (h *DefaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			handlerParam = routeParts[3]
 		}
 
+		if streaming {
+			var handler api.StreamHandler
+			switch routeGroup {
+			case "blob":
+				handler = &h.blob
+			default:
+				h.ErrorResponse(http.StatusNotFound, "", w, r)
+				return
+			}
+			handlerResponseStr, handlerErr = handler.HandleStream(handlerKey, handlerParam, w, r, userAuthData)
+			h.finishResponse(handlerResponseStr, handlerErr, true, w, r)
+			return
+		}
+
+		reqBodyString := ""
+		if r.Body != nil {
+			maxBody := h.maxBody
+			if maxBody <= 0 {
+				maxBody = DEFAULT_MAX_BODY
+			}
+			bodybytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+			if err != nil {
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					h.ErrorResponse(http.StatusRequestEntityTooLarge, "request body too large", w, r)
+				} else {
+					h.ErrorResponse(http.StatusBadRequest, "bad request body", w, r)
+				}
+				return
+			}
+			reqBodyString = string(bodybytes)
+		}
+
 		var handler api.Handler
 
 		switch routeGroup {
@@ -162,21 +205,26 @@ func (h *DefaultHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		handlerResponseStr, handlerErr = handler.HandleRequest(handlerKey, handlerParam, reqBodyString, userAuthData)
+		h.finishResponse(handlerResponseStr, handlerErr, false, w, r)
+	}
+}
 
-		if handlerErr != nil {
-			statusCode := http.StatusInternalServerError
-			metaValue := reflect.ValueOf(handlerErr).Elem()
-			if sv := metaValue.FieldByName("StatusCode"); sv != (reflect.Value{}) {
-				if code := int(sv.Int()); code != 0 {
-					statusCode = code
-				}
+// finishResponse sends a handler's error, or its JSON response. An empty response from a
+// StreamHandler (streamed) means it has written the response itself.
+func (h *DefaultHandler) finishResponse(handlerResponseStr string, handlerErr error, streamed bool, w http.ResponseWriter, r *http.Request) {
+	if handlerErr != nil {
+		statusCode := http.StatusInternalServerError
+		metaValue := reflect.ValueOf(handlerErr).Elem()
+		if sv := metaValue.FieldByName("StatusCode"); sv != (reflect.Value{}) {
+			if code := int(sv.Int()); code != 0 {
+				statusCode = code
 			}
-			msg := handlerErr.Error()
-			h.ErrorResponse(statusCode, msg, w, r)
-			log.Debug("handler error", handlerErr)
-		} else {
-			h.OkResponse(handlerResponseStr, w)
 		}
+		msg := handlerErr.Error()
+		h.ErrorResponse(statusCode, msg, w, r)
+		log.Debug("handler error", handlerErr)
+	} else if handlerResponseStr != "" || !streamed {
+		h.OkResponse(handlerResponseStr, w)
 	}
 }
 
@@ -242,14 +290,25 @@ func CreateDefaultHandler(conf *svc.Config, db *svc.DB, skB64 string) *DefaultHa
 	adminRoutes := make(Set)
 	adminRoutes["admin"] = true
 
+	streamRoutes := make(Set)
+	streamRoutes["blob"] = true
+
+	maxBody := DEFAULT_MAX_BODY
+	if mb, err := strconv.ParseInt(conf.Get("listen.maxbody"), 10, 64); err == nil && mb > 0 {
+		maxBody = mb
+	}
+
 	return &DefaultHandler{
-		health:    *api.NewHealthAPI(),
-		auth:      *api.NewAuthAPI(conf, db, skB64),
-		admin:     *api.NewAdminAPI(conf, db),
-		graph:     *api.NewGraphAPI(conf, db),
-		user:      *api.NewUserAPI(conf, db),
-		allowList: &unauthenticatedRoutes,
-		adminList: &adminRoutes,
+		health:     *api.NewHealthAPI(),
+		auth:       *api.NewAuthAPI(conf, db, skB64),
+		admin:      *api.NewAdminAPI(conf, db),
+		graph:      *api.NewGraphAPI(conf, db),
+		user:       *api.NewUserAPI(conf, db),
+		blob:       *api.NewBlobAPI(conf, db),
+		allowList:  &unauthenticatedRoutes,
+		adminList:  &adminRoutes,
+		streamList: &streamRoutes,
+		maxBody:    maxBody,
 	}
 }
 
@@ -1,6 +1,8 @@
 // Package models defines Cogged's graph domain types (GraphNode, GraphUser, GraphBase,
 // Geoloc) and the AuthzData signing/verification plus permission logic that enforces
-// cross-user access control (see node.go).
+// cross-user access control (see node.go), the per-type payload schemas that node writes
+// are validated against (payloadschema.go), and the signed cursors that page through query
+// results (cursor.go).
 package models
 
 type GraphBaser interface {
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// BLOB_REF_PREFIX starts a node's b when it refers to a blob in the server's blob store
+// rather than holding the data itself. The SHA-256 of the blob's content, in lower-case
+// hex, follows it.
+const BLOB_REF_PREFIX = "blob:sha256:"
+
+var rgxBlobSum = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidBlobSum reports whether sum is a SHA-256 in lower-case hex, as blobs are named.
+func ValidBlobSum(sum string) bool {
+	return rgxBlobSum.MatchString(sum)
+}
+
+// BlobRef is the b value that refers to the blob with SHA-256 sum.
+func BlobRef(sum string) string {
+	return BLOB_REF_PREFIX + sum
+}
+
+// BlobRefSum gives the SHA-256 of the blob a b value refers to, or "" if it is not a
+// blob reference.
+func BlobRefSum(b *string) string {
+	if b == nil || !strings.HasPrefix(*b, BLOB_REF_PREFIX) {
+		return ""
+	}
+	if sum := (*b)[len(BLOB_REF_PREFIX):]; ValidBlobSum(sum) {
+		return sum
+	}
+	return ""
+}
+
+// ValidateBlobField rejects a b sent by a client that starts with BLOB_REF_PREFIX. Only
+// the server writes blob references, once the blob is uploaded, so that knowing a blob's
+// hash is never enough to attach it to a node of one's own and read it.
+func ValidateBlobField(b *string) error {
+	if b != nil && strings.HasPrefix(*b, BLOB_REF_PREFIX) {
+		return fmt.Errorf("b cannot start with %q: upload the data to /blob/data/{ad} instead", BLOB_REF_PREFIX)
+	}
+	return nil
+}
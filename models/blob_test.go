@@ -0,0 +1,33 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBlobRef(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	ref := BlobRef(sum)
+	if got := BlobRefSum(&ref); got != sum {
+		t.Errorf("expected %s back, got %q", sum, got)
+	}
+	for _, b := range []string{"inline text", BLOB_REF_PREFIX + "abc", BLOB_REF_PREFIX + strings.Repeat("AB", 32)} {
+		if got := BlobRefSum(&b); got != "" {
+			t.Errorf("%q is not a blob reference, got %q", b, got)
+		}
+	}
+	if BlobRefSum(nil) != "" {
+		t.Error("a nil b is not a blob reference")
+	}
+}
+
+func TestValidateNewNodePayloadRejectsBlobRef(t *testing.T) {
+	ref := BlobRef(strings.Repeat("ab", 32))
+	if err := ValidateNewNodePayload(&GraphNode{Blob: &ref}); err == nil {
+		t.Error("a client should not be able to write a blob reference")
+	}
+	text := "blobs of text"
+	if err := ValidateNewNodePayload(&GraphNode{Blob: &text}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	sec "cogged/security"
+	"encoding/json"
+)
+
+// PageCursor marks where a page of query results ended, so that the next page carries on
+// after it under the same ordering. It is handed to the client signed with the user's key,
+// like AuthzData, so it cannot be forged or used by anyone else.
+type PageCursor struct {
+	// Order is the sort keys of the query the page came from, each a field name with a
+	// leading "-" when descending.
+	Order []string `json:"o,omitempty"`
+	// Vals holds the last node's value for each of the sort keys.
+	Vals []string `json:"v,omitempty"`
+	// Uid is the last node's uid, which orders the nodes that tie on every key.
+	Uid string `json:"u"`
+}
+
+// Pack signs the cursor for the user. The JSON is base64 encoded before signing so the
+// signed message holds no "." and can never be read back as a node or user AuthzData.
+func (c *PageCursor) Pack(uad *sec.UserAuthData) string {
+	b, _ := json.Marshal(c)
+	return sec.MessageAndMAC(sec.B64Encode(b), uad.SecretKey)
+}
+
+func PageCursorFromString(packed, key string) *PageCursor {
+	msg := DecodeAndVerifyAD(packed, key)
+	if msg == "" {
+		return nil
+	}
+	c := PageCursor{}
+	if err := json.Unmarshal(sec.B64Decode(msg), &c); err != nil {
+		return nil
+	}
+	if c.Uid == "" || len(c.Vals) != len(c.Order) {
+		return nil
+	}
+	return &c
+}
@@ -1,6 +1,176 @@
 package models
 
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+const (
+	GEO_POINT        = "Point"
+	GEO_LINESTRING   = "LineString"
+	GEO_POLYGON      = "Polygon"
+	GEO_MULTIPOLYGON = "MultiPolygon"
+
+	// MAX_GEO_POSITIONS caps the positions in one geometry, over all its rings and polygons.
+	MAX_GEO_POSITIONS = 10000
+)
+
+// Geoloc is a GeoJSON geometry, as held in a node's g predicate: a Point, LineString,
+// Polygon or MultiPolygon. Positions are [longitude, latitude], longitude first as in
+// GeoJSON. Only the field for Type is set; the others are nil.
 type Geoloc struct {
-	Type   string    `json:"type,omitempty"`
-	Coords []float64 `json:"coordinates,omitempty"`
+	Type string `json:"type,omitempty"`
+	// Coords is a Point's position.
+	Coords []float64 `json:"-"`
+	// Line is a LineString's positions.
+	Line [][]float64 `json:"-"`
+	// Polygon is a Polygon's rings, the outer boundary first and then any holes.
+	Polygon [][][]float64 `json:"-"`
+	// MultiPolygon is a MultiPolygon's polygons.
+	MultiPolygon [][][][]float64 `json:"-"`
+}
+
+func (g Geoloc) MarshalJSON() ([]byte, error) {
+	var coords any
+	switch {
+	case g.Type == GEO_LINESTRING && len(g.Line) > 0:
+		coords = g.Line
+	case g.Type == GEO_POLYGON && len(g.Polygon) > 0:
+		coords = g.Polygon
+	case g.Type == GEO_MULTIPOLYGON && len(g.MultiPolygon) > 0:
+		coords = g.MultiPolygon
+	case len(g.Coords) > 0:
+		coords = g.Coords
+	}
+	return json.Marshal(struct {
+		Type   string `json:"type,omitempty"`
+		Coords any    `json:"coordinates,omitempty"`
+	}{g.Type, coords})
+}
+
+// UnmarshalJSON reads GeoJSON coordinates into the field for the geometry's type. Ones
+// that are not nested as the type needs are left out rather than failing the whole
+// request, so that Validate can say what is wrong with them.
+func (g *Geoloc) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Type   string          `json:"type"`
+		Coords json.RawMessage `json:"coordinates"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*g = Geoloc{Type: raw.Type}
+	if len(raw.Coords) == 0 {
+		return nil
+	}
+	// encoding/json fills in what it can before a type mismatch, so start again on error
+	switch raw.Type {
+	case GEO_POINT:
+		if json.Unmarshal(raw.Coords, &g.Coords) != nil {
+			g.Coords = nil
+		}
+	case GEO_LINESTRING:
+		if json.Unmarshal(raw.Coords, &g.Line) != nil {
+			g.Line = nil
+		}
+	case GEO_POLYGON:
+		if json.Unmarshal(raw.Coords, &g.Polygon) != nil {
+			g.Polygon = nil
+		}
+	case GEO_MULTIPOLYGON:
+		if json.Unmarshal(raw.Coords, &g.MultiPolygon) != nil {
+			g.MultiPolygon = nil
+		}
+	}
+	return nil
+}
+
+// Validate checks the geometry is well formed: a known type, positions within range, a
+// line of at least two positions, and polygon rings of at least four positions that end
+// where they start. A nil Geoloc is valid, as g is optional.
+func (g *Geoloc) Validate() error {
+	if g == nil {
+		return nil
+	}
+	n := 0
+	switch g.Type {
+	case GEO_POINT:
+		if err := validatePosition(g.Coords); err != nil {
+			return err
+		}
+	case GEO_LINESTRING:
+		if len(g.Line) < 2 {
+			return fmt.Errorf("a LineString needs at least 2 positions")
+		}
+		if err := validatePositions(g.Line, &n); err != nil {
+			return err
+		}
+	case GEO_POLYGON:
+		if err := validatePolygon(g.Polygon, &n); err != nil {
+			return err
+		}
+	case GEO_MULTIPOLYGON:
+		if len(g.MultiPolygon) == 0 {
+			return fmt.Errorf("a MultiPolygon needs at least one polygon")
+		}
+		for _, p := range g.MultiPolygon {
+			if err := validatePolygon(p, &n); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("geo type must be one of %s, %s, %s or %s", GEO_POINT, GEO_LINESTRING, GEO_POLYGON, GEO_MULTIPOLYGON)
+	}
+	return nil
+}
+
+func validatePolygon(rings [][][]float64, n *int) error {
+	if len(rings) == 0 {
+		return fmt.Errorf("a Polygon needs at least one ring")
+	}
+	for _, ring := range rings {
+		if len(ring) < 4 {
+			return fmt.Errorf("a Polygon ring needs at least 4 positions")
+		}
+		if err := validatePositions(ring, n); err != nil {
+			return err
+		}
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			return fmt.Errorf("a Polygon ring must end at the position it starts from")
+		}
+	}
+	return nil
+}
+
+func validatePositions(positions [][]float64, n *int) error {
+	if *n += len(positions); *n > MAX_GEO_POSITIONS {
+		return fmt.Errorf("a geometry can have at most %d positions", MAX_GEO_POSITIONS)
+	}
+	for _, p := range positions {
+		if err := validatePosition(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePosition checks a [longitude, latitude] position. Latitude out of range usually
+// means the two were swapped.
+func validatePosition(p []float64) error {
+	if len(p) != 2 {
+		return fmt.Errorf("a geo position must be [longitude, latitude]")
+	}
+	lon, lat := p[0], p[1]
+	if math.IsNaN(lon) || math.IsInf(lon, 0) || math.IsNaN(lat) || math.IsInf(lat, 0) {
+		return fmt.Errorf("geo coordinates must be finite numbers")
+	}
+	if lon < -180 || lon > 180 {
+		return fmt.Errorf("geo longitude must be between -180 and 180 (positions are [longitude, latitude])")
+	}
+	if lat < -90 || lat > 90 {
+		return fmt.Errorf("geo latitude must be between -90 and 90 (positions are [longitude, latitude])")
+	}
+	return nil
 }
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestGeolocJSONRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		`{"type":"Point","coordinates":[2.3508,48.8567]}`,
+		`{"type":"LineString","coordinates":[[2.35,48.85],[2.36,48.86]]}`,
+		`{"type":"Polygon","coordinates":[[[2.3508,48.8567],[2.3509,48.8567],[2.3509,48.8568],[2.3508,48.8567]]]}`,
+		`{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[5,5],[6,5],[6,6],[5,5]]]]}`,
+	} {
+		g := Geoloc{}
+		if err := json.Unmarshal([]byte(in), &g); err != nil {
+			t.Fatalf("unmarshal %s: %v", in, err)
+		}
+		if err := g.Validate(); err != nil {
+			t.Errorf("%s should be valid: %v", in, err)
+		}
+		out, _ := json.Marshal(g)
+		if string(out) != in {
+			t.Errorf("round trip changed %s to %s", in, out)
+		}
+	}
+}
+
+func TestGeolocValidate(t *testing.T) {
+	cases := map[string]string{
+		`{"type":"Circle","coordinates":[0,0]}`:                                     "geo type",
+		`{"type":"Point","coordinates":[0,91]}`:                                     "latitude",
+		`{"type":"Point","coordinates":[[0,0]]}`:                                    "[longitude, latitude]",
+		`{"type":"LineString","coordinates":[[0,0]]}`:                               "at least 2",
+		`{"type":"LineString","coordinates":[[0,0],[181,0]]}`:                       "longitude",
+		`{"type":"Polygon","coordinates":[]}`:                                       "at least one ring",
+		`{"type":"Polygon","coordinates":[[[0,0],[1,0],[0,0]]]}`:                    "at least 4",
+		`{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}`:              "end at the position",
+		`{"type":"Polygon","coordinates":[[0,0],[1,0],[1,1],[0,0]]}`:                "at least one ring",
+		`{"type":"MultiPolygon","coordinates":[]}`:                                  "at least one polygon",
+		`{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,1],[0,2]]]]}`: "end at the position",
+		`{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,100],[0,0]]]]}`:     "latitude",
+	}
+	for in, want := range cases {
+		g := Geoloc{}
+		if err := json.Unmarshal([]byte(in), &g); err != nil {
+			t.Fatalf("unmarshal %s: %v", in, err)
+		}
+		if err := g.Validate(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error about %q, got %v", in, want, err)
+		}
+	}
+
+	var none *Geoloc
+	if none.Validate() != nil {
+		t.Error("a node without g is valid")
+	}
+	ring := make([][]float64, MAX_GEO_POSITIONS+1)
+	for i := range ring {
+		ring[i] = []float64{0, 0}
+	}
+	if err := (&Geoloc{Type: GEO_POLYGON, Polygon: [][][]float64{ring}}).Validate(); err == nil {
+		t.Error("a geometry over the position cap should be rejected")
+	}
+}
+
+func TestValidateNewNodePayloadChecksGeo(t *testing.T) {
+	n := &GraphNode{Location: &Geoloc{Type: GEO_POINT, Coords: []float64{0, 100}}}
+	if ValidateNewNodePayload(n) == nil {
+		t.Error("a node with an invalid g should be rejected")
+	}
+}
@@ -29,7 +29,7 @@ type GraphNode struct {
 	String3      *string       `json:"s3,omitempty"`
 	String4      *string       `json:"s4,omitempty"`
 	Blob         *string       `json:"b,omitempty"`
-	Vec          *string       `json:"vec,omitempty"` // string-encoded float32 vector for similarity search, e.g. "[0.1,0.2,0.3]"
+	Vec          *Vector       `json:"vec,omitempty"` // Vector for similarity search, stored as a float32vector and always sent as a string such as "[0.1,0.2,0.3]"; a JSON array of numbers is accepted on input
 	Num1         *float64      `json:"n1,omitempty"`
 	Num2         *float64      `json:"n2,omitempty"`
 	TimeCreated  *time.Time    `json:"c,omitempty"`
@@ -38,10 +38,21 @@ type GraphNode struct {
 	Time2        *time.Time    `json:"t2,omitempty"`
 	Location     *Geoloc       `json:"g,omitempty"`
 
-	//TODO: g: geo .
-	//{"type":"Point","coordinates":[2.3508,48.8567]}}
-	//{"type":"Polygon","coordinates":[[[2.3508,48.8567],[2.3509,48.8567],[2.3509,48.8568],[2.3508,48.8567]]] }}
-
+	// Depth is how many edges from the nearest root a traversal reached the node at. It is
+	// only set on query results (see QueryRequest.WithDepth) and is never stored.
+	Depth *int `json:"depth,omitempty"`
+	// DistanceM is how far the node's g is from the point of a nearest geo search, in
+	// metres. Like Depth it is only set on query results and is never stored.
+	DistanceM *float64 `json:"distance_m,omitempty"`
+	// Similarity is the cosine similarity of the node's vec to the vector of a similarity
+	// search, from -1 to 1, most similar highest. It too is only set on query results.
+	Similarity *float64 `json:"similarity,omitempty"`
+	// Score is the node's combined score in a hybrid search, highest best. It too is only
+	// set on query results.
+	Score *float64 `json:"score,omitempty"`
+	// Unset lists the predicates an update deletes from the node (see UNSETTABLE_PREDICATES).
+	// An explicit null in an update request adds its predicate here too. It is never stored.
+	Unset []string `json:"unset,omitempty"`
 }
 
 func DecodeAndVerifyAD(adAndMAC, key string) string {
@@ -57,6 +68,18 @@ func DecodeAndVerifyAD(adAndMAC, key string) string {
 	return ""
 }
 
+// ClearUnstoredFields clears the fields that only travel in requests and responses:
+// AuthzData, Depth, DistanceM, Similarity, Score and Unset. Every path that writes a node
+// taken from a request calls it first, so none of them can reach the DB.
+func (n *GraphNode) ClearUnstoredFields() {
+	n.AuthzData = ""
+	n.Depth = nil
+	n.DistanceM = nil
+	n.Similarity = nil
+	n.Score = nil
+	n.Unset = nil
+}
+
 func (n *GraphNode) ConvertNullBoolFieldsToFalse() {
 	b := false
 	if n.PermRead == nil {
@@ -154,6 +177,38 @@ func AuthzDataUnpackADStringSlicePlusNodes(adSlice *[]string, outNodes *[]*Graph
 	return false
 }
 
+// AuthzDataUnpackOwnedADString verifies a node token and returns the node only when uad owns
+// it or is a sys-role user. Permission bits granted through a share group never suffice
+// here: operations that change who controls a node (ownership, permissions, sgi) are
+// owner-only, whatever bits the owner handed out.
+func AuthzDataUnpackOwnedADString(ads string, uad sec.UserAuthData) *GraphNode {
+	tmpNode := GraphNodeFromAD(ads, uad.SecretKey)
+	if tmpNode != nil && (uad.Uid == (*tmpNode).Owner.Uid || uad.Role == sec.SYS_ROLE) {
+		return tmpNode
+	}
+	return nil
+}
+
+// AuthzDataUnpackOwnedADStringSlicePlusNodes is the owner-only counterpart of
+// AuthzDataUnpackADStringSlicePlusNodes: every token must verify via
+// AuthzDataUnpackOwnedADString, or the whole slice is rejected.
+func AuthzDataUnpackOwnedADStringSlicePlusNodes(adSlice *[]string, outNodes *[]*GraphNode, uad sec.UserAuthData) bool {
+	if adSlice != nil && len(*adSlice) > 0 {
+		for i, ads := range *adSlice {
+			tmpNode := AuthzDataUnpackOwnedADString(ads, uad)
+			if tmpNode == nil {
+				return false
+			}
+			(*adSlice)[i] = (*tmpNode).Uid
+			if outNodes != nil {
+				(*outNodes) = append(*outNodes, tmpNode)
+			}
+		}
+		return true
+	}
+	return false
+}
+
 func AuthzDataUnpackNodeSlice(nodeSlice *[]*GraphNode, uad sec.UserAuthData, permsRequired string) bool {
 	if nodeSlice != nil && len(*nodeSlice) > 0 {
 		for _, n := range *nodeSlice {
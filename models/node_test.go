@@ -3,6 +3,7 @@ package models
 import (
 	"os"
 	"testing"
+	"time"
 
 	sec "cogged/security"
 	state "cogged/state"
@@ -101,6 +102,51 @@ func TestAuthzDataRejectsTamperAndWrongKey(t *testing.T) {
 	}
 }
 
+func TestPageCursorRoundTrip(t *testing.T) {
+	key := newKey(t)
+	uad := &sec.UserAuthData{Uid: "0xowner", Role: "user", SecretKey: key}
+	c := &PageCursor{Order: []string{"t1", "-id"}, Vals: []string{"2024-05-01T10:00:00.5Z", "a.b.c.d"}, Uid: "0x2a"}
+	packed := c.Pack(uad)
+
+	got := PageCursorFromString(packed, key)
+	if got == nil || got.Uid != "0x2a" || got.Vals[1] != "a.b.c.d" || got.Order[1] != "-id" {
+		t.Fatalf("cursor did not round trip: %+v", got)
+	}
+	if PageCursorFromString(packed, newKey(t)) != nil {
+		t.Error("cursor verified under a different key")
+	}
+	// values holding dots must not let a cursor pass for a node's AuthzData
+	if GraphNodeFromAD(packed, key) != nil {
+		t.Error("a cursor must not unpack as a node")
+	}
+}
+
+func TestReadSnapshotRoundTrip(t *testing.T) {
+	key := newKey(t)
+	uad := &sec.UserAuthData{Uid: "0xowner", Role: "user", SecretKey: key}
+	packed := (&ReadSnapshot{Ts: 4242, Expires: time.Now().Add(time.Minute).Unix()}).Pack(uad)
+
+	got := ReadSnapshotFromString(packed, key)
+	if got == nil || got.Ts != 4242 || got.Expired() {
+		t.Fatalf("snapshot did not round trip: %+v", got)
+	}
+	if ReadSnapshotFromString(packed, newKey(t)) != nil {
+		t.Error("snapshot verified under a different key")
+	}
+	cursor := (&PageCursor{Uid: "0x2a"}).Pack(uad)
+	if ReadSnapshotFromString(cursor, key) != nil {
+		t.Error("a cursor must not unpack as a snapshot")
+	}
+	if PageCursorFromString(packed, key) != nil {
+		t.Error("a snapshot must not unpack as a cursor")
+	}
+
+	old := (&ReadSnapshot{Ts: 4242, Expires: time.Now().Add(-time.Second).Unix()}).Pack(uad)
+	if got := ReadSnapshotFromString(old, key); got == nil || !got.Expired() {
+		t.Errorf("an expired snapshot should verify but report expired: %+v", got)
+	}
+}
+
 func TestAuthzDataPackPropagatesToEdges(t *testing.T) {
 	key := newKey(t)
 	uad := &sec.UserAuthData{Uid: "0xowner", Role: "user", SecretKey: key}
@@ -268,3 +314,19 @@ func TestAuthzFieldsAreEqual(t *testing.T) {
 		t.Error("nil comparand should not be equal")
 	}
 }
+
+func TestClearUnstoredFields(t *testing.T) {
+	depth, f := 2, 1.5
+	n := NewGraphNodeJustUID("0x1")
+	n.AuthzData, n.Depth, n.DistanceM, n.Similarity, n.Score = "ad", &depth, &f, &f, &f
+	n.Unset = []string{"s1"}
+	s1 := "kept"
+	n.String1 = &s1
+	n.ClearUnstoredFields()
+	if n.AuthzData != "" || n.Depth != nil || n.DistanceM != nil || n.Similarity != nil || n.Score != nil || n.Unset != nil {
+		t.Errorf("expected every unstored field cleared, got %+v", n)
+	}
+	if n.Uid != "0x1" || n.String1 == nil {
+		t.Error("stored fields should be left alone")
+	}
+}
@@ -0,0 +1,336 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SlotRule constrains one payload slot of a node. Which rules apply depends on the slot:
+// pattern, enum and max_length on the string slots (s1-s4, b), min and max on the number
+// slots (n1, n2) and json_schema on b only. The time slots (t1, t2) can only be required.
+type SlotRule struct {
+	Required   bool            `json:"required,omitempty"`
+	Pattern    string          `json:"pattern,omitempty"`
+	Enum       []string        `json:"enum,omitempty"`
+	MaxLength  int             `json:"max_length,omitempty"`
+	Min        *float64        `json:"min,omitempty"`
+	Max        *float64        `json:"max,omitempty"`
+	JSONSchema json.RawMessage `json:"json_schema,omitempty"`
+
+	re   *regexp.Regexp
+	json *JSONSchema
+}
+
+// PayloadSchema declares which payload slots a node of type Type may carry and what they
+// may hold. A slot with no rule in Slots is not allowed at all. With FixedType, a node can
+// neither be changed to nor from this type once it has been created. With VecDim, a vec
+// written to a node of this type must have exactly that many dimensions, those of the
+// model its embeddings come from; vec itself is not a slot, and is always allowed.
+type PayloadSchema struct {
+	Type      string               `json:"ty"`
+	Slots     map[string]*SlotRule `json:"slots"`
+	FixedType bool                 `json:"fixed_type"`
+	VecDim    int                  `json:"vec_dim,omitempty"`
+}
+
+// MAX_VEC_DIM is the most dimensions a schema's vec_dim may require.
+const MAX_VEC_DIM = 8192
+
+const (
+	slotString = iota
+	slotNumber
+	slotTime
+)
+
+var payloadSlotKinds = map[string]int{
+	"s1": slotString, "s2": slotString, "s3": slotString, "s4": slotString, "b": slotString,
+	"n1": slotNumber, "n2": slotNumber,
+	"t1": slotTime, "t2": slotTime,
+}
+
+// PayloadSlotNames lists the slots a PayloadSchema governs, in a stable order.
+func PayloadSlotNames() []string {
+	return []string{"s1", "s2", "s3", "s4", "b", "n1", "n2", "t1", "t2"}
+}
+
+// Compile checks the schema is well formed and prepares its patterns and JSON schema. It
+// must be called before Validate.
+func (s *PayloadSchema) Compile() error {
+	if strings.TrimSpace(s.Type) == "" {
+		return fmt.Errorf("schema needs a ty")
+	}
+	if s.VecDim < 0 || s.VecDim > MAX_VEC_DIM {
+		return fmt.Errorf("vec_dim must be between 0 and %d", MAX_VEC_DIM)
+	}
+	for slot, rule := range s.Slots {
+		kind, ok := payloadSlotKinds[slot]
+		if !ok {
+			return fmt.Errorf("%q is not a payload slot (slots: %s)", slot, strings.Join(PayloadSlotNames(), ", "))
+		}
+		if rule == nil {
+			rule = &SlotRule{}
+			s.Slots[slot] = rule
+		}
+		if kind != slotString && (rule.Pattern != "" || len(rule.Enum) > 0 || rule.MaxLength != 0) {
+			return fmt.Errorf("%s: pattern, enum and max_length only apply to string slots", slot)
+		}
+		if kind != slotNumber && (rule.Min != nil || rule.Max != nil) {
+			return fmt.Errorf("%s: min and max only apply to number slots", slot)
+		}
+		if slot != "b" && len(rule.JSONSchema) > 0 {
+			return fmt.Errorf("%s: json_schema only applies to b", slot)
+		}
+		if rule.MaxLength < 0 {
+			return fmt.Errorf("%s: max_length cannot be negative", slot)
+		}
+		if rule.Pattern != "" {
+			// the whole value must match, not just part of it
+			re, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern: %v", slot, err)
+			}
+			rule.re = re
+		}
+		if len(rule.JSONSchema) > 0 {
+			js, err := ParseJSONSchema(rule.JSONSchema)
+			if err != nil {
+				return fmt.Errorf("%s: %v", slot, err)
+			}
+			rule.json = js
+		}
+	}
+	return nil
+}
+
+// payloadSlotValues returns the slots n sets, as strings, numbers or times.
+func payloadSlotValues(n *GraphNode) map[string]interface{} {
+	vals := make(map[string]interface{})
+	for slot, p := range map[string]*string{"s1": n.String1, "s2": n.String2, "s3": n.String3, "s4": n.String4, "b": n.Blob} {
+		if p != nil {
+			vals[slot] = *p
+		}
+	}
+	for slot, p := range map[string]*float64{"n1": n.Num1, "n2": n.Num2} {
+		if p != nil {
+			vals[slot] = *p
+		}
+	}
+	for slot, p := range map[string]*time.Time{"t1": n.Time1, "t2": n.Time2} {
+		if p != nil {
+			vals[slot] = *p
+		}
+	}
+	return vals
+}
+
+// Validate checks the payload slots n sets. With complete, n is the whole node (a create)
+// and every required slot must be present; otherwise n is a partial update and only the
+// slots it sets are checked. Either way n may not unset a required slot.
+func (s *PayloadSchema) Validate(n *GraphNode, complete bool) error {
+	if err := s.ValidateVecDim(n.Vec); err != nil {
+		return err
+	}
+	vals := payloadSlotValues(n)
+	for _, slot := range PayloadSlotNames() {
+		rule, allowed := s.Slots[slot]
+		if allowed && rule.Required && n.Unsets(slot) {
+			return fmt.Errorf("a %q node must set %s, so it cannot be unset", s.Type, slot)
+		}
+		v, set := vals[slot]
+		if !set {
+			if complete && allowed && rule.Required {
+				return fmt.Errorf("a %q node must set %s", s.Type, slot)
+			}
+			continue
+		}
+		if !allowed {
+			return fmt.Errorf("a %q node may not set %s", s.Type, slot)
+		}
+		switch x := v.(type) {
+		case string:
+			if rule.MaxLength > 0 && len([]rune(x)) > rule.MaxLength {
+				return fmt.Errorf("%s of a %q node must be at most %d characters", slot, s.Type, rule.MaxLength)
+			}
+			if len(rule.Enum) > 0 {
+				ok := false
+				for _, e := range rule.Enum {
+					ok = ok || e == x
+				}
+				if !ok {
+					return fmt.Errorf("%s of a %q node must be one of: %s", slot, s.Type, strings.Join(rule.Enum, ", "))
+				}
+			}
+			if rule.re != nil && !rule.re.MatchString(x) {
+				return fmt.Errorf("%s of a %q node must match %q", slot, s.Type, rule.Pattern)
+			}
+			if rule.json != nil {
+				var doc interface{}
+				if err := json.Unmarshal([]byte(x), &doc); err != nil {
+					return fmt.Errorf("%s of a %q node must be JSON", slot, s.Type)
+				}
+				if err := rule.json.Validate(doc, slot); err != nil {
+					return fmt.Errorf("%s of a %q node: %v", slot, s.Type, err)
+				}
+			}
+		case float64:
+			if rule.Min != nil && x < *rule.Min {
+				return fmt.Errorf("%s of a %q node must be at least %v", slot, s.Type, *rule.Min)
+			}
+			if rule.Max != nil && x > *rule.Max {
+				return fmt.Errorf("%s of a %q node must be at most %v", slot, s.Type, *rule.Max)
+			}
+		}
+	}
+	return nil
+}
+
+// payloadAfterUpdate returns n with each slot it neither sets nor unsets taken from stored:
+// the payload the node will hold once the update is applied.
+func payloadAfterUpdate(n, stored *GraphNode) *GraphNode {
+	after := *n
+	if stored == nil {
+		return &after
+	}
+	keepSlot(n, "s1", &after.String1, stored.String1)
+	keepSlot(n, "s2", &after.String2, stored.String2)
+	keepSlot(n, "s3", &after.String3, stored.String3)
+	keepSlot(n, "s4", &after.String4, stored.String4)
+	keepSlot(n, "b", &after.Blob, stored.Blob)
+	keepSlot(n, "n1", &after.Num1, stored.Num1)
+	keepSlot(n, "n2", &after.Num2, stored.Num2)
+	keepSlot(n, "t1", &after.Time1, stored.Time1)
+	keepSlot(n, "t2", &after.Time2, stored.Time2)
+	return &after
+}
+
+func keepSlot[T any](n *GraphNode, slot string, dst **T, stored *T) {
+	if *dst == nil && !n.Unsets(slot) {
+		*dst = stored
+	}
+}
+
+// ValidateVecDim checks a vec written to a node of this type has VecDim dimensions, when
+// VecDim is set.
+func (s *PayloadSchema) ValidateVecDim(v *Vector) error {
+	if v == nil || s.VecDim == 0 {
+		return nil
+	}
+	vals, err := v.Values()
+	if err != nil {
+		return err
+	}
+	if len(vals) != s.VecDim {
+		return fmt.Errorf("vec of a %q node must have %d dimensions, not %d", s.Type, s.VecDim, len(vals))
+	}
+	return nil
+}
+
+// The registry holds the compiled schema for each ty. It is loaded from the DB at start-up
+// and replaced whenever an admin changes a schema, and read on every create and update, so
+// readers share a lock and a change swaps in a whole new map.
+var (
+	payloadSchemasMu sync.RWMutex
+	payloadSchemas   = map[string]*PayloadSchema{}
+)
+
+// SetPayloadSchemas replaces the registry. Every schema must already be compiled.
+func SetPayloadSchemas(schemas []*PayloadSchema) {
+	m := make(map[string]*PayloadSchema, len(schemas))
+	for _, s := range schemas {
+		m[s.Type] = s
+	}
+	payloadSchemasMu.Lock()
+	payloadSchemas = m
+	payloadSchemasMu.Unlock()
+}
+
+// PayloadSchemaFor returns the schema registered for ty, or nil if nodes of that type are
+// unconstrained.
+func PayloadSchemaFor(ty *string) *PayloadSchema {
+	if ty == nil {
+		return nil
+	}
+	payloadSchemasMu.RLock()
+	defer payloadSchemasMu.RUnlock()
+	return payloadSchemas[*ty]
+}
+
+// PayloadSchemaList returns every registered schema, ordered by ty.
+func PayloadSchemaList() []*PayloadSchema {
+	payloadSchemasMu.RLock()
+	l := make([]*PayloadSchema, 0, len(payloadSchemas))
+	for _, s := range payloadSchemas {
+		l = append(l, s)
+	}
+	payloadSchemasMu.RUnlock()
+	sort.Slice(l, func(i, j int) bool { return l[i].Type < l[j].Type })
+	return l
+}
+
+// ValidateNewNodePayload checks a node about to be created against its type's schema.
+func ValidateNewNodePayload(n *GraphNode) error {
+	if len(n.Unset) > 0 {
+		return fmt.Errorf("unset only applies to updates of existing nodes")
+	}
+	if err := n.Location.Validate(); err != nil {
+		return err
+	}
+	if err := n.Vec.Validate(); err != nil {
+		return err
+	}
+	if err := ValidateBlobField(n.Blob); err != nil {
+		return err
+	}
+	if s := PayloadSchemaFor(n.Type); s != nil {
+		return s.Validate(n, true)
+	}
+	return nil
+}
+
+// ValidateNodePayloadUpdate checks an update to a node whose stored type and payload slots
+// are those of stored (nil, or with no ty, if unknown or untyped). The slots need only be
+// loaded for a type change. Both the old and new types must then allow the change, and the
+// node as it will be stored, its stored slots overlaid by the update, must satisfy the new
+// type in full. A stored slot the new type does not allow has to be unset in the same update.
+func ValidateNodePayloadUpdate(n *GraphNode, stored *GraphNode) error {
+	ty := ""
+	if stored != nil && stored.Type != nil {
+		ty = *stored.Type
+	}
+	if n.Type != nil && *n.Type != ty {
+		for _, t := range []string{ty, *n.Type} {
+			if s := PayloadSchemaFor(&t); s != nil && s.FixedType {
+				return fmt.Errorf("the type of a %q node cannot be changed after creation", t)
+			}
+		}
+		s := PayloadSchemaFor(n.Type)
+		if s == nil {
+			return nil
+		}
+		after := payloadAfterUpdate(n, stored)
+		if stored != nil {
+			kept, set := payloadSlotValues(stored), payloadSlotValues(n)
+			for _, slot := range PayloadSlotNames() {
+				_, allowed := s.Slots[slot]
+				_, isKept := kept[slot]
+				_, isSet := set[slot]
+				if !allowed && isKept && !isSet && !n.Unsets(slot) {
+					return fmt.Errorf("a %q node may not set %s, so it must be unset to change the type", s.Type, slot)
+				}
+			}
+		}
+		return s.Validate(after, true)
+	}
+	if n.Type != nil {
+		ty = *n.Type
+	}
+	if s := PayloadSchemaFor(&ty); s != nil {
+		return s.Validate(n, false)
+	}
+	return nil
+}
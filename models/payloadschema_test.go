@@ -0,0 +1,220 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func f(v float64) *float64 { return &v }
+
+// registerSchemas compiles and registers schemas for the duration of a test.
+func registerSchemas(t *testing.T, defs ...string) {
+	t.Helper()
+	list := []*PayloadSchema{}
+	for _, d := range defs {
+		ps := &PayloadSchema{}
+		if err := json.Unmarshal([]byte(d), ps); err != nil {
+			t.Fatalf("bad schema JSON %s: %v", d, err)
+		}
+		if err := ps.Compile(); err != nil {
+			t.Fatalf("schema %s did not compile: %v", d, err)
+		}
+		list = append(list, ps)
+	}
+	SetPayloadSchemas(list)
+	t.Cleanup(func() { SetPayloadSchemas(nil) })
+}
+
+func TestPayloadSchemaCompileRejectsBadRules(t *testing.T) {
+	for _, bad := range []string{
+		`{"slots":{}}`,
+		`{"ty":"doc","slots":{"s9":{}}}`,
+		`{"ty":"doc","slots":{"n1":{"pattern":"x"}}}`,
+		`{"ty":"doc","slots":{"s1":{"min":1}}}`,
+		`{"ty":"doc","slots":{"s1":{"json_schema":{"type":"object"}}}}`,
+		`{"ty":"doc","slots":{"s1":{"pattern":"("}}}`,
+		`{"ty":"doc","slots":{"b":{"json_schema":{"type":"object","format":"email"}}}}`,
+		`{"ty":"doc","slots":{"b":{"json_schema":{"type":"thing"}}}}`,
+		`{"ty":"doc","slots":{},"vec_dim":-1}`,
+	} {
+		ps := &PayloadSchema{}
+		if err := json.Unmarshal([]byte(bad), ps); err != nil {
+			t.Fatalf("bad test JSON %s: %v", bad, err)
+		}
+		if err := ps.Compile(); err == nil {
+			t.Errorf("expected %s to be rejected", bad)
+		}
+	}
+}
+
+func TestValidateNewNodePayload(t *testing.T) {
+	registerSchemas(t, `{"ty":"invoice","slots":{
+		"s1":{"required":true,"pattern":"INV-[0-9]+"},
+		"s2":{"enum":["draft","sent","paid"]},
+		"s3":{"max_length":4},
+		"n1":{"required":true,"min":0,"max":1000},
+		"b":{"json_schema":{"type":"object","required":["lines"],"properties":{
+			"lines":{"type":"array","minItems":1,"items":{"type":"object","additionalProperties":false,
+				"properties":{"sku":{"type":"string"},"qty":{"type":"integer","minimum":1}}}}}}}
+	}}`)
+
+	valid := func() *GraphNode {
+		n := NewGraphNodeJustUID("$i")
+		n.Type, n.String1, n.Num1 = s("invoice"), s("INV-42"), f(10)
+		return n
+	}
+	if err := ValidateNewNodePayload(valid()); err != nil {
+		t.Fatalf("valid node rejected: %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		edit  func(n *GraphNode)
+		wants string
+	}{
+		{"missing required", func(n *GraphNode) { n.Num1 = nil }, "must set n1"},
+		{"slot not allowed", func(n *GraphNode) { n.String4 = s("x") }, "may not set s4"},
+		{"partial pattern match", func(n *GraphNode) { n.String1 = s("xINV-42") }, "must match"},
+		{"not in enum", func(n *GraphNode) { n.String2 = s("void") }, "must be one of"},
+		{"too long", func(n *GraphNode) { n.String3 = s("abcde") }, "at most 4 characters"},
+		{"out of range", func(n *GraphNode) { n.Num1 = f(1000.5) }, "at most 1000"},
+		{"blob not JSON", func(n *GraphNode) { n.Blob = s("{") }, "must be JSON"},
+		{"blob missing property", func(n *GraphNode) { n.Blob = s(`{}`) }, "b.lines is required"},
+		{"blob nested type", func(n *GraphNode) { n.Blob = s(`{"lines":[{"sku":"a","qty":0.5}]}`) }, "b.lines[0].qty"},
+		{"blob extra property", func(n *GraphNode) { n.Blob = s(`{"lines":[{"sku":"a","colour":"red"}]}`) }, "b.lines[0].colour is not allowed"},
+	}
+	for _, c := range cases {
+		n := valid()
+		c.edit(n)
+		err := ValidateNewNodePayload(n)
+		if err == nil || !strings.Contains(err.Error(), c.wants) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.wants, err)
+		}
+	}
+
+	n := valid()
+	n.Blob = s(`{"lines":[{"sku":"a","qty":2}]}`)
+	if err := ValidateNewNodePayload(n); err != nil {
+		t.Errorf("valid blob rejected: %v", err)
+	}
+
+	untyped := NewGraphNodeJustUID("$u")
+	untyped.String4 = s("anything")
+	if err := ValidateNewNodePayload(untyped); err != nil {
+		t.Errorf("a type with no schema should be unconstrained: %v", err)
+	}
+}
+
+// storedAs is a stored node of type ty, with no payload slots loaded.
+func storedAs(ty string) *GraphNode {
+	n := NewGraphNodeJustUID("0x1")
+	n.Type = &ty
+	return n
+}
+
+func TestValidateNodePayloadUpdate(t *testing.T) {
+	registerSchemas(t,
+		`{"ty":"invoice","fixed_type":true,"slots":{"s1":{"required":true},"s2":{}}}`,
+		`{"ty":"note","slots":{"s1":{"required":true},"s2":{}}}`,
+	)
+
+	partial := NewGraphNodeJustUID("0x1")
+	partial.String2 = s("x")
+	if err := ValidateNodePayloadUpdate(partial, storedAs("note")); err != nil {
+		t.Errorf("an update need not carry required slots: %v", err)
+	}
+	partial.String3 = s("x")
+	if err := ValidateNodePayloadUpdate(partial, storedAs("note")); err == nil {
+		t.Error("an update setting a slot its stored type does not allow should fail")
+	}
+
+	toInvoice := NewGraphNodeJustUID("0x1")
+	toInvoice.Type, toInvoice.String1 = s("invoice"), s("INV-1")
+	if err := ValidateNodePayloadUpdate(toInvoice, storedAs("note")); err == nil || !strings.Contains(err.Error(), "cannot be changed") {
+		t.Errorf("changing to a fixed type should fail, got %v", err)
+	}
+	fromInvoice := NewGraphNodeJustUID("0x1")
+	fromInvoice.Type, fromInvoice.String1 = s("note"), s("x")
+	if err := ValidateNodePayloadUpdate(fromInvoice, storedAs("invoice")); err == nil {
+		t.Error("changing from a fixed type should fail")
+	}
+	same := NewGraphNodeJustUID("0x1")
+	same.Type = s("invoice")
+	if err := ValidateNodePayloadUpdate(same, storedAs("invoice")); err != nil {
+		t.Errorf("restating an unchanged fixed type is not a change: %v", err)
+	}
+
+	toNote := NewGraphNodeJustUID("0x1")
+	toNote.Type = s("note")
+	if err := ValidateNodePayloadUpdate(toNote, storedAs("doc")); err == nil || !strings.Contains(err.Error(), "must set s1") {
+		t.Errorf("a type change must carry the new type's required slots, got %v", err)
+	}
+
+	// a type change is checked against the slots the node already holds
+	doc := storedAs("doc")
+	doc.String1, doc.String3 = s("kept"), s("x")
+	if err := ValidateNodePayloadUpdate(toNote, doc); err == nil || !strings.Contains(err.Error(), "must be unset") {
+		t.Errorf("a stored slot the new type does not allow should block the change, got %v", err)
+	}
+	toNote.Unset = []string{"s3"}
+	if err := ValidateNodePayloadUpdate(toNote, doc); err != nil {
+		t.Errorf("unsetting the slot should allow the change, keeping the stored s1: %v", err)
+	}
+	toNote.Unset = []string{"s1", "s3"}
+	if err := ValidateNodePayloadUpdate(toNote, doc); err == nil {
+		t.Error("a type change should not leave out a required slot by unsetting it")
+	}
+}
+
+func TestValidateUnset(t *testing.T) {
+	registerSchemas(t, `{"ty":"note","slots":{"s1":{"required":true},"s2":{},"t2":{}}}`)
+
+	n := NewGraphNodeJustUID("0x1")
+	n.Unset = []string{"t2", "g", "p"}
+	if err := ValidateUnset(n); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := ValidateNodePayloadUpdate(n, storedAs("note")); err != nil {
+		t.Errorf("an optional slot should be unsettable: %v", err)
+	}
+	n.Unset = []string{"s1"}
+	if err := ValidateNodePayloadUpdate(n, storedAs("note")); err == nil || !strings.Contains(err.Error(), "cannot be unset") {
+		t.Errorf("a required slot should not be unsettable, got %v", err)
+	}
+	for name, unset := range map[string][]string{
+		"not unsettable": {"ty"},
+		"twice":          {"t2", "t2"},
+		"also set":       {"s2"},
+	} {
+		bad := NewGraphNodeJustUID("0x1")
+		bad.String2, bad.Unset = s("x"), unset
+		if err := ValidateUnset(bad); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	created := NewGraphNodeJustUID("$n")
+	created.Unset = []string{"s2"}
+	if err := ValidateNewNodePayload(created); err == nil {
+		t.Error("a new node should have nothing to unset")
+	}
+}
+
+func TestPayloadSchemaVecDim(t *testing.T) {
+	registerSchemas(t, `{"ty":"doc","slots":{"s1":{}},"vec_dim":3}`)
+	ty := "doc"
+	good, short, zeros := Vector("[0.1, 0.2, 0.3]"), Vector("[0.1,0.2]"), Vector("[0,0,0]")
+	if err := ValidateNewNodePayload(&GraphNode{Type: &ty, Vec: &good}); err != nil {
+		t.Errorf("a vec of vec_dim should pass: %v", err)
+	}
+	if err := ValidateNewNodePayload(&GraphNode{Type: &ty, Vec: &short}); err == nil || !strings.Contains(err.Error(), "3 dimensions, not 2") {
+		t.Errorf("expected a dimension error, got %v", err)
+	}
+	// the stored type is checked when an update leaves ty out
+	if err := ValidateNodePayloadUpdate(&GraphNode{Vec: &short}, storedAs("doc")); err == nil {
+		t.Error("expected the stored type's vec_dim to apply")
+	}
+	if err := ValidateNewNodePayload(&GraphNode{Vec: &zeros}); err == nil {
+		t.Error("an all-zero vec should be rejected whatever the type")
+	}
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	sec "cogged/security"
+	"encoding/json"
+	"time"
+)
+
+// ReadSnapshot pins the pages of a paginated query to one Dgraph read timestamp, so that
+// nodes written while a client pages through a list are neither skipped nor seen twice.
+// Like PageCursor it is handed to the client signed with the user's key, and it is only
+// honoured until Expires, as Dgraph does not keep old versions of the data indefinitely.
+type ReadSnapshot struct {
+	// Ts is the Dgraph timestamp the first page was read at.
+	Ts uint64 `json:"ts"`
+	// Expires is when the snapshot stops being honoured, in Unix seconds.
+	Expires int64 `json:"exp"`
+}
+
+// Pack signs the snapshot for the user, encoded as PageCursor.Pack encodes cursors.
+func (s *ReadSnapshot) Pack(uad *sec.UserAuthData) string {
+	b, _ := json.Marshal(s)
+	return sec.MessageAndMAC(sec.B64Encode(b), uad.SecretKey)
+}
+
+func (s *ReadSnapshot) Expired() bool {
+	return time.Now().Unix() >= s.Expires
+}
+
+// ReadSnapshotFromString verifies and decodes a packed snapshot. An expired snapshot is
+// still returned, so the caller can tell it apart from a forged one.
+func ReadSnapshotFromString(packed, key string) *ReadSnapshot {
+	msg := DecodeAndVerifyAD(packed, key)
+	if msg == "" {
+		return nil
+	}
+	s := ReadSnapshot{}
+	if err := json.Unmarshal(sec.B64Decode(msg), &s); err != nil {
+		return nil
+	}
+	// a signed cursor decodes without error but has no timestamp
+	if s.Ts == 0 || s.Expires == 0 {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,60 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// UNSETTABLE_PREDICATES are the predicates an update may delete from a node, through its
+// unset list or an explicit null. The rest identify the node, control access to it or are
+// kept by the server, and can only be given new values.
+var UNSETTABLE_PREDICATES = []string{"id", "p", "s1", "s2", "s3", "s4", "b", "vec", "n1", "n2", "t1", "t2", "g"}
+
+// predicateIsSet reports whether n gives a value to the unsettable predicate pred.
+func predicateIsSet(n *GraphNode, pred string) bool {
+	switch pred {
+	case "id":
+		return n.Id != nil
+	case "p":
+		return n.PrivateData != nil
+	case "vec":
+		return n.Vec != nil
+	case "g":
+		return n.Location != nil
+	}
+	_, set := payloadSlotValues(n)[pred]
+	return set
+}
+
+// Unsets reports whether an update of n deletes pred.
+func (n *GraphNode) Unsets(pred string) bool {
+	for _, u := range n.Unset {
+		if u == pred {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateUnset checks that every predicate in n's unset list can be unset, and that n
+// does not also set it.
+func ValidateUnset(n *GraphNode) error {
+	seen := make(map[string]bool, len(n.Unset))
+	for _, pred := range n.Unset {
+		ok := false
+		for _, u := range UNSETTABLE_PREDICATES {
+			ok = ok || u == pred
+		}
+		if !ok {
+			return fmt.Errorf("%q cannot be unset (unsettable: %s)", pred, strings.Join(UNSETTABLE_PREDICATES, ", "))
+		}
+		if seen[pred] {
+			return fmt.Errorf("%s is unset twice", pred)
+		}
+		seen[pred] = true
+		if predicateIsSet(n, pred) {
+			return fmt.Errorf("%s cannot be both set and unset", pred)
+		}
+	}
+	return nil
+}
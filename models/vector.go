@@ -0,0 +1,68 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Vector is an embedding as a node's vec holds it: a string-encoded float array such as
+// "[0.1,-2,0.001]". It is written to Dgraph in that form, and read back into it whether
+// Dgraph returns the string or a JSON array.
+type Vector string
+
+func (v *Vector) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*v = Vector(s)
+		return nil
+	}
+	var f []float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("vec must be a string-encoded float array")
+	}
+	parts := make([]string, len(f))
+	for i, x := range f {
+		parts[i] = strconv.FormatFloat(x, 'g', -1, 32)
+	}
+	*v = Vector("[" + strings.Join(parts, ",") + "]")
+	return nil
+}
+
+// Values parses the vector, which must hold at least one number, each finite and within
+// float32 range, as vec is stored as float32s.
+func (v Vector) Values() ([]float64, error) {
+	s := strings.TrimSpace(string(v))
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") || strings.TrimSpace(s[1:len(s)-1]) == "" {
+		return nil, fmt.Errorf("vec must be a string-encoded float array, e.g. \"[0.1,0.2,0.3]\"")
+	}
+	vals := []float64{}
+	for _, part := range strings.Split(s[1:len(s)-1], ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(f) || math.Abs(f) > math.MaxFloat32 {
+			return nil, fmt.Errorf("vec must be a string-encoded float array of finite float32 numbers")
+		}
+		vals = append(vals, f)
+	}
+	return vals, nil
+}
+
+// Validate checks the vector parses and is not all zeros, which has no direction to be
+// similar to anything by. A nil Vector is valid, as vec is optional.
+func (v *Vector) Validate() error {
+	if v == nil {
+		return nil
+	}
+	vals, err := v.Values()
+	if err != nil {
+		return err
+	}
+	for _, f := range vals {
+		if f != 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("vec cannot be all zeros")
+}
@@ -0,0 +1,34 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVectorUnmarshal(t *testing.T) {
+	var n GraphNode
+	if err := json.Unmarshal([]byte(`{"uid":"0x1","vec":[0.5,-2,0.1]}`), &n); err != nil || n.Vec == nil || *n.Vec != "[0.5,-2,0.1]" {
+		t.Errorf("a vec returned as an array should read back as a string, got %v %v", n.Vec, err)
+	}
+	if err := json.Unmarshal([]byte(`{"uid":"0x1","vec":"[1, 2]"}`), &n); err != nil || *n.Vec != "[1, 2]" {
+		t.Errorf("a vec returned as a string should be kept, got %v %v", n.Vec, err)
+	}
+	if err := json.Unmarshal([]byte(`{"vec":{"a":1}}`), &n); err == nil {
+		t.Error("expected an object to be rejected")
+	}
+}
+
+func TestVectorValues(t *testing.T) {
+	if v, err := Vector(" [1e-3, -2] ").Values(); err != nil || len(v) != 2 || v[0] != 0.001 {
+		t.Errorf("unexpected parse %v %v", v, err)
+	}
+	for _, bad := range []Vector{"", "[]", "1,2", "[1,,2]", "[NaN]", "[1e39]", "[a]"} {
+		if _, err := bad.Values(); err == nil {
+			t.Errorf("%q should not parse", bad)
+		}
+	}
+	var none *Vector
+	if err := none.Validate(); err != nil {
+		t.Errorf("a missing vec is valid, got %v", err)
+	}
+}
@@ -1,12 +1,24 @@
 package requests
 
 import (
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	cm "cogged/models"
 	sec "cogged/security"
+	state "cogged/state"
 )
 
+// TestMain boots the in-memory session manager, which the shared paths of the authz
+// checks ask whether a user may access a share group.
+func TestMain(m *testing.M) {
+	state.UsmInit()
+	state.UsmRun()
+	os.Exit(m.Run())
+}
+
 func reqKey(t *testing.T) string {
 	t.Helper()
 	b, err := sec.GenerateRandomBytes(32)
@@ -121,3 +133,220 @@ func TestShareNodesRequestAuthz(t *testing.T) {
 		t.Error("share request with a node token signed by another user must be denied")
 	}
 }
+
+// Only the owner (or sys) may transfer a node: a sharee holding a validly-signed token
+// with every permission bit set is still refused.
+func TestTransferNodesRequestAuthz(t *testing.T) {
+	uad := sec.UserAuthData{Uid: "0xowner", Role: "user", SecretKey: reqKey(t)}
+	target := cm.NewGraphUser("0xtarget")
+	role := "user"
+	target.Role = &role
+	target.AuthzDataPack(&uad)
+
+	ok := &TransferNodesRequest{
+		Nodes: &[]string{packOwnedNode("0xnode", "0xowner", &uad)},
+		User:  target.AuthzData,
+	}
+	if !ok.AuthzDataUnpack(uad, "") || !ok.Validate() {
+		t.Fatal("owner should be able to transfer their own node")
+	}
+	if (*ok.Nodes)[0] != "0xnode" || ok.NewOwner.Uid != "0xtarget" {
+		t.Errorf("unpack should substitute real uids, got nodes %v owner %+v", *ok.Nodes, ok.NewOwner)
+	}
+
+	sharee := cm.NewGraphNodeJustUID("0xnode")
+	sharee.Owner = &cm.GraphUser{GraphBase: cm.GraphBase{Uid: "0xsomeoneelse"}}
+	sgi := "sgi-req"
+	sharee.Sgi = &sgi
+	tr := true
+	sharee.PermRead, sharee.PermWrite, sharee.PermShare = &tr, &tr, &tr
+	sharee.AuthzDataPack(&uad)
+	denied := &TransferNodesRequest{Nodes: &[]string{sharee.AuthzData}, User: target.AuthzData}
+	if denied.AuthzDataUnpack(uad, "") {
+		t.Error("a non-owner must not be able to transfer a node, whatever its permission bits")
+	}
+
+	sys := sec.UserAuthData{Uid: "0xsys", Role: sec.SYS_ROLE, SecretKey: uad.SecretKey}
+	if !(&TransferNodesRequest{Nodes: &[]string{sharee.AuthzData}, User: target.AuthzData}).AuthzDataUnpack(sys, "") {
+		t.Error("sys should be able to transfer any node")
+	}
+
+	badUser := &TransferNodesRequest{
+		Nodes: &[]string{packOwnedNode("0xnode", "0xowner", &uad)},
+		User:  "not-a-token",
+	}
+	if badUser.AuthzDataUnpack(uad, "") {
+		t.Error("a transfer to an unverifiable user token must be denied")
+	}
+}
+
+// Bulk permission/share group changes are owner-only, and must actually change something.
+func TestSubgraphPermsRequestAuthz(t *testing.T) {
+	uad := sec.UserAuthData{Uid: "0xowner", Role: "user", SecretKey: reqKey(t)}
+	f := false
+
+	ok := &SubgraphPermsRequest{
+		Nodes: &[]string{packOwnedNode("0xnode", "0xowner", &uad)},
+		Perms: &PermissionMask{PermWrite: &f},
+	}
+	if !ok.AuthzDataUnpack(uad, "") || !ok.Validate() {
+		t.Fatal("owner should be able to change their own node's permissions")
+	}
+
+	sharee := cm.NewGraphNodeJustUID("0xnode")
+	sharee.Owner = &cm.GraphUser{GraphBase: cm.GraphBase{Uid: "0xsomeoneelse"}}
+	sgi := "sgi-req"
+	sharee.Sgi = &sgi
+	tr := true
+	sharee.PermRead, sharee.PermWrite, sharee.PermShare = &tr, &tr, &tr
+	sharee.AuthzDataPack(&uad)
+	if (&SubgraphPermsRequest{Nodes: &[]string{sharee.AuthzData}, ResetSgi: true}).AuthzDataUnpack(uad, "") {
+		t.Error("a non-owner must not be able to change a node's permissions or share group")
+	}
+
+	noop := &SubgraphPermsRequest{Nodes: &[]string{packOwnedNode("0xnode", "0xowner", &uad)}, Perms: &PermissionMask{}}
+	if !noop.AuthzDataUnpack(uad, "") || noop.Validate() {
+		t.Error("a request with an empty mask and no reset_sgi should fail validation")
+	}
+	reset := &SubgraphPermsRequest{Nodes: &[]string{packOwnedNode("0xnode", "0xowner", &uad)}, ResetSgi: true}
+	if !reset.AuthzDataUnpack(uad, "") || !reset.Validate() {
+		t.Error("reset_sgi alone should be a valid request")
+	}
+}
+
+func TestPermissionMaskApply(t *testing.T) {
+	tr, f := true, false
+	n := cm.NewGraphNodeJustUID("0x1")
+	n.PermRead, n.PermWrite = &tr, &tr
+
+	(&PermissionMask{PermWrite: &f, PermShare: &tr}).Apply(n)
+	if !*n.PermRead || *n.PermWrite || !*n.PermShare || n.PermDelete != nil {
+		t.Errorf("mask should set only the given bits, got r=%v w=%v s=%v d=%v", *n.PermRead, *n.PermWrite, *n.PermShare, n.PermDelete)
+	}
+}
+
+// Both ends of a path request must be readable by the caller.
+func TestPathRequestAuthz(t *testing.T) {
+	uad := sec.UserAuthData{Uid: "0xowner", Role: "user", SecretKey: reqKey(t)}
+	ok := &PathRequest{From: packOwnedNode("0xa", "0xowner", &uad), To: packOwnedNode("0xb", "0xowner", &uad)}
+	if !ok.AuthzDataUnpack(uad, "r") || !ok.Validate() {
+		t.Fatal("owner should be able to search between their own nodes")
+	}
+	if ok.UnpackedFrom.Uid != "0xa" || ok.UnpackedTo.Uid != "0xb" {
+		t.Errorf("unpack should expose the real uids, got %+v %+v", ok.UnpackedFrom, ok.UnpackedTo)
+	}
+	if (&PathRequest{From: ok.From, To: "not-a-token"}).AuthzDataUnpack(uad, "r") {
+		t.Error("a path to an unverifiable node token must be denied")
+	}
+	for _, bad := range []*PathRequest{{NumPaths: MAX_PATHS + 1}, {Direction: "up"}, {Types: []string{`x") OR eq(r, true`}}} {
+		if bad.Validate() {
+			t.Errorf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+// An owner clause names the user by AuthzData, which is unpacked wherever it sits in the
+// clause tree, even on a query without root_ids.
+func TestQueryRequestOwnerClauseAuthz(t *testing.T) {
+	uad := sec.UserAuthData{Uid: "0xme", Role: "user", SecretKey: reqKey(t)}
+	other := cm.NewGraphUser("0xother")
+	role := "user"
+	other.Role = &role
+	other.AuthzDataPack(&uad)
+
+	q := &QueryRequest{Filters: &QueryRequestClause{Not: &QueryRequestClause{Op: OP_OWNER, Val: other.AuthzData}}}
+	if !q.AuthzDataUnpack(uad, "r") {
+		t.Fatal("a valid user token should unpack")
+	}
+	if q.Filters.Not.OwnerUid != "0xother" {
+		t.Errorf("expected the owner uid to be unpacked, got %q", q.Filters.Not.OwnerUid)
+	}
+
+	forged := &QueryRequest{Filters: &QueryRequestClause{And: []QueryRequestClause{{Op: OP_OWNER, Val: "0xother"}}}}
+	if forged.AuthzDataUnpack(uad, "r") {
+		t.Error("a bare uid must not be accepted in place of a user token")
+	}
+	node := &QueryRequest{Filters: &QueryRequestClause{Op: OP_OWNER, Val: packOwnedNode("0x1", "0xme", &uad)}}
+	if node.AuthzDataUnpack(uad, "r") {
+		t.Error("a node token must not be accepted in place of a user token")
+	}
+}
+
+func TestQueryRequestCursorAuthz(t *testing.T) {
+	uad := sec.UserAuthData{Uid: "0xme", Role: "user", SecretKey: reqKey(t)}
+	packed := (&cm.PageCursor{Order: []string{"-t1"}, Vals: []string{"2024-01-01T00:00:00Z"}, Uid: "0x2a"}).Pack(&uad)
+
+	q := &QueryRequest{RootIDs: []string{packOwnedNode("0x1", "0xme", &uad)}, Cursor: &packed}
+	if !q.AuthzDataUnpack(uad, "r") {
+		t.Fatal("the user's own cursor should unpack")
+	}
+	if q.PageCursor == nil || q.PageCursor.Uid != "0x2a" || q.PageCursor.Order[0] != "-t1" {
+		t.Errorf("expected the cursor to be unpacked, got %+v", q.PageCursor)
+	}
+
+	other := sec.UserAuthData{Uid: "0xother", Role: "user", SecretKey: reqKey(t)}
+	if (&QueryRequest{Cursor: &packed}).AuthzDataUnpack(other, "r") {
+		t.Error("a cursor must not be usable by another user")
+	}
+	node := packOwnedNode("0x1", "0xme", &uad)
+	if (&QueryRequest{Cursor: &node}).AuthzDataUnpack(uad, "r") {
+		t.Error("a node token must not be accepted as a cursor")
+	}
+}
+
+func TestQueryRequestSnapshotAuthz(t *testing.T) {
+	uad := sec.UserAuthData{Uid: "0xme", Role: "user", SecretKey: reqKey(t)}
+	packed := (&cm.ReadSnapshot{Ts: 77, Expires: time.Now().Add(time.Minute).Unix()}).Pack(&uad)
+
+	q := &QueryRequest{RootIDs: []string{packOwnedNode("0x1", "0xme", &uad)}, Snapshot: &packed}
+	if !q.AuthzDataUnpack(uad, "r") || !q.Validate() {
+		t.Fatal("the user's own snapshot should unpack and validate")
+	}
+	if q.ReadSnapshot == nil || q.ReadSnapshot.Ts != 77 {
+		t.Errorf("expected the snapshot to be unpacked, got %+v", q.ReadSnapshot)
+	}
+
+	other := sec.UserAuthData{Uid: "0xother", Role: "user", SecretKey: reqKey(t)}
+	if (&QueryRequest{Snapshot: &packed}).AuthzDataUnpack(other, "r") {
+		t.Error("a snapshot must not be usable by another user")
+	}
+
+	old := (&cm.ReadSnapshot{Ts: 77, Expires: time.Now().Add(-time.Second).Unix()}).Pack(&uad)
+	q = &QueryRequest{Snapshot: &old}
+	if !q.AuthzDataUnpack(uad, "r") {
+		t.Fatal("an expired snapshot should still unpack")
+	}
+	if q.Validate() || !strings.Contains(q.ValidationError(), "expired") {
+		t.Errorf("an expired snapshot should fail validation, got %q", q.ValidationError())
+	}
+}
+
+// A sharee with w can update a node, but only its owner (or sys) can unset its p.
+func TestUpdateNodesRequestUnsetPrivateDataAuthz(t *testing.T) {
+	uad := sec.UserAuthData{Uid: "0xsharee", Role: "user", SecretKey: reqKey(t)}
+	state.UsmUserAllowlistSgi("0xsharee", "sgi-unset")
+	// the node as a query returned it to uad, with its token, plus what to unset
+	update := func(owner string, unset ...string) *UpdateNodesRequest {
+		n := cm.NewGraphNodeJustUID("0xnode")
+		n.Owner = &cm.GraphUser{GraphBase: cm.GraphBase{Uid: owner}}
+		sgi, tr := "sgi-unset", true
+		n.Sgi, n.PermRead, n.PermWrite = &sgi, &tr, &tr
+		n.AuthzDataPack(&uad)
+		n.Unset = unset
+		return &UpdateNodesRequest{Nodes: &[]*cm.GraphNode{n}}
+	}
+
+	if !update("0xowner", "s1").AuthzDataUnpack(uad, "w") {
+		t.Fatal("a sharee with w should be able to unset a payload slot")
+	}
+	if update("0xowner", "s1", "p").AuthzDataUnpack(uad, "w") {
+		t.Error("a sharee must not be able to unset p")
+	}
+	if !update("0xsharee", "p").AuthzDataUnpack(uad, "w") {
+		t.Error("the owner should be able to unset p")
+	}
+	sys := sec.UserAuthData{Uid: "0xsys", Role: sec.SYS_ROLE, SecretKey: uad.SecretKey}
+	if !update("0xowner", "p").AuthzDataUnpack(sys, "w") {
+		t.Error("sys should be able to unset p")
+	}
+}
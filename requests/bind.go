@@ -41,8 +41,13 @@ func Validate[T any](v *T) bool {
 
 func BindToRequest[T any](jsonString string, requestStruct *T, ud UnpackData) error {
 	err := json.Unmarshal([]byte(jsonString), requestStruct)
-	if err == nil && TryAuthzDataUnpack[T](requestStruct, ud) && Validate[T](requestStruct) {
-		return nil
+	if err == nil && TryAuthzDataUnpack[T](requestStruct, ud) {
+		if Validate[T](requestStruct) {
+			return nil
+		}
+		if ve, ok := any(requestStruct).(ValidationExplainer); ok && ve.ValidationError() != "" {
+			return &BindError{Info: "invalid request: " + ve.ValidationError()}
+		}
 	}
 
 	return &BindError{Info: "unpack and validate failed"}
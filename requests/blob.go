@@ -0,0 +1,54 @@
+package requests
+
+import (
+	cm "cogged/models"
+	sec "cogged/security"
+	"strings"
+)
+
+// BlobUploadRequest starts a resumable upload of Size bytes whose SHA-256, in hex, is
+// SHA256. The node the blob is for is the ad in the route, which the handler checks.
+type BlobUploadRequest struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	validationErr string
+}
+
+// not applicable, as the request carries no node or user ids
+func (req *BlobUploadRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
+	return true
+}
+
+func (req *BlobUploadRequest) Validate() bool {
+	req.SHA256 = strings.ToLower(strings.TrimSpace(req.SHA256))
+	if req.Size < 1 {
+		req.validationErr = "size must be at least 1 byte"
+		return false
+	}
+	if !cm.ValidBlobSum(req.SHA256) {
+		req.validationErr = "sha256 must be the hex SHA-256 of the content"
+		return false
+	}
+	return true
+}
+
+func (req *BlobUploadRequest) ValidationError() string {
+	return req.validationErr
+}
+
+// BlobGCRequest asks for the blobs no node refers to, and the expired resumable uploads, to
+// be deleted; with DryRun they are only counted. It is only accepted on the admin route
+// group.
+type BlobGCRequest struct {
+	DryRun bool `json:"dry_run"`
+}
+
+// not applicable, as the request is admin only and carries no node or user ids
+func (req *BlobGCRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
+	return true
+}
+
+func (req *BlobGCRequest) Validate() bool {
+	return true
+}
@@ -3,14 +3,28 @@ package requests
 import (
 	cm "cogged/models"
 	sec "cogged/security"
+	"fmt"
 	"strings"
 )
 
 const TMP_UID_PREFIX = "$"
 
+// UPSERT_BY_PARENT and UPSERT_BY_OWNER are the ways a CreateNodesRequest can upsert: a
+// node is the same as an existing one with its id and ty that the parent node links to,
+// or that the user owns.
+const (
+	UPSERT_BY_PARENT = "parent"
+	UPSERT_BY_OWNER  = "owner"
+)
+
 type CreateNodesRequest struct {
 	Nodes    *[]*cm.GraphNode `json:"nodes,omitempty"`
 	ResetSgi bool             `json:"reset_sgi"`
+	// Upsert, when set, updates the existing node each new node is the same as (see
+	// UPSERT_BY_PARENT) instead of creating another, so an import can be run again.
+	Upsert string `json:"upsert,omitempty"`
+
+	validationErr string
 }
 
 // there should be no AuthzData because there should be no actual UIDs of nodes or edges, just $placeholders
@@ -49,7 +63,64 @@ func CheckUidsArePlaceholders(nl *[]*cm.GraphNode) bool {
 	return true
 }
 
+// validateNewNodePayloads checks every node in the list, and every new node nested in their
+// out-edges, against the payload schema of its type.
+func validateNewNodePayloads(nl *[]*cm.GraphNode) error {
+	if nl == nil {
+		return nil
+	}
+	for _, n := range *nl {
+		if err := cm.ValidateNewNodePayload(n); err != nil {
+			return err
+		}
+		if err := validateNewNodePayloads(n.OutEdges); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateUpsertKeys checks every node in an upsert has the id and ty it is matched on,
+// and that no two have the same. In an upsert by parent, the nodes are matched among the
+// parent's children, so each must be one and cannot link to another.
+func (req *CreateNodesRequest) validateUpsertKeys() error {
+	if req.Upsert != UPSERT_BY_PARENT && req.Upsert != UPSERT_BY_OWNER {
+		return fmt.Errorf("upsert must be %q or %q", UPSERT_BY_PARENT, UPSERT_BY_OWNER)
+	}
+	keys := make(map[[2]string]bool)
+	for _, n := range *req.Nodes {
+		if n.Id == nil || *n.Id == "" || n.Type == nil || *n.Type == "" {
+			return fmt.Errorf("node %q needs an id and a ty to upsert", n.Uid)
+		}
+		k := [2]string{*n.Id, *n.Type}
+		if keys[k] {
+			return fmt.Errorf("two nodes have id %q and ty %q", *n.Id, *n.Type)
+		}
+		keys[k] = true
+		if req.Upsert == UPSERT_BY_PARENT && n.OutEdges != nil && len(*n.OutEdges) > 0 {
+			return fmt.Errorf("node %q cannot link to another node in an upsert by parent; upsert by owner instead", n.Uid)
+		}
+	}
+	return nil
+}
+
 func (req *CreateNodesRequest) Validate() bool {
 	res := req.Nodes != nil && len(*req.Nodes) > 0 && CheckUidsArePlaceholders(req.Nodes)
+	if res {
+		if err := validateNewNodePayloads(req.Nodes); err != nil {
+			req.validationErr = err.Error()
+			return false
+		}
+		if req.Upsert != "" {
+			if err := req.validateUpsertKeys(); err != nil {
+				req.validationErr = err.Error()
+				return false
+			}
+		}
+	}
 	return res
 }
+
+func (req *CreateNodesRequest) ValidationError() string {
+	return req.validationErr
+}
@@ -0,0 +1,64 @@
+package requests
+
+import (
+	cm "cogged/models"
+	sec "cogged/security"
+	"fmt"
+	"regexp"
+)
+
+const MAX_PATHS = 10
+
+var rgxPathType = regexp.MustCompile(`^[A-Za-z0-9_.:/-]+$`)
+
+// PathRequest asks how one node is connected to another: the shortest path(s) of `e`
+// edges from From to To.
+type PathRequest struct {
+	// From and To are the AuthzData of the two end nodes; the caller must be able to read both.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// MaxDepth is the most edges a path may have. 0 means the server maximum.
+	MaxDepth uint `json:"max_depth"`
+	// NumPaths is how many paths to return, shortest first (default 1).
+	NumPaths uint `json:"num_paths,omitempty"`
+	// Types, when set, restricts the nodes a path may pass through to these `ty` values.
+	// The two end nodes do not have to match.
+	Types []string `json:"types,omitempty"`
+	// Direction is which way edges may be followed, as for QueryRequest: "out" (the
+	// default), "in" or "both".
+	Direction string   `json:"direction,omitempty"`
+	Select    []string `json:"select,omitempty"`
+
+	UnpackedFrom *cm.GraphNode `json:"-"`
+	UnpackedTo   *cm.GraphNode `json:"-"`
+
+	validationErr string
+}
+
+func (req *PathRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
+	req.UnpackedFrom = cm.AuthzDataUnpackADString(req.From, uad, permissionsRequired)
+	req.UnpackedTo = cm.AuthzDataUnpackADString(req.To, uad, permissionsRequired)
+	return req.UnpackedFrom != nil && req.UnpackedTo != nil
+}
+
+func (req *PathRequest) Validate() bool {
+	switch {
+	case req.NumPaths > MAX_PATHS:
+		req.validationErr = fmt.Sprintf("num_paths must be at most %d", MAX_PATHS)
+	case req.Direction != "" && req.Direction != DIRECTION_OUT && req.Direction != DIRECTION_IN && req.Direction != DIRECTION_BOTH:
+		req.validationErr = "direction must be one of: out, in, both"
+	default:
+		for _, t := range req.Types {
+			if !rgxPathType.MatchString(t) {
+				req.validationErr = "invalid type in types: " + t
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (req *PathRequest) ValidationError() string {
+	return req.validationErr
+}
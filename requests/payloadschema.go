@@ -0,0 +1,31 @@
+package requests
+
+import (
+	cm "cogged/models"
+	sec "cogged/security"
+)
+
+// PayloadSchemaRequest registers (or replaces) the payload schema for one node type. It is
+// only accepted on the admin route group.
+type PayloadSchemaRequest struct {
+	cm.PayloadSchema
+
+	validationErr string
+}
+
+// not applicable, as the request is admin only and carries no node or user ids
+func (req *PayloadSchemaRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
+	return true
+}
+
+func (req *PayloadSchemaRequest) Validate() bool {
+	if err := req.Compile(); err != nil {
+		req.validationErr = err.Error()
+		return false
+	}
+	return true
+}
+
+func (req *PayloadSchemaRequest) ValidationError() string {
+	return req.validationErr
+}
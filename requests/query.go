@@ -4,6 +4,9 @@ import (
 	"cogged/log"
 	cm "cogged/models"
 	sec "cogged/security"
+	"encoding/json"
+	"fmt"
+	"strings"
 )
 
 type QueryRequestClause struct {
@@ -13,11 +16,56 @@ type QueryRequestClause struct {
 	Op    string               `json:"op,omitempty"`
 	Val   string               `json:"val,omitempty"`
 
-	// Geo, when set, makes this clause a radius test on the `g` predicate instead of a
-	// Field/Op/Val comparison — so proximity can be ANDed and ORed with ordinary filters
+	// Geo, when set, makes this clause a geo test on the `g` predicate instead of a
+	// Field/Op/Val comparison — so location can be ANDed and ORed with ordinary filters
 	// and applied to a root_ids traversal, which QueryRequest.Geo (a root function)
 	// cannot. Field/Op/Val must be left unset on a geo clause.
 	Geo *QueryGeo `json:"geo,omitempty"`
+
+	// Not, when set, makes this clause match every node the wrapped clause does not.
+	Not *QueryRequestClause `json:"not,omitempty"`
+
+	// Vals holds the values for the ops that take more than one: the list for "in" and the
+	// inclusive lower and upper bounds for "between".
+	Vals []string `json:"vals,omitempty"`
+
+	// MatchDistance is how many edits away from Val a "match" clause may be, 2 if unset.
+	MatchDistance uint `json:"match_distance,omitempty"`
+
+	// OwnerUid is the uid of the user named by Val on an "owner" clause, unpacked from that
+	// user's AuthzData by QueryRequest.AuthzDataUnpack. Only this is ever compiled, never
+	// Val itself.
+	OwnerUid string `json:"-"`
+}
+
+// OP_OWNER is the clause op that matches nodes owned by the user whose AuthzData is the
+// clause's Val.
+const OP_OWNER = "owner"
+
+// unpackOwnerClauses verifies the user AuthzData of every owner clause in the tree and
+// records the user's uid on the clause.
+func unpackOwnerClauses(clause *QueryRequestClause, uad sec.UserAuthData) bool {
+	if clause == nil {
+		return true
+	}
+	if strings.EqualFold(clause.Op, OP_OWNER) {
+		user := cm.GraphUserFromAD(clause.Val, uad.SecretKey)
+		if user == nil || user.Uid == "" {
+			return false
+		}
+		clause.OwnerUid = user.Uid
+	}
+	for i := range clause.And {
+		if !unpackOwnerClauses(&clause.And[i], uad) {
+			return false
+		}
+	}
+	for i := range clause.Or {
+		if !unpackOwnerClauses(&clause.Or[i], uad) {
+			return false
+		}
+	}
+	return unpackOwnerClauses(clause.Not, uad)
 }
 
 type QueryRequest struct {
@@ -27,64 +75,291 @@ type QueryRequest struct {
 	Filters   *QueryRequestClause `json:"filters,omitempty"`
 	Select    []string            `json:"select,omitempty"`
 
-	// Pagination (all optional). First/Offset give offset-based paging; First/After
-	// give cursor-based paging (After is a node uid, results after it in the ordering).
-	// OrderBy names an indexed predicate to sort by (OrderDesc for descending); when
-	// unset, results follow Dgraph's default uid order.
+	// Pagination (all optional). First/Offset give offset-based paging; First/Cursor
+	// give cursor-based paging under any ordering (Cursor is the next_cursor of the
+	// previous page). After is the older uid cursor, which only pages correctly in uid
+	// order. OrderBy lists the indexed predicates to sort by, each ascending unless Desc
+	// is set; when unset, results follow Dgraph's default uid order. OrderDesc sorts a
+	// single key descending, for requests that give order_by as a plain field name.
 	//
 	// The read-permission check is applied inside the query (see renderReadAuthzFilter in
 	// services/db.go), so paginated results contain only nodes the caller may read.
-	First     *int    `json:"first,omitempty"`
-	Offset    *int    `json:"offset,omitempty"`
-	After     *string `json:"after,omitempty"`
-	OrderBy   *string `json:"order_by,omitempty"`
-	OrderDesc bool    `json:"order_desc,omitempty"`
-
-	// Similar, when set, runs a vector-similarity search over the `vec` predicate
-	// (HNSW index) instead of a uid/root traversal: it returns the nodes nearest to
-	// the given query vector. Results are still scoped by the caller's read
-	// permissions and any Filters/Select. See QuerySimilarity.
+	First     *int       `json:"first,omitempty"`
+	Offset    *int       `json:"offset,omitempty"`
+	After     *string    `json:"after,omitempty"`
+	Cursor    *string    `json:"cursor,omitempty"`
+	OrderBy   QueryOrder `json:"order_by,omitempty"`
+	OrderDesc bool       `json:"order_desc,omitempty"`
+
+	// PageCursor is Cursor once its signature has been verified by AuthzDataUnpack.
+	PageCursor *cm.PageCursor `json:"-"`
+
+	// Snapshot is the snapshot token returned with the first page of a paginated query.
+	// Passing it back with later pages reads them at the same point in time as the first,
+	// so that concurrent writes cannot shift nodes between pages. It is time-limited.
+	Snapshot *string `json:"snapshot,omitempty"`
+	// ReadSnapshot is Snapshot once its signature has been verified by AuthzDataUnpack.
+	ReadSnapshot *cm.ReadSnapshot `json:"-"`
+
+	// Similar, when set, runs a vector-similarity search over the `vec` predicate: it
+	// returns the top_k readable nodes most similar to the given query vector, most similar
+	// first, each with its similarity. With RootIDs it only searches the nodes a traversal
+	// from them reaches (Depth, Direction and TraverseFilter apply as usual). Filters and
+	// Select still apply, and First and Offset page through the top_k. See QuerySimilarity.
 	Similar *QuerySimilarity `json:"similar,omitempty"`
 
-	// Geo, when set, runs a radius search over the `g` predicate (geo index) instead of
-	// a uid/root traversal. Like Similar it replaces the root function, so RootIDs and
-	// Depth are ignored; Filters and Select still apply, and results are still scoped by
-	// the caller's read permissions. Geo and Similar cannot be combined. See QueryGeo.
+	// Geo, when set, runs a geo search over the `g` predicate (geo index) instead of
+	// a uid/root traversal. It replaces the root function, so RootIDs and Depth are
+	// ignored; Filters and Select still apply, and results are still scoped by the
+	// caller's read permissions. Geo and Similar cannot be combined. See QueryGeo.
 	Geo *QueryGeo `json:"geo,omitempty"`
+
+	// Direction picks which way a root_ids traversal follows `e` edges: "out" (the
+	// default) to the nodes each node links to, "in" along the reverse edge to the nodes
+	// that link to it, or "both". Only node-to-node traversals (POST /graph/nodes) can go
+	// "in"; every node reached either way is still checked against the caller's read
+	// permissions.
+	Direction string `json:"direction,omitempty"`
+
+	// TraverseFilter prunes a root_ids traversal: an edge is only followed into a node that
+	// matches it, so whole branches that fail it are never walked. Filters, by contrast,
+	// only picks among the nodes the traversal has already reached. The root nodes
+	// themselves are not tested.
+	TraverseFilter *QueryRequestClause `json:"traverse_filter,omitempty"`
+
+	// WithDepth sets depth on each result node of a root_ids traversal: the fewest edges
+	// from a root to that node along the (pruned) walk, 0 for the roots.
+	WithDepth bool `json:"with_depth,omitempty"`
+
+	// Shape picks how a root_ids traversal is returned: "flat" (the default) lists every
+	// node reached in result_nodes, "tree" returns just the roots with the nodes reached
+	// from each nested under `e`, so clients need not rebuild the hierarchy themselves.
+	// A tree is built from the readable nodes that pass Filters, so it cannot be paged.
+	Shape string `json:"shape,omitempty"`
+
+	// Aggregate, when set, returns figures computed over the matching nodes in place of the
+	// nodes themselves. See QueryAggregate.
+	Aggregate *QueryAggregate `json:"aggregate,omitempty"`
+
+	// Cluster, when set, returns the matching nodes inside a bounding box counted into map
+	// clusters in place of the nodes themselves. Like Geo it replaces the root function, so
+	// RootIDs and Depth are ignored. See QueryCluster.
+	Cluster *QueryCluster `json:"cluster,omitempty"`
+
+	validationErr string
+}
+
+// QueryCluster asks for the readable nodes with a `g` inside BBox that pass Filters, grouped
+// into clusters by geohash cell: a count and the centroid of each cell's nodes, for drawing
+// on a map. The cells are Precision geohash characters long, or sized for the map zoom
+// level Zoom; exactly one of the two must be set.
+type QueryCluster struct {
+	// BBox is the area to cluster, [west, south, east, north] in degrees. A box with west
+	// greater than east crosses the antimeridian.
+	BBox []float64 `json:"bbox"`
+	// Zoom is the map's zoom level, 0 for the whole world in one tile.
+	Zoom *int `json:"zoom,omitempty"`
+	// Precision is the geohash length of the cells, from 1 (about 5000 km across) to 9
+	// (about 5 m).
+	Precision int `json:"precision,omitempty"`
+}
+
+// QueryAggregate asks for aggregates over the nodes a query matches, after Filters and the
+// caller's read permissions are applied, optionally split into groups by up to all three
+// of ty, s3 and s4. Each of Sum, Min, Max and Avg lists the fields to apply it to; Sum and
+// Avg take n1 and n2, Min and Max also take t1 and t2.
+type QueryAggregate struct {
+	Count   bool     `json:"count,omitempty"`
+	Sum     []string `json:"sum,omitempty"`
+	Min     []string `json:"min,omitempty"`
+	Max     []string `json:"max,omitempty"`
+	Avg     []string `json:"avg,omitempty"`
+	GroupBy []string `json:"group_by,omitempty"`
+}
+
+var (
+	aggregateNumericFields = map[string]bool{"n1": true, "n2": true}
+	aggregateOrderedFields = map[string]bool{"n1": true, "n2": true, "t1": true, "t2": true}
+	aggregateGroupFields   = map[string]bool{"ty": true, "s3": true, "s4": true}
+)
+
+// AggregateFunction is one function of a QueryAggregate applied to one field.
+type AggregateFunction struct {
+	Fn    string
+	Field string
+}
+
+// Functions lists each aggregate function asked for with a field it applies to, in a fixed
+// order.
+func (a *QueryAggregate) Functions() []AggregateFunction {
+	fns := []AggregateFunction{}
+	for _, fn := range []struct {
+		name   string
+		fields []string
+	}{{"sum", a.Sum}, {"min", a.Min}, {"max", a.Max}, {"avg", a.Avg}} {
+		for _, f := range fn.fields {
+			fns = append(fns, AggregateFunction{fn.name, f})
+		}
+	}
+	return fns
+}
+
+func (a *QueryAggregate) validate() string {
+	if !a.Count && len(a.Functions()) == 0 {
+		return "aggregate needs count or at least one of sum, min, max, avg"
+	}
+	for _, f := range append(a.Sum, a.Avg...) {
+		if !aggregateNumericFields[f] {
+			return "sum and avg only apply to n1 and n2, not " + f
+		}
+	}
+	for _, f := range append(a.Min, a.Max...) {
+		if !aggregateOrderedFields[f] {
+			return "min and max only apply to n1, n2, t1 and t2, not " + f
+		}
+	}
+	seen := map[string]bool{}
+	for _, f := range a.GroupBy {
+		if !aggregateGroupFields[f] || seen[f] {
+			return "group_by takes distinct fields from ty, s3 and s4, not " + f
+		}
+		seen[f] = true
+	}
+	return ""
+}
+
+// MAX_ORDER_KEYS caps how many keys a query may be sorted by.
+const MAX_ORDER_KEYS = 3
+
+// OrderKey is one sort key of a query: a predicate and its direction.
+type OrderKey struct {
+	Field string `json:"field"`
+	Desc  bool   `json:"desc,omitempty"`
 }
 
-// QueryGeo requests a radius search: every node whose `g` point lies within Distance
-// metres of Point.
+// QueryOrder is the list of keys a query is sorted by, most significant first. In JSON it
+// is either that list or, as before it could hold more than one key, a single field name.
+type QueryOrder []OrderKey
+
+func (o *QueryOrder) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+	var field string
+	if err := json.Unmarshal(b, &field); err == nil {
+		*o = QueryOrder{{Field: field}}
+		return nil
+	}
+	var keys []OrderKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return err
+	}
+	*o = keys
+	return nil
+}
+
+// OrderKeys returns the keys the query is sorted by, with OrderDesc applied.
+func (req *QueryRequest) OrderKeys() []OrderKey {
+	keys := append([]OrderKey{}, req.OrderBy...)
+	if req.OrderDesc && len(keys) == 1 {
+		keys[0].Desc = true
+	}
+	return keys
+}
+
+const (
+	DIRECTION_OUT  = "out"
+	DIRECTION_IN   = "in"
+	DIRECTION_BOTH = "both"
+)
+
+const (
+	SHAPE_FLAT = "flat"
+	SHAPE_TREE = "tree"
+)
+
+const (
+	GEO_NEAR       = "near"
+	GEO_WITHIN     = "within"
+	GEO_CONTAINS   = "contains"
+	GEO_INTERSECTS = "intersects"
+	GEO_NEAREST    = "nearest"
+)
+
+// QueryGeo requests a geo search, by Mode:
+//   - near (the default): every node whose `g` lies within Distance metres of Point.
+//   - within: every node whose `g` lies inside Shape, a Polygon or MultiPolygon.
+//   - contains: every node whose `g` is an area holding Point, or Shape if Point is unset.
+//   - intersects: every node whose `g` crosses or overlaps Shape, a Polygon or MultiPolygon.
+//   - nearest: the readable nodes nearest to Point, nearest first, each with its
+//     distance_m. Distance, if set, is how far out to look.
 //
-// This is a containment test, not a nearest-neighbour search. Dgraph returns geo matches
+// near is a containment test, not a nearest-neighbour search. Dgraph returns geo matches
 // in uid order and cannot sort by distance (`orderasc: g` is rejected outright with
 // "Value of type: geo isn't sortable"), nor does it return the computed distance. So
-// pairing this with First does NOT give "the N nearest" — it gives an arbitrary N of the
-// nodes inside the radius. If a caller needs nearest-first, they must fetch the whole
-// radius and sort client-side.
+// pairing near with First gives an arbitrary N of the nodes inside the radius; use nearest
+// for "the N nearest". nearest is only for the request's own geo block, not a filter
+// clause, and pages with First and Offset rather than a cursor or order_by.
 type QueryGeo struct {
+	Mode string `json:"mode,omitempty"`
 	// Point is the centre of the search as [longitude, latitude] — longitude FIRST,
 	// matching GeoJSON and the format stored in a node's `g` predicate.
-	Point []float64 `json:"point"`
-	// Distance is the search radius in metres. Must be > 0.
-	Distance float64 `json:"distance"`
+	Point []float64 `json:"point,omitempty"`
+	// Distance is the search radius in metres. Must be > 0, except for nearest, where it
+	// is optional and defaults to the whole globe.
+	Distance float64 `json:"distance,omitempty"`
+	// Shape is the area to test against for within, contains and intersects.
+	Shape *cm.Geoloc `json:"shape,omitempty"`
 }
 
 // QuerySimilarity requests a vector-similarity search.
 type QuerySimilarity struct {
 	// Vector is the query embedding as a string-encoded float array, e.g.
 	// "[0.1,0.2,0.3]" (the same format stored in a node's `vec` predicate).
-	Vector string `json:"vector"`
-	// TopK is how many nearest neighbours to retrieve (before read filtering).
+	Vector string `json:"vector,omitempty"`
+	// Text, sent instead of Vector, is embedded by the server's configured embedder, the
+	// same one that fills in nodes' vec.
+	Text string `json:"text,omitempty"`
+	// TopK is how many of the most similar readable nodes to return: 10 by default and
+	// 1000 at most.
 	TopK uint `json:"top_k,omitempty"`
 }
 
+// validate checks that exactly one of Vector and Text is set, trimming Text, and returns
+// what is wrong if not.
+func (s *QuerySimilarity) validate() string {
+	s.Text = strings.TrimSpace(s.Text)
+	switch {
+	case (s.Vector == "") == (s.Text == ""):
+		return "similar takes one of vector or text"
+	case len(s.Text) > MAX_SEARCH_TEXT:
+		return fmt.Sprintf("similar text must be at most %d characters", MAX_SEARCH_TEXT)
+	}
+	return ""
+}
+
 func (req *QueryRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
 	log.Debug("QueryRes AuthzDataUnpack", req)
 	// only system role can supply a root query:
 	if uad.Role != sec.SYS_ROLE && req.RootQuery != nil {
 		return false
 	}
+	for _, clause := range []*QueryRequestClause{req.Filters, req.RootQuery, req.TraverseFilter} {
+		if !unpackOwnerClauses(clause, uad) {
+			return false
+		}
+	}
+	if req.Cursor != nil {
+		// a cursor is only good for the user it was issued to
+		if req.PageCursor = cm.PageCursorFromString(*req.Cursor, uad.SecretKey); req.PageCursor == nil {
+			return false
+		}
+	}
+	if req.Snapshot != nil {
+		if req.ReadSnapshot = cm.ReadSnapshotFromString(*req.Snapshot, uad.SecretKey); req.ReadSnapshot == nil {
+			return false
+		}
+	}
 	// allowe empty root IDs (for system users running a rootQuery or POST /user/nodes/shared|own)
 	if len(req.RootIDs) < 1 {
 		return true
@@ -93,5 +368,100 @@ func (req *QueryRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequir
 }
 
 func (req *QueryRequest) Validate() bool {
+	switch req.Direction {
+	case "", DIRECTION_OUT, DIRECTION_IN, DIRECTION_BOTH:
+	default:
+		req.validationErr = "direction must be one of: out, in, both"
+		return false
+	}
+	switch req.Shape {
+	case "", SHAPE_FLAT:
+	case SHAPE_TREE:
+		if req.RootQuery != nil || req.Similar != nil || req.Geo != nil {
+			req.validationErr = "shape tree is only for root_ids traversals"
+			return false
+		}
+		if req.First != nil || req.Offset != nil || req.After != nil || req.Cursor != nil || len(req.OrderBy) > 0 {
+			req.validationErr = "shape tree cannot be combined with first, offset, after, cursor or order_by"
+			return false
+		}
+	default:
+		req.validationErr = "shape must be one of: flat, tree"
+		return false
+	}
+	if req.First != nil && *req.First < 0 {
+		req.validationErr = "first must not be negative"
+		return false
+	}
+	if req.Offset != nil && *req.Offset < 0 {
+		req.validationErr = "offset must not be negative"
+		return false
+	}
+	if len(req.OrderBy) > MAX_ORDER_KEYS {
+		req.validationErr = fmt.Sprintf("order_by takes at most %d keys", MAX_ORDER_KEYS)
+		return false
+	}
+	if req.OrderDesc && len(req.OrderBy) > 1 {
+		req.validationErr = "order_desc only applies to a single order_by key; set desc on each key instead"
+		return false
+	}
+	if req.Cursor != nil {
+		if req.Offset != nil || req.After != nil {
+			req.validationErr = "cursor cannot be combined with offset or after"
+			return false
+		}
+		if req.Similar != nil {
+			req.validationErr = "cursor cannot be used with a similarity search"
+			return false
+		}
+	}
+	if req.Geo != nil && req.Geo.Mode == GEO_NEAREST {
+		if req.After != nil || req.Cursor != nil || len(req.OrderBy) > 0 || req.Aggregate != nil {
+			req.validationErr = "geo mode nearest is ordered by distance and pages with first and offset; it cannot be combined with after, cursor, order_by or aggregate"
+			return false
+		}
+	}
+	if req.Similar != nil {
+		if req.RootQuery != nil || req.After != nil || len(req.OrderBy) > 0 || req.Aggregate != nil || req.WithDepth {
+			req.validationErr = "similar is ordered by similarity and pages with first and offset; it cannot be combined with root_query, after, order_by, aggregate or with_depth"
+			return false
+		}
+		if msg := req.Similar.validate(); msg != "" {
+			req.validationErr = msg
+			return false
+		}
+	}
+	if req.Cluster != nil {
+		if req.Similar != nil || req.Geo != nil || req.Aggregate != nil || req.Shape == SHAPE_TREE || req.WithDepth {
+			req.validationErr = "cluster cannot be combined with similar, geo, aggregate, shape tree or with_depth"
+			return false
+		}
+		if req.First != nil || req.Offset != nil || req.After != nil || req.Cursor != nil || len(req.OrderBy) > 0 {
+			req.validationErr = "cluster cannot be combined with first, offset, after, cursor or order_by"
+			return false
+		}
+	}
+	if req.ReadSnapshot != nil && req.ReadSnapshot.Expired() {
+		req.validationErr = "snapshot has expired; start again from the first page"
+		return false
+	}
+	if req.Aggregate != nil {
+		if req.Shape == SHAPE_TREE || req.WithDepth {
+			req.validationErr = "aggregate cannot be combined with shape tree or with_depth"
+			return false
+		}
+		if req.First != nil || req.Offset != nil || req.After != nil || req.Cursor != nil || len(req.OrderBy) > 0 {
+			req.validationErr = "aggregate cannot be combined with first, offset, after, cursor or order_by"
+			return false
+		}
+		if msg := req.Aggregate.validate(); msg != "" {
+			req.validationErr = msg
+			return false
+		}
+	}
 	return true
 }
+
+func (req *QueryRequest) ValidationError() string {
+	return req.validationErr
+}
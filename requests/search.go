@@ -0,0 +1,151 @@
+package requests
+
+import (
+	sec "cogged/security"
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	SEARCH_MODE_TERMS = "terms"
+	SEARCH_MODE_TEXT  = "text"
+	SEARCH_MODE_FUZZY = "fuzzy"
+
+	FUSION_RRF      = "rrf"
+	FUSION_WEIGHTED = "weighted"
+
+	MAX_SEARCH_TEXT = 200
+	MAX_SEARCH_PAGE = 100
+)
+
+// SearchRequest looks for text across every node the caller may read, without needing a
+// root node to start from.
+type SearchRequest struct {
+	// Text is what to search for.
+	Text string `json:"text"`
+	// Mode picks how Text is matched: "terms" (the default) for any of its words, "text"
+	// for any of its words after stemming, or "fuzzy" for values within a couple of edits
+	// of it.
+	Mode string `json:"mode,omitempty"`
+	// Fields narrows the fields searched. By default every field indexed for Mode is.
+	Fields []string `json:"fields,omitempty"`
+	// Filters further restricts the matches, as for QueryRequest.
+	Filters *QueryRequestClause `json:"filters,omitempty"`
+	Select  []string            `json:"select,omitempty"`
+	// First and Offset page through the matches, best first. First defaults to 20.
+	First  *int `json:"first,omitempty"`
+	Offset *int `json:"offset,omitempty"`
+
+	// Similar and Geo make this a hybrid search, which ranks the readable nodes by each of
+	// up to three signals and fuses the rankings into one: Text as above, the similarity of
+	// a node's vec to Similar.Vector, and the nearness of its g to Geo.Point (within
+	// Geo.Distance metres if given). Text is optional in a hybrid search; Filters apply to
+	// every signal. Each result node has its combined score.
+	Similar *QuerySimilarity `json:"similar,omitempty"`
+	Geo     *QueryGeo        `json:"geo,omitempty"`
+	// Fusion says how a hybrid search combines its rankings. See SearchFusion.
+	Fusion *SearchFusion `json:"fusion,omitempty"`
+
+	validationErr string
+}
+
+// SearchFusion combines the rankings of a hybrid search into one.
+type SearchFusion struct {
+	// Method is "rrf" (the default), reciprocal-rank fusion, under which a node scores the
+	// sum over the rankings it is in of weight / (k + its rank there, counted from 1); or
+	// "weighted", under which it scores the sum of weight times its score in each ranking,
+	// scaled to between 0 and 1 across that ranking.
+	Method string `json:"method,omitempty"`
+	// K is the rrf constant, 60 by default. A bigger K narrows the lead of the top ranks.
+	K int `json:"k,omitempty"`
+	// Weights scale each signal's part in the combined score. A weight of 0 leaves its
+	// signal out.
+	Weights *SearchWeights `json:"weights,omitempty"`
+}
+
+// SearchWeights weighs the signals of a hybrid search. Each defaults to 1.
+type SearchWeights struct {
+	Text   *float64 `json:"text,omitempty"`
+	Vector *float64 `json:"vector,omitempty"`
+	Geo    *float64 `json:"geo,omitempty"`
+}
+
+func (req *SearchRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
+	return unpackOwnerClauses(req.Filters, uad)
+}
+
+func (req *SearchRequest) Validate() bool {
+	text := strings.TrimSpace(req.Text)
+	hybrid := req.Similar != nil || req.Geo != nil
+	switch {
+	case text == "" && !hybrid:
+		req.validationErr = "text must not be empty"
+	case len(text) > MAX_SEARCH_TEXT:
+		req.validationErr = fmt.Sprintf("text must be at most %d characters", MAX_SEARCH_TEXT)
+	case req.Mode != "" && req.Mode != SEARCH_MODE_TERMS && req.Mode != SEARCH_MODE_TEXT && req.Mode != SEARCH_MODE_FUZZY:
+		req.validationErr = "mode must be one of: terms, text, fuzzy"
+	case req.First != nil && (*req.First < 1 || *req.First > MAX_SEARCH_PAGE):
+		req.validationErr = fmt.Sprintf("first must be between 1 and %d", MAX_SEARCH_PAGE)
+	case req.Offset != nil && *req.Offset < 0:
+		req.validationErr = "offset must not be negative"
+	case req.Similar != nil && req.Similar.validate() != "":
+		req.validationErr = req.Similar.validate()
+	case req.Similar != nil && req.Similar.TopK != 0:
+		req.validationErr = "top_k does not apply to a search; first and offset page through the results"
+	case req.Geo != nil && req.Geo.Mode != "" && req.Geo.Mode != GEO_NEAREST:
+		req.validationErr = "a search ranks by nearness to the geo point; use mode nearest or leave it unset, and put other geo tests in filters"
+	case req.Fusion != nil && !hybrid:
+		req.validationErr = "fusion only applies to a search with similar or geo"
+	case req.Fusion != nil && req.Fusion.Method != "" && req.Fusion.Method != FUSION_RRF && req.Fusion.Method != FUSION_WEIGHTED:
+		req.validationErr = "fusion method must be one of: rrf, weighted"
+	case req.Fusion != nil && req.Fusion.K < 0:
+		req.validationErr = "fusion k must not be negative"
+	case !req.Fusion.validWeights():
+		req.validationErr = "fusion weights must be finite and not negative"
+	case hybrid && !req.Fusion.weighsAny(text != "", req.Similar != nil, req.Geo != nil):
+		req.validationErr = "a hybrid search needs at least one signal with a weight above 0"
+	default:
+		req.Text = text
+		return true
+	}
+	return false
+}
+
+// SignalWeights returns the weights of the text, vector and geo signals, 1 where unset.
+func (f *SearchFusion) SignalWeights() (text, vector, geo float64) {
+	text, vector, geo = 1, 1, 1
+	if f == nil || f.Weights == nil {
+		return
+	}
+	if f.Weights.Text != nil {
+		text = *f.Weights.Text
+	}
+	if f.Weights.Vector != nil {
+		vector = *f.Weights.Vector
+	}
+	if f.Weights.Geo != nil {
+		geo = *f.Weights.Geo
+	}
+	return
+}
+
+func (f *SearchFusion) validWeights() bool {
+	text, vector, geo := f.SignalWeights()
+	for _, w := range []float64{text, vector, geo} {
+		if math.IsNaN(w) || math.IsInf(w, 0) || w < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// weighsAny reports whether any of the signals in use has a weight above 0.
+func (f *SearchFusion) weighsAny(useText, useVector, useGeo bool) bool {
+	text, vector, geo := f.SignalWeights()
+	return (useText && text > 0) || (useVector && vector > 0) || (useGeo && geo > 0)
+}
+
+func (req *SearchRequest) ValidationError() string {
+	return req.validationErr
+}
@@ -0,0 +1,69 @@
+package requests
+
+import (
+	"cogged/log"
+	cm "cogged/models"
+	sec "cogged/security"
+)
+
+// PermissionMask sets node permission bits; a bit left out (null) is not changed.
+type PermissionMask struct {
+	PermRead    *bool `json:"r,omitempty"`
+	PermWrite   *bool `json:"w,omitempty"`
+	PermOutEdge *bool `json:"o,omitempty"`
+	PermInEdge  *bool `json:"i,omitempty"`
+	PermDelete  *bool `json:"d,omitempty"`
+	PermShare   *bool `json:"s,omitempty"`
+}
+
+func (m *PermissionMask) IsEmpty() bool {
+	return m == nil || (m.PermRead == nil && m.PermWrite == nil && m.PermOutEdge == nil &&
+		m.PermInEdge == nil && m.PermDelete == nil && m.PermShare == nil)
+}
+
+// Apply sets the masked bits on n, leaving the rest as they are.
+func (m *PermissionMask) Apply(n *cm.GraphNode) {
+	if m == nil {
+		return
+	}
+	for _, p := range []struct{ from, to **bool }{
+		{&m.PermRead, &n.PermRead},
+		{&m.PermWrite, &n.PermWrite},
+		{&m.PermOutEdge, &n.PermOutEdge},
+		{&m.PermInEdge, &n.PermInEdge},
+		{&m.PermDelete, &n.PermDelete},
+		{&m.PermShare, &n.PermShare},
+	} {
+		if *p.from != nil {
+			v := **p.from
+			*p.to = &v
+		}
+	}
+}
+
+// SubgraphPermsRequest applies a permission mask and/or a fresh share group to one or more
+// nodes and, with Depth > 0, to the subgraph below each of them owned by the same user.
+type SubgraphPermsRequest struct {
+	Nodes *[]string       `json:"nodes,omitempty"`
+	Depth uint            `json:"depth"`
+	Perms *PermissionMask `json:"perms,omitempty"`
+	// ResetSgi moves every affected node into one new share group, splitting the subgraph
+	// off from the share group it was in.
+	ResetSgi bool `json:"reset_sgi"`
+	// DryRun reports what would change without writing anything.
+	DryRun bool `json:"dry_run"`
+
+	UnpackedNodes *[]*cm.GraphNode `json:"-"`
+}
+
+// Like a transfer, this is owner-only: holding 's' on a node is not enough to rewrite its
+// permission bits or move it to another share group.
+func (req *SubgraphPermsRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
+	log.Debug("SubgraphPermsRequest.AuthzDataUnpack", *req)
+	req.UnpackedNodes = &[]*cm.GraphNode{}
+	return cm.AuthzDataUnpackOwnedADStringSlicePlusNodes(req.Nodes, req.UnpackedNodes, uad)
+}
+
+func (req *SubgraphPermsRequest) Validate() bool {
+	return req.Nodes != nil && len(*req.Nodes) > 0 && (req.ResetSgi || !req.Perms.IsEmpty())
+}
@@ -0,0 +1,45 @@
+package requests
+
+import (
+	"cogged/log"
+	cm "cogged/models"
+	sec "cogged/security"
+)
+
+// TransferNodesRequest hands ownership of one or more nodes (and, with Depth > 0, the
+// subgraph below each of them that the same user owns) to another user.
+type TransferNodesRequest struct {
+	Nodes *[]string `json:"nodes,omitempty"`
+	// User is the AuthzData of the new owner, as returned by GET /user/name or /user/uid.
+	User string `json:"user"`
+	// Depth is how many levels of out-edges below each node to follow. Descendants are
+	// only transferred while they are owned by the same user as the node they hang off;
+	// the walk stops at a node owned by anyone else.
+	Depth uint `json:"depth"`
+	// KeepShare leaves each previous owner with a share edge to the transferred root
+	// nodes, so they keep whatever access the nodes' permission bits grant a sharee.
+	KeepShare bool `json:"keep_share"`
+
+	UnpackedNodes *[]*cm.GraphNode `json:"-"`
+	NewOwner      *cm.GraphUser    `json:"-"`
+}
+
+// Only the current owner of every node (or a sys user) may transfer it; share permissions
+// are deliberately not enough.
+func (req *TransferNodesRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
+	log.Debug("TransferNodesRequest.AuthzDataUnpack", *req)
+	req.UnpackedNodes = &[]*cm.GraphNode{}
+	if !cm.AuthzDataUnpackOwnedADStringSlicePlusNodes(req.Nodes, req.UnpackedNodes, uad) {
+		return false
+	}
+	users := []string{req.User}
+	if !cm.AuthzDataUnpackUserADStringSlice(&users, uad, "") {
+		return false
+	}
+	req.NewOwner = cm.GraphUserFromUnpackedAD(users[0])
+	return req.NewOwner != nil
+}
+
+func (req *TransferNodesRequest) Validate() bool {
+	return req.Nodes != nil && len(*req.Nodes) > 0 && req.NewOwner != nil && req.NewOwner.Uid != ""
+}
@@ -1,20 +1,102 @@
 package requests
 
 import (
+	"bytes"
 	"cogged/log"
 	cm "cogged/models"
 	sec "cogged/security"
+	"encoding/json"
+	"sort"
 )
 
 type UpdateNodesRequest struct {
 	Nodes *[]*cm.GraphNode `json:"nodes,omitempty"`
+
+	validationErr string
+}
+
+// UnmarshalJSON adds each unsettable predicate a node gives an explicit null to its unset
+// list, as in a JSON Merge Patch. A null anywhere else means no change, as before.
+func (req *UpdateNodesRequest) UnmarshalJSON(data []byte) error {
+	type plain UpdateNodesRequest
+	if err := json.Unmarshal(data, (*plain)(req)); err != nil {
+		return err
+	}
+	raw := struct {
+		Nodes []map[string]json.RawMessage `json:"nodes"`
+	}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for i, fields := range raw.Nodes {
+		n := (*req.Nodes)[i]
+		if n == nil {
+			continue
+		}
+		nulls := []string{}
+		for _, pred := range cm.UNSETTABLE_PREDICATES {
+			if v, ok := fields[pred]; ok && bytes.Equal(bytes.TrimSpace(v), []byte("null")) && !n.Unsets(pred) {
+				nulls = append(nulls, pred)
+			}
+		}
+		sort.Strings(nulls)
+		n.Unset = append(n.Unset, nulls...)
+	}
+	return nil
 }
 
+// AuthzDataUnpack also requires a node that unsets p to be the user's own: p is private to
+// its owner, so no one else can see what they would be deleting.
 func (req *UpdateNodesRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
 	log.Debug("UpdateNodesRequest.AuthzDataUnpack", uad, permissionsRequired)
-	return cm.AuthzDataUnpackNodeSlice(req.Nodes, uad, permissionsRequired)
+	if !cm.AuthzDataUnpackNodeSlice(req.Nodes, uad, permissionsRequired) {
+		return false
+	}
+	for _, n := range *req.Nodes {
+		if n.Unsets("p") && cm.AuthzDataUnpackOwnedADString(n.AuthzData, uad) == nil {
+			return false
+		}
+	}
+	return true
 }
 
+// Validate checks the payload of each node that states its ty against that type's schema.
+// A node's stored type is not known here, so nodes that leave ty out, and type changes,
+// are checked again against the DB in services.UpsertNodes.
 func (req *UpdateNodesRequest) Validate() bool {
+	if req.Nodes == nil {
+		return true
+	}
+	for _, n := range *req.Nodes {
+		if n == nil {
+			continue
+		}
+		if err := n.Location.Validate(); err != nil {
+			req.validationErr = err.Error()
+			return false
+		}
+		if err := n.Vec.Validate(); err != nil {
+			req.validationErr = err.Error()
+			return false
+		}
+		if err := cm.ValidateBlobField(n.Blob); err != nil {
+			req.validationErr = err.Error()
+			return false
+		}
+		if err := cm.ValidateUnset(n); err != nil {
+			req.validationErr = err.Error()
+			return false
+		}
+		if s := cm.PayloadSchemaFor(n.Type); s != nil {
+			if err := s.Validate(n, false); err != nil {
+				req.validationErr = err.Error()
+				return false
+			}
+		}
+	}
 	return true
 }
+
+func (req *UpdateNodesRequest) ValidationError() string {
+	return req.validationErr
+}
@@ -7,6 +7,8 @@ import (
 
 type UserNodeRequest struct {
 	Node *cm.GraphNode `json:"node,omitempty"`
+
+	validationErr string
 }
 
 // not applicable, as the request does not access an existing UID, just a $placeholder UID for a new node
@@ -15,5 +17,16 @@ func (req *UserNodeRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsReq
 }
 
 func (req *UserNodeRequest) Validate() bool {
-	return (*req).Node != nil && CheckUidIsPlaceholder((*req).Node.Uid)
+	if (*req).Node == nil || !CheckUidIsPlaceholder((*req).Node.Uid) {
+		return false
+	}
+	if err := cm.ValidateNewNodePayload(req.Node); err != nil {
+		req.validationErr = err.Error()
+		return false
+	}
+	return true
+}
+
+func (req *UserNodeRequest) ValidationError() string {
+	return req.validationErr
 }
@@ -1,6 +1,8 @@
 package requests
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 
 	cm "cogged/models"
@@ -106,6 +108,43 @@ func TestCreateNodesRequestValidate(t *testing.T) {
 	}
 }
 
+func TestCreateNodesRequestUpsert(t *testing.T) {
+	node := func(uid, id, ty string) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(uid)
+		if id != "" {
+			n.Id = &id
+		}
+		if ty != "" {
+			n.Type = &ty
+		}
+		return n
+	}
+	nodes := []*cm.GraphNode{node("$a", "A-1", "task"), node("$b", "A-1", "note")}
+	if r := (&CreateNodesRequest{Nodes: &nodes, Upsert: UPSERT_BY_OWNER}); !r.Validate() {
+		t.Errorf("nodes with an id and ty each should validate, got %q", r.ValidationError())
+	}
+	for name, r := range map[string]*CreateNodesRequest{
+		"unknown mode": {Nodes: &[]*cm.GraphNode{node("$a", "A-1", "task")}, Upsert: "sgi"},
+		"no id":        {Nodes: &[]*cm.GraphNode{node("$a", "", "task")}, Upsert: UPSERT_BY_OWNER},
+		"no ty":        {Nodes: &[]*cm.GraphNode{node("$a", "A-1", "")}, Upsert: UPSERT_BY_PARENT},
+		"same key":     {Nodes: &[]*cm.GraphNode{node("$a", "A-1", "task"), node("$b", "A-1", "task")}, Upsert: UPSERT_BY_OWNER},
+	} {
+		if r.Validate() || r.ValidationError() == "" {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+
+	linked := node("$a", "A-1", "task")
+	linked.OutEdges = &[]*cm.GraphNode{node("$b", "", "")}
+	nodes = []*cm.GraphNode{linked, node("$b", "B-1", "task")}
+	if r := (&CreateNodesRequest{Nodes: &nodes, Upsert: UPSERT_BY_PARENT}); r.Validate() || !strings.Contains(r.ValidationError(), "upsert by owner") {
+		t.Errorf("linked nodes should be refused in an upsert by parent, got %q", r.ValidationError())
+	}
+	if r := (&CreateNodesRequest{Nodes: &nodes, Upsert: UPSERT_BY_OWNER}); !r.Validate() {
+		t.Errorf("linked nodes should validate in an upsert by owner, got %q", r.ValidationError())
+	}
+}
+
 func TestQueryRequestAuthzGating(t *testing.T) {
 	sysUAD := sec.UserAuthData{Uid: "0x1", Role: sec.SYS_ROLE}
 	userUAD := sec.UserAuthData{Uid: "0x2", Role: "user"}
@@ -126,3 +165,264 @@ func TestQueryRequestAuthzGating(t *testing.T) {
 		t.Error("empty root ids should be allowed")
 	}
 }
+
+func TestCreateNodesRequestPayloadSchema(t *testing.T) {
+	ps := &cm.PayloadSchema{Type: "tag", Slots: map[string]*cm.SlotRule{"s1": {Required: true, MaxLength: 8}}}
+	if err := ps.Compile(); err != nil {
+		t.Fatalf("schema did not compile: %v", err)
+	}
+	cm.SetPayloadSchemas([]*cm.PayloadSchema{ps})
+	defer cm.SetPayloadSchemas(nil)
+
+	// the nested child breaks the schema, so the whole request is rejected with the reason
+	body := `{"nodes":[{"uid":"$a","ty":"tag","s1":"ok","e":[{"uid":"$b","ty":"tag","s1":"far too long"}]}]}`
+	r := &CreateNodesRequest{}
+	err := BindToRequest[CreateNodesRequest](body, r, UnpackData{UAD: &sec.UserAuthData{Uid: "0x1"}})
+	if err == nil || !strings.Contains(err.Error(), "at most 8 characters") {
+		t.Errorf("expected the schema violation to be reported, got %v", err)
+	}
+
+	body = `{"node":{"uid":"$a","ty":"tag"}}`
+	ur := &UserNodeRequest{}
+	err = BindToRequest[UserNodeRequest](body, ur, UnpackData{UAD: &sec.UserAuthData{Uid: "0x1"}})
+	if err == nil || !strings.Contains(err.Error(), "must set s1") {
+		t.Errorf("expected the missing required slot to be reported, got %v", err)
+	}
+
+	if (&PayloadSchemaRequest{PayloadSchema: cm.PayloadSchema{Type: "tag", Slots: map[string]*cm.SlotRule{"x": {}}}}).Validate() {
+		t.Error("a schema for an unknown slot should not validate")
+	}
+}
+
+func TestNodeRequestsValidateGeo(t *testing.T) {
+	body := `{"nodes":[{"uid":"$a","g":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,1]]]}}]}`
+	err := BindToRequest[CreateNodesRequest](body, &CreateNodesRequest{}, UnpackData{UAD: &sec.UserAuthData{Uid: "0x1"}})
+	if err == nil || !strings.Contains(err.Error(), "end at the position it starts from") {
+		t.Errorf("expected the open ring to be reported, got %v", err)
+	}
+
+	line := &cm.Geoloc{Type: cm.GEO_LINESTRING, Line: [][]float64{{0, 0}, {0, 95}}}
+	ur := &UpdateNodesRequest{Nodes: &[]*cm.GraphNode{{Location: line}}}
+	if ur.Validate() || !strings.Contains(ur.ValidationError(), "latitude") {
+		t.Errorf("expected the bad latitude to be reported, got %q", ur.ValidationError())
+	}
+	line.Line[1][1] = 45
+	if !ur.Validate() {
+		t.Errorf("a good line should validate, got %q", ur.ValidationError())
+	}
+}
+
+func TestUpdateNodesRequestUnset(t *testing.T) {
+	body := `{"nodes":[{"uid":"0x1","s1":"x","t2":null,"g":null,"ty":null,"unset":["b"]},null,{"uid":"0x2"}]}`
+	ur := &UpdateNodesRequest{}
+	if err := json.Unmarshal([]byte(body), ur); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n := (*ur.Nodes)[0]
+	if strings.Join(n.Unset, ",") != "b,g,t2" || *n.String1 != "x" || (*ur.Nodes)[2].Unset != nil {
+		t.Errorf("expected explicit nulls of unsettable predicates added to unset, got %v", n.Unset)
+	}
+
+	ur = &UpdateNodesRequest{Nodes: &[]*cm.GraphNode{{Unset: []string{"sgi"}}}}
+	if ur.Validate() || !strings.Contains(ur.ValidationError(), "cannot be unset") {
+		t.Errorf("expected sgi to be refused, got %q", ur.ValidationError())
+	}
+	if err := json.Unmarshal([]byte(`{"nodes":[{"uid":"0x1","s1":"x","unset":["s1"]}]}`), ur); err != nil || ur.Validate() {
+		t.Error("a predicate both set and unset should not validate")
+	}
+}
+
+func TestQueryRequestDirection(t *testing.T) {
+	for _, d := range []string{"", DIRECTION_OUT, DIRECTION_IN, DIRECTION_BOTH} {
+		if !(&QueryRequest{Direction: d}).Validate() {
+			t.Errorf("direction %q should validate", d)
+		}
+	}
+	r := &QueryRequest{}
+	err := BindToRequest[QueryRequest](`{"root_ids":[],"direction":"up"}`, r, UnpackData{UAD: &sec.UserAuthData{Uid: "0x1"}})
+	if err == nil || !strings.Contains(err.Error(), "direction must be one of") {
+		t.Errorf("an unknown direction should be rejected with the reason, got %v", err)
+	}
+}
+
+func TestQueryRequestShape(t *testing.T) {
+	for _, sh := range []string{"", SHAPE_FLAT, SHAPE_TREE} {
+		if !(&QueryRequest{Shape: sh}).Validate() {
+			t.Errorf("shape %q should validate", sh)
+		}
+	}
+	first := 10
+	for _, r := range []*QueryRequest{
+		{Shape: "graph"},
+		{Shape: SHAPE_TREE, First: &first},
+		{Shape: SHAPE_TREE, Similar: &QuerySimilarity{Vector: "[1]"}},
+	} {
+		if r.Validate() {
+			t.Errorf("%+v should be rejected", r)
+		}
+	}
+}
+
+func TestQueryRequestAggregate(t *testing.T) {
+	if !(&QueryRequest{Aggregate: &QueryAggregate{Count: true, Min: []string{"t1"}, GroupBy: []string{"ty", "s4"}}}).Validate() {
+		t.Error("a count with a min over t1 grouped by ty and s4 should validate")
+	}
+	first := 10
+	for _, r := range []*QueryRequest{
+		{Aggregate: &QueryAggregate{}},
+		{Aggregate: &QueryAggregate{Sum: []string{"t1"}}},
+		{Aggregate: &QueryAggregate{Max: []string{"s1"}}},
+		{Aggregate: &QueryAggregate{Count: true, GroupBy: []string{"p"}}},
+		{Aggregate: &QueryAggregate{Count: true, GroupBy: []string{"ty", "ty"}}},
+		{Aggregate: &QueryAggregate{Count: true}, First: &first},
+		{Aggregate: &QueryAggregate{Count: true}, Shape: SHAPE_TREE},
+	} {
+		if r.Validate() {
+			t.Errorf("%+v should be rejected", r.Aggregate)
+		}
+	}
+}
+
+func TestQueryRequestOrder(t *testing.T) {
+	r := &QueryRequest{}
+	if err := BindToRequest[QueryRequest](`{"root_ids":[],"order_by":"c","order_desc":true}`, r, UnpackData{UAD: &sec.UserAuthData{Uid: "0x1"}}); err != nil {
+		t.Fatalf("a single field name should still bind: %v", err)
+	}
+	if keys := r.OrderKeys(); len(keys) != 1 || keys[0].Field != "c" || !keys[0].Desc {
+		t.Errorf("order_desc should apply to the single key, got %+v", keys)
+	}
+	r = &QueryRequest{}
+	if err := BindToRequest[QueryRequest](`{"root_ids":[],"order_by":[{"field":"t1","desc":true},{"field":"c"}]}`, r, UnpackData{UAD: &sec.UserAuthData{Uid: "0x1"}}); err != nil {
+		t.Fatalf("a list of keys should bind: %v", err)
+	}
+	if keys := r.OrderKeys(); len(keys) != 2 || !keys[0].Desc || keys[1].Field != "c" || keys[1].Desc {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+
+	cursor, offset := "x", 5
+	two := QueryOrder{{Field: "t1"}, {Field: "c"}}
+	for _, r := range []*QueryRequest{
+		{OrderBy: append(two, two...)},
+		{OrderBy: two, OrderDesc: true},
+		{Cursor: &cursor, Offset: &offset},
+		{Cursor: &cursor, After: &cursor},
+		{Cursor: &cursor, Similar: &QuerySimilarity{Vector: "[1]"}},
+		{Aggregate: &QueryAggregate{Count: true}, OrderBy: two},
+	} {
+		if r.Validate() {
+			t.Errorf("%+v should be rejected", r)
+		}
+	}
+}
+
+func TestQueryRequestNearest(t *testing.T) {
+	first, offset := 10, 20
+	nearest := &QueryGeo{Mode: GEO_NEAREST, Point: []float64{0, 0}}
+	if !(&QueryRequest{Geo: nearest, First: &first, Offset: &offset}).Validate() {
+		t.Error("nearest should page with first and offset")
+	}
+	cursor, negative := "x", -1
+	for _, r := range []*QueryRequest{
+		{Geo: nearest, Cursor: &cursor},
+		{Geo: nearest, After: &cursor},
+		{Geo: nearest, OrderBy: QueryOrder{{Field: "c"}}},
+		{Geo: nearest, Aggregate: &QueryAggregate{Count: true}},
+		{Geo: nearest, First: &first, Offset: &negative},
+		{Geo: nearest, First: &negative},
+	} {
+		if r.Validate() {
+			t.Errorf("%+v should be rejected", r)
+		}
+	}
+}
+
+func TestQueryRequestSimilar(t *testing.T) {
+	first, offset := 5, 5
+	similar := &QuerySimilarity{Vector: "[1, 0]", TopK: 20}
+	if !(&QueryRequest{Similar: similar, RootIDs: []string{"0x1"}, Depth: 2, First: &first, Offset: &offset}).Validate() {
+		t.Error("similar should search a subgraph and page with first and offset")
+	}
+	if r := (&QueryRequest{Similar: &QuerySimilarity{Text: " oat milk "}}); !r.Validate() || r.Similar.Text != "oat milk" {
+		t.Error("similar should take text instead of a vector, trimmed")
+	}
+	after, negative := "0x1", -1
+	for _, r := range []*QueryRequest{
+		{Similar: similar, After: &after},
+		{Similar: similar, OrderBy: QueryOrder{{Field: "c"}}},
+		{Similar: similar, Aggregate: &QueryAggregate{Count: true}},
+		{Similar: similar, RootIDs: []string{"0x1"}, Depth: 2, WithDepth: true},
+		{Similar: similar, RootQuery: &QueryRequestClause{Field: "ty", Op: "eq", Val: "doc"}},
+		{Similar: &QuerySimilarity{}},
+		{Similar: &QuerySimilarity{Vector: "[1]", Text: "oat"}},
+		{Similar: &QuerySimilarity{Text: strings.Repeat("a", MAX_SEARCH_TEXT+1)}},
+		{Similar: similar, First: &first, Offset: &negative},
+		{Similar: similar, First: &negative},
+	} {
+		if r.Validate() {
+			t.Errorf("%+v should be rejected", r)
+		}
+	}
+}
+
+func TestQueryRequestCluster(t *testing.T) {
+	cluster := &QueryCluster{BBox: []float64{0, 0, 1, 1}, Precision: 4}
+	if !(&QueryRequest{Cluster: cluster, Filters: &QueryRequestClause{Field: "ty", Op: "eq", Val: "cafe"}}).Validate() {
+		t.Error("cluster with filters should validate")
+	}
+	first := 10
+	for _, r := range []*QueryRequest{
+		{Cluster: cluster, First: &first},
+		{Cluster: cluster, OrderBy: QueryOrder{{Field: "c"}}},
+		{Cluster: cluster, Aggregate: &QueryAggregate{Count: true}},
+		{Cluster: cluster, Geo: &QueryGeo{Point: []float64{0, 0}, Distance: 10}},
+		{Cluster: cluster, WithDepth: true},
+	} {
+		if r.Validate() {
+			t.Errorf("%+v should be rejected", r)
+		}
+	}
+}
+
+func TestSearchRequestValidate(t *testing.T) {
+	r := &SearchRequest{Text: "  invoice  "}
+	if !r.Validate() || r.Text != "invoice" {
+		t.Errorf("a plain search should validate and be trimmed, got %q", r.Text)
+	}
+	zero, big, neg := 0, MAX_SEARCH_PAGE+1, -1
+	for _, r := range []*SearchRequest{
+		{Text: "   "},
+		{Text: strings.Repeat("a", MAX_SEARCH_TEXT+1)},
+		{Text: "x", Mode: "regex"},
+		{Text: "x", First: &zero},
+		{Text: "x", First: &big},
+		{Text: "x", Offset: &neg},
+	} {
+		if r.Validate() {
+			t.Errorf("%+v should be rejected", r)
+		}
+	}
+}
+
+func TestSearchRequestHybrid(t *testing.T) {
+	similar := &QuerySimilarity{Vector: "[1, 0]"}
+	if !(&SearchRequest{Similar: similar}).Validate() {
+		t.Error("a hybrid search should not need text")
+	}
+	if !(&SearchRequest{Text: "x", Geo: &QueryGeo{Mode: GEO_NEAREST}, Fusion: &SearchFusion{Method: FUSION_WEIGHTED, K: 10}}).Validate() {
+		t.Error("text and geo should fuse by weight")
+	}
+	zero, neg := 0.0, -1.0
+	for _, r := range []*SearchRequest{
+		{Similar: &QuerySimilarity{Vector: "[1, 0]", TopK: 5}},
+		{Geo: &QueryGeo{Mode: GEO_WITHIN}},
+		{Text: "x", Fusion: &SearchFusion{}},
+		{Similar: similar, Fusion: &SearchFusion{Method: "max"}},
+		{Similar: similar, Fusion: &SearchFusion{K: -1}},
+		{Similar: similar, Fusion: &SearchFusion{Weights: &SearchWeights{Text: &neg}}},
+		{Text: "x", Similar: similar, Fusion: &SearchFusion{Weights: &SearchWeights{Text: &zero, Vector: &zero}}},
+	} {
+		if r.Validate() {
+			t.Errorf("%+v should be rejected", r)
+		}
+	}
+}
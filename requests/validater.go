@@ -6,3 +6,9 @@ package requests
 type Validater interface {
 	Validate() bool
 }
+
+// ValidationExplainer is implemented by requests that can say why Validate failed, so the
+// client gets a reason rather than a bare "unpack and validate failed".
+type ValidationExplainer interface {
+	ValidationError() string
+}
@@ -0,0 +1,31 @@
+package requests
+
+import (
+	sec "cogged/security"
+	"strings"
+)
+
+// VectorCheckRequest asks for the vec of every node, or of every node of type Type, to be
+// checked against its type's payload schema. With Reembed, each invalid one whose node has
+// text in the server's embed fields is replaced by a fresh embedding of it. It is only
+// accepted on the admin route group.
+type VectorCheckRequest struct {
+	Type    string `json:"ty,omitempty"`
+	Reembed bool   `json:"reembed,omitempty"`
+
+	validationErr string
+}
+
+// not applicable, as the request is admin only and carries no node or user ids
+func (req *VectorCheckRequest) AuthzDataUnpack(uad sec.UserAuthData, permissionsRequired string) bool {
+	return true
+}
+
+func (req *VectorCheckRequest) Validate() bool {
+	req.Type = strings.TrimSpace(req.Type)
+	return true
+}
+
+func (req *VectorCheckRequest) ValidationError() string {
+	return req.validationErr
+}
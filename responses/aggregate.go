@@ -0,0 +1,24 @@
+package responses
+
+import (
+	"time"
+)
+
+// AggregateGroup is one row of an aggregate query: the figures for the nodes that share the
+// Group values, or for every matching node when no group_by was given. Values is keyed
+// "count" for the node count and "<fn>_<field>" for the rest, e.g. "sum_n1" or "max_t1".
+// Min and max of t1/t2 are RFC 3339 timestamps, everything else is a number.
+type AggregateGroup struct {
+	Group  map[string]string      `json:"group,omitempty"`
+	Values map[string]interface{} `json:"values"`
+}
+
+func CoggedResponseFromAggregates(groups []*AggregateGroup) *CoggedResponse {
+
+	tnow := time.Now().UTC()
+	cr := CoggedResponse{
+		Aggregates: groups,
+		ServerTime: &tnow,
+	}
+	return &cr
+}
@@ -0,0 +1,42 @@
+package responses
+
+import "time"
+
+// BlobResponse describes the blob a node's b was just set to refer to, returned by
+// PUT /blob/data/{ad} and by the PATCH that completes a resumable upload.
+type BlobResponse struct {
+	Blob       string     `json:"b"`
+	SHA256     string     `json:"sha256"`
+	Size       int64      `json:"size"`
+	ServerTime *time.Time `json:"timestamp"`
+}
+
+// BlobUploadResponse reports how far a resumable upload has got: the next chunk is sent at
+// Offset. Blob is set once the last chunk is in and the blob attached to its node.
+type BlobUploadResponse struct {
+	UploadID   string        `json:"upload_id"`
+	Offset     int64         `json:"offset"`
+	Size       int64         `json:"size"`
+	Expires    *time.Time    `json:"expires,omitempty"`
+	Blob       *BlobResponse `json:"blob,omitempty"`
+	ServerTime *time.Time    `json:"timestamp"`
+}
+
+// BlobGCResponse reports a garbage collection of the blob store, returned by
+// POST /admin/blobs. Kept counts the blobs no node refers to that are still within their
+// grace period.
+type BlobGCResponse struct {
+	DryRun         bool       `json:"dry_run"`
+	Referenced     int        `json:"referenced"`
+	Deleted        int        `json:"deleted"`
+	FreedBytes     int64      `json:"freed_bytes"`
+	Kept           int        `json:"kept"`
+	ExpiredUploads int        `json:"expired_uploads"`
+	ServerTime     *time.Time `json:"timestamp"`
+	Error          string     `json:"error,omitempty"`
+}
+
+func BlobGCResponseFromError(e string) *BlobGCResponse {
+	tnow := time.Now().UTC()
+	return &BlobGCResponse{Error: e, ServerTime: &tnow}
+}
@@ -0,0 +1,25 @@
+package responses
+
+import (
+	"time"
+)
+
+// GeoCluster is one cell of a cluster query: how many of the matching nodes lie in the
+// geohash cell, and where they are on average. Centroid is [longitude, latitude] and BBox
+// is the cell's [west, south, east, north], for zooming in on the cluster.
+type GeoCluster struct {
+	Geohash  string    `json:"geohash"`
+	Count    int       `json:"count"`
+	Centroid []float64 `json:"centroid"`
+	BBox     []float64 `json:"bbox"`
+}
+
+func CoggedResponseFromClusters(clusters []*GeoCluster) *CoggedResponse {
+
+	tnow := time.Now().UTC()
+	cr := CoggedResponse{
+		Clusters:   clusters,
+		ServerTime: &tnow,
+	}
+	return &cr
+}
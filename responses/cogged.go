@@ -12,18 +12,39 @@ type CoggedResponse struct {
 	ResultUsers  []*cm.GraphUser      `json:"result_users,omitempty"`
 	CreatedNodes cm.NodePtrDictionary `json:"created_nodes,omitempty"`
 	CreatedUids  map[string]string    `json:"created_uids,omitempty"`
-	ServerTime   *time.Time           `json:"timestamp"`
-	Error        string               `json:"error,omitempty"`
+	// Upserted says whether each node of an upsert by id was "created" or "updated", by
+	// the placeholder uid it was sent with, as CreatedNodes is keyed.
+	Upserted   map[string]string `json:"upserted,omitempty"`
+	Aggregates []*AggregateGroup `json:"aggregates,omitempty"`
+	Clusters   []*GeoCluster     `json:"clusters,omitempty"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+	HasMore    bool              `json:"has_more,omitempty"`
+	Snapshot   string            `json:"snapshot,omitempty"`
+	ServerTime *time.Time        `json:"timestamp"`
+	Error      string            `json:"error,omitempty"`
+
+	// PageEnd is where a page of results ended when HasMore is set. AuthzDataPack signs
+	// it into NextCursor.
+	PageEnd *cm.PageCursor `json:"-"`
+	// ReadAt is the snapshot a page of results was read at. AuthzDataPack signs it into
+	// Snapshot.
+	ReadAt *cm.ReadSnapshot `json:"-"`
+}
+
+// nodeReadableBy reports whether uad may read node: it owns the node, is an admin, or has
+// been granted the node's share group and the node's r bit is set.
+func nodeReadableBy(node *cm.GraphNode, uad *sec.UserAuthData) bool {
+	owner := node.Owner
+	return (owner != nil && owner.Uid == uad.Uid) ||
+		uad.IsAdmin() ||
+		(node.Sgi != nil && state.UsmUserCanAccessSgi(uad.Uid, *node.Sgi) && node.PermRead != nil && *node.PermRead)
 }
 
 func (resp *CoggedResponse) AuthzDataPack(uad *sec.UserAuthData) {
 	if resp.ResultNodes != nil {
 		filteredNodes := []*cm.GraphNode{}
 		for _, node := range resp.ResultNodes {
-			owner := node.Owner
-			if (owner != nil && owner.Uid == uad.Uid) ||
-				uad.IsAdmin() ||
-				(node.Sgi != nil && state.UsmUserCanAccessSgi(uad.Uid, *node.Sgi) && node.PermRead != nil && *node.PermRead) {
+			if nodeReadableBy(node, uad) {
 				// A node reached through a share edge is readable, but `p` belongs to its
 				// owner: strip it for anyone who is neither the owner nor a sys-role admin.
 				node.RedactPrivateDataFor(uad)
@@ -51,6 +72,13 @@ func (resp *CoggedResponse) AuthzDataPack(uad *sec.UserAuthData) {
 		}
 	}
 
+	if resp.PageEnd != nil {
+		resp.NextCursor = resp.PageEnd.Pack(uad)
+	}
+	if resp.ReadAt != nil {
+		resp.Snapshot = resp.ReadAt.Pack(uad)
+	}
+
 	// CreatedUids is only sent by PUT /admin/user so no need to do AuthzDataPack
 }
 
@@ -1,8 +1,11 @@
 package responses
 
 import (
+	"encoding/json"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	cm "cogged/models"
 	sec "cogged/security"
@@ -55,6 +58,25 @@ func TestAuthzDataPackKeepsPrivateDataForOwner(t *testing.T) {
 	}
 }
 
+func TestAuthzDataPackSignsNextCursor(t *testing.T) {
+	uad := &sec.UserAuthData{Uid: "0xowner", Role: "user", SecretKey: newKey(t)}
+	resp := &CoggedResponse{HasMore: true, PageEnd: &cm.PageCursor{Order: []string{"c"}, Vals: []string{"x"}, Uid: "0x2a"},
+		ReadAt: &cm.ReadSnapshot{Ts: 31337, Expires: time.Now().Add(time.Minute).Unix()}}
+	resp.AuthzDataPack(uad)
+
+	c := cm.PageCursorFromString(resp.NextCursor, uad.SecretKey)
+	if c == nil || c.Uid != "0x2a" {
+		t.Fatalf("expected next_cursor to hold the page end, got %q", resp.NextCursor)
+	}
+	if s := cm.ReadSnapshotFromString(resp.Snapshot, uad.SecretKey); s == nil || s.Ts != 31337 {
+		t.Fatalf("expected snapshot to hold the read timestamp, got %q", resp.Snapshot)
+	}
+	data, _ := json.Marshal(resp)
+	if strings.Contains(string(data), "0x2a") || strings.Contains(string(data), "31337") {
+		t.Error("the page end and read timestamp should only go out signed")
+	}
+}
+
 func TestAuthzDataPackKeepsPrivateDataForAdmin(t *testing.T) {
 	uad := &sec.UserAuthData{Uid: "0xadmin", Role: sec.SYS_ROLE, SecretKey: newKey(t)}
 	n := readableNode("0xabc", "0xowner", "sgi-1")
@@ -131,3 +153,22 @@ func TestAuthzDataPackDropsUnreadableNode(t *testing.T) {
 		t.Fatalf("unreadable node should be dropped, got %d nodes", len(resp.ResultNodes))
 	}
 }
+
+// A path is all or nothing: one unreadable node hides the whole path, not just that node.
+func TestPathResponseDropsPathsThroughUnreadableNodes(t *testing.T) {
+	uad := &sec.UserAuthData{Uid: "0xreader", Role: "user", SecretKey: newKey(t)}
+	mine := func(uid string) *cm.GraphNode { return readableNode(uid, "0xreader", "sgi-p") }
+	hidden := readableNode("0xh", "0xother", "sgi-not-granted")
+
+	resp := PathResponseFromPaths([]*NodePath{
+		{Nodes: []*cm.GraphNode{mine("0x1"), mine("0x2")}, Hops: 1},
+		{Nodes: []*cm.GraphNode{mine("0x1"), hidden, mine("0x2")}, Hops: 2},
+	})
+	resp.AuthzDataPack(uad)
+	if len(resp.Paths) != 1 || resp.Paths[0].Hops != 1 {
+		t.Fatalf("the path through the unreadable node should be dropped, got %+v", resp.Paths)
+	}
+	if resp.Paths[0].Nodes[0].AuthzData == "" {
+		t.Error("nodes on a returned path should be signed")
+	}
+}
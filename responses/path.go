@@ -0,0 +1,57 @@
+package responses
+
+import (
+	cm "cogged/models"
+	sec "cogged/security"
+	"time"
+)
+
+// NodePath is one path between two nodes, in order from the first node to the last.
+type NodePath struct {
+	Nodes []*cm.GraphNode `json:"nodes"`
+	Hops  int             `json:"hops"`
+}
+
+type PathResponse struct {
+	Paths      []*NodePath `json:"paths"`
+	ServerTime *time.Time  `json:"timestamp"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func PathResponseFromPaths(paths []*NodePath) *PathResponse {
+	tnow := time.Now().UTC()
+	for _, p := range paths {
+		for _, node := range p.Nodes {
+			node.DgraphType = nil
+		}
+	}
+	return &PathResponse{Paths: paths, ServerTime: &tnow}
+}
+
+func PathResponseFromError(e string) *PathResponse {
+	tnow := time.Now().UTC()
+	return &PathResponse{Paths: []*NodePath{}, Error: e, ServerTime: &tnow}
+}
+
+// AuthzDataPack drops every path that passes through a node the caller may not read, so
+// that even the existence of such a route is not revealed, then signs the nodes of the
+// rest. The query already only follows readable nodes; this is defense-in-depth, as for
+// CoggedResponse.
+func (resp *PathResponse) AuthzDataPack(uad *sec.UserAuthData) {
+	filtered := []*NodePath{}
+	for _, p := range resp.Paths {
+		readable := true
+		for _, node := range p.Nodes {
+			readable = readable && nodeReadableBy(node, uad)
+		}
+		if !readable {
+			continue
+		}
+		for _, node := range p.Nodes {
+			node.RedactPrivateDataFor(uad)
+			node.AuthzDataPack(uad)
+		}
+		filtered = append(filtered, p)
+	}
+	resp.Paths = filtered
+}
@@ -0,0 +1,21 @@
+package responses
+
+import (
+	cm "cogged/models"
+)
+
+// PayloadSchemasResponse lists every registered payload schema, ordered by ty. It is
+// returned by GET /admin/schemas and, reflecting the change, by PUT and DELETE
+// /admin/schema.
+type PayloadSchemasResponse struct {
+	Schemas []*cm.PayloadSchema `json:"schemas"`
+	Error   string              `json:"error,omitempty"`
+}
+
+func PayloadSchemasResponseFromError(e string) *PayloadSchemasResponse {
+	return &PayloadSchemasResponse{Error: e}
+}
+
+func PayloadSchemasResponseFromRegistry() *PayloadSchemasResponse {
+	return &PayloadSchemasResponse{Schemas: cm.PayloadSchemaList()}
+}
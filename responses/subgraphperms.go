@@ -0,0 +1,54 @@
+package responses
+
+import (
+	cm "cogged/models"
+	sec "cogged/security"
+	"time"
+)
+
+// ShareeAccessChange counts the affected nodes a user the subgraph is shared with can read
+// after a bulk permission/share group change but could not before (Gained), and vice versa
+// (Lost).
+type ShareeAccessChange struct {
+	User   *cm.GraphUser `json:"user"`
+	Gained int           `json:"gained"`
+	Lost   int           `json:"lost"`
+
+	// share groups the user's session allowlist needs adding/removing once the change is
+	// written; never sent to the client
+	SgisGranted []string `json:"-"`
+	SgisRevoked []string `json:"-"`
+}
+
+type SubgraphPermsResponse struct {
+	DryRun        bool                  `json:"dry_run"`
+	AffectedNodes int                   `json:"affected_nodes"`
+	ResultNodes   []*cm.GraphNode       `json:"result_nodes,omitempty"`
+	Sharees       []*ShareeAccessChange `json:"sharees,omitempty"`
+	ServerTime    *time.Time            `json:"timestamp"`
+	Error         string                `json:"error,omitempty"`
+}
+
+func SubgraphPermsResponseFromError(e string) *SubgraphPermsResponse {
+	tnow := time.Now().UTC()
+	return &SubgraphPermsResponse{Error: e, ServerTime: &tnow}
+}
+
+// AuthzDataPack re-signs the updated nodes, whose AuthzData changes with their permission
+// bits and share group. Only the owner (or sys) can make this request, so every node is
+// theirs to see.
+func (resp *SubgraphPermsResponse) AuthzDataPack(uad *sec.UserAuthData) {
+	for _, node := range resp.ResultNodes {
+		node.DgraphType = nil
+		node.AuthzDataPack(uad)
+	}
+	filtered := []*ShareeAccessChange{}
+	for _, sc := range resp.Sharees {
+		if sc.User != nil && (uad.IsAdmin() || sc.User.Role == nil || *sc.User.Role != sec.SYS_ROLE) {
+			sc.User.DgraphType = nil
+			sc.User.AuthzDataPack(uad)
+			filtered = append(filtered, sc)
+		}
+	}
+	resp.Sharees = filtered
+}
@@ -0,0 +1,29 @@
+package responses
+
+import "time"
+
+// InvalidVector is a node whose vec could not be used: Reason says why. Reembedded is set
+// when the check replaced it with a fresh embedding of the node's text.
+type InvalidVector struct {
+	Uid        string `json:"uid"`
+	Type       string `json:"ty,omitempty"`
+	Dims       int    `json:"dims,omitempty"`
+	Reason     string `json:"reason"`
+	Reembedded bool   `json:"reembedded,omitempty"`
+}
+
+// VectorCheckResponse reports a check of every stored vec, returned by POST /admin/vectors.
+// Invalid lists the first of the Found invalid vectors.
+type VectorCheckResponse struct {
+	Checked    int              `json:"checked"`
+	Found      int              `json:"invalid_count"`
+	Invalid    []*InvalidVector `json:"invalid"`
+	Reembedded int              `json:"reembedded"`
+	ServerTime *time.Time       `json:"timestamp"`
+	Error      string           `json:"error,omitempty"`
+}
+
+func VectorCheckResponseFromError(e string) *VectorCheckResponse {
+	tnow := time.Now().UTC()
+	return &VectorCheckResponse{Error: e, ServerTime: &tnow}
+}
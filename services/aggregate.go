@@ -0,0 +1,132 @@
+package services
+
+import (
+	"cogged/log"
+	req "cogged/requests"
+	res "cogged/responses"
+	"encoding/json"
+	"strings"
+)
+
+// renderAggregateVars renders the body of the AGG var block that holds the nodes an
+// aggregate query matched. Sums, minimums and so on, grouped or not, are taken over value
+// variables, one per field, named AG_<field>.
+func renderAggregateVars(a *req.QueryAggregate) string {
+	seen := make(map[string]bool)
+	vars := []string{}
+	for _, f := range a.Functions() {
+		field := renderField(f.Field)
+		if field != "" && !seen[field] {
+			seen[field] = true
+			vars = append(vars, "AG_"+field+" as "+field)
+		}
+	}
+	if len(vars) == 0 {
+		return "uid"
+	}
+	return strings.Join(vars, " ")
+}
+
+// renderAggregateBlocks renders the blocks that compute the aggregates over AGG: ct for
+// the count and av for the rest, or a single @groupby block gb when grouping. Inside
+// @groupby Dgraph only counts uids and aggregates value variables, so each group's sum and
+// so on is taken over the AG_<field> variable, as in the ungrouped av block.
+func renderAggregateBlocks(a *req.QueryAggregate) string {
+	if len(a.GroupBy) > 0 {
+		by := []string{}
+		for _, g := range a.GroupBy {
+			if f := renderField(g); f != "" {
+				by = append(by, f)
+			}
+		}
+		fns := []string{}
+		if a.Count {
+			fns = append(fns, "count(uid)")
+		}
+		for _, f := range a.Functions() {
+			if field := renderField(f.Field); field != "" {
+				fns = append(fns, f.Fn+"_"+field+": "+f.Fn+"(val(AG_"+field+"))")
+			}
+		}
+		return `
+			gb(func: uid(AGG)) @groupby(` + strings.Join(by, ", ") + `) {
+				` + strings.Join(fns, " ") + `
+			}`
+	}
+	blocks := ""
+	if a.Count {
+		blocks += `
+			ct(func: uid(AGG)) { count: count(uid) }`
+	}
+	fns := []string{}
+	for _, f := range a.Functions() {
+		if field := renderField(f.Field); field != "" {
+			fns = append(fns, f.Fn+"_"+field+": "+f.Fn+"(val(AG_"+field+"))")
+		}
+	}
+	if len(fns) > 0 {
+		blocks += `
+			av() {
+				` + strings.Join(fns, "\n\t\t\t\t") + `
+			}`
+	}
+	return blocks
+}
+
+// parseAggregates reads the ct/av or gb blocks of an aggregate query result. The @groupby
+// aggregates are aliased to the "sum_n1" form the ungrouped figures use; one that comes
+// back named after its function instead, e.g. "sum(val(AG_n1))", is turned into that form
+// too. A figure with nothing to aggregate over (a sum
+// of nodes that have no n1, say) is left out of Values.
+func parseAggregates(result *string, a *req.QueryAggregate) ([]*res.AggregateGroup, error) {
+	var r struct {
+		CT []map[string]interface{} `json:"ct"`
+		AV []map[string]interface{} `json:"av"`
+		GB []struct {
+			Groups []map[string]interface{} `json:"@groupby"`
+		} `json:"gb"`
+	}
+	if err := json.Unmarshal([]byte(*result), &r); err != nil {
+		log.Error("unmarshal aggregates", err)
+		return nil, err
+	}
+
+	if len(a.GroupBy) == 0 {
+		g := &res.AggregateGroup{Values: make(map[string]interface{})}
+		// each aggregate in an empty root block comes back as an object of its own
+		for _, list := range [][]map[string]interface{}{r.CT, r.AV} {
+			for _, o := range list {
+				for k, v := range o {
+					g.Values[k] = v
+				}
+			}
+		}
+		return []*res.AggregateGroup{g}, nil
+	}
+
+	groupFields := make(map[string]bool)
+	for _, f := range a.GroupBy {
+		groupFields[f] = true
+	}
+	groups := []*res.AggregateGroup{}
+	for _, gb := range r.GB {
+		for _, o := range gb.Groups {
+			g := &res.AggregateGroup{Group: make(map[string]string), Values: make(map[string]interface{})}
+			for k, v := range o {
+				if groupFields[k] {
+					if s, ok := v.(string); ok {
+						g.Group[k] = s
+					}
+					continue
+				}
+				if fn, arg, ok := strings.Cut(strings.TrimSuffix(k, ")"), "("); ok {
+					arg = strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(arg, "val("), ")"), "AG_")
+					k = fn + "_" + arg
+				}
+				g.Values[k] = v
+			}
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
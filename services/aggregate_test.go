@@ -0,0 +1,74 @@
+package services
+
+import (
+	req "cogged/requests"
+	sec "cogged/security"
+	"strings"
+	"testing"
+)
+
+func TestQueryWithOptionsAggregate(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"ct":[{"count":3}],"av":[{"sum_n1":7.5},{"max_t1":"2024-05-01T00:00:00Z"}]}`)}
+	q := &req.QueryRequest{
+		RootIDs:   []string{"0x1"},
+		Depth:     3,
+		Filters:   &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "Task"},
+		Select:    []string{"s1"},
+		Aggregate: &req.QueryAggregate{Count: true, Sum: []string{"n1"}, Max: []string{"t1"}},
+	}
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, &sec.UserAuthData{Uid: "0x9", Role: "user"}, []string{"sg1"})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	for _, want := range []string{
+		"AGG as var(func: uid(NID))  @filter((eq(ty,",
+		"uid_in(own, 0x9)",
+		"AG_n1 as n1 AG_t1 as t1",
+		"ct(func: uid(AGG)) { count: count(uid) }",
+		"sum_n1: sum(val(AG_n1))",
+		"max_t1: max(val(AG_t1))",
+	} {
+		if !strings.Contains(fake.lastQuery, want) {
+			t.Errorf("expected %q in query:\n%s", want, fake.lastQuery)
+		}
+	}
+	if strings.Contains(fake.lastQuery, "qr(func") || strings.Contains(fake.lastQuery, "s1") {
+		t.Errorf("an aggregate query should not return nodes:\n%s", fake.lastQuery)
+	}
+	if len(resp.ResultNodes) != 0 || len(resp.Aggregates) != 1 {
+		t.Fatalf("expected one aggregate row and no nodes, got %+v", resp)
+	}
+	v := resp.Aggregates[0].Values
+	if v["count"] != 3.0 || v["sum_n1"] != 7.5 || v["max_t1"] != "2024-05-01T00:00:00Z" {
+		t.Errorf("unexpected values %v", v)
+	}
+}
+
+func TestQueryWithOptionsAggregateGroupBy(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"gb":[{"@groupby":[
+		{"s3":"a","count":2,"sum_n1":3},
+		{"s3":"b","count":1,"sum(val(AG_n1))":4}]}]}`)}
+	q := &req.QueryRequest{
+		RootIDs:   []string{"0x1"},
+		Aggregate: &req.QueryAggregate{Count: true, Sum: []string{"n1"}, GroupBy: []string{"s3"}},
+	}
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	if !strings.Contains(fake.lastQuery, "gb(func: uid(AGG)) @groupby(s3) {") ||
+		!strings.Contains(fake.lastQuery, "AG_n1 as n1") ||
+		!strings.Contains(fake.lastQuery, "count(uid) sum_n1: sum(val(AG_n1))") {
+		t.Errorf("expected a groupby block:\n%s", fake.lastQuery)
+	}
+	if len(resp.Aggregates) != 2 {
+		t.Fatalf("expected two groups, got %+v", resp.Aggregates)
+	}
+	g := resp.Aggregates[1]
+	if g.Group["s3"] != "b" || g.Values["count"] != 1.0 || g.Values["sum_n1"] != 4.0 {
+		t.Errorf("unexpected group %+v", g)
+	}
+	if _, ok := g.Values["s3"]; ok {
+		t.Error("the group key should not be repeated among the values")
+	}
+}
@@ -0,0 +1,273 @@
+package services
+
+import (
+	"cogged/log"
+	cm "cogged/models"
+	res "cogged/responses"
+	sec "cogged/security"
+	"fmt"
+	"io"
+	"time"
+)
+
+// BLOB_GC_CHUNK is how many nodes with a b garbage collection reads at a time.
+const BLOB_GC_CHUNK = 1000
+
+func (db *DB) blobs() (*Blobs, error) {
+	if db.Blobs == nil || db.Blobs.Store == nil {
+		return nil, BlobError{Info: "blob storage is not configured", Kind: BLOB_ERR_NOT_FOUND}
+	}
+	return db.Blobs, nil
+}
+
+// attachBlob sets the b of node uid to refer to a stored blob. It goes through
+// UpsertNodes, so the payload schema of the node's type must allow b to be set.
+func (db *DB) attachBlob(uid string, info *BlobInfo) (*res.BlobResponse, error) {
+	ref := cm.BlobRef(info.SHA256)
+	cr, err := db.UpsertNodes(&[]*cm.GraphNode{{GraphBase: cm.GraphBase{Uid: uid}, Blob: &ref}})
+	if err != nil {
+		return nil, err
+	}
+	if cr.Error != "" {
+		return nil, DBError{Info: cr.Error}
+	}
+	tnow := time.Now().UTC()
+	return &res.BlobResponse{Blob: ref, SHA256: info.SHA256, Size: info.Size, ServerTime: &tnow}, nil
+}
+
+// PutNodeBlob stores the content read from r, which must hash to wantSum if that is not
+// "", and sets the b of node uid to refer to it.
+func (db *DB) PutNodeBlob(uid string, r io.Reader, wantSum string) (*res.BlobResponse, error) {
+	b, err := db.blobs()
+	if err != nil {
+		return nil, err
+	}
+	info, err := b.Store.Put(r, b.MaxSize, wantSum)
+	if err != nil {
+		return nil, err
+	}
+	return db.attachBlob(uid, info)
+}
+
+// OpenNodeBlob opens the blob the b of node uid refers to. The node must be readable by
+// uad, checked against the DB as a query would be.
+func (db *DB) OpenNodeBlob(uid string, uad *sec.UserAuthData, allowedSgis []string) (io.ReadSeekCloser, *BlobInfo, error) {
+	b, err := db.blobs()
+	if err != nil {
+		return nil, nil, err
+	}
+	vars := map[string]string{"$id": SanitiseUID(uid)}
+	filter := ""
+	if authz := renderReadAuthzFilter(NODENODE, uad, allowedSgis); authz != "" {
+		filter = " @filter(" + authz + ")"
+	}
+	query := `query q($id: string) {
+		qr(func: uid($id))` + filter + ` {
+			uid b
+		}
+	}`
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, nil, DBError{Info: "DB query failed"}
+	}
+	nodes := SliceFromResultJSON[cm.GraphNode](sp)
+	if nodes == nil {
+		return nil, nil, DBError{Info: "could not parse query result"}
+	}
+	sum := ""
+	if len(*nodes) == 1 {
+		sum = cm.BlobRefSum((*nodes)[0].Blob)
+	}
+	if sum == "" {
+		return nil, nil, BlobError{Info: "node has no blob", Kind: BLOB_ERR_NOT_FOUND}
+	}
+	return b.Store.Open(sum)
+}
+
+func uploadResponse(b *Blobs, u *BlobUpload) *res.BlobUploadResponse {
+	tnow := time.Now().UTC()
+	expires := u.Created.Add(b.UploadExpiry).UTC()
+	return &res.BlobUploadResponse{UploadID: u.ID, Offset: u.Offset, Size: u.Size, Expires: &expires, ServerTime: &tnow}
+}
+
+// StartBlobUpload starts a resumable upload by user userUid of size bytes, hashing to sum,
+// to be attached to node uid once complete.
+func (db *DB) StartBlobUpload(uid, userUid string, size int64, sum string) (*res.BlobUploadResponse, error) {
+	b, err := db.blobs()
+	if err != nil {
+		return nil, err
+	}
+	if size > b.MaxSize {
+		return nil, tooLarge(b.MaxSize)
+	}
+	id, err := sec.GenerateGuid()
+	if err != nil {
+		return nil, err
+	}
+	u := &BlobUpload{ID: id, NodeUid: uid, UserUid: userUid, Size: size, SHA256: sum, Created: time.Now().UTC()}
+	if err := b.Store.CreateUpload(u); err != nil {
+		return nil, err
+	}
+	return uploadResponse(b, u), nil
+}
+
+// userUpload gets upload id for the user who started it. To anyone else, and once it has
+// expired, it does not exist.
+func (db *DB) userUpload(b *Blobs, id, userUid string) (*BlobUpload, error) {
+	u, err := b.Store.GetUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.UserUid != userUid {
+		return nil, uploadNotFound()
+	}
+	if time.Since(u.Created) > b.UploadExpiry {
+		b.Store.DeleteUpload(id)
+		return nil, uploadNotFound()
+	}
+	return u, nil
+}
+
+// BlobUploadStatus reports how far upload id has got, so an interrupted upload can be
+// resumed from its Offset.
+func (db *DB) BlobUploadStatus(id, userUid string) (*res.BlobUploadResponse, error) {
+	b, err := db.blobs()
+	if err != nil {
+		return nil, err
+	}
+	u, err := db.userUpload(b, id, userUid)
+	if err != nil {
+		return nil, err
+	}
+	return uploadResponse(b, u), nil
+}
+
+// AppendBlobUpload adds the chunk read from r at offset to upload id. The chunk that
+// completes it commits the upload as a blob and attaches that to the upload's node.
+func (db *DB) AppendBlobUpload(id, userUid string, offset int64, r io.Reader) (*res.BlobUploadResponse, error) {
+	b, err := db.blobs()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.userUpload(b, id, userUid); err != nil {
+		return nil, err
+	}
+	u, err := b.Store.AppendUpload(id, offset, r)
+	if err != nil {
+		return nil, err
+	}
+	resp := uploadResponse(b, u)
+	if u.Offset < u.Size {
+		return resp, nil
+	}
+	info, err := b.Store.CommitUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Blob, err = db.attachBlob(u.NodeUid, info); err != nil {
+		return nil, err
+	}
+	resp.Expires = nil
+	return resp, nil
+}
+
+// AbortBlobUpload deletes upload id and the data it has so far.
+func (db *DB) AbortBlobUpload(id, userUid string) (*res.BlobUploadResponse, error) {
+	b, err := db.blobs()
+	if err != nil {
+		return nil, err
+	}
+	u, err := db.userUpload(b, id, userUid)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Store.DeleteUpload(id); err != nil {
+		return nil, err
+	}
+	resp := uploadResponse(b, u)
+	resp.Expires = nil
+	return resp, nil
+}
+
+// CollectBlobGarbage deletes every stored blob that no node's b refers to and that was
+// stored longer ago than the grace period, and every resumable upload that has expired.
+// The references are read a chunk at a time at one Dgraph timestamp before the store is
+// walked, so a blob attached after that was stored after it too, and is within its grace.
+func (db *DB) CollectBlobGarbage(dryRun bool) *res.BlobGCResponse {
+	b, err := db.blobs()
+	if err != nil {
+		return res.BlobGCResponseFromError(err.Error())
+	}
+	tnow := time.Now().UTC()
+	resp := &res.BlobGCResponse{DryRun: dryRun, ServerTime: &tnow}
+	referenced := make(map[string]bool)
+	vars := make(map[string]string)
+	var ts uint64
+	after := ""
+	for {
+		page := ""
+		if after != "" {
+			page = ", after: " + SanitiseUID(after)
+		}
+		query := `query q() {
+		qr(func: has(b), first: ` + fmt.Sprintf("%d", BLOB_GC_CHUNK) + page + `) {
+			uid b
+		}
+	}`
+		sp, readTs, err := db.QueryAt(query, &vars, ts)
+		if err != nil {
+			return res.BlobGCResponseFromError("DB query failed")
+		}
+		ts = readTs
+		nodes := SliceFromResultJSON[cm.GraphNode](sp)
+		if nodes == nil {
+			return res.BlobGCResponseFromError("could not parse query result")
+		}
+		for _, n := range *nodes {
+			if sum := cm.BlobRefSum(n.Blob); sum != "" {
+				referenced[sum] = true
+			}
+		}
+		if len(*nodes) < BLOB_GC_CHUNK {
+			break
+		}
+		after = (*nodes)[len(*nodes)-1].Uid
+	}
+	resp.Referenced = len(referenced)
+
+	cutoff := tnow.Add(-b.GCGrace)
+	err = b.Store.Walk(func(info *BlobInfo) error {
+		if referenced[info.SHA256] {
+			return nil
+		}
+		if info.ModTime.After(cutoff) {
+			resp.Kept++
+			return nil
+		}
+		if !dryRun {
+			if err := b.Store.Delete(info.SHA256); err != nil {
+				return err
+			}
+		}
+		resp.Deleted++
+		resp.FreedBytes += info.Size
+		return nil
+	})
+	if err == nil {
+		err = b.Store.WalkUploads(func(u *BlobUpload) error {
+			if tnow.Sub(u.Created) <= b.UploadExpiry {
+				return nil
+			}
+			resp.ExpiredUploads++
+			if dryRun {
+				return nil
+			}
+			return b.Store.DeleteUpload(u.ID)
+		})
+	}
+	if err != nil {
+		log.Error("blob garbage collection", err)
+		resp.Error = "blob store operation failed"
+	}
+	return resp
+}
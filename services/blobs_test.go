@@ -0,0 +1,186 @@
+package services
+
+import (
+	"bytes"
+	cm "cogged/models"
+	sec "cogged/security"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/dgo/v250/protos/api"
+)
+
+func newBlobDB(t *testing.T, fake *fakeClient) *DB {
+	t.Helper()
+	db := newFakeDB(fake)
+	store, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Blobs = &Blobs{Store: store, MaxSize: 64, UploadExpiry: time.Hour, GCGrace: time.Hour}
+	return db
+}
+
+func mutatedBlob(t *testing.T, fake *fakeClient) map[string]interface{} {
+	t.Helper()
+	var written []map[string]interface{}
+	if err := json.Unmarshal(fake.lastMutation.SetJson, &written); err != nil || len(written) != 1 {
+		t.Fatalf("expected one node written, got %s", fake.lastMutation.SetJson)
+	}
+	return written[0]
+}
+
+func TestPutNodeBlob(t *testing.T) {
+	fake := &fakeClient{mutateResp: &api.Response{}}
+	db := newBlobDB(t, fake)
+	data := []byte("attachment")
+
+	br, err := db.PutNodeBlob("0x5", bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if br.Blob != cm.BlobRef(hexSum(data)) || br.Size != int64(len(data)) {
+		t.Errorf("unexpected response %+v", br)
+	}
+	if n := mutatedBlob(t, fake); n["uid"] != "0x5" || n["b"] != br.Blob {
+		t.Errorf("expected the reference written to 0x5's b, got %v", n)
+	}
+	if _, err := newFakeDB(&fakeClient{}).PutNodeBlob("0x5", bytes.NewReader(data), ""); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("expected blob storage to be off, got %v", err)
+	}
+}
+
+func TestPutNodeBlobChecksSchema(t *testing.T) {
+	cm.SetPayloadSchemas([]*cm.PayloadSchema{{Type: "note", Slots: map[string]*cm.SlotRule{"s1": {}}}})
+	defer cm.SetPayloadSchemas(nil)
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[{"uid":"0x5","ty":"note"}]}`)}
+	_, err := newBlobDB(t, fake).PutNodeBlob("0x5", strings.NewReader("x"), "")
+	if _, ok := err.(PolicyError); !ok || fake.lastMutation != nil {
+		t.Errorf("a type whose schema has no b slot should not get a blob, got %v", err)
+	}
+}
+
+func TestOpenNodeBlob(t *testing.T) {
+	data := []byte("attachment")
+	ref := cm.BlobRef(hexSum(data))
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[{"uid":"0x5","b":"` + ref + `"}]}`)}
+	db := newBlobDB(t, fake)
+	db.Blobs.Store.Put(bytes.NewReader(data), 64, "")
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+
+	f, info, err := db.OpenNodeBlob("0x5", reader, []string{"sg1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.Close()
+	if info.SHA256 != hexSum(data) {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if !strings.Contains(fake.lastQuery, `@filter((uid_in(own, 0x9) OR (eq(sgi, ["sg1"]) AND eq(r, true))))`) {
+		t.Errorf("the node should be read with the caller's read permissions:\n%s", fake.lastQuery)
+	}
+	for _, answer := range []string{`{"qr":[]}`, `{"qr":[{"uid":"0x5","b":"inline text"}]}`} {
+		fake.queryJSON = []byte(answer)
+		if _, _, err := db.OpenNodeBlob("0x5", reader, nil); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+			t.Errorf("%s: expected not found, got %v", answer, err)
+		}
+	}
+}
+
+func TestBlobUpload(t *testing.T) {
+	fake := &fakeClient{mutateResp: &api.Response{}}
+	db := newBlobDB(t, fake)
+	data := []byte("resumable")
+
+	if _, err := db.StartBlobUpload("0x5", "0x2", 65, hexSum(data)); blobErrKind(err) != BLOB_ERR_TOO_LARGE {
+		t.Errorf("expected an upload over the max size rejected, got %v", err)
+	}
+	ur, err := db.StartBlobUpload("0x5", "0x2", int64(len(data)), hexSum(data))
+	if err != nil || ur.UploadID == "" || ur.Offset != 0 || ur.Expires == nil {
+		t.Fatalf("unexpected start %+v %v", ur, err)
+	}
+	if _, err := db.BlobUploadStatus(ur.UploadID, "0x3"); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("another user should not see the upload, got %v", err)
+	}
+	if _, err := db.AppendBlobUpload(ur.UploadID, "0x3", 0, bytes.NewReader(data)); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("another user should not append to the upload, got %v", err)
+	}
+	if got, err := db.AppendBlobUpload(ur.UploadID, "0x2", 0, bytes.NewReader(data[:4])); err != nil || got.Offset != 4 || got.Blob != nil {
+		t.Fatalf("unexpected append %+v %v", got, err)
+	}
+	if got, _ := db.BlobUploadStatus(ur.UploadID, "0x2"); got.Offset != 4 {
+		t.Errorf("expected the upload resumable at 4, got %+v", got)
+	}
+	if fake.lastMutation != nil {
+		t.Error("nothing should be written before the upload completes")
+	}
+	got, err := db.AppendBlobUpload(ur.UploadID, "0x2", 4, bytes.NewReader(data[4:]))
+	if err != nil || got.Blob == nil || got.Blob.Blob != cm.BlobRef(hexSum(data)) {
+		t.Fatalf("expected the completed blob, got %+v %v", got, err)
+	}
+	if n := mutatedBlob(t, fake); n["uid"] != "0x5" || n["b"] != got.Blob.Blob {
+		t.Errorf("expected the reference written to 0x5's b, got %v", n)
+	}
+	if _, err := db.BlobUploadStatus(ur.UploadID, "0x2"); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("a completed upload should be gone, got %v", err)
+	}
+
+	ur, _ = db.StartBlobUpload("0x5", "0x2", 3, hexSum(data))
+	if _, err := db.AbortBlobUpload(ur.UploadID, "0x2"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := db.BlobUploadStatus(ur.UploadID, "0x2"); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("an aborted upload should be gone, got %v", err)
+	}
+}
+
+func TestCollectBlobGarbage(t *testing.T) {
+	kept, orphan, recent := []byte("kept"), []byte("orphan"), []byte("recent")
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[
+		{"uid":"0x1","b":"` + cm.BlobRef(hexSum(kept)) + `"},
+		{"uid":"0x2","b":"inline text"}
+	]}`)}
+	db := newBlobDB(t, fake)
+	store := db.Blobs.Store.(*LocalBlobStore)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, data := range [][]byte{kept, orphan, recent} {
+		store.Put(bytes.NewReader(data), 64, "")
+		if string(data) != "recent" {
+			os.Chtimes(store.blobPath(hexSum(data)), old, old)
+		}
+	}
+	store.CreateUpload(&BlobUpload{ID: "2b7e4d6a-1c2f-4a3b-8c9d-0e1f2a3b4c5d", Size: 1, Created: old})
+	store.CreateUpload(&BlobUpload{ID: "3b7e4d6a-1c2f-4a3b-8c9d-0e1f2a3b4c5d", Size: 1, Created: time.Now()})
+
+	resp := db.CollectBlobGarbage(true)
+	if resp.Error != "" || resp.Referenced != 1 || resp.Deleted != 1 || resp.Kept != 1 || resp.ExpiredUploads != 1 || resp.FreedBytes != int64(len(orphan)) {
+		t.Fatalf("unexpected dry run %+v", resp)
+	}
+	if _, _, err := store.Open(hexSum(orphan)); err != nil {
+		t.Error("a dry run should delete nothing")
+	}
+	if !strings.Contains(fake.queries[0], "qr(func: has(b), first: 1000)") {
+		t.Errorf("expected a scan of the nodes with a b:\n%s", fake.queries[0])
+	}
+
+	resp = db.CollectBlobGarbage(false)
+	if resp.Deleted != 1 || resp.ExpiredUploads != 1 {
+		t.Fatalf("unexpected collection %+v", resp)
+	}
+	for _, data := range [][]byte{kept, recent} {
+		if _, _, err := store.Open(hexSum(data)); err != nil {
+			t.Errorf("%s should be kept: %v", data, err)
+		}
+	}
+	if _, _, err := store.Open(hexSum(orphan)); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("the old unreferenced blob should be deleted, got %v", err)
+	}
+	n := 0
+	store.WalkUploads(func(*BlobUpload) error { n++; return nil })
+	if n != 1 {
+		t.Errorf("only the expired upload should be deleted, %d left", n)
+	}
+}
@@ -0,0 +1,518 @@
+package services
+
+import (
+	cm "cogged/models"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	Blob storage keeps binary attachments out of Dgraph: a node's b holds a reference of the
+	form "blob:sha256:<hex>" and the content lives in a blob store, named by its SHA-256 so
+	that the same content is only stored once. It is set up in the flat config file:
+
+	{
+		"blob.store": "local",
+		"blob.dir": "/var/lib/cogged/blobs",
+		"blob.maxsize": "104857600",
+		"blob.uploadexpiry": "86400",
+		"blob.gcgrace": "3600"
+	}
+
+	store         "local" for LocalBlobStore, which keeps blobs as files under dir; "" or
+	              missing turns blob storage off, and the /blob routes with it
+	dir           the directory the local store keeps blobs and unfinished uploads in
+	maxsize       the largest blob, in bytes, that may be uploaded (default 100 MiB)
+	uploadexpiry  seconds an unfinished resumable upload is kept after it was started
+	              (default 86400)
+	gcgrace       seconds a blob no node refers to is kept before garbage collection may
+	              delete it (default 3600), which covers a blob stored but not yet
+	              referenced by the node it was uploaded for
+
+	The store itself knows nothing of nodes or permissions: the /blob routes check the
+	node's ad, and garbage collection (POST /admin/blobs) finds the blobs still referenced.
+*/
+
+const BLOB_PREFIX string = "blob."
+
+const (
+	BLOB_STORE_LOCAL = "local"
+
+	DEFAULT_BLOB_MAX_SIZE      = 100 << 20
+	DEFAULT_BLOB_UPLOAD_EXPIRY = 86400
+	DEFAULT_BLOB_GC_GRACE      = 3600
+)
+
+// The kinds of BlobError, which the api package turns into HTTP statuses.
+const (
+	BLOB_ERR_INVALID = iota
+	BLOB_ERR_NOT_FOUND
+	BLOB_ERR_TOO_LARGE
+	BLOB_ERR_DIGEST
+	BLOB_ERR_CONFLICT
+)
+
+type BlobError struct {
+	Info string
+	Kind int
+}
+
+func (e BlobError) Error() string {
+	return e.Info
+}
+
+// BlobInfo describes a stored blob. ModTime is when it was last stored, which an upload of
+// content already in the store also refreshes.
+type BlobInfo struct {
+	SHA256  string
+	Size    int64
+	ModTime time.Time
+}
+
+// BlobUpload is a resumable upload: the data arrives in chunks, appended at Offset, and
+// becomes a blob once all Size bytes are in and hash to SHA256. NodeUid is the node whose b
+// is then set to refer to it, and UserUid the user who started it, the only one who may
+// continue it.
+type BlobUpload struct {
+	ID      string    `json:"id"`
+	NodeUid string    `json:"node"`
+	UserUid string    `json:"user"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	Created time.Time `json:"created"`
+	// Offset is how many bytes have arrived; it is read from the stored data, not saved.
+	Offset int64 `json:"-"`
+}
+
+// BlobStore stores blobs by the SHA-256 of their content, and the partial data of
+// resumable uploads until they are committed as blobs.
+type BlobStore interface {
+	// Put stores the content read from r, which may be at most maxSize bytes. wantSum, if
+	// not "", is the SHA-256 the content must have; nothing is stored if it does not.
+	Put(r io.Reader, maxSize int64, wantSum string) (*BlobInfo, error)
+	Open(sum string) (io.ReadSeekCloser, *BlobInfo, error)
+	Delete(sum string) error
+	Walk(fn func(*BlobInfo) error) error
+
+	CreateUpload(u *BlobUpload) error
+	GetUpload(id string) (*BlobUpload, error)
+	// AppendUpload adds the content read from r to an upload, which must have offset bytes
+	// so far, and may not take it past its Size.
+	AppendUpload(id string, offset int64, r io.Reader) (*BlobUpload, error)
+	// CommitUpload stores a complete upload as a blob and removes the upload. An upload
+	// whose data does not hash to its SHA256 is removed too, and must be started again.
+	CommitUpload(id string) (*BlobInfo, error)
+	DeleteUpload(id string) error
+	WalkUploads(fn func(*BlobUpload) error) error
+}
+
+// Blobs is the server's blob store and the limits it is used with.
+type Blobs struct {
+	Store        BlobStore
+	MaxSize      int64
+	UploadExpiry time.Duration
+	GCGrace      time.Duration
+}
+
+func positiveSetting(conf *Config, key string, def int64) (int64, error) {
+	s := conf.Get(key)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 1 {
+		return 0, BlobError{Info: fmt.Sprintf("%q must be a positive integer", key)}
+	}
+	return n, nil
+}
+
+// NewBlobs reads the blob.* keys from conf, returning nil when blob storage is off.
+func NewBlobs(conf *Config) (*Blobs, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	for key := range *conf {
+		if !strings.HasPrefix(key, BLOB_PREFIX) {
+			continue
+		}
+		switch strings.TrimPrefix(key, BLOB_PREFIX) {
+		case "store", "dir", "maxsize", "uploadexpiry", "gcgrace":
+		default:
+			return nil, BlobError{Info: fmt.Sprintf("unknown blob setting %q", key)}
+		}
+	}
+	b := &Blobs{}
+	switch store := conf.Get(BLOB_PREFIX + "store"); store {
+	case "":
+		return nil, nil
+	case BLOB_STORE_LOCAL:
+		dir := conf.Get(BLOB_PREFIX + "dir")
+		if dir == "" {
+			return nil, BlobError{Info: fmt.Sprintf("%q needs %q to be set", BLOB_PREFIX+"store", BLOB_PREFIX+"dir")}
+		}
+		ls, err := NewLocalBlobStore(dir)
+		if err != nil {
+			return nil, err
+		}
+		b.Store = ls
+	default:
+		return nil, BlobError{Info: fmt.Sprintf("unknown blob store %q (allowed: %s)", store, BLOB_STORE_LOCAL)}
+	}
+	var err error
+	if b.MaxSize, err = positiveSetting(conf, BLOB_PREFIX+"maxsize", DEFAULT_BLOB_MAX_SIZE); err != nil {
+		return nil, err
+	}
+	expiry, err := positiveSetting(conf, BLOB_PREFIX+"uploadexpiry", DEFAULT_BLOB_UPLOAD_EXPIRY)
+	if err != nil {
+		return nil, err
+	}
+	grace, err := positiveSetting(conf, BLOB_PREFIX+"gcgrace", DEFAULT_BLOB_GC_GRACE)
+	if err != nil {
+		return nil, err
+	}
+	b.UploadExpiry = time.Duration(expiry) * time.Second
+	b.GCGrace = time.Duration(grace) * time.Second
+	return b, nil
+}
+
+// LoadBlobs is NewBlobs for start-up, where a bad config is fatal.
+func LoadBlobs(conf *Config) *Blobs {
+	b, err := NewBlobs(conf)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+var rgxUploadID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// LocalBlobStore keeps each blob in a file named by its SHA-256 under Dir/sha256, fanned
+// out by the first two hex digits, and each unfinished upload as a data file and a JSON
+// file of its BlobUpload under Dir/uploads. Content is written to Dir/tmp first and moved
+// into place whole, so a blob file is never seen half written.
+type LocalBlobStore struct {
+	Dir string
+	// busy holds a mutex for each upload being appended to or committed, so two requests
+	// for one upload cannot interleave.
+	busy sync.Map
+}
+
+func NewLocalBlobStore(dir string) (*LocalBlobStore, error) {
+	for _, sub := range []string{"sha256", "uploads", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o750); err != nil {
+			return nil, BlobError{Info: "cannot create blob directory: " + err.Error()}
+		}
+	}
+	return &LocalBlobStore{Dir: dir}, nil
+}
+
+func (s *LocalBlobStore) blobPath(sum string) string {
+	return filepath.Join(s.Dir, "sha256", sum[:2], sum)
+}
+
+func (s *LocalBlobStore) uploadPath(id, ext string) string {
+	return filepath.Join(s.Dir, "uploads", id+ext)
+}
+
+func blobNotFound() error {
+	return BlobError{Info: "blob not found", Kind: BLOB_ERR_NOT_FOUND}
+}
+
+func uploadNotFound() error {
+	return BlobError{Info: "upload not found", Kind: BLOB_ERR_NOT_FOUND}
+}
+
+func tooLarge(max int64) error {
+	return BlobError{Info: fmt.Sprintf("blob is larger than %d bytes", max), Kind: BLOB_ERR_TOO_LARGE}
+}
+
+// store moves the file at path, whose content hashes to sum, into place as that blob. If
+// the blob is already stored the file is dropped and the blob's ModTime refreshed instead,
+// so garbage collection gives it the full grace period to be referenced again.
+func (s *LocalBlobStore) store(path, sum string) (*BlobInfo, error) {
+	dst := s.blobPath(sum)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		os.Remove(path)
+		tnow := time.Now()
+		if err := os.Chtimes(dst, tnow, tnow); err != nil {
+			return nil, err
+		}
+	} else if err := os.Rename(path, dst); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		return nil, err
+	}
+	return &BlobInfo{SHA256: sum, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *LocalBlobStore) Put(r io.Reader, maxSize int64, wantSum string) (*BlobInfo, error) {
+	f, err := os.CreateTemp(filepath.Join(s.Dir, "tmp"), "put-")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, maxSize+1))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n > maxSize {
+		err = tooLarge(maxSize)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err == nil && wantSum != "" && sum != wantSum {
+		err = BlobError{Info: "content does not match its digest", Kind: BLOB_ERR_DIGEST}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return s.store(f.Name(), sum)
+}
+
+func (s *LocalBlobStore) Open(sum string) (io.ReadSeekCloser, *BlobInfo, error) {
+	if !cm.ValidBlobSum(sum) {
+		return nil, nil, blobNotFound()
+	}
+	f, err := os.Open(s.blobPath(sum))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, blobNotFound()
+	} else if err != nil {
+		return nil, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, &BlobInfo{SHA256: sum, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (s *LocalBlobStore) Delete(sum string) error {
+	if !cm.ValidBlobSum(sum) {
+		return blobNotFound()
+	}
+	if err := os.Remove(s.blobPath(sum)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalBlobStore) Walk(fn func(*BlobInfo) error) error {
+	return filepath.WalkDir(filepath.Join(s.Dir, "sha256"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !cm.ValidBlobSum(d.Name()) {
+			return err
+		}
+		fi, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fn(&BlobInfo{SHA256: d.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+}
+
+func (s *LocalBlobStore) CreateUpload(u *BlobUpload) error {
+	if !rgxUploadID.MatchString(u.ID) {
+		return BlobError{Info: "bad upload id"}
+	}
+	meta, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.uploadPath(u.ID, ""), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := os.WriteFile(s.uploadPath(u.ID, ".json"), meta, 0o640); err != nil {
+		os.Remove(s.uploadPath(u.ID, ""))
+		return err
+	}
+	u.Offset = 0
+	return nil
+}
+
+func (s *LocalBlobStore) GetUpload(id string) (*BlobUpload, error) {
+	if !rgxUploadID.MatchString(id) {
+		return nil, uploadNotFound()
+	}
+	meta, err := os.ReadFile(s.uploadPath(id, ".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, uploadNotFound()
+	} else if err != nil {
+		return nil, err
+	}
+	u := &BlobUpload{}
+	if err := json.Unmarshal(meta, u); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(s.uploadPath(id, ""))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, uploadNotFound()
+	} else if err != nil {
+		return nil, err
+	}
+	u.Offset = fi.Size()
+	return u, nil
+}
+
+// lock claims an upload for one request, failing rather than waiting if another has it.
+func (s *LocalBlobStore) lock(id string) (func(), error) {
+	m, _ := s.busy.LoadOrStore(id, &sync.Mutex{})
+	mu := m.(*sync.Mutex)
+	if !mu.TryLock() {
+		return nil, BlobError{Info: "upload is busy with another request", Kind: BLOB_ERR_CONFLICT}
+	}
+	return mu.Unlock, nil
+}
+
+func (s *LocalBlobStore) AppendUpload(id string, offset int64, r io.Reader) (*BlobUpload, error) {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	u, err := s.GetUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if offset != u.Offset {
+		return u, BlobError{Info: fmt.Sprintf("upload is at offset %d, not %d", u.Offset, offset), Kind: BLOB_ERR_CONFLICT}
+	}
+	f, err := os.OpenFile(s.uploadPath(id, ""), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return nil, err
+	}
+	remaining := u.Size - u.Offset
+	n, err := io.Copy(f, io.LimitReader(r, remaining+1))
+	if err == nil && n > remaining {
+		err = BlobError{Info: fmt.Sprintf("upload is %d bytes, and only %d of them remain", u.Size, remaining), Kind: BLOB_ERR_TOO_LARGE}
+	}
+	if err != nil {
+		// drop the partial chunk, so the upload can be resumed from where it was
+		f.Truncate(u.Offset)
+		f.Close()
+		return u, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	u.Offset += n
+	return u, nil
+}
+
+func (s *LocalBlobStore) CommitUpload(id string) (*BlobInfo, error) {
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	u, err := s.GetUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Offset != u.Size {
+		return nil, BlobError{Info: fmt.Sprintf("upload has %d of its %d bytes", u.Offset, u.Size), Kind: BLOB_ERR_CONFLICT}
+	}
+	sum, err := fileSum(s.uploadPath(id, ""), sha256.New())
+	if err != nil {
+		return nil, err
+	}
+	if sum != u.SHA256 {
+		s.deleteUpload(id)
+		return nil, BlobError{Info: "uploaded content does not match its digest; start the upload again", Kind: BLOB_ERR_DIGEST}
+	}
+	// move the data out of uploads first, so that a failure cannot leave an upload whose
+	// data is gone
+	tmp := filepath.Join(s.Dir, "tmp", "upload-"+id)
+	if err := os.Rename(s.uploadPath(id, ""), tmp); err != nil {
+		return nil, err
+	}
+	os.Remove(s.uploadPath(id, ".json"))
+	s.busy.Delete(id)
+	return s.store(tmp, sum)
+}
+
+func fileSum(path string, h hash.Hash) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *LocalBlobStore) deleteUpload(id string) {
+	os.Remove(s.uploadPath(id, ".json"))
+	os.Remove(s.uploadPath(id, ""))
+	s.busy.Delete(id)
+}
+
+func (s *LocalBlobStore) DeleteUpload(id string) error {
+	if !rgxUploadID.MatchString(id) {
+		return uploadNotFound()
+	}
+	unlock, err := s.lock(id)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s.deleteUpload(id)
+	return nil
+}
+
+func (s *LocalBlobStore) WalkUploads(fn func(*BlobUpload) error) error {
+	entries, err := os.ReadDir(filepath.Join(s.Dir, "uploads"))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !rgxUploadID.MatchString(id) {
+			continue
+		}
+		u, err := s.GetUpload(id)
+		if err != nil {
+			var be BlobError
+			if errors.As(err, &be) && be.Kind == BLOB_ERR_NOT_FOUND {
+				continue
+			}
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
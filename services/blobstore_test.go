@@ -0,0 +1,161 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hexSum(data []byte) string {
+	s := sha256.Sum256(data)
+	return hex.EncodeToString(s[:])
+}
+
+func blobErrKind(err error) int {
+	var be BlobError
+	if !errors.As(err, &be) {
+		return -1
+	}
+	return be.Kind
+}
+
+func TestNewBlobs(t *testing.T) {
+	dir := t.TempDir()
+	b, err := NewBlobs(&Config{"blob.store": "local", "blob.dir": dir, "blob.maxsize": "10", "db.host": "x"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ls, ok := b.Store.(*LocalBlobStore); !ok || ls.Dir != dir || b.MaxSize != 10 {
+		t.Errorf("unexpected blobs %+v", b)
+	}
+	if b.UploadExpiry != DEFAULT_BLOB_UPLOAD_EXPIRY*time.Second || b.GCGrace != DEFAULT_BLOB_GC_GRACE*time.Second {
+		t.Errorf("expected the default expiry and grace, got %v %v", b.UploadExpiry, b.GCGrace)
+	}
+	if _, err := os.Stat(dir + "/sha256"); err != nil {
+		t.Errorf("the store's directories should be created: %v", err)
+	}
+	if b, err := NewBlobs(&Config{}); b != nil || err != nil {
+		t.Errorf("no store should turn blob storage off, got %v %v", b, err)
+	}
+	for name, conf := range map[string]Config{
+		"unknown store":   {"blob.store": "s3"},
+		"unknown setting": {"blob.store": "local", "blob.dir": dir, "blob.max": "1"},
+		"no dir":          {"blob.store": "local"},
+		"bad maxsize":     {"blob.store": "local", "blob.dir": dir, "blob.maxsize": "0"},
+		"bad grace":       {"blob.store": "local", "blob.dir": dir, "blob.gcgrace": "soon"},
+	} {
+		if _, err := NewBlobs(&conf); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLocalBlobStorePut(t *testing.T) {
+	s, _ := NewLocalBlobStore(t.TempDir())
+	data := []byte("hello blob")
+
+	info, err := s.Put(bytes.NewReader(data), 100, hexSum(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.SHA256 != hexSum(data) || info.Size != int64(len(data)) {
+		t.Errorf("unexpected info %+v", info)
+	}
+	// storing the same content again keeps one copy and refreshes its time
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(s.blobPath(info.SHA256), old, old)
+	again, err := s.Put(bytes.NewReader(data), 100, "")
+	if err != nil || !again.ModTime.After(old.Add(time.Minute)) {
+		t.Errorf("expected a refreshed ModTime, got %v %v", again, err)
+	}
+
+	f, got, err := s.Open(info.SHA256)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	buf.ReadFrom(f)
+	f.Close()
+	if buf.String() != string(data) || got.Size != info.Size {
+		t.Errorf("read back %q", buf.String())
+	}
+
+	if _, err := s.Put(bytes.NewReader(data), 5, ""); blobErrKind(err) != BLOB_ERR_TOO_LARGE {
+		t.Errorf("expected too large, got %v", err)
+	}
+	if _, err := s.Put(strings.NewReader("other"), 100, hexSum(data)); blobErrKind(err) != BLOB_ERR_DIGEST {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+	if _, _, err := s.Open(hexSum([]byte("missing"))); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if _, _, err := s.Open("../../etc/passwd"); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("a bad sum should not be opened, got %v", err)
+	}
+	tmp, _ := os.ReadDir(s.Dir + "/tmp")
+	if len(tmp) != 0 {
+		t.Errorf("failed puts should leave nothing behind, found %d files", len(tmp))
+	}
+
+	n := 0
+	s.Walk(func(*BlobInfo) error { n++; return nil })
+	if err := s.Delete(info.SHA256); err != nil || n != 1 {
+		t.Errorf("expected one blob walked and deleted, got %d %v", n, err)
+	}
+	if _, _, err := s.Open(info.SHA256); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("expected the deleted blob gone, got %v", err)
+	}
+}
+
+func TestLocalBlobStoreUploads(t *testing.T) {
+	s, _ := NewLocalBlobStore(t.TempDir())
+	data := []byte("0123456789")
+	u := &BlobUpload{ID: "0b7e4d6a-1c2f-4a3b-8c9d-0e1f2a3b4c5d", NodeUid: "0x1", UserUid: "0x2", Size: 10, SHA256: hexSum(data), Created: time.Now()}
+	if err := s.CreateUpload(u); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.CreateUpload(&BlobUpload{ID: "../x"}); err == nil {
+		t.Error("a bad upload id should be rejected")
+	}
+
+	if got, err := s.AppendUpload(u.ID, 0, bytes.NewReader(data[:4])); err != nil || got.Offset != 4 {
+		t.Fatalf("expected offset 4, got %v %v", got, err)
+	}
+	if _, err := s.AppendUpload(u.ID, 0, bytes.NewReader(data[:4])); blobErrKind(err) != BLOB_ERR_CONFLICT {
+		t.Errorf("a chunk at the wrong offset should conflict, got %v", err)
+	}
+	if _, err := s.AppendUpload(u.ID, 4, bytes.NewReader(append(data[4:], 'x'))); blobErrKind(err) != BLOB_ERR_TOO_LARGE {
+		t.Errorf("a chunk past the size should be rejected, got %v", err)
+	}
+	if got, _ := s.GetUpload(u.ID); got.Offset != 4 || got.NodeUid != "0x1" {
+		t.Errorf("a rejected chunk should be dropped whole, got %+v", got)
+	}
+	if _, err := s.CommitUpload(u.ID); blobErrKind(err) != BLOB_ERR_CONFLICT {
+		t.Errorf("an incomplete upload should not commit, got %v", err)
+	}
+	s.AppendUpload(u.ID, 4, bytes.NewReader(data[4:]))
+	info, err := s.CommitUpload(u.ID)
+	if err != nil || info.SHA256 != hexSum(data) || info.Size != 10 {
+		t.Fatalf("unexpected commit %v %v", info, err)
+	}
+	if _, err := s.GetUpload(u.ID); blobErrKind(err) != BLOB_ERR_NOT_FOUND {
+		t.Errorf("a committed upload should be gone, got %v", err)
+	}
+
+	bad := &BlobUpload{ID: "1b7e4d6a-1c2f-4a3b-8c9d-0e1f2a3b4c5d", Size: 3, SHA256: hexSum(data), Created: time.Now()}
+	s.CreateUpload(bad)
+	s.AppendUpload(bad.ID, 0, strings.NewReader("abc"))
+	if _, err := s.CommitUpload(bad.ID); blobErrKind(err) != BLOB_ERR_DIGEST {
+		t.Errorf("expected a digest mismatch, got %v", err)
+	}
+	n := 0
+	s.WalkUploads(func(*BlobUpload) error { n++; return nil })
+	if n != 0 {
+		t.Errorf("a mismatched upload should be deleted, %d left", n)
+	}
+}
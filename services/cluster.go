@@ -0,0 +1,289 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	res "cogged/responses"
+	sec "cogged/security"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// MAX_CLUSTER_NODES caps how many nodes one cluster query counts. They are read from
+	// Dgraph CLUSTER_CHUNK at a time, and only the cells are kept.
+	MAX_CLUSTER_NODES = 100000
+	CLUSTER_CHUNK     = 10000
+
+	MAX_CLUSTER_PRECISION = 9
+	MAX_CLUSTER_ZOOM      = 22
+
+	// Dgraph joins a shape's positions with great circles, not lines of latitude, so the
+	// box is sent as pieces at most CLUSTER_PIECE_DEGREES wide with a position every
+	// CLUSTER_EDGE_STEP degrees along their north and south edges, which keeps the edges
+	// within about 100 m of the box's.
+	CLUSTER_PIECE_DEGREES float64 = 90
+	CLUSTER_EDGE_STEP     float64 = 1
+)
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// clusterCell is the running total of one geohash cell.
+type clusterCell struct {
+	count          int
+	sumLon, sumLat float64
+	bbox           []float64
+}
+
+// queryClusters answers a QueryRequest with a Cluster block: the readable nodes whose g
+// lies inside the box and that pass the query's Filters, counted into geohash cells. Each
+// node is placed by its position, or by the mean of its positions for a line or area. The
+// nodes are read a chunk at a time at one Dgraph timestamp, so that the count is
+// consistent, and only their uid and g are read.
+func (d *DB) queryClusters(q *req.QueryRequest, et EdgeType, uad *sec.UserAuthData, allowedSgis []string) *res.CoggedResponse {
+	if et != NODENODE {
+		return res.CoggedResponseFromError("cluster is only supported when querying nodes")
+	}
+	if err := validateCluster(q.Cluster); err != nil {
+		return res.CoggedResponseFromError(err.Error())
+	}
+	precision := q.Cluster.Precision
+	if q.Cluster.Zoom != nil {
+		precision = zoomPrecision(*q.Cluster.Zoom)
+	}
+	bbox := q.Cluster.BBox
+
+	vars := make(map[string]string)
+	filter := renderRootFilter(renderReadAuthzFilter(et, uad, allowedSgis), q.Filters, &vars)
+	within := renderGeoFunc(&req.QueryGeo{Mode: req.GEO_WITHIN, Shape: clusterShape(bbox)})
+	cells := make(map[string]*clusterCell)
+	var ts uint64
+	after := ""
+	for read := 0; ; {
+		page := ""
+		if after != "" {
+			page = ", after: " + SanitiseUID(after)
+		}
+		query := `query q(` + renderQueryParams(nil, &vars) + `) {
+		qr(func: ` + within + `, first: ` + fmt.Sprintf("%d", CLUSTER_CHUNK) + page + `)` + filter + ` {
+			uid ` + GEO_FIELD + `
+		}
+	}`
+		sp, readTs, err := d.QueryAt(query, &vars, ts)
+		if err != nil {
+			return res.CoggedResponseFromError("DB query failed")
+		}
+		ts = readTs
+		nodes := SliceFromResultJSON[cm.GraphNode](sp)
+		if nodes == nil {
+			return res.CoggedResponseFromError("could not parse query result")
+		}
+		for _, n := range *nodes {
+			centre := geoCentre(n.Location)
+			// the pieces' edges bow a little outside the box
+			if centre == nil || !inBBox(centre, bbox) {
+				continue
+			}
+			hash, cellBox := geohashCell(centre, precision)
+			c, ok := cells[hash]
+			if !ok {
+				c = &clusterCell{bbox: cellBox}
+				cells[hash] = c
+			}
+			c.count++
+			c.sumLon += centre[0]
+			c.sumLat += centre[1]
+		}
+		read += len(*nodes)
+		if len(*nodes) < CLUSTER_CHUNK {
+			break
+		}
+		if read >= MAX_CLUSTER_NODES {
+			return res.CoggedResponseFromError(fmt.Sprintf("more than %d nodes in the box to cluster; zoom in or narrow the search with filters", MAX_CLUSTER_NODES))
+		}
+		after = (*nodes)[len(*nodes)-1].Uid
+	}
+
+	clusters := []*res.GeoCluster{}
+	for hash, c := range cells {
+		n := float64(c.count)
+		clusters = append(clusters, &res.GeoCluster{
+			Geohash:  hash,
+			Count:    c.count,
+			Centroid: []float64{c.sumLon / n, c.sumLat / n},
+			BBox:     c.bbox,
+		})
+	}
+	// biggest first, so a client short of space can draw the first few
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Count != clusters[j].Count {
+			return clusters[i].Count > clusters[j].Count
+		}
+		return clusters[i].Geohash < clusters[j].Geohash
+	})
+	return res.CoggedResponseFromClusters(clusters)
+}
+
+// validateCluster checks the box is in range and one of zoom and precision is set.
+func validateCluster(c *req.QueryCluster) error {
+	if len(c.BBox) != 4 {
+		return DBError{Info: "cluster bbox must be [west, south, east, north]"}
+	}
+	for _, f := range c.BBox {
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return DBError{Info: "cluster bbox must be finite numbers"}
+		}
+	}
+	west, south, east, north := c.BBox[0], c.BBox[1], c.BBox[2], c.BBox[3]
+	if west < -180 || west > 180 || east < -180 || east > 180 {
+		return DBError{Info: "cluster bbox longitudes must be between -180 and 180"}
+	}
+	if south < -90 || north > 90 {
+		return DBError{Info: "cluster bbox latitudes must be between -90 and 90"}
+	}
+	if south >= north {
+		return DBError{Info: "cluster bbox south must be less than north"}
+	}
+	// a box crossing the antimeridian is the only one with west greater than east
+	if width := east - west; width == 0 || width == -360 {
+		return DBError{Info: "cluster bbox west and east must differ"}
+	}
+	if (c.Zoom == nil) == (c.Precision == 0) {
+		return DBError{Info: "cluster takes one of zoom or precision"}
+	}
+	if c.Zoom != nil && (*c.Zoom < 0 || *c.Zoom > MAX_CLUSTER_ZOOM) {
+		return DBError{Info: fmt.Sprintf("cluster zoom must be between 0 and %d", MAX_CLUSTER_ZOOM)}
+	}
+	if c.Zoom == nil && (c.Precision < 1 || c.Precision > MAX_CLUSTER_PRECISION) {
+		return DBError{Info: fmt.Sprintf("cluster precision must be between 1 and %d", MAX_CLUSTER_PRECISION)}
+	}
+	return nil
+}
+
+// geohashCellWidth is the width in degrees of longitude of a geohash cell of the given
+// precision. Longitude takes the odd bits of the hash's five bits a character.
+func geohashCellWidth(precision int) float64 {
+	return 360 / math.Pow(2, float64((5*precision+1)/2))
+}
+
+// zoomPrecision picks the geohash precision for a map zoom level: the coarsest whose cells
+// fit four across one of the zoom level's map tiles.
+func zoomPrecision(zoom int) int {
+	tile := 360 / math.Pow(2, float64(zoom))
+	for p := 1; p < MAX_CLUSTER_PRECISION; p++ {
+		if geohashCellWidth(p) <= tile/4 {
+			return p
+		}
+	}
+	return MAX_CLUSTER_PRECISION
+}
+
+// geohashCell returns the geohash of a [longitude, latitude] position to the given
+// precision, along with the [west, south, east, north] of its cell.
+func geohashCell(p []float64, precision int) (string, []float64) {
+	lon, lat := [2]float64{-180, 180}, [2]float64{-90, 90}
+	hash := make([]byte, 0, precision)
+	bit, ch, even := 0, 0, true
+	for len(hash) < precision {
+		// even bits halve the longitude range, odd bits the latitude range
+		r, v := &lat, p[1]
+		if even {
+			r, v = &lon, p[0]
+		}
+		if mid := (r[0] + r[1]) / 2; v >= mid {
+			ch |= 1 << (4 - bit)
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		even = !even
+		if bit++; bit == 5 {
+			hash = append(hash, geohashBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash), []float64{lon[0], lat[0], lon[1], lat[1]}
+}
+
+// geoCentre returns the position a node is clustered at: a Point's own, or the mean of
+// the positions of a line or of the outer rings of an area. It is nil for a g with no
+// positions.
+func geoCentre(g *cm.Geoloc) []float64 {
+	if g == nil {
+		return nil
+	}
+	positions := [][]float64{}
+	switch g.Type {
+	case cm.GEO_POINT:
+		positions = append(positions, g.Coords)
+	case cm.GEO_LINESTRING:
+		positions = g.Line
+	case cm.GEO_POLYGON:
+		if len(g.Polygon) > 0 && len(g.Polygon[0]) > 1 {
+			// a ring ends where it starts, so leave out its last position
+			positions = g.Polygon[0][:len(g.Polygon[0])-1]
+		}
+	case cm.GEO_MULTIPOLYGON:
+		for _, poly := range g.MultiPolygon {
+			if len(poly) > 0 && len(poly[0]) > 1 {
+				positions = append(positions, poly[0][:len(poly[0])-1]...)
+			}
+		}
+	}
+	var lon, lat, n float64
+	for _, p := range positions {
+		if len(p) == 2 {
+			lon, lat, n = lon+p[0], lat+p[1], n+1
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return []float64{lon / n, lat / n}
+}
+
+// inBBox reports whether p lies in a [west, south, east, north] box, which crosses the
+// antimeridian when west is greater than east.
+func inBBox(p, bbox []float64) bool {
+	if p[1] < bbox[1] || p[1] > bbox[3] {
+		return false
+	}
+	if bbox[0] <= bbox[2] {
+		return p[0] >= bbox[0] && p[0] <= bbox[2]
+	}
+	return p[0] >= bbox[0] || p[0] <= bbox[2]
+}
+
+// clusterShape returns the MultiPolygon Dgraph is asked for the nodes within: the box split
+// at the antimeridian and into pieces CLUSTER_PIECE_DEGREES wide at most, their north and
+// south edges drawn with a position every CLUSTER_EDGE_STEP degrees.
+func clusterShape(bbox []float64) *cm.Geoloc {
+	west, south, east, north := bbox[0], bbox[1], bbox[2], bbox[3]
+	spans := [][2]float64{{west, east}}
+	if west > east {
+		spans = [][2]float64{{west, 180}, {-180, east}}
+	}
+	shape := &cm.Geoloc{Type: cm.GEO_MULTIPOLYGON}
+	for _, span := range spans {
+		// equal pieces, and positions stepped by count rather than by adding up steps, so
+		// that no piece or edge is left a rounding error wide
+		pieces := int(math.Ceil((span[1] - span[0]) / CLUSTER_PIECE_DEGREES))
+		for i := 0; i < pieces; i++ {
+			w := span[0] + (span[1]-span[0])*float64(i)/float64(pieces)
+			e := span[0] + (span[1]-span[0])*float64(i+1)/float64(pieces)
+			steps := max(1, int(math.Ceil((e-w)/CLUSTER_EDGE_STEP-1e-9)))
+			ring := [][]float64{}
+			for j := 0; j < steps; j++ {
+				ring = append(ring, []float64{w + float64(j)*CLUSTER_EDGE_STEP, south})
+			}
+			ring = append(ring, []float64{e, south})
+			for j := 0; j < steps; j++ {
+				ring = append(ring, []float64{e - float64(j)*CLUSTER_EDGE_STEP, north})
+			}
+			ring = append(ring, []float64{w, north}, []float64{w, south})
+			shape.MultiPolygon = append(shape.MultiPolygon, [][][]float64{ring})
+		}
+	}
+	return shape
+}
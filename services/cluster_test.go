@@ -0,0 +1,160 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	sec "cogged/security"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestQueryClusters(t *testing.T) {
+	nodes := []byte(`{"qr":[
+		{"uid":"0x1","g":{"type":"Point","coordinates":[151.2093,-33.8688]}},
+		{"uid":"0x2","g":{"type":"Point","coordinates":[151.2153,-33.8568]}},
+		{"uid":"0x3","g":{"type":"Polygon","coordinates":[[[151.20,-33.87],[151.22,-33.87],[151.22,-33.85],[151.20,-33.85],[151.20,-33.87]]]}},
+		{"uid":"0x4","g":{"type":"Point","coordinates":[144.9631,-37.8136]}},
+		{"uid":"0x5","g":{"type":"Point","coordinates":[160,-33.86]}},
+		{"uid":"0x6"}
+	]}`)
+	fake := &fakeClient{queryJSON: nodes}
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+	q := &req.QueryRequest{Cluster: &req.QueryCluster{BBox: []float64{140, -40, 155, -30}, Precision: 3},
+		Filters: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "cafe"}}
+
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, reader, []string{"sg1"})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	// Sydney's three in one cell, Melbourne in another; 0x5 is outside the box and 0x6
+	// has no g
+	if len(resp.Clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got %+v", resp.Clusters)
+	}
+	syd, mel := resp.Clusters[0], resp.Clusters[1]
+	if syd.Geohash != "r3g" || syd.Count != 3 || mel.Geohash != "r1r" || mel.Count != 1 {
+		t.Errorf("expected 3 in r3g and 1 in r1r, got %+v and %+v", syd, mel)
+	}
+	if math.Abs(syd.Centroid[0]-151.211533) > 1e-6 || math.Abs(syd.Centroid[1]+33.861867) > 1e-6 {
+		t.Errorf("unexpected centroid %v", syd.Centroid)
+	}
+	if !inBBox(syd.Centroid, syd.BBox) {
+		t.Errorf("the centroid %v should be in the cell %v", syd.Centroid, syd.BBox)
+	}
+	for _, want := range []string{
+		"qr(func: within(g, [[[[140, -40], [141, -40],",
+		"first: 10000) @filter((uid_in(own, 0x9) OR (eq(sgi, [\"sg1\"]) AND eq(r, true))) AND (eq(ty,",
+		"uid g",
+	} {
+		if !strings.Contains(fake.lastQuery, want) {
+			t.Errorf("expected %q in query:\n%s", want, fake.lastQuery)
+		}
+	}
+}
+
+func TestQueryClustersReadsInChunks(t *testing.T) {
+	chunk := []string{}
+	for i := 1; i <= CLUSTER_CHUNK; i++ {
+		chunk = append(chunk, fmt.Sprintf(`{"uid":"0x%x","g":{"type":"Point","coordinates":[1,1]}}`, i))
+	}
+	fake := &fakeClient{queryJSONs: [][]byte{
+		[]byte(`{"qr":[` + strings.Join(chunk, ",") + `]}`),
+		[]byte(`{"qr":[{"uid":"0x99999","g":{"type":"Point","coordinates":[-1,-1]}}]}`),
+	}, readTs: 40}
+	zoom := 0
+	q := &req.QueryRequest{Cluster: &req.QueryCluster{BBox: []float64{-180, -85, 180, 85}, Zoom: &zoom}}
+
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	if len(resp.Clusters) != 2 || resp.Clusters[0].Count != CLUSTER_CHUNK || resp.Clusters[1].Count != 1 {
+		t.Errorf("expected every node counted, got %+v", resp.Clusters)
+	}
+	if len(fake.queries) != 2 || !strings.Contains(fake.queries[1], fmt.Sprintf("first: 10000, after: 0x%x)", CLUSTER_CHUNK)) {
+		t.Errorf("expected the second chunk to follow the first:\n%s", fake.lastQuery)
+	}
+	if len(fake.readOpts) != 2 || fake.readOpts[1].StartTs != 40 {
+		t.Errorf("expected both chunks read at one timestamp, got %+v", fake.readOpts)
+	}
+}
+
+func TestQueryClustersValidation(t *testing.T) {
+	admin := &sec.UserAuthData{Role: sec.SYS_ROLE}
+	zoom, far := 3, MAX_CLUSTER_ZOOM+1
+	box := []float64{0, 0, 1, 1}
+
+	cases := []struct {
+		name string
+		c    *req.QueryCluster
+	}{
+		{"no bbox", &req.QueryCluster{Precision: 3}},
+		{"short bbox", &req.QueryCluster{BBox: []float64{0, 0, 1}, Precision: 3}},
+		{"NaN", &req.QueryCluster{BBox: []float64{0, math.NaN(), 1, 1}, Precision: 3}},
+		{"longitude out of range", &req.QueryCluster{BBox: []float64{0, 0, 181, 1}, Precision: 3}},
+		{"latitude out of range", &req.QueryCluster{BBox: []float64{0, -91, 1, 1}, Precision: 3}},
+		{"south above north", &req.QueryCluster{BBox: []float64{0, 1, 1, 0}, Precision: 3}},
+		{"no width", &req.QueryCluster{BBox: []float64{180, 0, -180, 1}, Precision: 3}},
+		{"neither zoom nor precision", &req.QueryCluster{BBox: box}},
+		{"both zoom and precision", &req.QueryCluster{BBox: box, Zoom: &zoom, Precision: 3}},
+		{"zoom too far", &req.QueryCluster{BBox: box, Zoom: &far}},
+		{"precision too fine", &req.QueryCluster{BBox: box, Precision: MAX_CLUSTER_PRECISION + 1}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+			if resp := newFakeDB(fake).QueryWithOptions(&req.QueryRequest{Cluster: tc.c}, NODENODE, admin, nil); resp.Error == "" {
+				t.Error("expected the query to be rejected")
+			}
+			if fake.lastQuery != "" {
+				t.Errorf("no query should reach Dgraph, got:\n%s", fake.lastQuery)
+			}
+		})
+	}
+
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+	q := &req.QueryRequest{Cluster: &req.QueryCluster{BBox: box, Zoom: &zoom}}
+	if resp := newFakeDB(fake).QueryWithOptions(q, USERNODE, admin, nil); resp.Error == "" {
+		t.Error("clustering the user's own nodes should be rejected")
+	}
+}
+
+func TestGeohashCell(t *testing.T) {
+	hash, cell := geohashCell([]float64{-5.6, 42.6}, 5)
+	if hash != "ezs42" {
+		t.Errorf("expected ezs42, got %s", hash)
+	}
+	if !inBBox([]float64{-5.6, 42.6}, cell) || math.Abs(cell[2]-cell[0]-geohashCellWidth(5)) > 1e-9 {
+		t.Errorf("unexpected cell %v", cell)
+	}
+	for zoom, want := range map[int]int{0: 1, 4: 3, 10: 5, 16: 7, MAX_CLUSTER_ZOOM: MAX_CLUSTER_PRECISION} {
+		if got := zoomPrecision(zoom); got != want {
+			t.Errorf("zoom %d: expected precision %d, got %d", zoom, want, got)
+		}
+	}
+}
+
+func TestClusterShape(t *testing.T) {
+	world := clusterShape([]float64{-180, -85, 180, 85})
+	if len(world.MultiPolygon) != 4 {
+		t.Errorf("the whole world should go in 4 pieces, got %d", len(world.MultiPolygon))
+	}
+	pacific := clusterShape([]float64{170, -10, -170.5, 10})
+	if len(pacific.MultiPolygon) != 2 || pacific.MultiPolygon[1][0][0][0] != -180 {
+		t.Errorf("a box over the antimeridian should be split there, got %+v", pacific.MultiPolygon)
+	}
+	small := clusterShape([]float64{151.2, -33.9, 151.3, -33.8})
+	if len(small.MultiPolygon) != 1 || len(small.MultiPolygon[0][0]) != 5 {
+		t.Errorf("a small box should be a plain rectangle, got %+v", small.MultiPolygon)
+	}
+	for _, g := range []*cm.Geoloc{world, pacific, small} {
+		if err := g.Validate(); err != nil {
+			t.Errorf("the shape should be a valid geometry: %v", err)
+		}
+	}
+	if !inBBox([]float64{179, 0}, []float64{170, -10, -170, 10}) || inBBox([]float64{0, 0}, []float64{170, -10, -170, 10}) {
+		t.Error("inBBox should handle a box over the antimeridian")
+	}
+}
@@ -22,6 +22,27 @@ import (
 	Dgraph connection: by default a plaintext endpoint is built from db.host/db.port. To
 	use TLS, ACL credentials or a Dgraph Cloud endpoint, set a full dgo connection string
 	in "db.connstr" (e.g. "dgraph://host:9080?sslmode=verify-ca"), which takes precedence.
+	"db.snapshotexpiry" is how many seconds the snapshot token of a paginated query stays
+	valid (default 300). "db.uniqueid" set to "owner" stops two nodes of the same owner
+	having the same id (see upsert.go); it is empty, allowing repeated ids, by default.
+
+	Server-side embedding (see embed.go) is off unless "embed.provider" is set:
+	"embed.provider"  "hash" or "http", or "" to turn embedding off
+	"embed.dim"       the length of the hash embedder's vectors (default 256)
+	"embed.url"       the http embedder's OpenAI-style embeddings endpoint
+	"embed.model"     the model the http embedder asks for, if the server needs one
+	"embed.timeout"   seconds the http embedder waits for a response (default 30)
+	"embed.fields"    comma-separated predicates, of s1 to s4, that vec is embedded from
+
+	"listen.maxbody" caps the JSON body of a request, in bytes (default 10485760); the /blob
+	routes stream their content and are capped by "blob.maxsize" instead.
+
+	Blob storage (see blobstore.go) is off unless "blob.store" is set:
+	"blob.store"         "local", or "" to turn blob storage and the /blob routes off
+	"blob.dir"           the directory the local store keeps blobs and uploads in
+	"blob.maxsize"       the largest blob in bytes (default 104857600)
+	"blob.uploadexpiry"  seconds an unfinished upload is kept (default 86400)
+	"blob.gcgrace"       seconds an unreferenced blob is kept before GC (default 3600)
 */
 
 const CONFIG_FILE_NAME string = "cogged.conf.json"
@@ -1,7 +1,19 @@
 // Package services holds Cogged's application services: configuration loading
-// (config.go), all Dgraph data access (db.go), and Dgraph schema setup/versioning
-// (dbsetup.go). The DB layer talks to Dgraph through the DgraphClient interface so
-// it can be driven by a fake in tests; see NewDBWithClient.
+// (config.go), Dgraph data access (db.go), Dgraph schema setup/versioning
+// (dbsetup.go), and per-type node permission policies (policy.go) and edge topology
+// constraints (topology.go). Per-type payload schemas are stored via db.go but
+// enforced from models, so request validation can reach them.
+//
+// Beyond the reads and writes in db.go, data access is split by feature: sorted and
+// cursor paging (paging.go), read snapshots (snapshot.go), shortest paths (path.go),
+// text search (search.go), aggregates (aggregate.go), nearest geo ranking
+// (nearest.go), geohash clusters (cluster.go), vector similarity (similar.go), hybrid
+// search (hybrid.go), server-side embedding (embed.go), the admin vector check
+// (vectors.go), blobs (blobs.go, stored through blobstore.go) and upserts by id
+// (upsert.go).
+//
+// The DB layer talks to Dgraph through the DgraphClient interface so it can be driven
+// by a fake in tests; see NewDBWithClient.
 package services
 
 import (
@@ -10,6 +22,7 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -53,6 +66,24 @@ const (
 	OP_LT         string = "lt"
 	OP_GTE        string = "ge"
 	OP_LTE        string = "le"
+	OP_IN         string = "in"
+	OP_BETWEEN    string = "between"
+	OP_EXISTS     string = "exists"
+	OP_OWNER      string = req.OP_OWNER
+	OP_ANYOFTERMS string = "anyofterms"
+	OP_ALLOFTERMS string = "allofterms"
+	OP_ANYOFTEXT  string = "anyoftext"
+	OP_ALLOFTEXT  string = "alloftext"
+	OP_MATCH      string = "match"
+
+	// MAX_IN_VALS caps the value list of an "in" clause, which compiles to one eq() per
+	// value.
+	MAX_IN_VALS = 100
+
+	// DEFAULT_MATCH_DISTANCE and MAX_MATCH_DISTANCE bound the edit distance of a "match"
+	// clause; past a handful of edits a trigram match returns most of the index.
+	DEFAULT_MATCH_DISTANCE uint = 2
+	MAX_MATCH_DISTANCE     uint = 8
 
 	// PRIVATE_FIELD is the owner-private `p` predicate. It may be named in `select`
 	// (the response layer strips it for callers who are neither the owner nor sys —
@@ -62,10 +93,15 @@ const (
 
 	// GEO_FIELD is the `g` geo predicate. It may be named in `select`, but no
 	// QueryRequestClause op can express a geo predicate, so naming it in filters or
-	// order_by is rejected; radius search goes through QueryRequest.Geo instead.
+	// order_by is rejected; geo search goes through the geo blocks instead.
 	// See checkGeoFieldNotFiltered.
 	GEO_FIELD string = "g"
 
+	// VEC_FIELD is the `vec` embedding predicate. Like `g` it may be named in `select`,
+	// read by whoever may read the node, but not in filters or order_by; similarity search
+	// goes through the similar block.
+	VEC_FIELD string = "vec"
+
 	MAX_QUERY_RECURSE_DEPTH uint = 20
 
 	// MAX_GEO_DISTANCE_METRES caps a radius search. Half the Earth's circumference is
@@ -84,6 +120,27 @@ var (
 		OP_LT:         true,
 		OP_GTE:        true,
 		OP_LTE:        true,
+		OP_IN:         true,
+		OP_BETWEEN:    true,
+		OP_EXISTS:     true,
+		OP_OWNER:      true,
+		OP_ANYOFTERMS: true,
+		OP_ALLOFTERMS: true,
+		OP_ANYOFTEXT:  true,
+		OP_ALLOFTEXT:  true,
+		OP_MATCH:      true,
+	}
+
+	// textOpFields lists, for each text search op, the fields with the index it needs in
+	// DGRAPH_SCHEMA: term for the *ofterms ops, fulltext for the *oftext ops and trigram
+	// for match. Fulltext values are stored without a language tag, so Dgraph analyses
+	// them as English.
+	textOpFields = map[string][]string{
+		OP_ANYOFTERMS: {"id", "s1", "s2"},
+		OP_ALLOFTERMS: {"id", "s1", "s2"},
+		OP_ANYOFTEXT:  {"s1", "s2"},
+		OP_ALLOFTEXT:  {"s1", "s2"},
+		OP_MATCH:      {"id", "s1"},
 	}
 
 	// allowedFields gates every predicate a client may name, in `select` as well as in
@@ -91,22 +148,23 @@ var (
 	// must still allow it; the narrower rule for the filter/order paths lives in
 	// checkPrivateFieldQueryable, which QueryWithOptions applies before compiling a query.
 	allowedFields = map[string]bool{
-		"e":  true,
-		"ty": true,
-		"id": true,
-		"p":  true,
-		"s1": true,
-		"s2": true,
-		"s3": true,
-		"s4": true,
-		"b":  true,
-		"n1": true,
-		"n2": true,
-		"c":  true,
-		"m":  true,
-		"t1": true,
-		"t2": true,
-		"g":  true,
+		"e":   true,
+		"ty":  true,
+		"id":  true,
+		"p":   true,
+		"s1":  true,
+		"s2":  true,
+		"s3":  true,
+		"s4":  true,
+		"b":   true,
+		"n1":  true,
+		"n2":  true,
+		"c":   true,
+		"m":   true,
+		"t1":  true,
+		"t2":  true,
+		"g":   true,
+		"vec": true,
 	}
 
 	rgxAlphaNumSpace *regexp.Regexp
@@ -131,12 +189,23 @@ type DgraphTxn interface {
 	Query(ctx context.Context, q string) (*api.Response, error)
 	QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error)
 	Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error)
+	Do(ctx context.Context, req *api.Request) (*api.Response, error)
+}
+
+// ReadTxnOptions configures a read-only transaction. StartTs, when set, reads the database
+// as it was at that Dgraph timestamp; otherwise the transaction gets a new one. BestEffort
+// lets an alpha answer at the latest timestamp it has applied without asking Zero for one,
+// at the cost of possibly missing the most recent commits.
+type ReadTxnOptions struct {
+	StartTs    uint64
+	BestEffort bool
 }
 
 // DgraphClient abstracts the dgo client surface used by db.go.
 // The real *dgo.Dgraph is adapted to this interface by dgoClientAdapter.
 type DgraphClient interface {
 	NewTxn() DgraphTxn
+	NewReadOnlyTxn(opts ReadTxnOptions) DgraphTxn
 	Alter(ctx context.Context, op *api.Operation) error
 }
 
@@ -148,14 +217,41 @@ type dgoClientAdapter struct {
 
 func (a *dgoClientAdapter) NewTxn() DgraphTxn { return a.dg.NewTxn() }
 
+// NewReadOnlyTxn returns a dgo read-only transaction, or a snapshotTxn when a start
+// timestamp is given, as dgo has no way to start a transaction at one.
+func (a *dgoClientAdapter) NewReadOnlyTxn(opts ReadTxnOptions) DgraphTxn {
+	if opts.StartTs != 0 {
+		return &snapshotTxn{dg: a.dg, startTs: opts.StartTs}
+	}
+	txn := a.dg.NewReadOnlyTxn()
+	if opts.BestEffort {
+		txn = txn.BestEffort()
+	}
+	return txn
+}
+
 func (a *dgoClientAdapter) Alter(ctx context.Context, op *api.Operation) error {
 	return a.dg.Alter(ctx, op)
 }
 
 type DB struct {
 	Configuration *Config
-	client        DgraphClient
-	cCancel       CancelFunc
+	Constraints   TopologyConstraints
+	// SnapshotExpiry is how long, in seconds, the snapshot token of a paginated query is
+	// honoured for (config "db.snapshotexpiry").
+	SnapshotExpiry int64
+	// Embedder, when set, fills vec from the EmbedFields of the nodes written and embeds
+	// the text of similarity searches (config "embed.*", see embed.go).
+	Embedder    Embedder
+	EmbedFields []string
+	// Blobs, when set, stores the content a node's b refers to (config "blob.*", see
+	// blobstore.go).
+	Blobs *Blobs
+	// UniqueID, when "owner", stops two nodes of the same owner having the same id
+	// (config "db.uniqueid", see upsert.go).
+	UniqueID string
+	client   DgraphClient
+	cCancel  CancelFunc
 }
 
 func initGlobal() {
@@ -172,8 +268,13 @@ func NewDB(conf *Config) *DB {
 	}
 
 	newDB := &DB{
-		Configuration: conf,
+		Configuration:  conf,
+		Constraints:    LoadTopologyConstraints(conf),
+		SnapshotExpiry: getSnapshotExpiry(conf.Get("db.snapshotexpiry")),
 	}
+	newDB.Embedder, newDB.EmbedFields = LoadEmbedder(conf)
+	newDB.Blobs = LoadBlobs(conf)
+	newDB.UniqueID = LoadUniqueID(conf)
 
 	// create Dgraph client
 	err := newDB.Connect(dgraphConnString(newDB.Configuration))
@@ -181,6 +282,10 @@ func NewDB(conf *Config) *DB {
 		panic("Could not connect to Dgraph")
 	}
 	newDB.MaybeUpdateSchema()
+	if err := newDB.LoadPayloadSchemas(); err != nil {
+		log.Error("load payload schemas", err)
+		panic(err)
+	}
 
 	return newDB
 }
@@ -192,10 +297,16 @@ func NewDBWithClient(conf *Config, client DgraphClient) *DB {
 	if !initialisedGlobal {
 		initGlobal()
 	}
-	return &DB{
-		Configuration: conf,
-		client:        client,
+	db := &DB{
+		Configuration:  conf,
+		Constraints:    LoadTopologyConstraints(conf),
+		SnapshotExpiry: getSnapshotExpiry(conf.Get("db.snapshotexpiry")),
+		client:         client,
 	}
+	db.Embedder, db.EmbedFields = LoadEmbedder(conf)
+	db.Blobs = LoadBlobs(conf)
+	db.UniqueID = LoadUniqueID(conf)
+	return db
 }
 
 // dgraphConnString returns the dgo connection string to connect with. A full
@@ -287,6 +398,19 @@ func (d *DB) Query(query string, vars *map[string]string) (*string, error) {
 	return &rj, nil
 }
 
+// QueryAt runs a read-only query at the Dgraph timestamp ts, or at a new one when ts is 0,
+// and returns the timestamp it read at along with the result.
+func (d *DB) QueryAt(query string, vars *map[string]string, ts uint64) (*string, uint64, error) {
+	log.Debug("DB QueryAt", query, vars, ts)
+	resp, err := d.client.NewReadOnlyTxn(ReadTxnOptions{StartTs: ts}).QueryWithVars(context.Background(), query, *vars)
+	if err != nil {
+		log.Error("query at timestamp", err)
+		return nil, 0, err
+	}
+	rj := string(resp.Json)
+	return &rj, resp.GetTxn().GetStartTs(), nil
+}
+
 func (d *DB) Mutate(i interface{}, SetOrDelete UpdateType) (*api.Response, error) {
 	j, _ := json.Marshal(i)
 	log.Debug("DB Mutate:", i)
@@ -311,6 +435,30 @@ func (d *DB) Mutate(i interface{}, SetOrDelete UpdateType) (*api.Response, error
 	return response, nil
 }
 
+// MutateSetDelete applies a set and a delete as one committed mutation, so the two halves
+// of a change (moving an edge from one node to another, say) are never observed apart and
+// cannot half-fail. Either side may be nil.
+func (d *DB) MutateSetDelete(setObj, delObj interface{}) (*api.Response, error) {
+	log.Debug("DB MutateSetDelete:", setObj, delObj)
+
+	mu := &api.Mutation{
+		CommitNow: true,
+	}
+	if setObj != nil {
+		mu.SetJson, _ = json.Marshal(setObj)
+	}
+	if delObj != nil {
+		mu.DeleteJson, _ = json.Marshal(delObj)
+	}
+
+	response, err := d.client.NewTxn().Mutate(context.Background(), mu)
+	if err != nil {
+		log.Error("mutate set/delete", err)
+		return nil, err
+	}
+	return response, nil
+}
+
 func escapeAllNonAlphanumOrSpaceChars(strVal string) string {
 	retString := ""
 	re := rgxAlphaNumSpace
@@ -367,14 +515,42 @@ func constructQueryStringAndAddVars(clause req.QueryRequestClause, queryvars *ma
 		}
 		retval = "(" + strings.Join(clStrings, opstr) + ")"
 
+	} else if clause.Not != nil {
+		retval = "not (" + constructQueryStringAndAddVars(*clause.Not, queryvars) + ")"
+
 	} else if clause.Geo != nil {
-		// Radius test on `g`, composable with the surrounding and/or. Already validated
+		// Geo test on `g`, composable with the surrounding and/or. Already validated
 		// by validateGeoClauses, and rendered from parsed float64s, so nothing
 		// client-supplied is interpolated as text and no query var is needed.
 		retval = renderGeoFunc(clause.Geo)
 
+	} else if op := renderOp(clause.Op); op == OP_EXISTS {
+		retval = "has(" + renderField(clause.Field) + ")"
+
+	} else if op == OP_OWNER {
+		// OwnerUid was unpacked from a user's AuthzData; Val is never used here
+		retval = "uid_in(own, " + SanitiseUID(clause.OwnerUid) + ")"
+
+	} else if op == OP_IN {
+		field := renderField(clause.Field)
+		eqs := []string{}
+		for _, v := range clause.Vals {
+			eqs = append(eqs, "eq("+field+","+bindQueryVar(v, queryvars)+")")
+		}
+		retval = "(" + strings.Join(eqs, " or ") + ")"
+
+	} else if op == OP_MATCH {
+		distance := clause.MatchDistance
+		if distance == 0 {
+			distance = DEFAULT_MATCH_DISTANCE
+		}
+		retval = fmt.Sprintf("match(%s,%s,%d)", renderField(clause.Field), bindQueryVar(clause.Val, queryvars), distance)
+
+	} else if op == OP_BETWEEN {
+		field := renderField(clause.Field)
+		retval = "between(" + field + "," + bindQueryVar(clause.Vals[0], queryvars) + "," + bindQueryVar(clause.Vals[1], queryvars) + ")"
+
 	} else {
-		op := renderOp(clause.Op)
 		field := renderField(clause.Field)
 		clVal := clause.Val
 		if clVal == "" {
@@ -385,9 +561,6 @@ func constructQueryStringAndAddVars(clause req.QueryRequestClause, queryvars *ma
 			clVal = epoch.String()
 		}
 
-		tmpHash := sec.MD5SumHex([]byte(clVal))
-		valStr := fmt.Sprintf("$vv%s", tmpHash[:20])
-
 		if op == OP_TEXTSEARCH {
 			clVal = strings.TrimSpace(clVal)
 			if len(clVal) > 2 {
@@ -396,13 +569,20 @@ func constructQueryStringAndAddVars(clause req.QueryRequestClause, queryvars *ma
 			}
 		}
 
-		(*queryvars)[valStr] = clVal
-
-		retval += op + "(" + field + "," + valStr + ")"
+		retval += op + "(" + field + "," + bindQueryVar(clVal, queryvars) + ")"
 	}
 	return retval
 }
 
+// bindQueryVar adds a clause value to the query variables and returns its name. The name
+// is derived from the value, so a value used twice is bound once.
+func bindQueryVar(val string, queryvars *map[string]string) string {
+	tmpHash := sec.MD5SumHex([]byte(val))
+	valStr := fmt.Sprintf("$vv%s", tmpHash[:20])
+	(*queryvars)[valStr] = val
+	return valStr
+}
+
 func SanitiseUID(uid string) string {
 	tmpUid := uid
 	if startsWith0x := strings.HasPrefix(uid, "0x"); startsWith0x {
@@ -442,6 +622,26 @@ func getEdgePredicateName(edgeType EdgeType) string {
 	}
 }
 
+// getTraversalPredicates returns the edge predicate(s) a recurse block follows for a query
+// direction. Only node-to-node edges have a reverse (~e) worth following: a reverse user
+// edge would lead from nodes back to users, which are not query results.
+func getTraversalPredicates(et EdgeType, direction string) (string, error) {
+	pred := getEdgePredicateName(et)
+	switch direction {
+	case "", req.DIRECTION_OUT:
+		return pred, nil
+	case req.DIRECTION_IN, req.DIRECTION_BOTH:
+		if et != NODENODE {
+			return "", DBError{Info: "direction '" + direction + "' is only supported when traversing from nodes"}
+		}
+		if direction == req.DIRECTION_IN {
+			return "~" + pred, nil
+		}
+		return pred + " ~" + pred, nil
+	}
+	return "", DBError{Info: "direction must be one of: out, in, both"}
+}
+
 func renderQueryVarsString(vars *map[string]string) string {
 	tmpV := []string{}
 	for key := range *vars {
@@ -518,34 +718,36 @@ func SliceFromResultJSON[T any](j *string) *[]*T {
 }
 
 // renderPagination builds the DQL pagination/order arguments (with a leading comma) to
-// inject inside a query block's func(...), e.g. ", orderasc: c, first: 10, offset: 5,
-// after: 0x2a". Every value is validated or sanitised first — the order predicate against
+// inject inside a query block's func(...), e.g. ", orderasc: c, orderdesc: m, first: 11,
+// offset: 5". Every value is validated or sanitised first — the order predicates against
 // allowedFields, the After cursor via SanitiseUID, and First/Offset are plain ints — so
-// they are safe to inline. Returns "" when no pagination is requested.
+// they are safe to inline. Returns "" when no pagination is requested, and after a sorted
+// PageCursor, which renderCursorBlocks pages instead. First asks for one node more than
+// the page holds (see pageFetchSize).
 //
 // Pagination is applied by Dgraph at query time. For NODENODE queries the read-permission
 // check is pushed into the same query (see renderReadAuthzFilter), so Dgraph pages over
 // only the nodes the caller may read and pages are exact. Owner-scoped queries
 // (USERNODE/USERSHARE) are already scoped to the caller by their traversal edge.
 func renderPagination(q *req.QueryRequest) string {
-	parts := []string{}
-	if q.OrderBy != nil {
-		if f := renderField(*q.OrderBy); f != "" {
-			if q.OrderDesc {
-				parts = append(parts, "orderdesc: "+f)
-			} else {
-				parts = append(parts, "orderasc: "+f)
-			}
-		}
+	keys := orderKeys(q)
+	if q.PageCursor != nil && len(keys) > 0 {
+		return ""
 	}
+	parts := renderOrderArgs(keys)
 	if q.First != nil {
-		parts = append(parts, fmt.Sprintf("first: %d", *q.First))
+		parts = append(parts, fmt.Sprintf("first: %d", pageFetchSize(*q.First)))
 	}
 	if q.Offset != nil {
 		parts = append(parts, fmt.Sprintf("offset: %d", *q.Offset))
 	}
-	if q.After != nil && *q.After != "" {
-		parts = append(parts, "after: "+SanitiseUID(*q.After))
+	after := q.After
+	if q.PageCursor != nil {
+		// an unsorted cursor is just the last uid, as uid order is what after pages in
+		after = &q.PageCursor.Uid
+	}
+	if after != nil && *after != "" {
+		parts = append(parts, "after: "+SanitiseUID(*after))
 	}
 	if len(parts) == 0 {
 		return ""
@@ -589,6 +791,23 @@ func renderReadAuthzFilter(et EdgeType, uad *sec.UserAuthData, allowedSgis []str
 	return "(" + ownClause + " OR " + sgiClause + ")"
 }
 
+// renderRootFilter renders the @filter of a query that reads nodes through its own root
+// function, as Search does: the read-authz clause and the caller's filters, both of which
+// a node must pass. It is "" when there is neither.
+func renderRootFilter(authz string, filters *req.QueryRequestClause, vars *map[string]string) string {
+	clauses := []string{}
+	if authz != "" {
+		clauses = append(clauses, authz)
+	}
+	if filters != nil {
+		clauses = append(clauses, "("+constructQueryStringAndAddVars(*filters, vars)+")")
+	}
+	if len(clauses) == 0 {
+		return ""
+	}
+	return " @filter(" + strings.Join(clauses, " AND ") + ")"
+}
+
 // clauseNamesField reports whether any clause in the tree filters on the named predicate.
 func clauseNamesField(clause *req.QueryRequestClause, field string) bool {
 	if clause == nil {
@@ -607,13 +826,21 @@ func clauseNamesField(clause *req.QueryRequestClause, field string) bool {
 			return true
 		}
 	}
-	return false
+	return clauseNamesField(clause.Not, field)
 }
 
 // queryNamesField reports whether a request filters or orders by the named predicate.
 func queryNamesField(q *req.QueryRequest, field string) bool {
-	return clauseNamesField(q.Filters, field) || clauseNamesField(q.RootQuery, field) ||
-		(q.OrderBy != nil && strings.EqualFold(*q.OrderBy, field))
+	if clauseNamesField(q.Filters, field) || clauseNamesField(q.RootQuery, field) ||
+		clauseNamesField(q.TraverseFilter, field) {
+		return true
+	}
+	for _, k := range q.OrderBy {
+		if strings.EqualFold(k.Field, field) {
+			return true
+		}
+	}
+	return false
 }
 
 // checkQueryFields applies the per-field restrictions that allowedFields is too coarse to
@@ -626,13 +853,77 @@ func checkQueryFields(q *req.QueryRequest, uad *sec.UserAuthData) *res.CoggedRes
 	if denied := checkGeoFieldNotFiltered(q); denied != nil {
 		return denied
 	}
+	if queryNamesField(q, VEC_FIELD) {
+		return res.CoggedResponseFromError("field 'vec' is an embedding: use a 'similar' block to search by it, it cannot be used as a filter field or in order_by")
+	}
 	if q.Similar != nil && q.Geo != nil {
 		return res.CoggedResponseFromError("'similar' and 'geo' cannot be combined in one query")
 	}
-	for _, clause := range []*req.QueryRequestClause{q.Filters, q.RootQuery} {
+	for _, clause := range []*req.QueryRequestClause{q.Filters, q.RootQuery, q.TraverseFilter} {
 		if err := validateGeoClauses(clause); err != nil {
 			return res.CoggedResponseFromError(err.Error())
 		}
+		if err := validateClauseArgs(clause); err != nil {
+			return res.CoggedResponseFromError(err.Error())
+		}
+	}
+	return nil
+}
+
+// validateClauseArgs checks that every clause in a filter tree has what its op needs: a
+// field for in, between and exists, the right number of vals for in and between, and an
+// unpacked user for owner. Like validateGeoClauses it runs before compiling, as
+// constructQueryStringAndAddVars cannot report an error.
+func validateClauseArgs(clause *req.QueryRequestClause) error {
+	if clause == nil {
+		return nil
+	}
+	if clause.Not != nil {
+		if clause.Field != "" || clause.Op != "" || clause.Val != "" || clause.Geo != nil || len(clause.And) > 0 || len(clause.Or) > 0 {
+			return DBError{Info: "a not clause must only wrap another clause"}
+		}
+		return validateClauseArgs(clause.Not)
+	}
+	switch strings.ToLower(clause.Op) {
+	case OP_IN, OP_BETWEEN, OP_EXISTS:
+		if renderField(clause.Field) == "" {
+			return DBError{Info: "'" + strings.ToLower(clause.Op) + "' needs a field"}
+		}
+	}
+	switch strings.ToLower(clause.Op) {
+	case OP_IN:
+		if len(clause.Vals) == 0 || len(clause.Vals) > MAX_IN_VALS {
+			return DBError{Info: fmt.Sprintf("'in' needs between 1 and %d vals", MAX_IN_VALS)}
+		}
+	case OP_BETWEEN:
+		if len(clause.Vals) != 2 {
+			return DBError{Info: "'between' needs exactly two vals, the lower and upper bound"}
+		}
+	case OP_OWNER:
+		if !ValidateUid(clause.OwnerUid) {
+			return DBError{Info: "'owner' needs the AuthzData of a user as its val"}
+		}
+	case OP_ANYOFTERMS, OP_ALLOFTERMS, OP_ANYOFTEXT, OP_ALLOFTEXT, OP_MATCH:
+		op, fields := strings.ToLower(clause.Op), textOpFields[strings.ToLower(clause.Op)]
+		if !slices.Contains(fields, renderField(clause.Field)) {
+			return DBError{Info: "'" + op + "' only works on the fields " + strings.Join(fields, ", ")}
+		}
+		if strings.TrimSpace(clause.Val) == "" {
+			return DBError{Info: "'" + op + "' needs a val to search for"}
+		}
+		if clause.MatchDistance > MAX_MATCH_DISTANCE {
+			return DBError{Info: fmt.Sprintf("match_distance must be at most %d", MAX_MATCH_DISTANCE)}
+		}
+	}
+	for i := range clause.And {
+		if err := validateClauseArgs(&clause.And[i]); err != nil {
+			return err
+		}
+	}
+	for i := range clause.Or {
+		if err := validateClauseArgs(&clause.Or[i]); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -644,7 +935,7 @@ func checkQueryFields(q *req.QueryRequest, uad *sec.UserAuthData) *res.CoggedRes
 // failed"; point the caller at the geo blocks instead. `g` remains valid in `select`.
 func checkGeoFieldNotFiltered(q *req.QueryRequest) *res.CoggedResponse {
 	if queryNamesField(q, GEO_FIELD) {
-		return res.CoggedResponseFromError("field 'g' is a geo predicate: use a 'geo' block (on the request for a radius search, or on a filter clause to combine proximity with other filters), it cannot be used as a filter field or in order_by")
+		return res.CoggedResponseFromError("field 'g' is a geo predicate: use a 'geo' block (on the request for a geo search, or on a filter clause to combine location with other filters), it cannot be used as a filter field or in order_by")
 	}
 	return nil
 }
@@ -655,14 +946,84 @@ func formatCoord(f float64) string {
 	return strconv.FormatFloat(f, 'f', -1, 64)
 }
 
-// validateGeo range-checks a radius search. Every geo request is validated up front, before
-// any DQL is built, so renderGeoFunc can assume a good value.
+// geoMode returns the mode of a geo search, near when unset.
+func geoMode(g *req.QueryGeo) string {
+	if g.Mode == "" {
+		return req.GEO_NEAR
+	}
+	return g.Mode
+}
+
+// validateGeo checks a geo search has what its mode needs and range-checks it. Every geo
+// request is validated up front, before any DQL is built, so renderGeoFunc can assume a
+// good value.
 func validateGeo(g *req.QueryGeo) error {
-	if len(g.Point) != 2 {
+	switch geoMode(g) {
+	case req.GEO_NEAR:
+		if g.Shape != nil {
+			return DBError{Info: "geo mode near takes a point and distance, not a shape"}
+		}
+		if err := validateGeoPoint(g.Point); err != nil {
+			return err
+		}
+		if math.IsNaN(g.Distance) || math.IsInf(g.Distance, 0) {
+			return DBError{Info: "geo point and distance must be finite numbers"}
+		}
+		if g.Distance <= 0 {
+			return DBError{Info: "geo distance must be greater than 0 metres"}
+		}
+		if g.Distance > MAX_GEO_DISTANCE_METRES {
+			return DBError{Info: fmt.Sprintf("geo distance must be at most %.0f metres", MAX_GEO_DISTANCE_METRES)}
+		}
+	case req.GEO_NEAREST:
+		// the same as near, except that the distance is an optional limit
+		if g.Shape != nil {
+			return DBError{Info: "geo mode nearest takes a point, not a shape"}
+		}
+		if err := validateGeoPoint(g.Point); err != nil {
+			return err
+		}
+		if math.IsNaN(g.Distance) || math.IsInf(g.Distance, 0) {
+			return DBError{Info: "geo point and distance must be finite numbers"}
+		}
+		if g.Distance < 0 {
+			return DBError{Info: "geo distance must be greater than 0 metres"}
+		}
+		if g.Distance > MAX_GEO_DISTANCE_METRES {
+			return DBError{Info: fmt.Sprintf("geo distance must be at most %.0f metres", MAX_GEO_DISTANCE_METRES)}
+		}
+	case req.GEO_WITHIN, req.GEO_INTERSECTS, req.GEO_CONTAINS:
+		mode := geoMode(g)
+		if g.Distance != 0 {
+			return DBError{Info: "geo mode " + mode + " takes no distance"}
+		}
+		if mode == req.GEO_CONTAINS && g.Point != nil {
+			if g.Shape != nil {
+				return DBError{Info: "geo mode contains takes a point or a shape, not both"}
+			}
+			return validateGeoPoint(g.Point)
+		}
+		if g.Point != nil {
+			return DBError{Info: "geo mode " + mode + " takes a shape, not a point"}
+		}
+		if g.Shape == nil || (g.Shape.Type != cm.GEO_POLYGON && g.Shape.Type != cm.GEO_MULTIPOLYGON) {
+			return DBError{Info: "geo mode " + mode + " needs a Polygon or MultiPolygon shape"}
+		}
+		if err := g.Shape.Validate(); err != nil {
+			return DBError{Info: err.Error()}
+		}
+	default:
+		return DBError{Info: "geo mode must be one of: near, nearest, within, contains, intersects"}
+	}
+	return nil
+}
+
+func validateGeoPoint(point []float64) error {
+	if len(point) != 2 {
 		return DBError{Info: "geo point must be [longitude, latitude]"}
 	}
-	lon, lat := g.Point[0], g.Point[1]
-	for _, f := range []float64{lon, lat, g.Distance} {
+	lon, lat := point[0], point[1]
+	for _, f := range []float64{lon, lat} {
 		if math.IsNaN(f) || math.IsInf(f, 0) {
 			return DBError{Info: "geo point and distance must be finite numbers"}
 		}
@@ -673,16 +1034,10 @@ func validateGeo(g *req.QueryGeo) error {
 	if lat < -90 || lat > 90 {
 		return DBError{Info: "geo latitude must be between -90 and 90 (point is [longitude, latitude])"}
 	}
-	if g.Distance <= 0 {
-		return DBError{Info: "geo distance must be greater than 0 metres"}
-	}
-	if g.Distance > MAX_GEO_DISTANCE_METRES {
-		return DBError{Info: fmt.Sprintf("geo distance must be at most %.0f metres", MAX_GEO_DISTANCE_METRES)}
-	}
 	return nil
 }
 
-// renderGeoFunc returns the DQL near() call for an already-validated radius search. It is
+// renderGeoFunc returns the DQL geo function for an already-validated geo search. It is
 // used both as a query root function and inside an @filter clause.
 //
 // Nothing client-supplied reaches the query as text: the coordinates arrive as float64
@@ -690,10 +1045,44 @@ func validateGeo(g *req.QueryGeo) error {
 // injection surface to defend — unlike the vector path, which has to regex-validate a
 // client-supplied string before inlining it.
 func renderGeoFunc(g *req.QueryGeo) string {
-	return "near(" + GEO_FIELD + ", [" + formatCoord(g.Point[0]) + ", " + formatCoord(g.Point[1]) + "], " + formatCoord(g.Distance) + ")"
+	switch mode := geoMode(g); mode {
+	case req.GEO_WITHIN, req.GEO_CONTAINS, req.GEO_INTERSECTS:
+		if g.Point != nil {
+			return mode + "(" + GEO_FIELD + ", " + renderGeoPosition(g.Point) + ")"
+		}
+		return mode + "(" + GEO_FIELD + ", " + renderGeoShape(g.Shape) + ")"
+	}
+	return "near(" + GEO_FIELD + ", " + renderGeoPosition(g.Point) + ", " + formatCoord(g.Distance) + ")"
+}
+
+func renderGeoPosition(p []float64) string {
+	return "[" + formatCoord(p[0]) + ", " + formatCoord(p[1]) + "]"
+}
+
+// renderGeoShape renders the coordinates of a Polygon or MultiPolygon as a DQL geo literal.
+func renderGeoShape(shape *cm.Geoloc) string {
+	polygon := func(rings [][][]float64) string {
+		rs := []string{}
+		for _, ring := range rings {
+			ps := []string{}
+			for _, p := range ring {
+				ps = append(ps, renderGeoPosition(p))
+			}
+			rs = append(rs, "["+strings.Join(ps, ", ")+"]")
+		}
+		return "[" + strings.Join(rs, ", ") + "]"
+	}
+	if shape.Type == cm.GEO_MULTIPOLYGON {
+		ps := []string{}
+		for _, p := range shape.MultiPolygon {
+			ps = append(ps, polygon(p))
+		}
+		return "[" + strings.Join(ps, ", ") + "]"
+	}
+	return polygon(shape.Polygon)
 }
 
-// renderGeoRootFunc validates a radius search and returns it as a DQL root function.
+// renderGeoRootFunc validates a geo search and returns it as a DQL root function.
 func renderGeoRootFunc(g *req.QueryGeo) (string, error) {
 	if err := validateGeo(g); err != nil {
 		return "", err
@@ -713,6 +1102,10 @@ func validateGeoClauses(clause *req.QueryRequestClause) error {
 		if clause.Field != "" || clause.Op != "" || clause.Val != "" {
 			return DBError{Info: "a geo filter clause must not also set field, op or val"}
 		}
+		// nearest ranks the whole result, which a filter clause has no say in
+		if clause.Geo.Mode == req.GEO_NEAREST {
+			return DBError{Info: "geo mode nearest can only be used in the request's geo block, not in a filter clause"}
+		}
 		if err := validateGeo(clause.Geo); err != nil {
 			return err
 		}
@@ -727,7 +1120,7 @@ func validateGeoClauses(clause *req.QueryRequestClause) error {
 			return err
 		}
 	}
-	return nil
+	return validateGeoClauses(clause.Not)
 }
 
 // checkPrivateFieldQueryable rejects a query that filters or orders on the owner-private
@@ -756,39 +1149,40 @@ func (d *DB) QueryWithOptions(q *req.QueryRequest, et EdgeType, uad *sec.UserAut
 	if denied := checkQueryFields(q, uad); denied != nil {
 		return denied
 	}
+	if q.Geo != nil && q.Geo.Mode == req.GEO_NEAREST {
+		return d.queryNearest(q, et, uad, allowedSgis)
+	}
+	if q.Cluster != nil {
+		return d.queryClusters(q, et, uad, allowedSgis)
+	}
+	if q.Similar != nil {
+		return d.querySimilar(q, et, uad, allowedSgis)
+	}
+
+	edgePreds, derr := getTraversalPredicates(et, q.Direction)
+	if derr != nil {
+		return res.CoggedResponseFromError(derr.Error())
+	}
+	tree := q.Shape == req.SHAPE_TREE
+	if tree && et != NODENODE {
+		return res.CoggedResponseFromError("shape tree is only supported when traversing from nodes")
+	}
 
 	query := ""
 	vars := make(map[string]string)
+	// set to the traversal roots when the result is annotated with depths or nested into a
+	// tree; a recursive query then carries an lv block with the edges walked
+	var traversalRoots []string
 	// Fixed query parameters for the chosen query shape; bound values are appended by
 	// renderQueryParams below.
 	fixedParams := []string{}
 
-	if q.Similar != nil {
-		// Vector-similarity search: rank nodes by nearness to the query vector using
-		// the HNSW index on `vec`. Results are still access-filtered (@filter below).
-		vec := strings.TrimSpace(q.Similar.Vector)
-		if !rgxVectorLiteral.MatchString(vec) {
-			return res.CoggedResponseFromError("invalid similarity query vector")
-		}
-		topK := q.Similar.TopK
-		if topK == 0 {
-			topK = DEFAULT_SIMILAR_TOPK
-		}
-		if topK > MAX_SIMILAR_TOPK {
-			topK = MAX_SIMILAR_TOPK
-		}
-		// vec is validated to contain only digits, signs, dots, exponents, commas and
-		// brackets, so it is safe to inline inside the quoted third argument.
-		query += `
-		query q(__QVARS__) {
-			qr(func: similar_to(vec, ` + fmt.Sprintf("%d", topK) + `, "` + vec + `")__PAGEARGS__)
-		`
-
-	} else if q.Geo != nil {
-		// Radius search: every node whose `g` point is within Distance metres of Point.
-		// Results are still access-filtered (@filter below). Note this is a containment
-		// test — Dgraph returns geo matches in uid order, so First truncates arbitrarily
-		// rather than yielding the nearest N. See req.QueryGeo.
+	if q.Geo != nil {
+		// Geo search: every node whose `g` is within Distance metres of Point, or is
+		// within, contains or intersects Shape. Results are still access-filtered (@filter
+		// below). Dgraph returns geo matches in uid order, so First truncates arbitrarily
+		// rather than yielding the nearest N; mode nearest (queryNearest) is for that. See
+		// req.QueryGeo.
 		rootFunc, gerr := renderGeoRootFunc(q.Geo)
 		if gerr != nil {
 			return res.CoggedResponseFromError(gerr.Error())
@@ -833,18 +1227,27 @@ func (d *DB) QueryWithOptions(q *req.QueryRequest, et EdgeType, uad *sec.UserAut
 		vars["$ids"] = serialisedParentNodeList
 
 		if recurseDepth > 0 {
-			vars["$rdepth"] = fmt.Sprintf("%d", recurseDepth)
 			fixedParams = append(fixedParams, "$ids: string", "$rdepth: int")
-			query = `query q(__QVARS__) {
-				var(func: uid($ids)) @recurse(depth: $rdepth) 
-				{
-				  NID as uid
-				  __EDGETYPE__
+			levels := ""
+			if q.WithDepth || tree {
+				traversalRoots = sanitisedParentNodeList
+				// every edge between nodes the walk reached, from which the depth of each
+				// is worked out below
+				levels = `
+				lv(func: uid(NID)) {
+				  uid
+				  ` + strings.Join(strings.Fields(edgePreds), " @filter(uid(NID)) { uid }\n\t\t\t\t  ") + ` @filter(uid(NID)) { uid }
 				}
-			  
+			  `
+			}
+			query = `query q(__QVARS__) {
+				` + renderRecurseVar(q, edgePreds, recurseDepth, &vars) + `
+			  ` + levels + `
 				qr(func: uid(NID)__PAGEARGS__)`
-			query = strings.ReplaceAll(query, "__EDGETYPE__", getEdgePredicateName(et))
 		} else {
+			if q.WithDepth || tree {
+				traversalRoots = sanitisedParentNodeList
+			}
 			fixedParams = append(fixedParams, "$ids: string")
 			query = `query q(__QVARS__) {
 				qr(func: uid($ids)__PAGEARGS__)`
@@ -854,10 +1257,35 @@ func (d *DB) QueryWithOptions(q *req.QueryRequest, et EdgeType, uad *sec.UserAut
 		epoch := time.Unix(0, 0)
 		q.Filters = &req.QueryRequestClause{Field: "m", Op: "gt", Val: epoch.String()}
 	}
+	keys := orderKeys(q)
+	if q.PageCursor != nil && !slices.Equal(q.PageCursor.Order, cursorOrder(keys)) {
+		return res.CoggedResponseFromError("cursor does not match the query's order_by")
+	}
+	paged := q.First != nil && *q.First > 0
+	resultBody := "uid own {uid} sgi r w o i d s __FIELDS__"
+	if paged {
+		resultBody += renderOrderAliases(keys)
+	}
+	pageBlocks := ""
+	if q.PageCursor != nil && len(keys) > 0 {
+		// the matching nodes become the PG variable, from which the qr and tie blocks read
+		// the page after the cursor
+		query = strings.Replace(query, "qr(func:", "PG as var(func:", 1)
+		pageBlocks = renderCursorBlocks(q, keys, resultBody, &vars)
+		resultBody = "uid"
+	}
+	aggregateBlocks := ""
+	if q.Aggregate != nil {
+		// the matching nodes become the AGG variable the aggregates are computed over, in
+		// place of the qr result block
+		query = strings.Replace(query, "qr(func:", "AGG as var(func:", 1)
+		resultBody = renderAggregateVars(q.Aggregate)
+		aggregateBlocks = renderAggregateBlocks(q.Aggregate)
+	}
 	query += `  @filter(__FILTERS__)
 			{
-				uid own {uid} sgi r w o i d s __FIELDS__
-			}
+				` + resultBody + `
+			}` + pageBlocks + aggregateBlocks + `
 		}`
 
 	fields := ""
@@ -866,6 +1294,11 @@ func (d *DB) QueryWithOptions(q *req.QueryRequest, et EdgeType, uad *sec.UserAut
 	}
 	query = strings.ReplaceAll(query, "__FIELDS__", fields)
 	userFilter := constructQueryStringAndAddVars(*q.Filters, &vars)
+	if len(keys) > 0 && (paged || q.PageCursor != nil) {
+		// only a paged query needs every node placed in the order; an unpaged one keeps the
+		// nodes without a key, which Dgraph sorts last
+		userFilter = "(" + userFilter + ") AND " + renderHasKeys(keys)
+	}
 	if authz := renderReadAuthzFilter(et, uad, allowedSgis); authz != "" {
 		userFilter = "(" + userFilter + ") AND " + authz
 	}
@@ -873,15 +1306,217 @@ func (d *DB) QueryWithOptions(q *req.QueryRequest, et EdgeType, uad *sec.UserAut
 	query = strings.ReplaceAll(query, "__PAGEARGS__", renderPagination(q))
 	query = strings.ReplaceAll(query, "__QVARS__", renderQueryParams(fixedParams, &vars))
 
-	sp, err := d.Query(query, &vars)
+	// a paginated query is read at a snapshot, which its later pages can pass back to be
+	// read at too
+	var sp *string
+	var err error
+	snapshot := q.ReadSnapshot
+	if paged || q.PageCursor != nil || snapshot != nil {
+		var ts, readTs uint64
+		if snapshot != nil {
+			ts = snapshot.Ts
+		}
+		sp, readTs, err = d.QueryAt(query, &vars, ts)
+		if err == nil && snapshot == nil && readTs != 0 {
+			snapshot = &cm.ReadSnapshot{Ts: readTs, Expires: time.Now().Unix() + d.SnapshotExpiry}
+		}
+	} else {
+		sp, err = d.Query(query, &vars)
+	}
 	if err != nil {
 		return res.CoggedResponseFromError("DB query failed")
 	}
+	if q.Aggregate != nil {
+		groups, err := parseAggregates(sp, q.Aggregate)
+		if err != nil {
+			return res.CoggedResponseFromError("could not parse aggregates")
+		}
+		return res.CoggedResponseFromAggregates(groups)
+	}
 	nodesReturned := SliceFromResultJSON[cm.GraphNode](sp)
+	hasMore := false
+	var pageEnd *cm.PageCursor
+	if paged || q.PageCursor != nil {
+		ties, rest, err := parsePage(sp, keys)
+		if err != nil {
+			return res.CoggedResponseFromError("could not read query result")
+		}
+		page, more, continuable := append(ties, rest...), false, true
+		if paged && len(keys) > 0 {
+			page, more, continuable = cutPage(ties, rest, *q.First)
+			if more && !continuable && q.Offset == nil {
+				// the page is all one run of ties, cut short by Dgraph: read the run in uid
+				// order instead, as a cursor from just before it would
+				q.PageCursor = &cm.PageCursor{Order: cursorOrder(keys), Vals: page[0].vals, Uid: "0x0"}
+				q.ReadSnapshot = snapshot
+				return d.QueryWithOptions(q, et, uad, allowedSgis)
+			}
+		} else if paged && len(page) > *q.First {
+			page, more = page[:*q.First], true
+		}
+		nodes := []*cm.GraphNode{}
+		for _, pn := range page {
+			nodes = append(nodes, pn.node)
+		}
+		hasMore = more
+		if last := len(page) - 1; more && continuable && last >= 0 && page[last].vals != nil {
+			pageEnd = &cm.PageCursor{Order: cursorOrder(keys), Vals: page[last].vals, Uid: page[last].node.Uid}
+		}
+		nodesReturned = &nodes
+	}
+	if traversalRoots != nil && nodesReturned != nil {
+		adj, err := traversalEdges(sp, strings.Fields(edgePreds))
+		if err != nil {
+			return res.CoggedResponseFromError("could not read traversal edges")
+		}
+		if tree {
+			roots := buildTree(*nodesReturned, adj, traversalRoots, q.WithDepth)
+			nodesReturned = &roots
+		} else {
+			annotateDepths(*nodesReturned, adj, traversalRoots)
+		}
+	}
 	resp := res.CoggedResponseFromNodes(nodesReturned)
+	resp.HasMore, resp.PageEnd, resp.ReadAt = hasMore, pageEnd, snapshot
 	return resp
 }
 
+// renderRecurseVar returns the var block of a root_ids traversal, which walks edgePreds
+// from the roots in $ids down to depth, pruned by the query's TraverseFilter, and collects
+// the nodes reached (the roots among them) as NID. It binds $rdepth; the caller binds $ids.
+func renderRecurseVar(q *req.QueryRequest, edgePreds string, depth uint, vars *map[string]string) string {
+	(*vars)["$rdepth"] = fmt.Sprintf("%d", depth)
+	walk := strings.Fields(edgePreds)
+	if q.TraverseFilter != nil {
+		tf := " @filter(" + constructQueryStringAndAddVars(*q.TraverseFilter, vars) + ")"
+		for i := range walk {
+			walk[i] += tf
+		}
+	}
+	return `var(func: uid($ids)) @recurse(depth: $rdepth) 
+				{
+				  NID as uid
+				  ` + strings.Join(walk, "\n\t\t\t\t  ") + `
+				}`
+}
+
+// traversalEdges reads the lv block of a traversal result into an adjacency list: for each
+// node reached, the nodes it leads to along preds. A result without an lv block (a query
+// that did not recurse) gives no edges.
+func traversalEdges(result *string, preds []string) (map[string][]string, error) {
+	var a struct {
+		LV []map[string]json.RawMessage `json:"lv"`
+	}
+	if err := json.Unmarshal([]byte(*result), &a); err != nil {
+		log.Error("unmarshal traversal levels", err)
+		return nil, err
+	}
+	adj := make(map[string][]string)
+	for _, n := range a.LV {
+		var uid string
+		if err := json.Unmarshal(n["uid"], &uid); err != nil {
+			return nil, err
+		}
+		for _, p := range preds {
+			var next []cm.GraphBase
+			if raw, ok := n[p]; ok {
+				if err := json.Unmarshal(raw, &next); err != nil {
+					return nil, err
+				}
+			}
+			for _, d := range next {
+				adj[uid] = append(adj[uid], d.Uid)
+			}
+		}
+	}
+	return adj, nil
+}
+
+// annotateDepths sets Depth on each node by a breadth-first walk from the roots over the
+// edges between the nodes reached. Dgraph's @recurse does not report the level it reached
+// a node at, so it is worked out here rather than in the query.
+func annotateDepths(nodes []*cm.GraphNode, adj map[string][]string, roots []string) {
+	depth := make(map[string]int)
+	queue := []string{}
+	for _, r := range roots {
+		if _, ok := depth[r]; !ok {
+			depth[r] = 0
+			queue = append(queue, r)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, next := range adj[n] {
+			if _, ok := depth[next]; !ok {
+				depth[next] = depth[n] + 1
+				queue = append(queue, next)
+			}
+		}
+	}
+	for _, n := range nodes {
+		if d, ok := depth[n.Uid]; ok {
+			n.Depth = &d
+		}
+	}
+}
+
+// buildTree nests the nodes returned by a traversal under the roots, breadth first, so
+// each node sits at the fewest edges it can be reached in. Only the returned nodes (those
+// the caller may read and that pass the query's filters) are walked through, so anything
+// reachable only by way of a hidden node is left out. A node is nested in full once; every
+// other edge into it, including one that closes a cycle, gets a stub with just its uid,
+// owner and permissions, like the entries of a flat result's `e` list. With withDepth each
+// full node's Depth is its level in the tree.
+func buildTree(nodes []*cm.GraphNode, adj map[string][]string, roots []string, withDepth bool) []*cm.GraphNode {
+	byUid := make(map[string]*cm.GraphNode)
+	for _, n := range nodes {
+		// a selected `e` would be the flat edge list; the tree replaces it
+		n.OutEdges = nil
+		n.Depth = nil
+		byUid[n.Uid] = n
+	}
+
+	placed := make(map[string]bool)
+	level := make(map[string]int)
+	tree := []*cm.GraphNode{}
+	queue := []*cm.GraphNode{}
+	for _, r := range roots {
+		if n, ok := byUid[r]; ok && !placed[r] {
+			placed[r] = true
+			tree = append(tree, n)
+			queue = append(queue, n)
+		}
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if withDepth {
+			d := level[n.Uid]
+			n.Depth = &d
+		}
+		children := []*cm.GraphNode{}
+		for _, c := range adj[n.Uid] {
+			child, ok := byUid[c]
+			if !ok {
+				continue
+			}
+			if placed[c] {
+				children = append(children, cm.NewGraphNodeJustOwnerAndPerms(child))
+				continue
+			}
+			placed[c] = true
+			level[c] = level[n.Uid] + 1
+			children = append(children, child)
+			queue = append(queue, child)
+		}
+		if len(children) > 0 {
+			n.OutEdges = &children
+		}
+	}
+	return tree
+}
+
 func MakeTempKeyFromString(s string, tmpkeyToGuidMap *map[string]string) string {
 	var safeID string
 	if guid, ok := (*tmpkeyToGuidMap)[s]; ok {
@@ -1003,6 +1638,9 @@ func checkUpsertNodeList(nodeList *[]*cm.GraphNode) error {
 		if !ValidateUid(strings.TrimSpace(n.Uid)) && defined[n.Uid] {
 			return DBError{Info: fmt.Sprintf("duplicate temporary uid %q: each new node needs its own placeholder", n.Uid)}
 		}
+		if !ValidateUid(strings.TrimSpace(n.Uid)) && len(n.Unset) > 0 {
+			return DBError{Info: fmt.Sprintf("new node %q has nothing to unset", n.Uid)}
+		}
 		defined[n.Uid] = true
 	}
 	for _, n := range *nodeList {
@@ -1026,6 +1664,156 @@ func checkUpsertNodeList(nodeList *[]*cm.GraphNode) error {
 	return nil
 }
 
+// queryNodeTypes returns the stored ty of each of uids that has one.
+func (db *DB) queryNodeTypes(uids []string) (map[string]string, error) {
+	vars := map[string]string{
+		"$ids": "[" + strings.Join(sanitiseListOfUids(uids), ",") + "]",
+	}
+	query := `query q($ids: string) {
+		qr(func: uid($ids)) {
+			uid
+			ty
+		}
+	}`
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, err
+	}
+	nodes := SliceFromResultJSON[cm.GraphNode](sp)
+	if nodes == nil {
+		return nil, DBError{Info: "could not parse node types"}
+	}
+	types := make(map[string]string)
+	for _, n := range *nodes {
+		if n.Type != nil {
+			types[n.Uid] = *n.Type
+		}
+	}
+	return types, nil
+}
+
+// checkPayloadUpdates checks each existing node in an upsert against the payload schema of
+// its type. UpdateNodesRequest.Validate can only check nodes that state their ty; here the
+// stored ty is known, so it covers the rest, and type changes too, for which the stored
+// slots are read as well.
+func (db *DB) checkPayloadUpdates(nodeList *[]*cm.GraphNode) error {
+	if len(cm.PayloadSchemaList()) == 0 {
+		return nil
+	}
+	uids := []string{}
+	for _, n := range *nodeList {
+		if ValidateUid(n.Uid) {
+			uids = append(uids, n.Uid)
+		}
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	types, err := db.queryNodeTypes(uids)
+	if err != nil {
+		return err
+	}
+	retyped := []string{}
+	for _, n := range *nodeList {
+		if ValidateUid(n.Uid) && n.Type != nil && *n.Type != types[SanitiseUID(n.Uid)] {
+			retyped = append(retyped, n.Uid)
+		}
+	}
+	stored := make(map[string]*cm.GraphNode)
+	if len(retyped) > 0 {
+		if stored, err = db.queryNodePayloads(retyped); err != nil {
+			return err
+		}
+	}
+	for _, n := range *nodeList {
+		if !ValidateUid(n.Uid) {
+			continue
+		}
+		uid := SanitiseUID(n.Uid)
+		st, ok := stored[uid]
+		if !ok {
+			st = cm.NewGraphNodeJustUID(uid)
+		}
+		if ty, ok := types[uid]; ok {
+			st.Type = &ty
+		}
+		if err := cm.ValidateNodePayloadUpdate(n, st); err != nil {
+			return PolicyError{Info: err.Error()}
+		}
+	}
+	return nil
+}
+
+// queryNodePayloads reads the stored payload slots of the given nodes, keyed by uid, for
+// checking a type change against the slots the node already holds.
+func (db *DB) queryNodePayloads(uids []string) (map[string]*cm.GraphNode, error) {
+	vars := map[string]string{
+		"$ids": "[" + strings.Join(sanitiseListOfUids(uids), ",") + "]",
+	}
+	query := `query q($ids: string) {
+		qr(func: uid($ids)) {
+			uid
+			s1
+			s2
+			s3
+			s4
+			b
+			n1
+			n2
+			t1
+			t2
+		}
+	}`
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, err
+	}
+	nodes := SliceFromResultJSON[cm.GraphNode](sp)
+	if nodes == nil {
+		return nil, DBError{Info: "could not parse node payloads"}
+	}
+	stored := make(map[string]*cm.GraphNode)
+	for _, n := range *nodes {
+		stored[n.Uid] = n
+	}
+	return stored, nil
+}
+
+// unsetMutation is the delete half of an upsert: a null for each predicate a node unsets,
+// which deletes all its values. It is nil if no node unsets anything.
+func unsetMutation(nodeList *[]*cm.GraphNode) []map[string]interface{} {
+	var del []map[string]interface{}
+	for _, n := range *nodeList {
+		if len(n.Unset) == 0 {
+			continue
+		}
+		d := map[string]interface{}{"uid": SanitiseUID(n.Uid)}
+		for _, pred := range n.Unset {
+			d[pred] = nil
+		}
+		del = append(del, d)
+	}
+	return del
+}
+
+// upsertEdges lists the out-edges carried by an upsert's nodes, and the ty of every node
+// that sets one, for checkTopology.
+func upsertEdges(nodeList *[]*cm.GraphNode) ([]edgeSpec, map[string]*string) {
+	edges := []edgeSpec{}
+	types := make(map[string]*string)
+	for _, n := range *nodeList {
+		if n.Type != nil {
+			types[n.Uid] = n.Type
+		}
+		if n.OutEdges != nil {
+			for _, e := range *n.OutEdges {
+				edges = append(edges, edgeSpec{src: n.Uid, dst: e.Uid})
+			}
+		}
+	}
+	return edges, types
+}
+
 func (db *DB) UpsertNodes(nodeList *[]*cm.GraphNode) (*res.CoggedResponse, error) {
 	newUidsToReturn := make(cm.NodePtrDictionary)
 	safeKeyToOriginalMap := make(map[string]string)
@@ -1035,6 +1823,21 @@ func (db *DB) UpsertNodes(nodeList *[]*cm.GraphNode) (*res.CoggedResponse, error
 	if err := checkUpsertNodeList(nodeList); err != nil {
 		return res.CoggedResponseFromError(err.Error()), err
 	}
+	if err := db.checkPayloadUpdates(nodeList); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+	if err := db.checkUniqueIDs(nodeList); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+	if err := db.checkTopology(upsertEdges(nodeList)); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+	if err := db.embedNodes(nodeList); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+
+	// read after embedNodes, which unsets the vec of a node left with no text to embed
+	unset := unsetMutation(nodeList)
 
 	for _, n := range *nodeList {
 		originalKeyToNodeMap[n.Uid] = n
@@ -1055,7 +1858,7 @@ func (db *DB) UpsertNodes(nodeList *[]*cm.GraphNode) (*res.CoggedResponse, error
 					}
 				}
 				(*edgePtr).Uid = uidOrSafeUid
-				(*edgePtr).AuthzData = ""
+				(*edgePtr).ClearUnstoredFields()
 			}
 		}
 
@@ -1066,10 +1869,17 @@ func (db *DB) UpsertNodes(nodeList *[]*cm.GraphNode) (*res.CoggedResponse, error
 			n.TimeCreated = n.TimeModified
 			n.DgraphType = []string{"N"}
 		}
-		n.AuthzData = ""
+		n.ClearUnstoredFields()
 	}
 
-	mr, err := db.Mutate(nodeList, ADD)
+	// the deletes go in the same transaction as the sets, and m is bumped for both
+	var mr *api.Response
+	var err error
+	if unset != nil {
+		mr, err = db.MutateSetDelete(nodeList, unset)
+	} else {
+		mr, err = db.Mutate(nodeList, ADD)
+	}
 	if mr == nil || err != nil {
 		return res.CoggedResponseFromError("DB operation failed"), err
 	}
@@ -1185,6 +1995,25 @@ deleteJson : json
 func (db *DB) UpdateEdges(utype UpdateType, nodeUids, srcUids, destUids *[]string) (*res.CoggedResponse, error) {
 	updateList := make([]cm.GraphNode, 0)
 
+	if utype == ADD {
+		edges := []edgeSpec{}
+		for _, uid := range *nodeUids {
+			if srcUids != nil {
+				for _, src := range *srcUids {
+					edges = append(edges, edgeSpec{src: src, dst: uid})
+				}
+			}
+			if destUids != nil {
+				for _, dst := range *destUids {
+					edges = append(edges, edgeSpec{src: uid, dst: dst})
+				}
+			}
+		}
+		if err := db.checkTopology(edges, nil); err != nil {
+			return res.CoggedResponseFromError(err.Error()), err
+		}
+	}
+
 	if err := db.AddIncomingEdges(nodeUids, srcUids, &updateList, true); err != nil {
 		return res.CoggedResponseFromError("DB operation failed"), err
 	}
@@ -1368,6 +2197,13 @@ func (db *DB) UpsertUsers(users *[]*cm.GraphUser) (*res.CoggedResponse, error) {
 func (db *DB) UpsertUserNode(node *cm.GraphNode, userUid string) (*res.CoggedResponse, error) {
 	// Set node properties
 	node.Uid = "_:new"
+	node.Owner = &cm.GraphUser{GraphBase: cm.GraphBase{Uid: userUid}}
+	if err := db.checkUniqueIDs(&[]*cm.GraphNode{node}); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+	if err := db.embedNodes(&[]*cm.GraphNode{node}); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
 	tnow := time.Now().UTC()
 	node.TimeModified = &tnow
 	node.TimeCreated = node.TimeModified
@@ -1396,6 +2232,522 @@ func (db *DB) UpsertUserNode(node *cm.GraphNode, userUid string) (*res.CoggedRes
 	return res.CoggedResponseFromNodesMap(&newUidAndNode), nil
 }
 
+// queryOwnedSubgraph returns the uid, owner, sgi and permission bits of each root that is
+// owned by ownerUid, plus every node reachable from those roots along `e` within depth
+// levels that is owned by the same user. The walk is pruned at the first node owned by
+// anyone else, so a subtree reached only through a foreign node is never included.
+//
+// Roots not owned by ownerUid are dropped rather than reported: the caller's AuthzData for
+// a root may be stale (the node changed hands since it was issued), and the DB is the
+// authority on who owns it now.
+func (db *DB) queryOwnedSubgraph(rootUids []string, ownerUid string, depth uint) (*[]*cm.GraphNode, error) {
+	if depth > MAX_QUERY_RECURSE_DEPTH {
+		depth = MAX_QUERY_RECURSE_DEPTH
+	}
+	ownedBy := "uid_in(own, " + SanitiseUID(ownerUid) + ")"
+	vars := map[string]string{
+		"$ids": "[" + strings.Join(sanitiseListOfUids(rootUids), ",") + "]",
+	}
+
+	var query string
+	if depth > 0 {
+		vars["$rdepth"] = fmt.Sprintf("%d", depth)
+		query = `query q($ids: string, $rdepth: int) {
+			var(func: uid($ids)) @filter(` + ownedBy + `) @recurse(depth: $rdepth) {
+				NID as uid
+				e @filter(` + ownedBy + `)
+			}
+
+			qr(func: uid(NID)) @filter(` + ownedBy + `) {
+				uid own {uid} sgi r w o i d s
+			}
+		}`
+	} else {
+		query = `query q($ids: string) {
+			qr(func: uid($ids)) @filter(` + ownedBy + `) {
+				uid own {uid} sgi r w o i d s
+			}
+		}`
+	}
+
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, err
+	}
+	nodes := SliceFromResultJSON[cm.GraphNode](sp)
+	if nodes == nil {
+		return nil, DBError{Info: "could not parse owned subgraph"}
+	}
+	return nodes, nil
+}
+
+// groupRootsByOwner groups already-authorised root nodes by their owner, skipping any owned
+// by skipOwner. A sys caller may pass nodes belonging to several users in one request, and
+// each user's subgraph is walked separately so the walk stays inside what that user owns.
+func groupRootsByOwner(roots []*cm.GraphNode, skipOwner string) ([]string, map[string][]string) {
+	owners := []string{}
+	rootsByOwner := make(map[string][]string)
+	for _, n := range roots {
+		if n == nil || n.Owner == nil {
+			continue
+		}
+		owner := SanitiseUID(n.Owner.Uid)
+		if owner == skipOwner {
+			continue
+		}
+		if _, ok := rootsByOwner[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		rootsByOwner[owner] = append(rootsByOwner[owner], n.Uid)
+	}
+	return owners, rootsByOwner
+}
+
+// ownedSubgraphBlocks renders, for an upsert block, the subgraph that queryOwnedSubgraph
+// reads for the i-th owner: the roots in $ids<i> owned by owner and what hangs off them
+// owned by the same user, within depth levels. m<i> holds their uids, and the qt<i> block
+// returns them as they were before the block's mutations. It binds $ids<i> and, for depth
+// above 0, $rdepth, and returns their declarations.
+func ownedSubgraphBlocks(i int, owner string, roots []string, depth uint, vars map[string]string) ([]string, []string) {
+	if depth > MAX_QUERY_RECURSE_DEPTH {
+		depth = MAX_QUERY_RECURSE_DEPTH
+	}
+	ownedBy := "uid_in(own, " + SanitiseUID(owner) + ")"
+	decl := []string{fmt.Sprintf("$ids%d: string", i)}
+	vars[fmt.Sprintf("$ids%d", i)] = "[" + strings.Join(sanitiseListOfUids(roots), ",") + "]"
+	blocks := []string{}
+	if depth > 0 {
+		if _, ok := vars["$rdepth"]; !ok {
+			decl = append(decl, "$rdepth: int")
+			vars["$rdepth"] = fmt.Sprintf("%d", depth)
+		}
+		blocks = append(blocks,
+			fmt.Sprintf("var(func: uid($ids%d)) @filter(%s) @recurse(depth: $rdepth) { t%d as uid e @filter(%s) }", i, ownedBy, i, ownedBy),
+			fmt.Sprintf("m%d as var(func: uid(t%d)) @filter(%s)", i, i, ownedBy))
+	} else {
+		blocks = append(blocks, fmt.Sprintf("m%d as var(func: uid($ids%d)) @filter(%s)", i, i, ownedBy))
+	}
+	blocks = append(blocks, fmt.Sprintf("qt%d(func: uid(m%d)) { uid own {uid} sgi r w o i d s }", i, i))
+	return decl, blocks
+}
+
+// TransferNodeOwnership makes newOwnerUid the owner of each root node and, down to depth
+// levels, of every descendant owned by the same user as the root it hangs off. In the same
+// transaction each transferred node is unlinked from its previous owner's `nodes` list and
+// the roots are linked into the new owner's, so they show up in the new owner's POST
+// /user/nodes/own. With keepShare, each previous owner is given a share edge to the roots
+// they gave away; what that lets them do is still decided by the nodes' permission bits.
+//
+// The owned subgraph is found and rewritten in one upsert block, so a node that changes
+// hands while the transfer runs is never moved on the strength of a stale read: the walk
+// and every write are conditioned on uid_in(own, ...) for the previous owner.
+//
+// roots must already be authorised (see requests.TransferNodesRequest); their Owner field
+// is used only to group them, the DB re-checks ownership. The returned response lists the
+// transferred nodes with their new owner, ready for AuthzDataPack.
+func (db *DB) TransferNodeOwnership(roots []*cm.GraphNode, newOwnerUid string, depth uint, keepShare bool) (*res.CoggedResponse, error) {
+	nothing := DBError{Info: "no nodes to transfer: none of the nodes are owned by their supplied owner, or they already belong to the new owner"}
+	newOwner := SanitiseUID(newOwnerUid)
+	owners, rootsByOwner := groupRootsByOwner(roots, newOwner)
+	if len(owners) == 0 {
+		return res.CoggedResponseFromError(nothing.Error()), nothing
+	}
+
+	// for each previous owner i: m<i> is every node to move, r<i> the roots among them
+	tnow := time.Now().UTC()
+	decl, blocks := []string{}, []string{}
+	vars := make(map[string]string)
+	mus := []*api.Mutation{}
+	for i, from := range owners {
+		d, b := ownedSubgraphBlocks(i, from, rootsByOwner[from], depth, vars)
+		decl, blocks = append(decl, d...), append(blocks, b...)
+		blocks = append(blocks, fmt.Sprintf("r%d as var(func: uid(m%d)) @filter(uid($ids%d))", i, i, i))
+
+		moved := []*cm.GraphNode{cm.NewGraphNodeJustUID(fmt.Sprintf("uid(m%d)", i))}
+		movedRoots := []*cm.GraphNode{cm.NewGraphNodeJustUID(fmt.Sprintf("uid(r%d)", i))}
+		set := []interface{}{
+			&cm.GraphNode{GraphBase: cm.GraphBase{Uid: fmt.Sprintf("uid(m%d)", i)}, Owner: cm.NewGraphUser(newOwner), TimeModified: &tnow},
+			&cm.GraphUser{GraphBase: cm.GraphBase{Uid: newOwner}, Nodes: &movedRoots},
+		}
+		if keepShare {
+			set = append(set, &cm.GraphUser{GraphBase: cm.GraphBase{Uid: from}, Shared: &movedRoots})
+		}
+		// Any transferred node may hang directly off the previous owner's user node, not
+		// just the roots; deleting an edge that does not exist is a no-op.
+		del := []interface{}{&cm.GraphUser{GraphBase: cm.GraphBase{Uid: from}, Nodes: &moved}}
+		sj, _ := json.Marshal(set)
+		dj, _ := json.Marshal(del)
+		mus = append(mus, &api.Mutation{SetJson: sj, DeleteJson: dj, Cond: fmt.Sprintf("@if(gt(len(m%d), 0))", i)})
+	}
+
+	query := "query q(" + strings.Join(decl, ", ") + ") {\n" + strings.Join(blocks, "\n") + "\n}"
+	mr, err := db.Upsert(query, vars, mus)
+	if mr == nil || err != nil {
+		return res.CoggedResponseFromError("DB operation failed"), err
+	}
+	found := make(map[string][]*cm.GraphNode)
+	if err := json.Unmarshal(mr.Json, &found); err != nil {
+		return res.CoggedResponseFromError("could not parse upsert result"), DBError{Info: "could not parse upsert result"}
+	}
+
+	transferred := []*cm.GraphNode{}
+	for i := range owners {
+		for _, n := range found[fmt.Sprintf("qt%d", i)] {
+			n.Owner = cm.NewGraphUser(newOwner)
+			transferred = append(transferred, n)
+		}
+	}
+	if len(transferred) == 0 {
+		return res.CoggedResponseFromError(nothing.Error()), nothing
+	}
+	return res.CoggedResponseFromNodes(&transferred), nil
+}
+
+// queryShareesAbove returns every user holding a share edge to one of uids or to a node
+// above them, along with the out-edges of each node on the way, so the caller can work out
+// which of uids each of those users can reach.
+func (db *DB) queryShareesAbove(uids []string) (*[]*cm.GraphUser, map[string][]string, error) {
+	vars := map[string]string{
+		"$ids":    "[" + strings.Join(sanitiseListOfUids(uids), ",") + "]",
+		"$rdepth": fmt.Sprintf("%d", MAX_QUERY_RECURSE_DEPTH),
+	}
+	query := `query q($ids: string, $rdepth: int) {
+		var(func: uid($ids)) @recurse(depth: $rdepth) {
+			ANC as uid
+			~e
+		}
+
+		var(func: uid(ANC)) {
+			SH as ~shr
+		}
+
+		anc(func: uid(ANC)) {
+			uid
+			e { uid }
+		}
+
+		qr(func: uid(SH)) @filter(type(U)) {
+			uid un role
+			shr { uid own {uid} sgi r }
+		}
+	}`
+
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharees := SliceFromResultJSON[cm.GraphUser](sp)
+	var a struct {
+		Anc []*cm.GraphNode `json:"anc"`
+	}
+	if sharees == nil || json.Unmarshal([]byte(*sp), &a) != nil {
+		return nil, nil, DBError{Info: "could not parse sharees"}
+	}
+
+	edges := make(map[string][]string)
+	for _, n := range a.Anc {
+		if n.OutEdges == nil {
+			continue
+		}
+		for _, e := range *n.OutEdges {
+			edges[n.Uid] = append(edges[n.Uid], e.Uid)
+		}
+	}
+	return sharees, edges, nil
+}
+
+// canShareeRead mirrors the read check in CoggedResponse.AuthzDataPack for a non-owner:
+// the node must be readable and its share group granted to them.
+func canShareeRead(n *cm.GraphNode, granted map[string]bool) bool {
+	return n.PermRead != nil && *n.PermRead && n.Sgi != nil && granted[*n.Sgi]
+}
+
+// sharedSgis is the set of share groups a user is granted by their share edges, the same
+// set api.AllowListSharedSgis puts on their session allowlist. Nodes found in override are
+// taken in that state rather than as stored.
+func sharedSgis(u *cm.GraphUser, override map[string]*cm.GraphNode) map[string]bool {
+	granted := make(map[string]bool)
+	if u.Shared == nil {
+		return granted
+	}
+	for _, n := range *u.Shared {
+		if o, ok := override[n.Uid]; ok {
+			n = o
+		}
+		if n.Owner != nil && n.Owner.Uid == u.Uid {
+			continue
+		}
+		if n.PermRead != nil && *n.PermRead && n.Sgi != nil {
+			granted[*n.Sgi] = true
+		}
+	}
+	return granted
+}
+
+// shareeAccessChanges works out, for each sharee, how many of the affected nodes they can
+// reach (by following out-edges from their share edges) and read before the change but not
+// after, and vice versa, plus which share groups their session allowlist gains and loses.
+// Sharees whose access does not change are left out.
+func shareeAccessChanges(sharees []*cm.GraphUser, edges map[string][]string, before, after map[string]*cm.GraphNode) []*res.ShareeAccessChange {
+	changes := []*res.ShareeAccessChange{}
+	for _, u := range sharees {
+		grantedBefore := sharedSgis(u, nil)
+		grantedAfter := sharedSgis(u, after)
+
+		reached := make(map[string]bool)
+		queue := []string{}
+		if u.Shared != nil {
+			for _, n := range *u.Shared {
+				queue = append(queue, n.Uid)
+			}
+		}
+		for len(queue) > 0 {
+			uid := queue[0]
+			queue = queue[1:]
+			if reached[uid] {
+				continue
+			}
+			reached[uid] = true
+			queue = append(queue, edges[uid]...)
+		}
+
+		sc := &res.ShareeAccessChange{
+			User: &cm.GraphUser{GraphBase: cm.GraphBase{Uid: u.Uid}, Username: u.Username, Role: u.Role},
+		}
+		for uid, b := range before {
+			if !reached[uid] || (b.Owner != nil && b.Owner.Uid == u.Uid) {
+				continue
+			}
+			couldRead, canRead := canShareeRead(b, grantedBefore), canShareeRead(after[uid], grantedAfter)
+			if canRead && !couldRead {
+				sc.Gained++
+			} else if couldRead && !canRead {
+				sc.Lost++
+			}
+		}
+		for sgi := range grantedAfter {
+			if !grantedBefore[sgi] {
+				sc.SgisGranted = append(sc.SgisGranted, sgi)
+			}
+		}
+		for sgi := range grantedBefore {
+			if !grantedAfter[sgi] {
+				sc.SgisRevoked = append(sc.SgisRevoked, sgi)
+			}
+		}
+		if sc.Gained > 0 || sc.Lost > 0 || len(sc.SgisGranted) > 0 || len(sc.SgisRevoked) > 0 {
+			changes = append(changes, sc)
+		}
+	}
+	return changes
+}
+
+// UpdateSubgraphPermissions applies mask to each root node and, down to depth levels, to
+// every descendant owned by the same user as the root it hangs off, and when newSgi is not
+// empty moves all of them into that share group. The response reports how many nodes are
+// affected and which sharees gain or lose read access to any of them. With dryRun nothing
+// is written and no nodes are returned: their AuthzData would grant permissions the DB
+// does not yet hold.
+//
+// Otherwise the subgraph is walked and rewritten in one upsert block, as in
+// TransferNodeOwnership, so a node that changes hands or is linked in while the update
+// runs is judged by its owner at the time of the write, not by an earlier read.
+//
+// roots must already be authorised as owned by the caller (see
+// requests.SubgraphPermsRequest); the DB re-checks ownership during the walk.
+func (db *DB) UpdateSubgraphPermissions(roots []*cm.GraphNode, depth uint, mask *req.PermissionMask, newSgi string, dryRun bool) (*res.SubgraphPermsResponse, error) {
+	owners, rootsByOwner := groupRootsByOwner(roots, "")
+	tnow := time.Now().UTC()
+
+	var found [][]*cm.GraphNode
+	if dryRun {
+		for _, owner := range owners {
+			nodes, err := db.queryOwnedSubgraph(rootsByOwner[owner], owner, depth)
+			if err != nil {
+				return res.SubgraphPermsResponseFromError("DB query failed"), err
+			}
+			found = append(found, *nodes)
+		}
+	} else if len(owners) > 0 {
+		// every node in m<i> gets the same masked bits and share group
+		set := &cm.GraphNode{TimeModified: &tnow}
+		mask.Apply(set)
+		if newSgi != "" {
+			set.Sgi = &newSgi
+		}
+		decl, blocks := []string{}, []string{}
+		vars := make(map[string]string)
+		mus := []*api.Mutation{}
+		for i, owner := range owners {
+			d, b := ownedSubgraphBlocks(i, owner, rootsByOwner[owner], depth, vars)
+			decl, blocks = append(decl, d...), append(blocks, b...)
+			set.Uid = fmt.Sprintf("uid(m%d)", i)
+			sj, _ := json.Marshal(set)
+			mus = append(mus, &api.Mutation{SetJson: sj, Cond: fmt.Sprintf("@if(gt(len(m%d), 0))", i)})
+		}
+		query := "query q(" + strings.Join(decl, ", ") + ") {\n" + strings.Join(blocks, "\n") + "\n}"
+		mr, err := db.Upsert(query, vars, mus)
+		if mr == nil || err != nil {
+			return res.SubgraphPermsResponseFromError("DB operation failed"), err
+		}
+		qt := make(map[string][]*cm.GraphNode)
+		if err := json.Unmarshal(mr.Json, &qt); err != nil {
+			return res.SubgraphPermsResponseFromError("could not parse upsert result"), DBError{Info: "could not parse upsert result"}
+		}
+		for i := range owners {
+			found = append(found, qt[fmt.Sprintf("qt%d", i)])
+		}
+	}
+
+	affected := []*cm.GraphNode{}
+	before := make(map[string]*cm.GraphNode)
+	for _, nodes := range found {
+		for _, n := range nodes {
+			if _, ok := before[n.Uid]; !ok {
+				before[n.Uid] = n
+				affected = append(affected, n)
+			}
+		}
+	}
+	if len(affected) == 0 {
+		err := DBError{Info: "no nodes to update: none of the nodes are owned by their supplied owner"}
+		return res.SubgraphPermsResponseFromError(err.Error()), err
+	}
+
+	after := make(map[string]*cm.GraphNode)
+	updated := []*cm.GraphNode{}
+	uids := []string{}
+	for _, n := range affected {
+		u := *n
+		mask.Apply(&u)
+		if newSgi != "" {
+			u.Sgi = &newSgi
+		}
+		after[n.Uid] = &u
+		updated = append(updated, &u)
+		uids = append(uids, n.Uid)
+	}
+
+	// the sharees' share edges and the out-edges are not changed by the write, and the
+	// affected nodes are taken from before and after rather than as stored
+	sharees, edges, err := db.queryShareesAbove(uids)
+	if err != nil {
+		return res.SubgraphPermsResponseFromError("DB query failed"), err
+	}
+
+	resp := &res.SubgraphPermsResponse{
+		DryRun:        dryRun,
+		AffectedNodes: len(affected),
+		Sharees:       shareeAccessChanges(*sharees, edges, before, after),
+		ServerTime:    &tnow,
+	}
+	if !dryRun {
+		resp.ResultNodes = updated
+	}
+	return resp, nil
+}
+
+// payloadSchemaRecord is how a PayloadSchema is stored: a PS node keyed by the type it
+// applies to, holding the schema as JSON.
+type payloadSchemaRecord struct {
+	Uid        string   `json:"uid"`
+	Type       string   `json:"pst"`
+	Definition string   `json:"psd"`
+	DgraphType []string `json:"dgraph.type,omitempty"`
+}
+
+func (db *DB) queryPayloadSchemaRecords(ty *string) ([]*payloadSchemaRecord, error) {
+	vars := map[string]string{}
+	root := "type(PS)"
+	params := ""
+	if ty != nil {
+		vars["$ty"] = *ty
+		root = "eq(pst, $ty)"
+		params = "($ty: string)"
+	}
+	query := `query q` + params + ` {
+		qr(func: ` + root + `) @filter(type(PS)) {
+			uid
+			pst
+			psd
+		}
+	}`
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, err
+	}
+	records := SliceFromResultJSON[payloadSchemaRecord](sp)
+	if records == nil {
+		return nil, DBError{Info: "could not parse payload schemas"}
+	}
+	return *records, nil
+}
+
+// LoadPayloadSchemas reads every stored payload schema into the registry that request
+// validation consults (see models.PayloadSchemaFor). A stored schema that no longer
+// compiles is an error and the registry is left as it was, since leaving that schema out
+// would stop its type being validated at all. NewDB treats any error here as fatal.
+func (db *DB) LoadPayloadSchemas() error {
+	records, err := db.queryPayloadSchemaRecords(nil)
+	if err != nil {
+		return err
+	}
+	schemas := []*cm.PayloadSchema{}
+	for _, r := range records {
+		s := &cm.PayloadSchema{}
+		if err := json.Unmarshal([]byte(r.Definition), s); err != nil {
+			return DBError{Info: fmt.Sprintf("could not parse the stored payload schema for %q: %v", r.Type, err)}
+		}
+		if err := s.Compile(); err != nil {
+			return DBError{Info: fmt.Sprintf("the stored payload schema for %q does not compile: %v", r.Type, err)}
+		}
+		schemas = append(schemas, s)
+	}
+	cm.SetPayloadSchemas(schemas)
+	return nil
+}
+
+// UpsertPayloadSchema stores s (already compiled) as the schema for its type, replacing any
+// existing one, and reloads the registry.
+func (db *DB) UpsertPayloadSchema(s *cm.PayloadSchema) error {
+	existing, err := db.queryPayloadSchemaRecords(&s.Type)
+	if err != nil {
+		return err
+	}
+	def, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	rec := &payloadSchemaRecord{Uid: "_:ps", Type: s.Type, Definition: string(def), DgraphType: []string{"PS"}}
+	if len(existing) > 0 {
+		rec.Uid = existing[0].Uid
+	}
+	if _, err := db.Mutate(rec, ADD); err != nil {
+		return err
+	}
+	return db.LoadPayloadSchemas()
+}
+
+// DeletePayloadSchema removes the schema for ty, leaving nodes of that type unconstrained,
+// and reloads the registry.
+func (db *DB) DeletePayloadSchema(ty string) error {
+	existing, err := db.queryPayloadSchemaRecords(&ty)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		return DBError{Info: "no schema for type " + ty}
+	}
+	del := []map[string]string{}
+	for _, r := range existing {
+		del = append(del, map[string]string{"uid": r.Uid})
+	}
+	if _, err := db.Mutate(del, DELETE); err != nil {
+		return err
+	}
+	return db.LoadPayloadSchemas()
+}
+
 func (db *DB) UpdateUserShareEdges(uidsOfNodesToShare, uidsOfUsersToShareWith *[]string, addOrDel UpdateType) (*res.CoggedResponse, error) {
 	// Create list of shared nodes
 	var sharedNodesList []*cm.GraphNode
@@ -12,6 +12,7 @@ package services_test
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	cm "cogged/models"
 	req "cogged/requests"
@@ -357,6 +358,143 @@ func TestDBPagination(t *testing.T) {
 	}
 }
 
+// TestDBSortedCursorPaging pages a sorted query with next cursors, through runs of nodes
+// that tie on every sort key, and checks that every node with the sort keys is returned
+// once, in order.
+func TestDBSortedCursorPaging(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	folder := cm.NewGraphNodeJustUID("folder")
+	folder.Id, folder.Type = strp("sfolder_"+suffix), strp(typeFolder)
+	nodeList := []*cm.GraphNode{folder}
+	edges := &[]*cm.GraphNode{}
+	day := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	// three nodes on the first day, two on the second, one on the third, and one with no t1
+	for k, offset := range []int{0, 0, 0, 1, 1, 2, -1} {
+		key := fmt.Sprintf("msg%d", k)
+		m := cm.NewGraphNodeJustUID(key)
+		m.Id, m.Type = strp(fmt.Sprintf("smsg_%s_%d", suffix, k)), strp(typeMessage)
+		if offset >= 0 {
+			t1 := day.AddDate(0, 0, offset)
+			m.Time1 = &t1
+		}
+		nodeList = append(nodeList, m)
+		*edges = append(*edges, cm.NewGraphNodeJustUID(key))
+	}
+	folder.OutEdges = edges
+	created, err := db.UpsertNodes(&nodeList)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	first := 2
+	q := &req.QueryRequest{
+		RootIDs: []string{created.CreatedNodes["folder"].Uid},
+		Depth:   1,
+		Select:  []string{"id", "t1"},
+		Filters: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: typeMessage},
+		OrderBy: req.QueryOrder{{Field: "t1", Desc: true}, {Field: "c"}},
+		First:   &first,
+	}
+	seen := map[string]bool{}
+	var last *time.Time
+	for pages := 0; ; pages++ {
+		if pages > 6 {
+			t.Fatal("paging did not end")
+		}
+		r := db.QueryWithOptions(q, svc.NODENODE, adminUAD(), nil)
+		if r.Error != "" {
+			t.Fatalf("page query error: %s", r.Error)
+		}
+		for _, n := range r.ResultNodes {
+			if seen[n.Uid] {
+				t.Errorf("node %s returned twice", n.Uid)
+			}
+			seen[n.Uid] = true
+			if last != nil && n.Time1.After(*last) {
+				t.Errorf("node %s is out of order", n.Uid)
+			}
+			last = n.Time1
+		}
+		if !r.HasMore {
+			break
+		}
+		if r.PageEnd == nil {
+			t.Fatal("a page with more to come should give a cursor")
+		}
+		q.PageCursor = r.PageEnd
+	}
+	if len(seen) != 6 {
+		t.Errorf("expected the 6 nodes with a t1, got %d", len(seen))
+	}
+}
+
+// TestDBSnapshotPaging verifies that the later pages of a query read at the first page's
+// snapshot do not see a node added after it.
+func TestDBSnapshotPaging(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	folder := cm.NewGraphNodeJustUID("folder")
+	folder.Id, folder.Type = strp("snapfolder_"+suffix), strp(typeFolder)
+	nodeList := []*cm.GraphNode{folder}
+	edges := &[]*cm.GraphNode{}
+	for k := 0; k < 3; k++ {
+		key := fmt.Sprintf("msg%d", k)
+		m := cm.NewGraphNodeJustUID(key)
+		m.Id, m.Type = strp(fmt.Sprintf("snapmsg_%s_%d", suffix, k)), strp(typeMessage)
+		nodeList = append(nodeList, m)
+		*edges = append(*edges, cm.NewGraphNodeJustUID(key))
+	}
+	folder.OutEdges = edges
+	created, err := db.UpsertNodes(&nodeList)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+	folderUID := created.CreatedNodes["folder"].Uid
+
+	first, offset := 2, 2
+	query := func(snapshot *cm.ReadSnapshot, offset *int) *res.CoggedResponse {
+		q := &req.QueryRequest{
+			RootIDs:      []string{folderUID},
+			Depth:        1,
+			Filters:      &req.QueryRequestClause{Field: "ty", Op: "eq", Val: typeMessage},
+			First:        &first,
+			Offset:       offset,
+			ReadSnapshot: snapshot,
+		}
+		r := db.QueryWithOptions(q, svc.NODENODE, adminUAD(), nil)
+		if r.Error != "" {
+			t.Fatalf("page query error: %s", r.Error)
+		}
+		return r
+	}
+	page1 := query(nil, nil)
+	if len(page1.ResultNodes) != 2 || !page1.HasMore || page1.ReadAt == nil {
+		t.Fatalf("expected a first page of 2 with a snapshot, got %d nodes, snapshot %+v", len(page1.ResultNodes), page1.ReadAt)
+	}
+
+	late := cm.NewGraphNodeJustUID("late")
+	late.Id, late.Type = strp("snapmsg_late_"+suffix), strp(typeMessage)
+	lateRes, err := db.UpsertNodes(&[]*cm.GraphNode{late})
+	if err != nil {
+		t.Fatalf("UpsertNodes(late): %v", err)
+	}
+	if _, err := db.AddNodeEdges(&[]string{folderUID}, &[]string{}, &[]string{lateRes.CreatedNodes["late"].Uid}); err != nil {
+		t.Fatalf("AddNodeEdges(folder -> late): %v", err)
+	}
+
+	if page2 := query(page1.ReadAt, &offset); len(page2.ResultNodes) != 1 || page2.HasMore {
+		t.Errorf("expected the snapshot's last node only, got %d nodes, has_more %v", len(page2.ResultNodes), page2.HasMore)
+	}
+	if fresh := query(nil, &offset); len(fresh.ResultNodes) != 2 {
+		t.Errorf("expected a fresh read to see the late node, got %d nodes", len(fresh.ResultNodes))
+	}
+}
+
 // TestDBReadAuthzFilter verifies that a NODENODE query pushes the read-permission check
 // into DQL: a non-owner only sees nodes whose share-group they've been granted AND that
 // carry the r permission — so paginated pages contain only readable nodes.
@@ -484,7 +622,8 @@ func TestDBVectorSimilarity(t *testing.T) {
 
 	mk := func(key, id, vec string) *cm.GraphNode {
 		n := cm.NewGraphNodeJustUID(key)
-		n.Owner, n.Id, n.Type, n.PermRead, n.Vec = owner, strp(id+"_"+suffix), strp(typeMessage), &yes, strp(vec)
+		v := cm.Vector(vec)
+		n.Owner, n.Id, n.Type, n.PermRead, n.Vec = owner, strp(id+"_"+suffix), strp(typeMessage), &yes, &v
 		return n
 	}
 	nodes := []*cm.GraphNode{
@@ -515,6 +654,78 @@ func TestDBVectorSimilarity(t *testing.T) {
 	}
 }
 
+// TestDBVectorSimilarityInSubgraph verifies that a similarity search with root_ids only
+// ranks the nodes the traversal reaches, and that a whole-database search still returns
+// top_k readable nodes when the nearest vectors belong to another user.
+func TestDBVectorSimilarityInSubgraph(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	ures, err := db.UpsertUsers(&[]*cm.GraphUser{
+		{GraphBase: cm.GraphBase{Uid: "owner"}, Username: strp("simowner_" + suffix), PasswordHash: strp("pw"), Role: strp("user")},
+		{GraphBase: cm.GraphBase{Uid: "other"}, Username: strp("simother_" + suffix), PasswordHash: strp("pw"), Role: strp("user")},
+	})
+	if err != nil {
+		t.Fatalf("UpsertUsers: %v", err)
+	}
+	mk := func(key, id, vec, ownerKey string) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Owner = &cm.GraphUser{GraphBase: cm.GraphBase{Uid: ures.CreatedUids[ownerKey]}}
+		v := cm.Vector(vec)
+		n.Id, n.Type, n.Vec = strp(id+"_"+suffix), strp(typeMessage), &v
+		return n
+	}
+	folder := cm.NewGraphNodeJustUID("folder")
+	folder.Owner = &cm.GraphUser{GraphBase: cm.GraphBase{Uid: ures.CreatedUids["owner"]}}
+	folder.Id, folder.Type = strp("simfolder_"+suffix), strp(typeFolder)
+	folder.OutEdges = &[]*cm.GraphNode{cm.NewGraphNodeJustUID("a"), cm.NewGraphNodeJustUID("b"), cm.NewGraphNodeJustUID("c")}
+	nodes := []*cm.GraphNode{
+		folder,
+		mk("a", "simA", "[1.0, 0.0, 0.0]", "owner"),
+		mk("b", "simB", "[0.0, 1.0, 0.0]", "owner"),
+		mk("c", "simC", "[0.9, 0.1, 0.0]", "owner"),
+		// outside the folder, and as similar as a vector can be
+		mk("d", "simD", "[1.0, 0.0, 0.0]", "owner"),
+	}
+	// more of the nearest vectors than top_k, none of them readable by the owner
+	for i := 0; i < 30; i++ {
+		nodes = append(nodes, mk(fmt.Sprintf("x%d", i), fmt.Sprintf("simX%d", i), "[1.0, 0.0, 0.0]", "other"))
+	}
+	created, err := db.UpsertNodes(&nodes)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	ownerUAD := &sec.UserAuthData{Uid: ures.CreatedUids["owner"], Role: "user"}
+	r := db.QueryWithOptions(&req.QueryRequest{
+		RootIDs: []string{created.CreatedNodes["folder"].Uid},
+		Depth:   2,
+		Similar: &req.QuerySimilarity{Vector: "[1.0, 0.0, 0.0]", TopK: 2},
+		Select:  []string{"id"},
+	}, svc.NODENODE, ownerUAD, nil)
+	if r.Error != "" {
+		t.Fatalf("similarity query error: %s", r.Error)
+	}
+	if len(r.ResultNodes) != 2 || !findByID(r.ResultNodes[:1], "simA_"+suffix) || !findByID(r.ResultNodes[1:], "simC_"+suffix) {
+		t.Fatalf("expected simA then simC from the folder, got %+v", r.ResultNodes)
+	}
+	if s := r.ResultNodes[0].Similarity; s == nil || *s < 0.999 {
+		t.Errorf("simA should be as similar as can be, got %v", s)
+	}
+
+	r = db.QueryWithOptions(&req.QueryRequest{
+		Similar: &req.QuerySimilarity{Vector: "[1.0, 0.0, 0.0]", TopK: 2},
+		Select:  []string{"id"},
+	}, svc.NODENODE, ownerUAD, nil)
+	if r.Error != "" {
+		t.Fatalf("similarity query error: %s", r.Error)
+	}
+	if len(r.ResultNodes) != 2 || !findByID(r.ResultNodes, "simA_"+suffix) || !findByID(r.ResultNodes, "simD_"+suffix) {
+		t.Errorf("expected the owner's simA and simD past the other user's vectors, got %+v", r.ResultNodes)
+	}
+}
+
 // TestDBGeoRadiusSearch verifies the geo-indexed `g` predicate and the near() radius
 // search against a real Dgraph: that Geoloc round-trips through the write path, that a
 // radius search returns exactly the points inside it, and that the search is still scoped
@@ -740,6 +951,175 @@ func TestDBGeoFilterClause(t *testing.T) {
 	}
 }
 
+// TestDBGeoShapes verifies that Polygon and LineString values round-trip through `g` and
+// that the within, contains and intersects modes find them, both as the root function and
+// as a filter clause.
+func TestDBGeoShapes(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	rect := func(west, south, east, north float64) *cm.Geoloc {
+		return &cm.Geoloc{Type: cm.GEO_POLYGON, Polygon: [][][]float64{{
+			{west, south}, {east, south}, {east, north}, {west, north}, {west, south},
+		}}}
+	}
+	mk := func(key string, g *cm.Geoloc) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Id, n.Type, n.Location = strp(key+"_"+suffix), strp("geoshape"), g
+		return n
+	}
+	// a park by the Opera House, a walk through the CBD, the QVB and Perth
+	nodes := []*cm.GraphNode{
+		mk("park", rect(151.212, -33.866, 151.220, -33.860)),
+		mk("walk", &cm.Geoloc{Type: cm.GEO_LINESTRING, Line: [][]float64{{151.205, -33.870}, {151.210, -33.865}}}),
+		mk("qvb", &cm.Geoloc{Type: cm.GEO_POINT, Coords: []float64{151.2067, -33.8715}}),
+		mk("perth", &cm.Geoloc{Type: cm.GEO_POINT, Coords: []float64{115.8575, -31.9505}}),
+	}
+	if _, err := db.UpsertNodes(&nodes); err != nil {
+		t.Fatalf("UpsertNodes with shapes: %v", err)
+	}
+
+	search := func(g *req.QueryGeo) *res.CoggedResponse {
+		t.Helper()
+		r := db.QueryWithOptions(&req.QueryRequest{Geo: g, Select: []string{"id", "g"},
+			Filters: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "geoshape"}}, svc.NODENODE, adminUAD(), nil)
+		if r.Error != "" {
+			t.Fatalf("geo %s query error: %s", g.Mode, r.Error)
+		}
+		return r
+	}
+
+	cbd := rect(151.200, -33.875, 151.225, -33.855)
+	r := search(&req.QueryGeo{Mode: req.GEO_WITHIN, Shape: cbd})
+	for _, id := range []string{"park", "walk", "qvb"} {
+		if !findByID(r.ResultNodes, id+"_"+suffix) {
+			t.Errorf("%s should be within the CBD", id)
+		}
+	}
+	if findByID(r.ResultNodes, "perth_"+suffix) {
+		t.Error("perth is not within the CBD")
+	}
+	for _, n := range r.ResultNodes {
+		if n.Id != nil && *n.Id == "park_"+suffix && (n.Location == nil || len(n.Location.Polygon) != 1 || len(n.Location.Polygon[0]) != 5) {
+			t.Errorf("the park's polygon did not round-trip, got %+v", n.Location)
+		}
+	}
+
+	r = search(&req.QueryGeo{Mode: req.GEO_CONTAINS, Point: []float64{151.216, -33.863}})
+	if !findByID(r.ResultNodes, "park_"+suffix) || findByID(r.ResultNodes, "qvb_"+suffix) {
+		t.Errorf("only the park contains a point inside it, got %d nodes", len(r.ResultNodes))
+	}
+
+	overlap := rect(151.218, -33.864, 151.230, -33.850)
+	r = search(&req.QueryGeo{Mode: req.GEO_INTERSECTS, Shape: overlap})
+	if !findByID(r.ResultNodes, "park_"+suffix) || findByID(r.ResultNodes, "walk_"+suffix) {
+		t.Errorf("only the park overlaps the rectangle, got %d nodes", len(r.ResultNodes))
+	}
+
+	// the same test as a filter clause, beside an ordinary one
+	clause := db.QueryWithOptions(&req.QueryRequest{RootQuery: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "geoshape"},
+		Select: []string{"id"}, Filters: &req.QueryRequestClause{Geo: &req.QueryGeo{Mode: req.GEO_WITHIN, Shape: cbd}}},
+		svc.NODENODE, adminUAD(), nil)
+	if clause.Error != "" {
+		t.Fatalf("geo clause error: %s", clause.Error)
+	}
+	if !findByID(clause.ResultNodes, "walk_"+suffix) || findByID(clause.ResultNodes, "perth_"+suffix) {
+		t.Errorf("the within clause should keep the walk and drop perth, got %d nodes", len(clause.ResultNodes))
+	}
+}
+
+func TestDBGeoNearest(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	ty := fmt.Sprintf("nearest_%x", rnd)
+
+	// east of the point at widening steps, stored out of order
+	nodes := []*cm.GraphNode{}
+	for i, step := range []float64{0.1, 0.001, 1, 0.01} {
+		n := cm.NewGraphNodeJustUID(fmt.Sprintf("n%d", i))
+		n.Id, n.Type = strp(fmt.Sprintf("%s_%v", ty, step)), strp(ty)
+		n.Location = &cm.Geoloc{Type: cm.GEO_POINT, Coords: []float64{10 + step, 50}}
+		nodes = append(nodes, n)
+	}
+	if _, err := db.UpsertNodes(&nodes); err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	first, offset := 2, 2
+	q := &req.QueryRequest{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST, Point: []float64{10, 50}}, First: &first,
+		Select: []string{"id"}, Filters: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: ty}}
+	r := db.QueryWithOptions(q, svc.NODENODE, adminUAD(), nil)
+	if r.Error != "" {
+		t.Fatalf("nearest query error: %s", r.Error)
+	}
+	if len(r.ResultNodes) != 2 || *r.ResultNodes[0].Id != ty+"_0.001" || *r.ResultNodes[1].Id != ty+"_0.01" || !r.HasMore {
+		t.Fatalf("expected the two nearest with more to come, got %+v", r.ResultNodes)
+	}
+	if d := r.ResultNodes[0].DistanceM; d == nil || *d < 70 || *d > 73 {
+		t.Errorf("expected the nearest to be about 71.5 m away, got %v", d)
+	}
+
+	q.Offset, q.ReadSnapshot = &offset, r.ReadAt
+	r = db.QueryWithOptions(q, svc.NODENODE, adminUAD(), nil)
+	if r.Error != "" {
+		t.Fatalf("nearest second page error: %s", r.Error)
+	}
+	if len(r.ResultNodes) != 2 || *r.ResultNodes[0].Id != ty+"_0.1" || *r.ResultNodes[1].Id != ty+"_1" || r.HasMore {
+		t.Errorf("expected the two furthest and no more, got %+v", r.ResultNodes)
+	}
+	if r.ResultNodes[0].Location != nil {
+		t.Error("g was not selected and should not be returned")
+	}
+}
+
+func TestDBGeoClusters(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	ty := fmt.Sprintf("cluster_%x", rnd)
+
+	// three around Sydney, one in Melbourne, one in Fiji just west of the antimeridian
+	nodes := []*cm.GraphNode{}
+	for i, p := range [][]float64{{151.20, -33.87}, {151.21, -33.86}, {151.22, -33.85}, {144.96, -37.81}, {179.5, -17.7}} {
+		n := cm.NewGraphNodeJustUID(fmt.Sprintf("n%d", i))
+		n.Type = strp(ty)
+		n.Location = &cm.Geoloc{Type: cm.GEO_POINT, Coords: p}
+		nodes = append(nodes, n)
+	}
+	if _, err := db.UpsertNodes(&nodes); err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	cluster := func(bbox []float64, precision int) *res.CoggedResponse {
+		t.Helper()
+		r := db.QueryWithOptions(&req.QueryRequest{Cluster: &req.QueryCluster{BBox: bbox, Precision: precision},
+			Filters: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: ty}}, svc.NODENODE, adminUAD(), nil)
+		if r.Error != "" {
+			t.Fatalf("cluster query error: %s", r.Error)
+		}
+		return r
+	}
+
+	r := cluster([]float64{140, -40, 155, -30}, 3)
+	if len(r.Clusters) != 2 || r.Clusters[0].Count != 3 || r.Clusters[1].Count != 1 {
+		t.Errorf("expected Sydney's 3 and Melbourne's 1, got %+v", r.Clusters)
+	}
+
+	// the whole world in one coarse cell per region, and a box over the antimeridian
+	r = cluster([]float64{-180, -85, 180, 85}, 1)
+	total := 0
+	for _, c := range r.Clusters {
+		total += c.Count
+	}
+	if total != 5 {
+		t.Errorf("expected all 5 nodes counted over the world, got %d in %+v", total, r.Clusters)
+	}
+	r = cluster([]float64{170, -25, -170, -10}, 2)
+	if len(r.Clusters) != 1 || r.Clusters[0].Count != 1 {
+		t.Errorf("expected Fiji alone over the antimeridian, got %+v", r.Clusters)
+	}
+}
+
 // TestDBDuplicateTempUidRejected guards against silent data loss. Two nodes sharing a
 // placeholder hash to the same Dgraph blank node, so before this was rejected the pair
 // collapsed into one node carrying whichever values came last — verified against a real
@@ -793,3 +1173,447 @@ func TestDBDuplicateTempUidRejected(t *testing.T) {
 		t.Errorf("both nodes should survive with their own data, got %+v", r.ResultNodes)
 	}
 }
+
+// TestDBReverseTraversal builds top -> mid -> leaf and checks that a traversal from leaf
+// finds its ancestors with direction "in", and both neighbours of mid with "both".
+func TestDBReverseTraversal(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	mk := func(key string) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Id, n.Type = strp(key+"_"+suffix), strp("rev")
+		return n
+	}
+	top, mid, leaf := mk("top"), mk("mid"), mk("leaf")
+	top.OutEdges = &[]*cm.GraphNode{cm.NewGraphNodeJustUID("mid")}
+	mid.OutEdges = &[]*cm.GraphNode{cm.NewGraphNodeJustUID("leaf")}
+	nodeList := []*cm.GraphNode{top, mid, leaf}
+	res, err := db.UpsertNodes(&nodeList)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	traverse := func(root, direction string) []*cm.GraphNode {
+		r := db.QueryWithOptions(&req.QueryRequest{
+			RootIDs:   []string{res.CreatedNodes[root].Uid},
+			Depth:     uint(5),
+			Direction: direction,
+			Select:    []string{"id"},
+		}, svc.NODENODE, adminUAD(), nil)
+		if r.Error != "" {
+			t.Fatalf("%s traversal error: %s", direction, r.Error)
+		}
+		return r.ResultNodes
+	}
+
+	if got := traverse("leaf", req.DIRECTION_OUT); len(got) != 1 {
+		t.Errorf("leaf has no out-edges, so only the root should come back, got %d", len(got))
+	}
+	in := traverse("leaf", req.DIRECTION_IN)
+	if len(in) != 3 || !findByID(in, "mid_"+suffix) || !findByID(in, "top_"+suffix) {
+		t.Errorf("an 'in' traversal from leaf should reach mid and top, got %+v", in)
+	}
+	both := traverse("mid", req.DIRECTION_BOTH)
+	if len(both) != 3 || !findByID(both, "top_"+suffix) || !findByID(both, "leaf_"+suffix) {
+		t.Errorf("a 'both' traversal from mid should reach top and leaf, got %+v", both)
+	}
+}
+
+// TestDBShortestPath builds a->b->d and a->c->x->d: the shortest path from a to d goes
+// through b, unless b's type is left out of the allowed types.
+func TestDBShortestPath(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	mk := func(key, ty string, to ...string) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Id, n.Type = strp(key+"_"+suffix), strp(ty)
+		edges := []*cm.GraphNode{}
+		for _, k := range to {
+			edges = append(edges, cm.NewGraphNodeJustUID(k))
+		}
+		n.OutEdges = &edges
+		return n
+	}
+	nodeList := []*cm.GraphNode{
+		mk("a", "pkg", "b", "c"), mk("b", "vendored", "d"), mk("c", "pkg", "x"), mk("x", "pkg", "d"), mk("d", "pkg"),
+	}
+	res, err := db.UpsertNodes(&nodeList)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+	uidOf := func(k string) string { return res.CreatedNodes[k].Uid }
+
+	path := func(types []string) []string {
+		r := db.QueryShortestPaths(&req.PathRequest{
+			UnpackedFrom: cm.NewGraphNodeJustUID(uidOf("a")),
+			UnpackedTo:   cm.NewGraphNodeJustUID(uidOf("d")),
+			Types:        types,
+		}, adminUAD(), nil)
+		if r.Error != "" {
+			t.Fatalf("path query error: %s", r.Error)
+		}
+		if len(r.Paths) != 1 {
+			t.Fatalf("expected one path, got %d", len(r.Paths))
+		}
+		uids := []string{}
+		for _, n := range r.Paths[0].Nodes {
+			uids = append(uids, n.Uid)
+		}
+		return uids
+	}
+
+	if got, want := path(nil), []string{uidOf("a"), uidOf("b"), uidOf("d")}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("shortest path should go through b: got %v, want %v", got, want)
+	}
+	if got, want := path([]string{"pkg"}), []string{uidOf("a"), uidOf("c"), uidOf("x"), uidOf("d")}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("with b's type excluded the path should go round through c and x: got %v, want %v", got, want)
+	}
+}
+
+// TestDBTraverseFilter builds root -> f1 (Folder) -> f2 (Folder) -> doc, and root -> skip
+// (Other) -> hidden (Folder). Pruning by ty = Folder walks only the folder chain, so the
+// folder under skip is never reached.
+func TestDBTraverseFilter(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	mk := func(key, ty string, to ...string) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Id, n.Type = strp(key+"_"+suffix), strp(ty)
+		edges := []*cm.GraphNode{}
+		for _, k := range to {
+			edges = append(edges, cm.NewGraphNodeJustUID(k))
+		}
+		n.OutEdges = &edges
+		return n
+	}
+	nodeList := []*cm.GraphNode{
+		mk("root", "Folder", "f1", "skip"), mk("f1", "Folder", "f2"), mk("f2", "Folder", "doc"),
+		mk("doc", "Doc"), mk("skip", "Other", "hidden"), mk("hidden", "Folder"),
+	}
+	res, err := db.UpsertNodes(&nodeList)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	r := db.QueryWithOptions(&req.QueryRequest{
+		RootIDs:        []string{res.CreatedNodes["root"].Uid},
+		Depth:          uint(5),
+		TraverseFilter: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "Folder"},
+		WithDepth:      true,
+		Select:         []string{"id"},
+	}, svc.NODENODE, adminUAD(), nil)
+	if r.Error != "" {
+		t.Fatalf("query error: %s", r.Error)
+	}
+	want := map[string]int{"root_" + suffix: 0, "f1_" + suffix: 1, "f2_" + suffix: 2}
+	if len(r.ResultNodes) != len(want) {
+		t.Fatalf("expected only the folder chain, got %d nodes: %+v", len(r.ResultNodes), r.ResultNodes)
+	}
+	for _, n := range r.ResultNodes {
+		d, ok := want[*n.Id]
+		if !ok || n.Depth == nil || *n.Depth != d {
+			t.Errorf("%s: expected depth %d, got %v", *n.Id, d, n.Depth)
+		}
+	}
+}
+
+func TestDBTreeShape(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	mk := func(key string, to ...string) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Id = strp(key + "_" + suffix)
+		edges := []*cm.GraphNode{}
+		for _, k := range to {
+			edges = append(edges, cm.NewGraphNodeJustUID(k))
+		}
+		n.OutEdges = &edges
+		return n
+	}
+	// root -> a -> b -> root is a cycle
+	nodeList := []*cm.GraphNode{mk("root", "a"), mk("a", "b"), mk("b", "root")}
+	res, err := db.UpsertNodes(&nodeList)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	r := db.QueryWithOptions(&req.QueryRequest{
+		RootIDs: []string{res.CreatedNodes["root"].Uid},
+		Depth:   uint(5),
+		Shape:   req.SHAPE_TREE,
+		Select:  []string{"id"},
+	}, svc.NODENODE, adminUAD(), nil)
+	if r.Error != "" {
+		t.Fatalf("query error: %s", r.Error)
+	}
+	if len(r.ResultNodes) != 1 || *r.ResultNodes[0].Id != "root_"+suffix {
+		t.Fatalf("expected just the root at the top level, got %+v", r.ResultNodes)
+	}
+	a := (*r.ResultNodes[0].OutEdges)[0]
+	b := (*a.OutEdges)[0]
+	if *a.Id != "a_"+suffix || *b.Id != "b_"+suffix {
+		t.Fatalf("expected root > a > b, got %+v > %+v", a, b)
+	}
+	back := (*b.OutEdges)[0]
+	if back.Uid != res.CreatedNodes["root"].Uid || back.Id != nil || back.OutEdges != nil {
+		t.Errorf("the cycle back to the root should end in a stub, got %+v", back)
+	}
+}
+
+func TestDBAggregate(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	f := func(v float64) *float64 { return &v }
+	mk := func(key, s3 string, n1 *float64, to ...string) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Id, n.Type, n.String3, n.Num1 = strp(key+"_"+suffix), strp("Task"), strp(s3), n1
+		edges := []*cm.GraphNode{}
+		for _, k := range to {
+			edges = append(edges, cm.NewGraphNodeJustUID(k))
+		}
+		n.OutEdges = &edges
+		return n
+	}
+	project := cm.NewGraphNodeJustUID("project")
+	project.Type = strp("Project")
+	project.OutEdges = &[]*cm.GraphNode{cm.NewGraphNodeJustUID("t1"), cm.NewGraphNodeJustUID("t2"), cm.NewGraphNodeJustUID("t3"), cm.NewGraphNodeJustUID("t4")}
+	nodeList := []*cm.GraphNode{project, mk("t1", "a", f(1)), mk("t2", "a", f(2)), mk("t3", "b", f(4)), mk("t4", "b", f(6))}
+	created, err := db.UpsertNodes(&nodeList)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	q := func(a *req.QueryAggregate) *res.CoggedResponse {
+		r := db.QueryWithOptions(&req.QueryRequest{
+			RootIDs:   []string{created.CreatedNodes["project"].Uid},
+			Depth:     uint(1),
+			Filters:   &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "Task"},
+			Aggregate: a,
+		}, svc.NODENODE, adminUAD(), nil)
+		if r.Error != "" {
+			t.Fatalf("query error: %s", r.Error)
+		}
+		return r
+	}
+
+	r := q(&req.QueryAggregate{Count: true, Sum: []string{"n1"}, Max: []string{"n1"}})
+	if len(r.Aggregates) != 1 {
+		t.Fatalf("expected one row, got %+v", r.Aggregates)
+	}
+	if v := r.Aggregates[0].Values; v["count"] != 4.0 || v["sum_n1"] != 13.0 || v["max_n1"] != 6.0 {
+		t.Errorf("unexpected totals %v", v)
+	}
+
+	r = q(&req.QueryAggregate{Count: true, Sum: []string{"n1"}, Min: []string{"n1"}, Max: []string{"n1"}, Avg: []string{"n1"}, GroupBy: []string{"s3"}})
+	groups := map[string]map[string]interface{}{}
+	for _, g := range r.Aggregates {
+		groups[g.Group["s3"]] = g.Values
+	}
+	want := map[string]map[string]float64{
+		"a": {"count": 2, "sum_n1": 3, "min_n1": 1, "max_n1": 2, "avg_n1": 1.5},
+		"b": {"count": 2, "sum_n1": 10, "min_n1": 4, "max_n1": 6, "avg_n1": 5},
+	}
+	if len(groups) != len(want) {
+		t.Fatalf("expected %d groups, got %v", len(want), groups)
+	}
+	for g, figures := range want {
+		for k, v := range figures {
+			if groups[g][k] != v {
+				t.Errorf("group %s: expected %s %v, got %v", g, k, v, groups[g][k])
+			}
+		}
+	}
+}
+
+func TestDBRicherFilterOps(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	users := []*cm.GraphUser{
+		{GraphBase: cm.GraphBase{Uid: "ua"}, Username: strp("ua_" + suffix), Role: strp("user")},
+		{GraphBase: cm.GraphBase{Uid: "ub"}, Username: strp("ub_" + suffix), Role: strp("user")},
+	}
+	ures, err := db.UpsertUsers(&users)
+	if err != nil {
+		t.Fatalf("UpsertUsers: %v", err)
+	}
+	ua, ub := ures.CreatedUids["ua"], ures.CreatedUids["ub"]
+
+	ts := func(s string) *time.Time {
+		tm, _ := time.Parse(time.RFC3339, s)
+		return &tm
+	}
+	mk := func(key, ty, owner string, t1 *time.Time) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Id, n.Type, n.Time1 = strp(key+"_"+suffix), strp(ty), t1
+		n.Owner = &cm.GraphUser{GraphBase: cm.GraphBase{Uid: owner}}
+		return n
+	}
+	root := cm.NewGraphNodeJustUID("root")
+	root.Owner = &cm.GraphUser{GraphBase: cm.GraphBase{Uid: ua}}
+	root.OutEdges = &[]*cm.GraphNode{
+		cm.NewGraphNodeJustUID("n1"), cm.NewGraphNodeJustUID("n2"), cm.NewGraphNodeJustUID("n3"),
+	}
+	nodeList := []*cm.GraphNode{
+		root,
+		mk("n1", "Task", ua, ts("2024-01-10T00:00:00Z")),
+		mk("n2", "Note", ub, ts("2024-03-10T00:00:00Z")),
+		mk("n3", "Link", ua, nil),
+	}
+	created, err := db.UpsertNodes(&nodeList)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	ids := func(f *req.QueryRequestClause) map[string]bool {
+		r := db.QueryWithOptions(&req.QueryRequest{
+			RootIDs: []string{created.CreatedNodes["root"].Uid},
+			Depth:   uint(1),
+			Filters: &req.QueryRequestClause{And: []req.QueryRequestClause{{Field: "id", Op: "exists"}, *f}},
+			Select:  []string{"id"},
+		}, svc.NODENODE, adminUAD(), nil)
+		if r.Error != "" {
+			t.Fatalf("query error: %s", r.Error)
+		}
+		got := map[string]bool{}
+		for _, n := range r.ResultNodes {
+			got[(*n.Id)[:2]] = true
+		}
+		return got
+	}
+	for name, c := range map[string]struct {
+		clause req.QueryRequestClause
+		want   []string
+	}{
+		"in":      {req.QueryRequestClause{Field: "ty", Op: "in", Vals: []string{"Task", "Note"}}, []string{"n1", "n2"}},
+		"between": {req.QueryRequestClause{Field: "t1", Op: "between", Vals: []string{"2024-01-01T00:00:00Z", "2024-02-01T00:00:00Z"}}, []string{"n1"}},
+		"exists":  {req.QueryRequestClause{Field: "t1", Op: "exists"}, []string{"n1", "n2"}},
+		"not":     {req.QueryRequestClause{Not: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "Task"}}, []string{"n2", "n3"}},
+		"owner":   {req.QueryRequestClause{Op: "owner", OwnerUid: ub}, []string{"n2"}},
+	} {
+		got := ids(&c.clause)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: expected %v, got %v", name, c.want, got)
+			continue
+		}
+		for _, w := range c.want {
+			if !got[w] {
+				t.Errorf("%s: expected %v, got %v", name, c.want, got)
+			}
+		}
+	}
+}
+
+// TestDBTextSearchOps runs every text op, including the regexp that has compiles to,
+// against the indexes in DGRAPH_SCHEMA.
+func TestDBTextSearchOps(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+
+	mk := func(key, s1, s2 string) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Id, n.String1, n.String2 = strp(key+"_"+suffix), strp(s1), strp(s2)
+		return n
+	}
+	root := cm.NewGraphNodeJustUID("root")
+	root.OutEdges = &[]*cm.GraphNode{
+		cm.NewGraphNodeJustUID("a"), cm.NewGraphNodeJustUID("b"), cm.NewGraphNodeJustUID("c"),
+	}
+	nodeList := []*cm.GraphNode{
+		root,
+		mk("a", "Jonathan walks the red dog", "quarterly report"),
+		mk("b", "Johnny paints a blue fence", "annual reports"),
+		mk("c", "Maria runs with the dogs", "meeting notes"),
+	}
+	created, err := db.UpsertNodes(&nodeList)
+	if err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	for name, c := range map[string]struct {
+		clause req.QueryRequestClause
+		want   string
+	}{
+		"has":        {req.QueryRequestClause{Field: "s1", Op: "has", Val: "BLUE"}, "b"},
+		"anyofterms": {req.QueryRequestClause{Field: "s1", Op: "anyofterms", Val: "fence maria"}, "bc"},
+		"allofterms": {req.QueryRequestClause{Field: "s1", Op: "allofterms", Val: "red dog"}, "a"},
+		"anyoftext":  {req.QueryRequestClause{Field: "s2", Op: "anyoftext", Val: "reporting"}, "ab"},
+		"alloftext":  {req.QueryRequestClause{Field: "s1", Op: "alloftext", Val: "running dog"}, "c"},
+		"match":      {req.QueryRequestClause{Field: "s1", Op: "match", Val: "Johnny paints a blue fense", MatchDistance: 1}, "b"},
+	} {
+		r := db.QueryWithOptions(&req.QueryRequest{
+			RootIDs: []string{created.CreatedNodes["root"].Uid},
+			Depth:   uint(1),
+			Filters: &c.clause,
+			Select:  []string{"id"},
+		}, svc.NODENODE, adminUAD(), nil)
+		if r.Error != "" {
+			t.Errorf("%s: query error: %s", name, r.Error)
+			continue
+		}
+		got := ""
+		for _, k := range "abc" {
+			if findByID(r.ResultNodes, string(k)+"_"+suffix) {
+				got += string(k)
+			}
+		}
+		if got != c.want || len(r.ResultNodes) != len(c.want) {
+			t.Errorf("%s: expected %q, got %q (%d nodes)", name, c.want, got, len(r.ResultNodes))
+		}
+	}
+}
+
+func TestDBSearch(t *testing.T) {
+	db, _ := dbtest.MustStart(t)
+	rnd, _ := sec.GenerateRandomBytes(5)
+	suffix := fmt.Sprintf("%x", rnd)
+	word := "inv" + suffix
+
+	users := []*cm.GraphUser{
+		{GraphBase: cm.GraphBase{Uid: "me"}, Username: strp("me_" + suffix), Role: strp("user")},
+		{GraphBase: cm.GraphBase{Uid: "them"}, Username: strp("them_" + suffix), Role: strp("user")},
+	}
+	ures, err := db.UpsertUsers(&users)
+	if err != nil {
+		t.Fatalf("UpsertUsers: %v", err)
+	}
+	me, them := ures.CreatedUids["me"], ures.CreatedUids["them"]
+
+	tr := true
+	mk := func(key, owner, sgi, s1 string) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(key)
+		n.Id, n.String1, n.Sgi, n.PermRead = strp(key+"_"+suffix), strp(s1), strp(sgi), &tr
+		n.Owner = &cm.GraphUser{GraphBase: cm.GraphBase{Uid: owner}}
+		return n
+	}
+	shared := "sgs" + suffix
+	nodeList := []*cm.GraphNode{
+		mk("mine", me, "sgm"+suffix, "march "+word),
+		mk("shared", them, shared, word+" for march"),
+		mk("private", them, "sgp"+suffix, word),
+	}
+	if _, err := db.UpsertNodes(&nodeList); err != nil {
+		t.Fatalf("UpsertNodes: %v", err)
+	}
+
+	r := db.Search(&req.SearchRequest{Text: "march " + word, Select: []string{"id"}},
+		&sec.UserAuthData{Uid: me, Role: "user"}, []string{shared})
+	if r.Error != "" {
+		t.Fatalf("search error: %s", r.Error)
+	}
+	if len(r.ResultNodes) != 2 || *r.ResultNodes[0].Id != "mine_"+suffix || *r.ResultNodes[1].Id != "shared_"+suffix {
+		t.Errorf("expected my node then the shared one, got %+v", r.ResultNodes)
+	}
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"encoding/json"
 	"math"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
 	cm "cogged/models"
 	req "cogged/requests"
 	sec "cogged/security"
 
+	"github.com/dgraph-io/dgo/v250"
 	"github.com/dgraph-io/dgo/v250/protos/api"
 )
 
@@ -18,23 +21,41 @@ import (
 // returns canned responses, so DB-layer logic can be tested without a real Dgraph.
 type fakeClient struct {
 	queryJSON    []byte
+	queryJSONs   [][]byte // when set, successive queries are answered in order, before falling back to queryJSON
 	queryErr     error
 	mutateResp   *api.Response
 	mutateErr    error
 	lastQuery    string
 	lastVars     map[string]string
+	queries      []string // every query sent with vars, in order
 	lastMutation *api.Mutation
+	lastRequest  *api.Request // the last upsert block sent with Do
 	alterOps     []*api.Operation
+	readTs       uint64           // the timestamp read-only transactions started without one report
+	readOpts     []ReadTxnOptions // the options of each read-only transaction started
 }
 
 func (c *fakeClient) NewTxn() DgraphTxn { return &fakeTxn{c: c} }
 
+func (c *fakeClient) NewReadOnlyTxn(opts ReadTxnOptions) DgraphTxn {
+	c.readOpts = append(c.readOpts, opts)
+	ts := opts.StartTs
+	if ts == 0 {
+		ts = c.readTs
+	}
+	return &fakeTxn{c: c, readOnly: true, startTs: ts}
+}
+
 func (c *fakeClient) Alter(ctx context.Context, op *api.Operation) error {
 	c.alterOps = append(c.alterOps, op)
 	return nil
 }
 
-type fakeTxn struct{ c *fakeClient }
+type fakeTxn struct {
+	c        *fakeClient
+	readOnly bool
+	startTs  uint64
+}
 
 func (t *fakeTxn) Query(ctx context.Context, q string) (*api.Response, error) {
 	t.c.lastQuery = q
@@ -44,10 +65,19 @@ func (t *fakeTxn) Query(ctx context.Context, q string) (*api.Response, error) {
 func (t *fakeTxn) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
 	t.c.lastQuery = q
 	t.c.lastVars = vars
-	return &api.Response{Json: t.c.queryJSON}, t.c.queryErr
+	t.c.queries = append(t.c.queries, q)
+	j := t.c.queryJSON
+	if len(t.c.queryJSONs) > 0 {
+		j = t.c.queryJSONs[0]
+		t.c.queryJSONs = t.c.queryJSONs[1:]
+	}
+	return &api.Response{Json: j, Txn: &api.TxnContext{StartTs: t.startTs}}, t.c.queryErr
 }
 
 func (t *fakeTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	if t.readOnly {
+		return nil, dgo.ErrReadOnly
+	}
 	t.c.lastMutation = mu
 	if t.c.mutateResp != nil {
 		return t.c.mutateResp, t.c.mutateErr
@@ -55,6 +85,23 @@ func (t *fakeTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response,
 	return &api.Response{}, t.c.mutateErr
 }
 
+// Do answers an upsert block's query like QueryWithVars, and its mutations with the Uids
+// of mutateResp.
+func (t *fakeTxn) Do(ctx context.Context, req *api.Request) (*api.Response, error) {
+	if t.readOnly && len(req.Mutations) > 0 {
+		return nil, dgo.ErrReadOnly
+	}
+	t.c.lastRequest = req
+	resp, err := t.QueryWithVars(ctx, req.Query, req.Vars)
+	if err != nil {
+		return nil, err
+	}
+	if t.c.mutateResp != nil {
+		resp.Uids = t.c.mutateResp.Uids
+	}
+	return resp, t.c.mutateErr
+}
+
 func newFakeDB(fake *fakeClient) *DB {
 	return NewDBWithClient(&Config{}, fake)
 }
@@ -152,26 +199,26 @@ func TestQueryWithOptionsInjectsPagination(t *testing.T) {
 	db := newFakeDB(fake)
 
 	first, offset := 10, 20
-	order, after := "c", "0x2a"
+	after := "0x2a"
 	q := &req.QueryRequest{
 		RootIDs: []string{"0x11"},
 		Depth:   3,
 		First:   &first,
 		Offset:  &offset,
-		OrderBy: &order,
+		OrderBy: req.QueryOrder{{Field: "c"}},
 		After:   &after,
 	}
 	resp := db.QueryWithOptions(q, NODENODE, nil, nil)
 	if resp.Error != "" {
 		t.Fatalf("unexpected error: %q", resp.Error)
 	}
-	for _, want := range []string{"orderasc: c", "first: 10", "offset: 20", "after: 0x2a"} {
+	for _, want := range []string{"orderasc: c", "first: 11", "offset: 20", "after: 0x2a"} {
 		if !strings.Contains(fake.lastQuery, want) {
 			t.Errorf("query missing %q; got:\n%s", want, fake.lastQuery)
 		}
 	}
 	// the pagination args must sit inside the qr func parens, before the @filter
-	if !strings.Contains(fake.lastQuery, "first: 10, offset: 20, after: 0x2a)") {
+	if !strings.Contains(fake.lastQuery, "first: 11, offset: 20, after: 0x2a)") {
 		t.Errorf("pagination args not placed inside func(...): %s", fake.lastQuery)
 	}
 }
@@ -208,21 +255,21 @@ func TestQueryWithOptionsReadAuthzFilter(t *testing.T) {
 func TestQueryWithOptionsSimilaritySearch(t *testing.T) {
 	admin := &sec.UserAuthData{Role: sec.SYS_ROLE}
 
-	// builds a similar_to root func with the given topK and inline vector
+	// builds a similar_to var block over-fetching the given topK, with the inline vector
 	fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
 	q := &req.QueryRequest{Similar: &req.QuerySimilarity{Vector: "[0.1, 0.2, 0.3]", TopK: 5}}
 	if resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, admin, nil); resp.Error != "" {
 		t.Fatalf("unexpected error: %q", resp.Error)
 	}
-	if !strings.Contains(fake.lastQuery, `similar_to(vec, 5, "[0.1, 0.2, 0.3]")`) {
+	if !strings.Contains(fake.lastQuery, `similar_to(vec, 20, "[0.1,0.2,0.3]")`) {
 		t.Errorf("similarity query malformed:\n%s", fake.lastQuery)
 	}
 
 	// topK defaults to 10 when unset
 	f2 := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
 	newFakeDB(f2).QueryWithOptions(&req.QueryRequest{Similar: &req.QuerySimilarity{Vector: "[1,2]"}}, NODENODE, admin, nil)
-	if !strings.Contains(f2.lastQuery, "similar_to(vec, 10,") {
-		t.Errorf("expected default topK 10, got:\n%s", f2.lastQuery)
+	if !strings.Contains(f2.lastQuery, "similar_to(vec, 40,") {
+		t.Errorf("expected default topK 10 fetched four times over, got:\n%s", f2.lastQuery)
 	}
 
 	// invalid / injection-y vectors are rejected before any query is built
@@ -242,7 +289,6 @@ func TestQueryWithOptionsSimilaritySearch(t *testing.T) {
 // either: eq(p, "guess") would otherwise confirm the value via the result set.
 func TestQueryWithOptionsRejectsPrivateFieldFilter(t *testing.T) {
 	reader := &sec.UserAuthData{Uid: "0x1a", Role: "user"}
-	orderByPrivate := "p"
 
 	cases := []struct {
 		name string
@@ -265,7 +311,7 @@ func TestQueryWithOptionsRejectsPrivateFieldFilter(t *testing.T) {
 		}},
 		{"order_by", &req.QueryRequest{
 			RootIDs: []string{"0x5"},
-			OrderBy: &orderByPrivate,
+			OrderBy: req.QueryOrder{{Field: "p"}},
 		}},
 	}
 
@@ -356,7 +402,7 @@ func TestQueryWithOptionsGeoRadiusSearch(t *testing.T) {
 		Geo:   &req.QueryGeo{Point: []float64{0, 0}, Distance: 100},
 		First: &first,
 	}, NODENODE, admin, nil)
-	if !strings.Contains(fpage.lastQuery, "near(g, [0, 0], 100), first: 5)") {
+	if !strings.Contains(fpage.lastQuery, "near(g, [0, 0], 100), first: 6)") {
 		t.Errorf("pagination args not placed inside the geo func:\n%s", fpage.lastQuery)
 	}
 }
@@ -380,6 +426,15 @@ func TestQueryWithOptionsGeoValidation(t *testing.T) {
 		{"distance over cap", &req.QueryGeo{Point: []float64{0, 0}, Distance: MAX_GEO_DISTANCE_METRES + 1}},
 		{"NaN coordinate", &req.QueryGeo{Point: []float64{math.NaN(), 0}, Distance: 100}},
 		{"Inf distance", &req.QueryGeo{Point: []float64{0, 0}, Distance: math.Inf(1)}},
+		{"unknown mode", &req.QueryGeo{Mode: "beside", Point: []float64{0, 0}, Distance: 100}},
+		{"near with a shape", &req.QueryGeo{Point: []float64{0, 0}, Distance: 100, Shape: square(0, 0, 1)}},
+		{"within without a shape", &req.QueryGeo{Mode: "within", Point: []float64{0, 0}}},
+		{"within a line", &req.QueryGeo{Mode: "within", Shape: &cm.Geoloc{Type: "LineString", Line: [][]float64{{0, 0}, {1, 1}}}}},
+		{"intersects with a distance", &req.QueryGeo{Mode: "intersects", Shape: square(0, 0, 1), Distance: 100}},
+		{"contains a point and a shape", &req.QueryGeo{Mode: "contains", Point: []float64{0, 0}, Shape: square(0, 0, 1)}},
+		{"unclosed ring", &req.QueryGeo{Mode: "within", Shape: &cm.Geoloc{Type: "Polygon",
+			Polygon: [][][]float64{{{0, 0}, {1, 0}, {1, 1}, {0, 1}}}}}},
+		{"ring out of range", &req.QueryGeo{Mode: "intersects", Shape: square(179.5, 0, 1)}},
 	}
 
 	for _, tc := range cases {
@@ -396,11 +451,57 @@ func TestQueryWithOptionsGeoValidation(t *testing.T) {
 	}
 }
 
+// square returns a Polygon for the square with its south-west corner at lon, lat.
+func square(lon, lat, side float64) *cm.Geoloc {
+	return &cm.Geoloc{Type: "Polygon", Polygon: [][][]float64{{
+		{lon, lat}, {lon + side, lat}, {lon + side, lat + side}, {lon, lat + side}, {lon, lat},
+	}}}
+}
+
+func TestQueryWithOptionsGeoShapeModes(t *testing.T) {
+	admin := &sec.UserAuthData{Role: sec.SYS_ROLE}
+	ring := "[[[0, 0], [0.5, 0], [0.5, 0.5], [0, 0.5], [0, 0]]]"
+
+	cases := []struct {
+		name string
+		geo  *req.QueryGeo
+		want string
+	}{
+		{"within", &req.QueryGeo{Mode: "within", Shape: square(0, 0, 0.5)}, "within(g, " + ring + ")"},
+		{"intersects", &req.QueryGeo{Mode: "intersects", Shape: square(0, 0, 0.5)}, "intersects(g, " + ring + ")"},
+		{"contains a point", &req.QueryGeo{Mode: "contains", Point: []float64{0.25, 0.25}}, "contains(g, [0.25, 0.25])"},
+		{"contains a shape", &req.QueryGeo{Mode: "contains", Shape: square(0, 0, 0.5)}, "contains(g, " + ring + ")"},
+		{"within a multipolygon", &req.QueryGeo{Mode: "within", Shape: &cm.Geoloc{Type: "MultiPolygon",
+			MultiPolygon: [][][][]float64{square(0, 0, 0.5).Polygon, square(2, 2, 0.5).Polygon}}},
+			"within(g, [" + ring + ", [[[2, 2], [2.5, 2], [2.5, 2.5], [2, 2.5], [2, 2]]]])"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// as the root function
+			fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+			if resp := newFakeDB(fake).QueryWithOptions(&req.QueryRequest{Geo: tc.geo}, NODENODE, admin, nil); resp.Error != "" {
+				t.Fatalf("unexpected error: %q", resp.Error)
+			}
+			if !strings.Contains(fake.lastQuery, "qr(func: "+tc.want) {
+				t.Errorf("root query missing %q:\n%s", tc.want, fake.lastQuery)
+			}
+			// and as a filter clause beside another
+			fake = &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+			clause := &req.QueryRequestClause{And: []req.QueryRequestClause{{Field: "ty", Op: "eq", Val: "park"}, {Geo: tc.geo}}}
+			if resp := newFakeDB(fake).QueryWithOptions(&req.QueryRequest{RootIDs: []string{"0x5"}, Filters: clause}, NODENODE, admin, nil); resp.Error != "" {
+				t.Fatalf("unexpected error: %q", resp.Error)
+			}
+			if !strings.Contains(fake.lastQuery, " and "+tc.want) {
+				t.Errorf("filter missing %q:\n%s", tc.want, fake.lastQuery)
+			}
+		})
+	}
+}
+
 // `g` cannot be expressed by any filter op, so naming it in filters or order_by is
 // refused with a pointer at the geo block rather than an opaque "DB query failed".
 func TestQueryWithOptionsRejectsGeoFieldInFilters(t *testing.T) {
 	admin := &sec.UserAuthData{Role: sec.SYS_ROLE}
-	orderByGeo := "g"
 
 	cases := []struct {
 		name string
@@ -417,7 +518,7 @@ func TestQueryWithOptionsRejectsGeoFieldInFilters(t *testing.T) {
 				{Field: "G", Op: "has", Val: "somewhere"},
 			}},
 		}},
-		{"order_by g", &req.QueryRequest{RootIDs: []string{"0x5"}, OrderBy: &orderByGeo}},
+		{"order_by g", &req.QueryRequest{RootIDs: []string{"0x5"}, OrderBy: req.QueryOrder{{Field: "g"}}}},
 	}
 
 	for _, tc := range cases {
@@ -751,3 +852,611 @@ func TestUpsertNodesSkipsUnmappedMutationUid(t *testing.T) {
 		t.Errorf("the unmapped uid should be skipped, got %+v", resp.CreatedNodes)
 	}
 }
+
+func TestUpsertNodesUnset(t *testing.T) {
+	s1 := "x"
+	list := []*cm.GraphNode{
+		{GraphBase: cm.GraphBase{Uid: "0x1"}, String1: &s1, Unset: []string{"t2", "g"}},
+		{GraphBase: cm.GraphBase{Uid: "0x2"}, String1: &s1},
+	}
+	fake := &fakeClient{mutateResp: &api.Response{}}
+	if _, err := newFakeDB(fake).UpsertNodes(&list); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	set, del := string(fake.lastMutation.SetJson), string(fake.lastMutation.DeleteJson)
+	if del != `[{"g":null,"t2":null,"uid":"0x1"}]` {
+		t.Errorf("expected t2 and g of 0x1 deleted, got %s", del)
+	}
+	if !strings.Contains(set, `"s1":"x"`) || !strings.Contains(set, `"m":`) || strings.Contains(set, "unset") {
+		t.Errorf("expected the set in the same mutation, with m and without the unset list:\n%s", set)
+	}
+
+	fnew := &fakeClient{mutateResp: &api.Response{}}
+	created := []*cm.GraphNode{{GraphBase: cm.GraphBase{Uid: "$a"}, Unset: []string{"s1"}}}
+	if _, err := newFakeDB(fnew).UpsertNodes(&created); err == nil || fnew.lastMutation != nil {
+		t.Errorf("a new node should have nothing to unset, got %v", err)
+	}
+}
+
+func TestTransferNodeOwnership(t *testing.T) {
+	root := cm.NewGraphNodeJustUID("0xa")
+	root.Owner = cm.NewGraphUser("0x1")
+
+	fake := &fakeClient{queryJSON: []byte(`{"qt0":[
+		{"uid":"0xa","own":{"uid":"0x1"},"sgi":"sg","r":true},
+		{"uid":"0xb","own":{"uid":"0x1"},"sgi":"sg","r":true}]}`)}
+	resp, err := newFakeDB(fake).TransferNodeOwnership([]*cm.GraphNode{root}, "0x2", 3, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the walk is scoped to the previous owner at the root and at every hop, and runs in
+	// the same upsert block as the writes
+	r := fake.lastRequest
+	for _, want := range []string{
+		"var(func: uid($ids0)) @filter(uid_in(own, 0x1)) @recurse(depth: $rdepth) { t0 as uid e @filter(uid_in(own, 0x1)) }",
+		"m0 as var(func: uid(t0)) @filter(uid_in(own, 0x1))",
+		"r0 as var(func: uid(m0)) @filter(uid($ids0))",
+	} {
+		if !strings.Contains(r.Query, want) {
+			t.Errorf("owned-subgraph query missing %q:\n%s", want, r.Query)
+		}
+	}
+	if r.Vars["$ids0"] != "[0xa]" || !r.CommitNow || len(r.Mutations) != 1 || r.Mutations[0].Cond != "@if(gt(len(m0), 0))" {
+		t.Errorf("unexpected request %+v", r)
+	}
+
+	// set and delete travel in one mutation
+	set, del := string(r.Mutations[0].SetJson), string(r.Mutations[0].DeleteJson)
+	for _, want := range []string{`{"uid":"uid(m0)","own":{"uid":"0x2"}`,
+		`{"uid":"0x2","nodes":[{"uid":"uid(r0)"}]}`, `{"uid":"0x1","shr":[{"uid":"uid(r0)"}]}`} {
+		if !strings.Contains(set, want) {
+			t.Errorf("set mutation missing %s:\n%s", want, set)
+		}
+	}
+	if !strings.Contains(del, `{"uid":"0x1","nodes":[{"uid":"uid(m0)"}]}`) {
+		t.Errorf("previous owner's nodes edges should be removed:\n%s", del)
+	}
+
+	if len(resp.ResultNodes) != 2 || resp.ResultNodes[0].Owner.Uid != "0x2" {
+		t.Errorf("response should list the transferred nodes under their new owner, got %+v", resp.ResultNodes)
+	}
+
+	// without keep_share no share edge is added
+	fnoshare := &fakeClient{queryJSON: fake.queryJSON}
+	newFakeDB(fnoshare).TransferNodeOwnership([]*cm.GraphNode{root}, "0x2", 0, false)
+	if strings.Contains(string(fnoshare.lastRequest.Mutations[0].SetJson), `"shr"`) {
+		t.Errorf("no share edge should be set without keep_share:\n%s", fnoshare.lastRequest.Mutations[0].SetJson)
+	}
+	if strings.Contains(fnoshare.lastRequest.Query, "@recurse") {
+		t.Errorf("depth 0 should not recurse:\n%s", fnoshare.lastRequest.Query)
+	}
+}
+
+func TestTransferNodeOwnershipNothingToTransfer(t *testing.T) {
+	root := cm.NewGraphNodeJustUID("0xa")
+	root.Owner = cm.NewGraphUser("0x1")
+
+	// the DB no longer thinks 0x1 owns the root (a stale token)
+	fake := &fakeClient{queryJSON: []byte(`{"qt0":[]}`)}
+	resp, err := newFakeDB(fake).TransferNodeOwnership([]*cm.GraphNode{root}, "0x2", 2, false)
+	if err == nil || resp.Error == "" {
+		t.Error("expected an error when nothing is transferable")
+	}
+	if c := fake.lastRequest.Mutations[0].Cond; c != "@if(gt(len(m0), 0))" {
+		t.Errorf("the writes should only apply to nodes the previous owner still owns, got %q", c)
+	}
+
+	// transferring to the current owner is a no-op that never reaches the DB
+	fsame := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+	if _, err := newFakeDB(fsame).TransferNodeOwnership([]*cm.GraphNode{root}, "0x1", 2, false); err == nil {
+		t.Error("expected an error transferring to the current owner")
+	}
+	if fsame.lastQuery != "" || fsame.lastRequest != nil {
+		t.Errorf("no query should be issued, got:\n%s", fsame.lastQuery)
+	}
+}
+
+func TestShareeAccessChanges(t *testing.T) {
+	tr, f := true, false
+	node := func(uid, sgi string, r *bool) *cm.GraphNode {
+		n := cm.NewGraphNodeJustUID(uid)
+		n.Owner = cm.NewGraphUser("0x1")
+		n.Sgi, n.PermRead = &sgi, r
+		return n
+	}
+	sharee := func(uid string, shared ...*cm.GraphNode) *cm.GraphUser {
+		u := cm.NewGraphUser(uid)
+		u.Shared = &shared
+		return u
+	}
+
+	// 0xa -> 0xb -> 0xc, all in share group "old"; 0xc is moved to "new" and 0xb made unreadable
+	before := map[string]*cm.GraphNode{"0xb": node("0xb", "old", &tr), "0xc": node("0xc", "old", &tr)}
+	after := map[string]*cm.GraphNode{"0xb": node("0xb", "old", &f), "0xc": node("0xc", "new", &tr)}
+	edges := map[string][]string{"0xa": {"0xb"}, "0xb": {"0xc"}}
+
+	changes := shareeAccessChanges([]*cm.GraphUser{
+		sharee("0x10", node("0xa", "old", &tr)), // shared above the subgraph: loses both
+		sharee("0x11", node("0xc", "old", &tr)), // shared the moved node itself: keeps it under the new group
+		sharee("0x12", node("0xd", "other", &tr)),
+	}, edges, before, after)
+
+	if len(changes) != 2 {
+		t.Fatalf("expected changes for two sharees, got %d", len(changes))
+	}
+	if c := changes[0]; c.User.Uid != "0x10" || c.Lost != 2 || c.Gained != 0 || len(c.SgisGranted)+len(c.SgisRevoked) != 0 {
+		t.Errorf("sharee above the subgraph: %+v", c)
+	}
+	if c := changes[1]; c.User.Uid != "0x11" || c.Lost != 0 || c.Gained != 0 ||
+		len(c.SgisGranted) != 1 || c.SgisGranted[0] != "new" || len(c.SgisRevoked) != 1 || c.SgisRevoked[0] != "old" {
+		t.Errorf("sharee of the moved node should swap share groups without losing access: %+v", c)
+	}
+	if changes[0].User.Shared != nil {
+		t.Error("a sharee's other shared nodes must not be echoed back")
+	}
+}
+
+func TestUpdateSubgraphPermissions(t *testing.T) {
+	root := cm.NewGraphNodeJustUID("0xa")
+	root.Owner = cm.NewGraphUser("0x1")
+	subgraph := []byte(`{"qr":[
+		{"uid":"0xa","own":{"uid":"0x1"},"sgi":"old","r":true,"w":true},
+		{"uid":"0xb","own":{"uid":"0x1"},"sgi":"old","r":true}]}`)
+	sharees := []byte(`{"anc":[{"uid":"0xa","e":[{"uid":"0xb"}]},{"uid":"0xb"}],
+		"qr":[{"uid":"0x10","un":"bob","role":"user","shr":[{"uid":"0xa","own":{"uid":"0x1"},"sgi":"old","r":true}]}]}`)
+	f := false
+	mask := &req.PermissionMask{PermRead: &f}
+
+	fake := &fakeClient{queryJSONs: [][]byte{subgraph, sharees}}
+	resp, err := newFakeDB(fake).UpdateSubgraphPermissions([]*cm.GraphNode{root}, 1, mask, "", true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fake.lastMutation != nil {
+		t.Error("a dry run must not write anything")
+	}
+	if !resp.DryRun || resp.AffectedNodes != 2 || resp.ResultNodes != nil {
+		t.Errorf("dry run should report counts only, got %+v", resp)
+	}
+	if len(resp.Sharees) != 1 || resp.Sharees[0].Lost != 2 || *resp.Sharees[0].User.Username != "bob" {
+		t.Errorf("bob should lose read access to both nodes, got %+v", resp.Sharees)
+	}
+	if !strings.Contains(fake.lastQuery, "SH as ~shr") {
+		t.Errorf("sharees should be found through reverse share edges:\n%s", fake.lastQuery)
+	}
+
+	// the write walks the subgraph again in the same upsert block, so it only touches
+	// nodes the owner still owns then
+	walked := []byte(strings.Replace(string(subgraph), `"qr"`, `"qt0"`, 1))
+	fake = &fakeClient{queryJSONs: [][]byte{walked, sharees}}
+	resp, err = newFakeDB(fake).UpdateSubgraphPermissions([]*cm.GraphNode{root}, 1, mask, "fresh", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := fake.lastRequest
+	if !strings.Contains(r.Query, "m0 as var(func: uid(t0)) @filter(uid_in(own, 0x1))") || len(r.Mutations) != 1 || r.Mutations[0].Cond != "@if(gt(len(m0), 0))" {
+		t.Errorf("expected the walk and write in one block, got %+v", r)
+	}
+	if set := string(r.Mutations[0].SetJson); !strings.HasPrefix(set, `{"uid":"uid(m0)","r":false,"sgi":"fresh"`) {
+		t.Errorf("expected the masked bits and share group set on the walked nodes, got %s", set)
+	}
+	if len(resp.ResultNodes) != 2 || *resp.ResultNodes[1].Sgi != "fresh" {
+		t.Errorf("updated nodes should be returned for re-signing, got %+v", resp.ResultNodes)
+	}
+	if sc := resp.Sharees[0]; len(sc.SgisRevoked) != 1 || sc.SgisRevoked[0] != "old" || len(sc.SgisGranted) != 0 {
+		t.Errorf("bob's shared node is no longer readable, so its old share group should be revoked: %+v", sc)
+	}
+}
+
+func TestUpsertNodesChecksPayloadAgainstStoredType(t *testing.T) {
+	invoice := &cm.PayloadSchema{Type: "invoice", FixedType: true, Slots: map[string]*cm.SlotRule{"s1": {}}}
+	note := &cm.PayloadSchema{Type: "note", Slots: map[string]*cm.SlotRule{"s1": {}}}
+	for _, ps := range []*cm.PayloadSchema{invoice, note} {
+		if err := ps.Compile(); err != nil {
+			t.Fatalf("schema did not compile: %v", err)
+		}
+	}
+	cm.SetPayloadSchemas([]*cm.PayloadSchema{invoice, note})
+	defer cm.SetPayloadSchemas(nil)
+
+	stored := []byte(`{"qr":[{"uid":"0x1","ty":"invoice"}]}`)
+	ty := "note"
+	retype := cm.NewGraphNodeJustUID("0x1")
+	retype.Type = &ty
+	fake := &fakeClient{queryJSON: stored}
+	_, err := newFakeDB(fake).UpsertNodes(&[]*cm.GraphNode{retype})
+	if _, ok := err.(PolicyError); !ok || !strings.Contains(err.Error(), "cannot be changed") {
+		t.Errorf("changing a fixed type should be a PolicyError, got %v", err)
+	}
+	if fake.lastMutation != nil {
+		t.Error("nothing should be written when the payload check fails")
+	}
+
+	// the update does not state its ty, so only the stored one can catch the bad slot
+	s2 := "x"
+	partial := cm.NewGraphNodeJustUID("0x1")
+	partial.String2 = &s2
+	fake = &fakeClient{queryJSON: stored}
+	if _, err := newFakeDB(fake).UpsertNodes(&[]*cm.GraphNode{partial}); err == nil || !strings.Contains(err.Error(), "may not set s2") {
+		t.Errorf("expected the stored type's schema to be applied, got %v", err)
+	}
+}
+
+func TestUpsertNodesChecksStoredSlotsOnTypeChange(t *testing.T) {
+	note := &cm.PayloadSchema{Type: "note", Slots: map[string]*cm.SlotRule{"s1": {}}}
+	if err := note.Compile(); err != nil {
+		t.Fatalf("schema did not compile: %v", err)
+	}
+	cm.SetPayloadSchemas([]*cm.PayloadSchema{note})
+	defer cm.SetPayloadSchemas(nil)
+
+	types := []byte(`{"qr":[{"uid":"0x1","ty":"doc"}]}`)
+	slots := []byte(`{"qr":[{"uid":"0x1","s1":"kept","s2":"left over"}]}`)
+	ty := "note"
+	retype := cm.NewGraphNodeJustUID("0x1")
+	retype.Type = &ty
+	fake := &fakeClient{queryJSONs: [][]byte{types, slots}}
+	_, err := newFakeDB(fake).UpsertNodes(&[]*cm.GraphNode{retype})
+	if _, ok := err.(PolicyError); !ok || !strings.Contains(err.Error(), "s2, so it must be unset") {
+		t.Errorf("the stored s2 should block the change to note, got %v", err)
+	}
+	if fake.lastMutation != nil {
+		t.Error("nothing should be written when the payload check fails")
+	}
+	if !strings.Contains(fake.lastQuery, "s2") {
+		t.Errorf("the stored slots should be read for a type change, got:\n%s", fake.lastQuery)
+	}
+
+	retype.Unset = []string{"s2"}
+	fake = &fakeClient{queryJSONs: [][]byte{types, slots}}
+	if _, err := newFakeDB(fake).UpsertNodes(&[]*cm.GraphNode{retype}); err != nil {
+		t.Errorf("unsetting s2 along with the change should be allowed: %v", err)
+	}
+}
+
+func TestUpsertPayloadSchemaReplacesExisting(t *testing.T) {
+	defer cm.SetPayloadSchemas(nil)
+	ps := &cm.PayloadSchema{Type: "tag", Slots: map[string]*cm.SlotRule{"s1": {Required: true}}}
+	if err := ps.Compile(); err != nil {
+		t.Fatalf("schema did not compile: %v", err)
+	}
+	def, _ := json.Marshal(ps)
+	record, _ := json.Marshal(map[string]interface{}{"qr": []map[string]string{{"uid": "0x9", "pst": "tag", "psd": string(def)}}})
+
+	fake := &fakeClient{queryJSONs: [][]byte{record, record}}
+	if err := newFakeDB(fake).UpsertPayloadSchema(ps); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	set := string(fake.lastMutation.SetJson)
+	if !strings.Contains(set, `"uid":"0x9"`) || !strings.Contains(set, `"pst":"tag"`) {
+		t.Errorf("the existing schema node should be overwritten:\n%s", set)
+	}
+	tag := "tag"
+	if got := cm.PayloadSchemaFor(&tag); got == nil || !got.Slots["s1"].Required {
+		t.Errorf("the registry should be reloaded after the change, got %+v", got)
+	}
+}
+
+func TestLoadPayloadSchemasRejectsBadRecords(t *testing.T) {
+	defer cm.SetPayloadSchemas(nil)
+	tag := &cm.PayloadSchema{Type: "tag", Slots: map[string]*cm.SlotRule{"s1": {}}}
+	if err := tag.Compile(); err != nil {
+		t.Fatalf("schema did not compile: %v", err)
+	}
+	cm.SetPayloadSchemas([]*cm.PayloadSchema{tag})
+
+	bad := []byte(`{"qr":[{"uid":"0x9","pst":"note","psd":"{\"ty\":\"note\",\"slots\":{\"s9\":{}}}"}]}`)
+	err := newFakeDB(&fakeClient{queryJSON: bad}).LoadPayloadSchemas()
+	if err == nil || !strings.Contains(err.Error(), "does not compile") {
+		t.Errorf("a stored schema that does not compile should be an error, got %v", err)
+	}
+	ty := "tag"
+	if cm.PayloadSchemaFor(&ty) == nil {
+		t.Error("the registry should be left as it was")
+	}
+}
+
+func TestQueryWithOptionsDirection(t *testing.T) {
+	cases := []struct {
+		direction string
+		wants     string
+	}{
+		{"", "NID as uid\n\t\t\t\t  e\n"},
+		{req.DIRECTION_IN, "NID as uid\n\t\t\t\t  ~e\n"},
+		{req.DIRECTION_BOTH, "NID as uid\n\t\t\t\t  e\n\t\t\t\t  ~e\n"},
+	}
+	reader := &sec.UserAuthData{Uid: "0x5", Role: "user"}
+	for _, c := range cases {
+		fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+		q := &req.QueryRequest{RootIDs: []string{"0x11"}, Depth: 2, Direction: c.direction}
+		if resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, reader, []string{"grp"}); resp.Error != "" {
+			t.Fatalf("direction %q: unexpected error %q", c.direction, resp.Error)
+		}
+		if !strings.Contains(fake.lastQuery, c.wants) {
+			t.Errorf("direction %q: expected recurse over %q, got:\n%s", c.direction, c.wants, fake.lastQuery)
+		}
+		if !strings.Contains(fake.lastQuery, `uid_in(own, 0x5) OR (eq(sgi, ["grp"]) AND eq(r, true))`) {
+			t.Errorf("direction %q: nodes reached must still be read-filtered:\n%s", c.direction, fake.lastQuery)
+		}
+	}
+
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+	q := &req.QueryRequest{RootIDs: []string{"0x1"}, Depth: 1, Direction: req.DIRECTION_IN}
+	if resp := newFakeDB(fake).QueryWithOptions(q, USERNODE, reader, nil); resp.Error == "" || fake.lastQuery != "" {
+		t.Errorf("reverse traversal from a user should be refused before querying, got %+v", resp)
+	}
+}
+
+func TestQueryShortestPaths(t *testing.T) {
+	// two paths from 0x1 to 0x4: via 0x2, and via 0x3 and 0x5; the reader cannot read 0x5,
+	// so the second must not come back even if the DB were to return it
+	paths := []byte(`{"_path_":[
+		{"uid":"0x1","e":{"uid":"0x2","e":{"uid":"0x4"}},"_weight_":2},
+		{"uid":"0x1","e":[{"uid":"0x3","e":[{"uid":"0x5","e":[{"uid":"0x4"}]}]}],"_weight_":3}
+	],"pn":[]}`)
+	nodes := []byte(`{"qr":[
+		{"uid":"0x1","own":{"uid":"0x9"}},{"uid":"0x2","own":{"uid":"0x9"}},
+		{"uid":"0x3","own":{"uid":"0x9"}},{"uid":"0x4","own":{"uid":"0x9"}}
+	]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{paths, nodes}}
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+	r := &req.PathRequest{
+		UnpackedFrom: cm.NewGraphNodeJustUID("0x1"),
+		UnpackedTo:   cm.NewGraphNodeJustUID("0x4"),
+		NumPaths:     2,
+		Types:        []string{"pkg"},
+		Direction:    req.DIRECTION_BOTH,
+	}
+	resp := newFakeDB(fake).QueryShortestPaths(r, reader, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	if len(resp.Paths) != 1 || resp.Paths[0].Hops != 2 {
+		t.Fatalf("only the fully readable path should be returned, got %+v", resp.Paths)
+	}
+	for i, want := range []string{"0x1", "0x2", "0x4"} {
+		if resp.Paths[0].Nodes[i].Uid != want {
+			t.Errorf("path node %d: expected %s, got %s", i, want, resp.Paths[0].Nodes[i].Uid)
+		}
+	}
+	if !strings.Contains(fake.lastQuery, "@filter(uid_in(own, 0x9))") {
+		t.Errorf("the path nodes should be read back through the read filter:\n%s", fake.lastQuery)
+	}
+
+	fake = &fakeClient{queryJSON: []byte(`{"_path_":[]}`)}
+	resp = newFakeDB(fake).QueryShortestPaths(r, reader, nil)
+	if resp.Error != "" || len(resp.Paths) != 0 {
+		t.Errorf("no path should be an empty result, got %+v", resp)
+	}
+	for _, want := range []string{
+		"shortest(from: 0x1, to: 0x4, numpaths: 2, depth: ",
+		"e @filter((uid(0x4) OR eq(ty, $ty0)) AND uid_in(own, 0x9))",
+		"~e @filter((uid(0x4) OR eq(ty, $ty0)) AND uid_in(own, 0x9))",
+	} {
+		if !strings.Contains(fake.lastQuery, want) {
+			t.Errorf("expected %q in the shortest path query:\n%s", want, fake.lastQuery)
+		}
+	}
+	if fake.lastVars["$ty0"] != "pkg" {
+		t.Errorf("type names should be bound as variables, got %v", fake.lastVars)
+	}
+}
+
+func TestQueryWithOptionsTraverseFilterAndDepth(t *testing.T) {
+	// 0x1 -> 0x2 -> 0x3, plus a shortcut 0x1 -> 0x3: the walk reaches 0x3 at depth 1
+	fake := &fakeClient{queryJSON: []byte(`{
+		"lv":[{"uid":"0x1","e":[{"uid":"0x2"},{"uid":"0x3"}]},{"uid":"0x2","e":[{"uid":"0x3"}]},{"uid":"0x3"}],
+		"qr":[{"uid":"0x1"},{"uid":"0x2"},{"uid":"0x3"}]
+	}`)}
+	q := &req.QueryRequest{
+		RootIDs:        []string{"0x1"},
+		Depth:          5,
+		TraverseFilter: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "Folder"},
+		Filters:        &req.QueryRequestClause{Field: "s1", Op: "eq", Val: "x"},
+		WithDepth:      true,
+	}
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	walk := fake.lastQuery[strings.Index(fake.lastQuery, "@recurse"):strings.Index(fake.lastQuery, "lv(func")]
+	if !strings.Contains(walk, "e @filter(eq(ty,$vv") {
+		t.Errorf("the traverse filter should prune the recurse block:\n%s", fake.lastQuery)
+	}
+	if strings.Contains(walk, "s1") {
+		t.Errorf("the result filter must not prune the walk:\n%s", fake.lastQuery)
+	}
+	want := map[string]int{"0x1": 0, "0x2": 1, "0x3": 1}
+	for _, n := range resp.ResultNodes {
+		if n.Depth == nil || *n.Depth != want[n.Uid] {
+			t.Errorf("%s: expected depth %d, got %v", n.Uid, want[n.Uid], n.Depth)
+		}
+	}
+
+	// without with_depth, no lv block and no depths
+	fake = &fakeClient{queryJSON: []byte(`{"qr":[{"uid":"0x1"}]}`)}
+	q = &req.QueryRequest{RootIDs: []string{"0x1"}, Depth: 5}
+	resp = newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if strings.Contains(fake.lastQuery, "lv(func") || resp.ResultNodes[0].Depth != nil {
+		t.Errorf("depths should only be worked out when asked for:\n%s", fake.lastQuery)
+	}
+
+	// the traverse filter leaks through pruning just as a result filter would
+	fake = &fakeClient{}
+	q = &req.QueryRequest{RootIDs: []string{"0x1"}, Depth: 5, TraverseFilter: &req.QueryRequestClause{Field: "p", Op: "eq", Val: "guess"}}
+	if resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, &sec.UserAuthData{Uid: "0x5", Role: "user"}, nil); resp.Error == "" {
+		t.Error("a non-sys caller must not be able to prune by p")
+	}
+}
+
+func TestQueryWithOptionsTree(t *testing.T) {
+	// 0x1 -> 0x2 -> 0x3 -> 0x1 is a cycle, 0x1 -> 0x3 a shortcut, and 0x4 is only reached
+	// through 0x5, which the caller cannot read so it is missing from qr
+	fake := &fakeClient{queryJSON: []byte(`{
+		"lv":[{"uid":"0x1","e":[{"uid":"0x2"},{"uid":"0x3"},{"uid":"0x5"}]},{"uid":"0x2","e":[{"uid":"0x3"}]},
+			{"uid":"0x3","e":[{"uid":"0x1"}]},{"uid":"0x5","e":[{"uid":"0x4"}]},{"uid":"0x4"}],
+		"qr":[{"uid":"0x1","s1":"root"},{"uid":"0x2","s1":"a"},{"uid":"0x3","s1":"b"},{"uid":"0x4","s1":"c"}]
+	}`)}
+	q := &req.QueryRequest{RootIDs: []string{"0x1"}, Depth: 5, Select: []string{"s1"}, Shape: req.SHAPE_TREE, WithDepth: true}
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	if !strings.Contains(fake.lastQuery, "lv(func") {
+		t.Errorf("a tree needs the edges walked:\n%s", fake.lastQuery)
+	}
+	if len(resp.ResultNodes) != 1 || resp.ResultNodes[0].Uid != "0x1" {
+		t.Fatalf("expected just the root at the top level, got %+v", resp.ResultNodes)
+	}
+	root := resp.ResultNodes[0]
+	if root.OutEdges == nil || len(*root.OutEdges) != 2 {
+		t.Fatalf("expected 0x2 and 0x3 under the root, got %+v", root.OutEdges)
+	}
+	n2, n3 := (*root.OutEdges)[0], (*root.OutEdges)[1]
+	if n2.String1 == nil || *n2.String1 != "a" || n3.String1 == nil || *n3.String1 != "b" {
+		t.Error("nested nodes should carry the selected fields")
+	}
+	if *root.Depth != 0 || *n2.Depth != 1 || *n3.Depth != 1 {
+		t.Error("depth should be the level in the tree")
+	}
+	// 0x3 is already nested under the root, so 0x2 -> 0x3 is a stub, as is 0x3 -> 0x1
+	if n2.OutEdges == nil || (*n2.OutEdges)[0].Uid != "0x3" || (*n2.OutEdges)[0].String1 != nil {
+		t.Errorf("expected a stub for 0x3 under 0x2, got %+v", n2.OutEdges)
+	}
+	if n3.OutEdges == nil || (*n3.OutEdges)[0].Uid != "0x1" || (*n3.OutEdges)[0].OutEdges != nil {
+		t.Errorf("expected the cycle back to the root to end in a stub, got %+v", n3.OutEdges)
+	}
+	data, _ := json.Marshal(resp)
+	if strings.Contains(string(data), `"0x4"`) {
+		t.Error("a node reached only through an unreadable node should be left out")
+	}
+
+	if resp := newFakeDB(&fakeClient{}).QueryWithOptions(&req.QueryRequest{RootIDs: []string{"0x1"}, Shape: req.SHAPE_TREE}, USERNODE, nil, nil); resp.Error == "" {
+		t.Error("a tree should only be built from node traversals")
+	}
+}
+
+// Without first or a cursor, order_by only sorts: nodes lacking the key are still returned,
+// sorted last by Dgraph.
+func TestQueryWithOptionsOrderWithoutPaging(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[{"uid":"0x1","t1":"2024-05-01T00:00:00Z"},{"uid":"0x2"}]}`)}
+	q := &req.QueryRequest{RootIDs: []string{"0x11"}, Depth: 1, OrderBy: req.QueryOrder{{Field: "t1"}}}
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	if strings.Contains(fake.lastQuery, "has(t1)") || !strings.Contains(fake.lastQuery, "orderasc: t1") {
+		t.Errorf("an unpaged sort should not filter on the key:\n%s", fake.lastQuery)
+	}
+	if len(resp.ResultNodes) != 2 || resp.ResultNodes[1].Uid != "0x2" {
+		t.Errorf("the node without t1 should be returned last, got %+v", resp.ResultNodes)
+	}
+}
+
+func TestQueryWithOptionsCursorPaging(t *testing.T) {
+	first := 2
+	order := req.QueryOrder{{Field: "t1", Desc: true}, {Field: "id"}}
+	// one more node than the page holds comes back, so there is a next page
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[
+		{"uid":"0x3","id":"a","ok0":"2024-05-02T00:00:00Z","ok1":"a"},
+		{"uid":"0x1","id":"b","ok0":"2024-05-01T00:00:00Z","ok1":"b"},
+		{"uid":"0x2","id":"c","ok0":"2024-05-01T00:00:00Z","ok1":"c"}]}`)}
+	q := &req.QueryRequest{RootIDs: []string{"0x11"}, Depth: 2, Select: []string{"id"}, OrderBy: order, First: &first}
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	for _, want := range []string{"orderdesc: t1, orderasc: id, first: 3", "has(t1) AND has(id)", "ok0: t1 ok1: id"} {
+		if !strings.Contains(fake.lastQuery, want) {
+			t.Errorf("query missing %q:\n%s", want, fake.lastQuery)
+		}
+	}
+	if !resp.HasMore || len(resp.ResultNodes) != 2 {
+		t.Fatalf("expected a full page with more to come, got %d nodes, has_more %v", len(resp.ResultNodes), resp.HasMore)
+	}
+	end := resp.PageEnd
+	if end == nil || end.Uid != "0x1" || !slices.Equal(end.Order, []string{"-t1", "id"}) ||
+		!slices.Equal(end.Vals, []string{"2024-05-01T00:00:00Z", "b"}) {
+		t.Fatalf("expected the page to end at 0x1, got %+v", end)
+	}
+
+	// the next page reads the ties with the last node after its uid, then what follows
+	fake = &fakeClient{queryJSON: []byte(`{
+		"tie":[{"uid":"0x2","id":"b","ok0":"2024-05-01T00:00:00Z","ok1":"b"}],
+		"qr":[{"uid":"0x4","id":"c","ok0":"2024-05-01T00:00:00Z","ok1":"c"}]}`)}
+	q = &req.QueryRequest{RootIDs: []string{"0x11"}, Depth: 2, Select: []string{"id"}, OrderBy: order, First: &first, PageCursor: end}
+	resp = newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	for _, want := range []string{"PG as var(func: uid(NID))", "qr(func: uid(PG), orderdesc: t1, orderasc: id, first: 3)",
+		"tie(func: uid(PG), first: 3, after: 0x1)", "(lt(t1,$vv", ") or (eq(t1,$vv"} {
+		if !strings.Contains(fake.lastQuery, want) {
+			t.Errorf("query missing %q:\n%s", want, fake.lastQuery)
+		}
+	}
+	if resp.HasMore || resp.PageEnd != nil || len(resp.ResultNodes) != 2 ||
+		resp.ResultNodes[0].Uid != "0x2" || resp.ResultNodes[1].Uid != "0x4" {
+		t.Errorf("expected the tie then the next node as the last page, got %+v", resp.ResultNodes)
+	}
+
+	// a page that is all one run of ties, cut short, is read again in uid order
+	fake = &fakeClient{queryJSONs: [][]byte{
+		[]byte(`{"qr":[{"uid":"0x9","ok0":"t","ok1":"x"},{"uid":"0x7","ok0":"t","ok1":"x"},{"uid":"0x8","ok0":"t","ok1":"x"}]}`),
+		[]byte(`{"tie":[{"uid":"0x5","ok0":"t","ok1":"x"},{"uid":"0x6","ok0":"t","ok1":"x"},{"uid":"0x7","ok0":"t","ok1":"x"}]}`),
+	}}
+	q = &req.QueryRequest{RootIDs: []string{"0x11"}, Depth: 2, OrderBy: order, First: &first}
+	resp = newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if !strings.Contains(fake.lastQuery, "after: 0x0") {
+		t.Errorf("expected the run to be read from its start:\n%s", fake.lastQuery)
+	}
+	if len(resp.ResultNodes) != 2 || resp.ResultNodes[0].Uid != "0x5" || resp.ResultNodes[1].Uid != "0x6" ||
+		resp.PageEnd == nil || resp.PageEnd.Uid != "0x6" {
+		t.Errorf("expected the lowest uids of the run, got %+v ending at %+v", resp.ResultNodes, resp.PageEnd)
+	}
+
+	q.OrderBy = req.QueryOrder{{Field: "t1"}}
+	if resp := newFakeDB(&fakeClient{}).QueryWithOptions(q, NODENODE, nil, nil); resp.Error == "" {
+		t.Error("a cursor from another ordering should be refused")
+	}
+}
+
+func TestQueryWithOptionsSnapshotReads(t *testing.T) {
+	first := 1
+	page := []byte(`{"qr":[{"uid":"0x1"},{"uid":"0x2"}]}`)
+	fake := &fakeClient{queryJSON: page, readTs: 500}
+	db := newFakeDB(fake)
+
+	// the first page of a paginated query is read at a new timestamp, which comes back as
+	// the snapshot for the later pages
+	q := &req.QueryRequest{RootIDs: []string{"0x11"}, First: &first}
+	resp := db.QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	if len(fake.readOpts) != 1 || fake.readOpts[0].StartTs != 0 {
+		t.Fatalf("expected one read-only transaction at a new timestamp, got %+v", fake.readOpts)
+	}
+	snap := resp.ReadAt
+	if snap == nil || snap.Ts != 500 || snap.Expires <= time.Now().Unix() {
+		t.Fatalf("expected a live snapshot at ts 500, got %+v", snap)
+	}
+
+	// a later page is read at the snapshot, which is handed back unchanged
+	fake.readTs = 900
+	q = &req.QueryRequest{RootIDs: []string{"0x11"}, First: &first, Offset: &first, ReadSnapshot: snap}
+	resp = db.QueryWithOptions(q, NODENODE, nil, nil)
+	if len(fake.readOpts) != 2 || fake.readOpts[1].StartTs != 500 {
+		t.Errorf("expected the next page to be read at ts 500, got %+v", fake.readOpts)
+	}
+	if resp.ReadAt != snap {
+		t.Errorf("expected the same snapshot back, got %+v", resp.ReadAt)
+	}
+
+	// an unpaginated query runs in an ordinary transaction and issues no snapshot
+	resp = db.QueryWithOptions(&req.QueryRequest{RootIDs: []string{"0x11"}}, NODENODE, nil, nil)
+	if len(fake.readOpts) != 2 || resp.ReadAt != nil {
+		t.Errorf("an unpaginated query should not read at a snapshot, got %+v", fake.readOpts)
+	}
+}
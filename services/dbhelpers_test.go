@@ -128,6 +128,96 @@ func TestConstructQueryStringNestedAnd(t *testing.T) {
 	}
 }
 
+func TestConstructQueryStringRicherOps(t *testing.T) {
+	cases := []struct {
+		clause req.QueryRequestClause
+		want   []string
+	}{
+		{req.QueryRequestClause{Field: "ty", Op: "in", Vals: []string{"a", "b"}}, []string{"(eq(ty,$vv", ") or eq(ty,$vv"}},
+		{req.QueryRequestClause{Field: "n1", Op: "between", Vals: []string{"1", "5"}}, []string{"between(n1,$vv"}},
+		{req.QueryRequestClause{Field: "t1", Op: "exists"}, []string{"has(t1)"}},
+		{req.QueryRequestClause{Op: "owner", Val: "token", OwnerUid: "0x2a"}, []string{"uid_in(own, 0x2a)"}},
+		{req.QueryRequestClause{Not: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "x"}}, []string{"not (eq(ty,$vv"}},
+	}
+	for _, c := range cases {
+		vars := map[string]string{}
+		got := constructQueryStringAndAddVars(c.clause, &vars)
+		for _, w := range c.want {
+			if !strings.Contains(got, w) {
+				t.Errorf("%+v: got %q, want it to contain %q", c.clause, got, w)
+			}
+		}
+		if strings.Contains(got, "token") {
+			t.Errorf("an owner clause must only compile the unpacked uid, got %q", got)
+		}
+	}
+
+	vars := map[string]string{}
+	constructQueryStringAndAddVars(req.QueryRequestClause{Field: "n1", Op: "between", Vals: []string{"1", "5"}}, &vars)
+	if len(vars) != 2 {
+		t.Errorf("both bounds should be bound as variables, got %v", vars)
+	}
+}
+
+func TestValidateClauseArgs(t *testing.T) {
+	bad := []req.QueryRequestClause{
+		{Field: "ty", Op: "in"},
+		{Field: "n1", Op: "between", Vals: []string{"1"}},
+		{Op: "exists"},
+		{Op: "owner", Val: "0x1"},
+		{Field: "ty", Op: "eq", Val: "x", Not: &req.QueryRequestClause{Field: "ty", Op: "exists"}},
+		{Or: []req.QueryRequestClause{{Not: &req.QueryRequestClause{Field: "bogus", Op: "exists"}}}},
+		// the renderer would take the and branch and drop the not
+		{Not: &req.QueryRequestClause{Field: "ty", Op: "exists"}, And: []req.QueryRequestClause{{Field: "ty", Op: "in"}}},
+		{Not: &req.QueryRequestClause{Field: "ty", Op: "exists"}, Or: []req.QueryRequestClause{{Field: "ty", Op: "exists"}}},
+		{Field: "s3", Op: "anyofterms", Val: "a"},
+		{Field: "id", Op: "alloftext", Val: "a"},
+		{Field: "s2", Op: "match", Val: "a"},
+		{Field: "s1", Op: "anyoftext", Val: "  "},
+		{Field: "s1", Op: "match", Val: "a", MatchDistance: 9},
+	}
+	for _, c := range bad {
+		if validateClauseArgs(&c) == nil {
+			t.Errorf("%+v should be rejected", c)
+		}
+	}
+	if err := validateClauseArgs(&req.QueryRequestClause{Not: &req.QueryRequestClause{Op: "owner", OwnerUid: "0x1"}}); err != nil {
+		t.Errorf("a negated owner clause should be fine, got %v", err)
+	}
+	if !clauseNamesField(&req.QueryRequestClause{Not: &req.QueryRequestClause{Field: "p", Op: "exists"}}, PRIVATE_FIELD) {
+		t.Error("the p guard must see through a not clause")
+	}
+}
+
+func TestConstructQueryStringTextOps(t *testing.T) {
+	for _, c := range []struct {
+		clause req.QueryRequestClause
+		prefix string
+	}{
+		{req.QueryRequestClause{Field: "s1", Op: "anyofterms", Val: "red blue"}, "anyofterms(s1,$vv"},
+		{req.QueryRequestClause{Field: "s2", Op: "ALLOFTEXT", Val: "running dogs"}, "alloftext(s2,$vv"},
+		{req.QueryRequestClause{Field: "s1", Op: "match", Val: "jonh"}, "match(s1,$vv"},
+	} {
+		vars := map[string]string{}
+		got := constructQueryStringAndAddVars(c.clause, &vars)
+		if !strings.HasPrefix(got, c.prefix) {
+			t.Errorf("%+v: got %q, want prefix %q", c.clause, got, c.prefix)
+		}
+		for _, v := range vars {
+			if v != c.clause.Val {
+				t.Errorf("the search text should be bound unchanged, got %q", v)
+			}
+		}
+	}
+	vars := map[string]string{}
+	if got := constructQueryStringAndAddVars(req.QueryRequestClause{Field: "id", Op: "match", Val: "x", MatchDistance: 4}, &vars); !strings.HasSuffix(got, ",4)") {
+		t.Errorf("match should use the given distance, got %q", got)
+	}
+	if got := constructQueryStringAndAddVars(req.QueryRequestClause{Field: "id", Op: "match", Val: "x"}, &vars); !strings.HasSuffix(got, ",2)") {
+		t.Errorf("match should default to a distance of 2, got %q", got)
+	}
+}
+
 func TestRenderQueryVarsString(t *testing.T) {
 	single := map[string]string{"$vvAAA": "x", "$ids": "ignored"}
 	if got := renderQueryVarsString(&single); got != "$vvAAA: string" {
@@ -222,21 +312,72 @@ func TestRenderPagination(t *testing.T) {
 	if got := renderPagination(&req.QueryRequest{}); got != "" {
 		t.Errorf("no pagination should render empty, got %q", got)
 	}
-	// offset-based, ascending order
-	got := renderPagination(&req.QueryRequest{First: i(10), Offset: i(20), OrderBy: s("c")})
-	if got != ", orderasc: c, first: 10, offset: 20" {
+	// offset-based, ascending order; one more than first is fetched to tell if there is more
+	got := renderPagination(&req.QueryRequest{First: i(10), Offset: i(20), OrderBy: req.QueryOrder{{Field: "c"}}})
+	if got != ", orderasc: c, first: 11, offset: 20" {
 		t.Errorf("offset pagination = %q", got)
 	}
-	// cursor-based, descending order; After is sanitised to a 0x uid
-	got = renderPagination(&req.QueryRequest{First: i(5), After: s("2a"), OrderBy: s("m"), OrderDesc: true})
-	if got != ", orderdesc: m, first: 5, after: 0x2a" {
+	// uid cursor, descending order; After is sanitised to a 0x uid
+	got = renderPagination(&req.QueryRequest{First: i(5), After: s("2a"), OrderBy: req.QueryOrder{{Field: "m"}}, OrderDesc: true})
+	if got != ", orderdesc: m, first: 6, after: 0x2a" {
 		t.Errorf("cursor pagination = %q", got)
 	}
+	// several keys, each with its own direction
+	got = renderPagination(&req.QueryRequest{OrderBy: req.QueryOrder{{Field: "T1"}, {Field: "c", Desc: true}}})
+	if got != ", orderasc: t1, orderdesc: c" {
+		t.Errorf("multi-key order = %q", got)
+	}
 	// a disallowed order predicate is dropped (not injected)
-	got = renderPagination(&req.QueryRequest{OrderBy: s("evil; drop"), First: i(1)})
-	if got != ", first: 1" {
+	got = renderPagination(&req.QueryRequest{OrderBy: req.QueryOrder{{Field: "evil; drop"}}, First: i(1)})
+	if got != ", first: 2" {
 		t.Errorf("disallowed order field should be dropped, got %q", got)
 	}
+	// an unsorted page cursor pages with after from its uid
+	got = renderPagination(&req.QueryRequest{First: i(5), PageCursor: &cm.PageCursor{Uid: "0x2a"}})
+	if got != ", first: 6, after: 0x2a" {
+		t.Errorf("unsorted page cursor = %q", got)
+	}
+	// a sorted one is paged by renderCursorBlocks instead
+	got = renderPagination(&req.QueryRequest{First: i(5), OrderBy: req.QueryOrder{{Field: "c"}},
+		PageCursor: &cm.PageCursor{Order: []string{"c"}, Vals: []string{"x"}, Uid: "0x2a"}})
+	if got != "" {
+		t.Errorf("sorted page cursor should render no args, got %q", got)
+	}
+}
+
+func TestCutPage(t *testing.T) {
+	pn := func(uid, val string) pageNode {
+		return pageNode{cm.NewGraphNodeJustUID(uid), []string{val}}
+	}
+	uids := func(page []pageNode) string {
+		u := []string{}
+		for _, p := range page {
+			u = append(u, p.node.Uid)
+		}
+		return strings.Join(u, " ")
+	}
+	cases := []struct {
+		name        string
+		ties, rest  []pageNode
+		first       int
+		want        string
+		more, whole bool
+	}{
+		{"last page, runs in uid order", nil, []pageNode{pn("0x5", "x"), pn("0x3", "y"), pn("0x2", "y")}, 3, "0x5 0x2 0x3", false, true},
+		{"ends before the last run", nil, []pageNode{pn("0x5", "x"), pn("0x6", "y"), pn("0x2", "z")}, 2, "0x5 0x6", true, true},
+		{"cut back before a run cut short", nil, []pageNode{pn("0x5", "x"), pn("0x3", "y"), pn("0x2", "y")}, 2, "0x5", true, true},
+		{"all one run cut short", nil, []pageNode{pn("0x3", "y"), pn("0x2", "y"), pn("0x1", "y")}, 2, "0x1 0x2", true, false},
+		{"ties fill the page", []pageNode{pn("0x7", "w"), pn("0x8", "w")}, []pageNode{pn("0x1", "x")}, 1, "0x7", true, true},
+		{"ends inside a whole run", []pageNode{pn("0x7", "w")}, []pageNode{pn("0x3", "y"), pn("0x2", "y")}, 2, "0x7 0x2", true, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			page, more, whole := cutPage(tc.ties, tc.rest, tc.first)
+			if uids(page) != tc.want || more != tc.more || whole != tc.whole {
+				t.Errorf("got %q more=%v whole=%v, want %q more=%v whole=%v", uids(page), more, whole, tc.want, tc.more, tc.whole)
+			}
+		})
+	}
 }
 
 func TestEscapeAndRegex(t *testing.T) {
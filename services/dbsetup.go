@@ -23,10 +23,10 @@ s: bool .
 e: [uid] @reverse .
 sgi: string @index(hash) .
 ty: string @index(hash) .
-id: string @index(trigram, term) .
+id: string @index(hash, trigram, term) @upsert .
 p: string @index(hash) .
-s1: string @index(trigram, term) .
-s2: string @index(term) .
+s1: string @index(trigram, term, fulltext) .
+s2: string @index(term, fulltext) .
 s3: string @index(hash) .
 s4: string @index(hash) .
 b:  string .
@@ -38,6 +38,8 @@ t1: datetime @index(hour) .
 t2: datetime @index(hour) .
 g: geo @index(geo) .
 vec: float32vector @index(hnsw(metric: "cosine")) .
+pst: string @index(exact) .
+psd: string .
 
 type U {
     un
@@ -76,6 +78,11 @@ type N {
     g
     vec
 }
+
+type PS {
+    pst
+    psd
+}
 `
 
 func GetDgraphSchemaVersionString() string {
@@ -0,0 +1,404 @@
+package services
+
+import (
+	"bytes"
+	"cogged/log"
+	cm "cogged/models"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+	Server-side embedding fills a node's vec from its text, so clients no longer have to ship
+	an embedding model, and lets a similarity search be sent as plain text. It is set up in
+	the flat config file:
+
+	{
+		"embed.provider": "http",
+		"embed.url": "http://127.0.0.1:8080/v1/embeddings",
+		"embed.model": "nomic-embed-text",
+		"embed.timeout": "30",
+		"embed.fields": "s1,s2"
+	}
+
+	provider  "hash" for HashEmbedder, a local deterministic embedder for tests and
+	          development, or "http" for HTTPEmbedder; "" or missing turns embedding off
+	dim       the length of the hash embedder's vectors (default 256)
+	url       the http embedder's endpoint, which takes and returns the OpenAI embeddings
+	          format that local inference servers such as llama.cpp, Ollama and TEI serve
+	model     the model the http embedder asks for, if the server needs one
+	timeout   seconds the http embedder waits for a response (default 30)
+	fields    comma-separated text predicates, of s1 to s4, whose values are joined in that
+	          order to make the text a node's vec is embedded from
+
+	A node created or updated with any of the fields set, and no vec of its own, has its vec
+	filled in; on update the fields it leaves out are read from the stored node. A node whose
+	fields are all empty keeps whatever vec it had. p is never embedded, as that would let
+	anyone who can read the node search by its private data.
+*/
+
+const EMBED_PREFIX string = "embed."
+
+const (
+	EMBED_PROVIDER_HASH = "hash"
+	EMBED_PROVIDER_HTTP = "http"
+
+	DEFAULT_HASH_EMBED_DIM = 256
+	MAX_HASH_EMBED_DIM     = 4096
+	DEFAULT_EMBED_TIMEOUT  = 30
+)
+
+type EmbedError struct {
+	Info string
+}
+
+func (e EmbedError) Error() string {
+	return e.Info
+}
+
+// Embedder turns texts into embedding vectors, one for each text and in the same order.
+type Embedder interface {
+	Embed(texts []string) ([][]float64, error)
+}
+
+// embedFieldNames lists the predicates that may be embedded, in the order their values are
+// joined.
+var embedFieldNames = []string{"s1", "s2", "s3", "s4"}
+
+// NewEmbedder reads the embed.* keys from conf, returning the configured Embedder (nil when
+// embedding is off) and the predicates it fills vec from.
+func NewEmbedder(conf *Config) (Embedder, []string, error) {
+	if conf == nil {
+		return nil, nil, nil
+	}
+	for key := range *conf {
+		if !strings.HasPrefix(key, EMBED_PREFIX) {
+			continue
+		}
+		switch strings.TrimPrefix(key, EMBED_PREFIX) {
+		case "provider", "dim", "url", "model", "timeout", "fields":
+		default:
+			return nil, nil, EmbedError{Info: fmt.Sprintf("unknown embedding setting %q", key)}
+		}
+	}
+	fields := []string{}
+	if list := conf.Get(EMBED_PREFIX + "fields"); list != "" {
+		set := typeSet(list)
+		for f := range set {
+			if !slices.Contains(embedFieldNames, f) {
+				return nil, nil, EmbedError{Info: fmt.Sprintf("%q can only list s1, s2, s3 and s4, not %q", EMBED_PREFIX+"fields", f)}
+			}
+		}
+		for _, f := range embedFieldNames {
+			if set[f] {
+				fields = append(fields, f)
+			}
+		}
+	}
+
+	var e Embedder
+	switch provider := conf.Get(EMBED_PREFIX + "provider"); provider {
+	case "":
+		if len(fields) > 0 {
+			return nil, nil, EmbedError{Info: fmt.Sprintf("%q needs %q to be set", EMBED_PREFIX+"fields", EMBED_PREFIX+"provider")}
+		}
+		return nil, nil, nil
+	case EMBED_PROVIDER_HASH:
+		dim := DEFAULT_HASH_EMBED_DIM
+		if s := conf.Get(EMBED_PREFIX + "dim"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > MAX_HASH_EMBED_DIM {
+				return nil, nil, EmbedError{Info: fmt.Sprintf("%q must be an integer between 1 and %d", EMBED_PREFIX+"dim", MAX_HASH_EMBED_DIM)}
+			}
+			dim = n
+		}
+		e = &HashEmbedder{Dim: dim}
+	case EMBED_PROVIDER_HTTP:
+		url := conf.Get(EMBED_PREFIX + "url")
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return nil, nil, EmbedError{Info: fmt.Sprintf("%q must be an http or https URL", EMBED_PREFIX+"url")}
+		}
+		timeout := DEFAULT_EMBED_TIMEOUT
+		if s := conf.Get(EMBED_PREFIX + "timeout"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return nil, nil, EmbedError{Info: fmt.Sprintf("%q must be a positive number of seconds", EMBED_PREFIX+"timeout")}
+			}
+			timeout = n
+		}
+		e = &HTTPEmbedder{
+			URL:    url,
+			Model:  conf.Get(EMBED_PREFIX + "model"),
+			Client: &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		}
+	default:
+		return nil, nil, EmbedError{Info: fmt.Sprintf("unknown embedding provider %q (allowed: %s, %s)", provider, EMBED_PROVIDER_HASH, EMBED_PROVIDER_HTTP)}
+	}
+	return e, fields, nil
+}
+
+// LoadEmbedder is NewEmbedder for start-up, where a bad config is fatal.
+func LoadEmbedder(conf *Config) (Embedder, []string) {
+	e, fields, err := NewEmbedder(conf)
+	if err != nil {
+		panic(err)
+	}
+	return e, fields
+}
+
+// HashEmbedder embeds a text by hashing each of its words (as searchTokens splits them)
+// into one of Dim signed buckets, then scaling the vector to unit length. It needs no model
+// and always gives the same vector for the same text, so texts sharing words come out
+// similar; it knows nothing of meaning, and is for tests and development.
+type HashEmbedder struct {
+	Dim int
+}
+
+func (h *HashEmbedder) Embed(texts []string) ([][]float64, error) {
+	vecs := make([][]float64, len(texts))
+	for i, text := range texts {
+		v := make([]float64, h.Dim)
+		for _, word := range searchTokens(text) {
+			f := fnv.New64a()
+			f.Write([]byte(word))
+			sum := f.Sum64()
+			if sum>>63 == 1 {
+				v[sum%uint64(h.Dim)]--
+			} else {
+				v[sum%uint64(h.Dim)]++
+			}
+		}
+		var norm float64
+		for _, x := range v {
+			norm += x * x
+		}
+		if norm > 0 {
+			norm = math.Sqrt(norm)
+			for j := range v {
+				v[j] /= norm
+			}
+		}
+		vecs[i] = v
+	}
+	return vecs, nil
+}
+
+// HTTPEmbedder asks an inference server for embeddings, posting
+// {"model": Model, "input": [texts]} to URL and reading {"data": [{"index", "embedding"}]}
+// back, the OpenAI embeddings format.
+type HTTPEmbedder struct {
+	URL    string
+	Model  string
+	Client *http.Client
+}
+
+type httpEmbedRequest struct {
+	Model string   `json:"model,omitempty"`
+	Input []string `json:"input"`
+}
+
+type httpEmbedResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	} `json:"data"`
+}
+
+func (h *HTTPEmbedder) Embed(texts []string) ([][]float64, error) {
+	body, err := json.Marshal(httpEmbedRequest{Model: h.Model, Input: texts})
+	if err != nil {
+		return nil, EmbedError{Info: "could not build embedding request"}
+	}
+	resp, err := h.Client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Error("embedding request", err)
+		return nil, EmbedError{Info: "embedding server unavailable"}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Error("embedding request", resp.Status)
+		return nil, EmbedError{Info: "embedding server returned " + resp.Status}
+	}
+	var result httpEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Error("unmarshal embeddings", err)
+		return nil, EmbedError{Info: "could not parse embeddings"}
+	}
+	if len(result.Data) != len(texts) {
+		return nil, EmbedError{Info: fmt.Sprintf("embedding server returned %d embeddings for %d texts", len(result.Data), len(texts))}
+	}
+	sort.Slice(result.Data, func(i, j int) bool { return result.Data[i].Index < result.Data[j].Index })
+	vecs := make([][]float64, len(texts))
+	for i, d := range result.Data {
+		if d.Index != i || len(d.Embedding) == 0 || len(d.Embedding) != len(result.Data[0].Embedding) {
+			return nil, EmbedError{Info: "embedding server returned malformed embeddings"}
+		}
+		for _, f := range d.Embedding {
+			if math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) > math.MaxFloat32 {
+				return nil, EmbedError{Info: "embedding server returned malformed embeddings"}
+			}
+		}
+		vecs[i] = d.Embedding
+	}
+	return vecs, nil
+}
+
+// formatVector writes v in the string-encoded float32 array format vec is stored in, e.g.
+// "[0.1,-2,0.001]".
+func formatVector(v []float64) string {
+	parts := make([]string, len(v))
+	for i, f := range v {
+		parts[i] = strconv.FormatFloat(float64(float32(f)), 'g', -1, 32)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// embedField returns the node's value of an embeddable predicate.
+func embedField(n *cm.GraphNode, field string) *string {
+	switch field {
+	case "s1":
+		return n.String1
+	case "s2":
+		return n.String2
+	case "s3":
+		return n.String3
+	case "s4":
+		return n.String4
+	}
+	return nil
+}
+
+// embedText joins the values of fields on n, taking any n leaves out from stored, the node
+// as it is in the DB (nil for a new node).
+func embedText(n, stored *cm.GraphNode, fields []string) string {
+	parts := []string{}
+	for _, f := range fields {
+		v := embedField(n, f)
+		if v == nil && stored != nil && !n.Unsets(f) {
+			v = embedField(stored, f)
+		}
+		if v != nil && strings.TrimSpace(*v) != "" {
+			parts = append(parts, strings.TrimSpace(*v))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// embedNodes fills in the vec of each node in an upsert that sets or unsets one of the
+// configured embed fields and has no vec of its own, in one call to the Embedder. The vectors are
+// checked against the vec_dim of each node's payload schema, as the request's own checks
+// ran before they existed.
+func (db *DB) embedNodes(nodeList *[]*cm.GraphNode) error {
+	if db.Embedder == nil || len(db.EmbedFields) == 0 || nodeList == nil {
+		return nil
+	}
+	need := []*cm.GraphNode{}
+	existing := []string{}
+	for _, n := range *nodeList {
+		if n.Vec != nil || n.Unsets("vec") {
+			continue
+		}
+		for _, f := range db.EmbedFields {
+			if embedField(n, f) != nil || n.Unsets(f) {
+				need = append(need, n)
+				if ValidateUid(n.Uid) {
+					existing = append(existing, n.Uid)
+				}
+				break
+			}
+		}
+	}
+	if len(need) == 0 {
+		return nil
+	}
+	stored := make(map[string]*cm.GraphNode)
+	if len(existing) > 0 {
+		vars := map[string]string{
+			"$ids": "[" + strings.Join(sanitiseListOfUids(existing), ",") + "]",
+		}
+		query := `query q($ids: string) {
+		qr(func: uid($ids)) {
+			uid ty ` + strings.Join(db.EmbedFields, " ") + `
+		}
+	}`
+		sp, err := db.Query(query, &vars)
+		if err != nil {
+			return DBError{Info: "DB query failed"}
+		}
+		nodes := SliceFromResultJSON[cm.GraphNode](sp)
+		if nodes == nil {
+			return DBError{Info: "could not parse query result"}
+		}
+		for _, n := range *nodes {
+			stored[n.Uid] = n
+		}
+	}
+
+	texts := []string{}
+	targets := []*cm.GraphNode{}
+	for _, n := range need {
+		if text := embedText(n, stored[SanitiseUID(n.Uid)], db.EmbedFields); text != "" {
+			texts = append(texts, text)
+			targets = append(targets, n)
+		} else if len(n.Unset) > 0 {
+			// the update unsets all the text its vec was embedded from
+			n.Unset = append(n.Unset, "vec")
+		}
+	}
+	if len(texts) == 0 {
+		return nil
+	}
+	vecs, err := db.Embedder.Embed(texts)
+	if err != nil {
+		return err
+	}
+	if len(vecs) != len(texts) {
+		return EmbedError{Info: "embedder returned the wrong number of embeddings"}
+	}
+	for i, v := range vecs {
+		// a vector with no direction cannot be compared, so there is nothing to store
+		if _, ok := cosineSimilarity(v, v); !ok {
+			continue
+		}
+		n := targets[i]
+		ty := n.Type
+		if s := stored[SanitiseUID(n.Uid)]; ty == nil && s != nil {
+			ty = s.Type
+		}
+		vec := cm.Vector(formatVector(v))
+		if s := cm.PayloadSchemaFor(ty); s != nil {
+			if err := s.ValidateVecDim(&vec); err != nil {
+				log.Error("embedder dimensions do not match the payload schema", err)
+				return EmbedError{Info: fmt.Sprintf("the embedder gives %d-dimension vectors, which a %q node's schema does not allow", len(v), s.Type)}
+			}
+		}
+		n.Vec = &vec
+	}
+	return nil
+}
+
+// embedQueryText embeds the text of a similarity search sent as plain text.
+func (db *DB) embedQueryText(text string) ([]float64, error) {
+	if db.Embedder == nil {
+		return nil, EmbedError{Info: "similarity search by text needs an embedder configured on the server; send a vector instead"}
+	}
+	vecs, err := db.Embedder.Embed([]string{text})
+	if err != nil {
+		return nil, err
+	}
+	if len(vecs) != 1 {
+		return nil, EmbedError{Info: "embedder returned the wrong number of embeddings"}
+	}
+	if _, ok := cosineSimilarity(vecs[0], vecs[0]); !ok {
+		return nil, EmbedError{Info: "similarity text has no words to embed"}
+	}
+	return vecs[0], nil
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	sec "cogged/security"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/dgo/v250/protos/api"
+)
+
+func TestNewEmbedder(t *testing.T) {
+	e, fields, err := NewEmbedder(&Config{"embed.provider": "hash", "embed.fields": "s2, s1", "db.host": "x"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h, ok := e.(*HashEmbedder); !ok || h.Dim != DEFAULT_HASH_EMBED_DIM {
+		t.Errorf("expected a hash embedder of the default dim, got %#v", e)
+	}
+	if strings.Join(fields, ",") != "s1,s2" {
+		t.Errorf("fields should be in predicate order, got %v", fields)
+	}
+	if e, _, err := NewEmbedder(&Config{}); e != nil || err != nil {
+		t.Errorf("no provider should turn embedding off, got %v %v", e, err)
+	}
+	for name, conf := range map[string]Config{
+		"unknown provider": {"embed.provider": "magic"},
+		"unknown setting":  {"embed.provider": "hash", "embed.dims": "8"},
+		"bad dim":          {"embed.provider": "hash", "embed.dim": "0"},
+		"private field":    {"embed.provider": "hash", "embed.fields": "s1,p"},
+		"fields only":      {"embed.fields": "s1"},
+		"no url":           {"embed.provider": "http"},
+		"bad timeout":      {"embed.provider": "http", "embed.url": "http://x", "embed.timeout": "-1"},
+	} {
+		if _, _, err := NewEmbedder(&conf); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestHashEmbedder(t *testing.T) {
+	h := &HashEmbedder{Dim: 64}
+	vecs, _ := h.Embed([]string{"Oat milk latte", "oat milk", "oat milk latte", "green tea", "..."})
+	if s, ok := cosineSimilarity(vecs[0], vecs[2]); !ok || math.Abs(s-1) > 1e-12 {
+		t.Errorf("the same words should embed the same, got %v", s)
+	}
+	close, _ := cosineSimilarity(vecs[0], vecs[1])
+	far, _ := cosineSimilarity(vecs[0], vecs[3])
+	if close <= far {
+		t.Errorf("shared words should be more similar: %v vs %v", close, far)
+	}
+	if _, ok := cosineSimilarity(vecs[4], vecs[4]); ok {
+		t.Error("a text with no words should embed to the zero vector")
+	}
+}
+
+func TestHTTPEmbedder(t *testing.T) {
+	var got httpEmbedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		if len(got.Input) == 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// answered out of order, as the format allows
+		w.Write([]byte(`{"data":[{"index":1,"embedding":[0,1]},{"index":0,"embedding":[1,0]}]}`))
+	}))
+	defer srv.Close()
+	e := &HTTPEmbedder{URL: srv.URL, Model: "m", Client: srv.Client()}
+
+	vecs, err := e.Embed([]string{"a", "b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Model != "m" || len(vecs) != 2 || vecs[0][0] != 1 || vecs[1][1] != 1 {
+		t.Errorf("unexpected request %+v or embeddings %v", got, vecs)
+	}
+	if _, err := e.Embed([]string{"a"}); err == nil {
+		t.Error("expected two embeddings for one text to be rejected")
+	}
+	if _, err := e.Embed([]string{"a", "b", "c"}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected the server's status, got %v", err)
+	}
+}
+
+func TestUpsertNodesEmbedsText(t *testing.T) {
+	stored := []byte(`{"qr":[{"uid":"0x5","s1":"oat milk"}]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{stored}, mutateResp: &api.Response{Uids: map[string]string{}}}
+	db := newFakeDB(fake)
+	db.Embedder, db.EmbedFields = &HashEmbedder{Dim: 16}, []string{"s1", "s2"}
+	s1, s2, own := "oat milk", "latte", cm.Vector("[1,0]")
+	nodes := []*cm.GraphNode{
+		{GraphBase: cm.GraphBase{Uid: "new"}, String1: &s1, String2: &s2},
+		// an update of s2 alone is embedded with the stored s1
+		{GraphBase: cm.GraphBase{Uid: "0x5"}, String2: &s2},
+		{GraphBase: cm.GraphBase{Uid: "0x6"}, String1: &s1, Vec: &own},
+		{GraphBase: cm.GraphBase{Uid: "0x7"}, String3: &s1},
+	}
+
+	if resp, err := db.UpsertNodes(&nodes); err != nil || resp.Error != "" {
+		t.Fatalf("unexpected error: %v %v", err, resp)
+	}
+	if len(fake.queries) != 1 || fake.lastVars["$ids"] != "[0x5]" || !strings.Contains(fake.queries[0], "uid ty s1 s2") {
+		t.Errorf("expected the stored fields of 0x5 only to be read:\n%v %v", fake.queries, fake.lastVars)
+	}
+	want, _ := db.Embedder.Embed([]string{"oat milk\nlatte"})
+	if nodes[0].Vec == nil || string(*nodes[0].Vec) != formatVector(want[0]) || nodes[1].Vec == nil || *nodes[1].Vec != *nodes[0].Vec {
+		t.Errorf("expected both nodes embedded from s1 and s2, got %v %v", nodes[0].Vec, nodes[1].Vec)
+	}
+	if *nodes[2].Vec != own || nodes[3].Vec != nil {
+		t.Errorf("a node's own vec should be kept and one without embed fields left alone, got %v %v", *nodes[2].Vec, nodes[3].Vec)
+	}
+	if !strings.Contains(string(fake.lastMutation.SetJson), `"vec":"[`) {
+		t.Errorf("vec should be written:\n%s", fake.lastMutation.SetJson)
+	}
+}
+
+func TestUpsertNodesReembedsOnUnset(t *testing.T) {
+	stored := []byte(`{"qr":[{"uid":"0x5","s1":"oat milk","s2":"latte"},{"uid":"0x6","s1":"tea"}]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{stored}, mutateResp: &api.Response{Uids: map[string]string{}}}
+	db := newFakeDB(fake)
+	db.Embedder, db.EmbedFields = &HashEmbedder{Dim: 16}, []string{"s1", "s2"}
+	nodes := []*cm.GraphNode{
+		{GraphBase: cm.GraphBase{Uid: "0x5"}, Unset: []string{"s2"}},
+		{GraphBase: cm.GraphBase{Uid: "0x6"}, Unset: []string{"s1"}},
+	}
+
+	if _, err := db.UpsertNodes(&nodes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want, _ := db.Embedder.Embed([]string{"oat milk"})
+	if nodes[0].Vec == nil || string(*nodes[0].Vec) != formatVector(want[0]) {
+		t.Errorf("expected 0x5 embedded without its unset s2, got %v", nodes[0].Vec)
+	}
+	if del := string(fake.lastMutation.DeleteJson); !strings.Contains(del, `{"s1":null,"uid":"0x6","vec":null}`) {
+		t.Errorf("expected the vec of 0x6, left with no text, to be unset too:\n%s", del)
+	}
+}
+
+func TestQuerySimilarByText(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"n":[{"total":0}],"qr":[]}`)}
+	db := newFakeDB(fake)
+	q := &req.QueryRequest{Similar: &req.QuerySimilarity{Text: "oat milk"}}
+	admin := &sec.UserAuthData{Role: sec.SYS_ROLE}
+
+	if resp := db.QueryWithOptions(q, NODENODE, admin, nil); resp.Error == "" || fake.lastQuery != "" {
+		t.Errorf("text without an embedder should be rejected before any query, got %q", resp.Error)
+	}
+	db.Embedder = &HashEmbedder{Dim: 8}
+	if resp := db.QueryWithOptions(q, NODENODE, admin, nil); resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	want, _ := db.Embedder.Embed([]string{"oat milk"})
+	if !strings.Contains(fake.lastQuery, `similar_to(vec, 40, "`+formatVector(want[0])+`")`) {
+		t.Errorf("expected the embedded text in the query:\n%s", fake.lastQuery)
+	}
+}
+
+func TestEmbedNodesChecksVecDim(t *testing.T) {
+	cm.SetPayloadSchemas([]*cm.PayloadSchema{{Type: "doc", VecDim: 768}})
+	defer cm.SetPayloadSchemas(nil)
+	db := newFakeDB(&fakeClient{})
+	db.Embedder, db.EmbedFields = &HashEmbedder{Dim: 16}, []string{"s1"}
+	ty, s1 := "doc", "oat milk"
+	nodes := []*cm.GraphNode{{GraphBase: cm.GraphBase{Uid: "new"}, Type: &ty, String1: &s1}}
+	if err := db.embedNodes(&nodes); err == nil || !strings.Contains(err.Error(), "16-dimension") {
+		t.Errorf("expected the embedder's dimensions to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	res "cogged/responses"
+	sec "cogged/security"
+	"sort"
+)
+
+const (
+	// HYBRID_SIGNAL_DEPTH is how far down each of its rankings a hybrid search looks for
+	// nodes to fuse, or further when the requested page reaches past it.
+	HYBRID_SIGNAL_DEPTH = 100
+
+	DEFAULT_RRF_K = 60
+)
+
+// hybridRanking is one signal's ranking in a hybrid search: uids best first, with the score
+// each was ranked by.
+type hybridRanking struct {
+	uids   []string
+	scores map[string]float64
+	weight float64
+	// lowerBetter is set for a ranking by distance
+	lowerBetter bool
+}
+
+// hybridSearch answers a SearchRequest with a Similar or Geo block. Each signal it asks
+// for — text matches, vector similarity and nearness — ranks the readable nodes that pass
+// r.Filters on its own, the same way Search, querySimilar and queryNearest do, so a node
+// the caller cannot read never takes a place in any ranking. The rankings are then fused
+// (see fuseRankings), and the selected fields read back for just the requested page, each
+// node with its combined score and, where it has them, its similarity and distance.
+func (db *DB) hybridSearch(r *req.SearchRequest, uad *sec.UserAuthData, allowedSgis []string) *res.CoggedResponse {
+	offset, first := 0, DEFAULT_SEARCH_PAGE
+	if r.Offset != nil {
+		offset = *r.Offset
+	}
+	if r.First != nil {
+		first = *r.First
+	}
+	// the vector and point are checked before any signal is run
+	var vector []float64
+	if r.Similar != nil {
+		v, err := db.similarityVector(r.Similar)
+		if err != nil {
+			return res.CoggedResponseFromError(err.Error())
+		}
+		vector = v
+	}
+	var geo *req.QueryGeo
+	if r.Geo != nil {
+		g := *r.Geo
+		g.Mode = req.GEO_NEAREST
+		if err := validateGeo(&g); err != nil {
+			return res.CoggedResponseFromError(err.Error())
+		}
+		geo = &g
+	}
+	depth := min(max(HYBRID_SIGNAL_DEPTH, offset+first), MAX_NEAREST_CANDIDATES-1)
+	textWeight, vectorWeight, geoWeight := r.Fusion.SignalWeights()
+	authz := renderReadAuthzFilter(NODENODE, uad, allowedSgis)
+
+	rankings := []hybridRanking{}
+	if r.Text != "" && textWeight > 0 {
+		ranked, scores, err := db.searchText(r, authz)
+		if err != nil {
+			return res.CoggedResponseFromError(err.Error())
+		}
+		h := hybridRanking{scores: make(map[string]float64), weight: textWeight}
+		for _, n := range ranked[:min(depth, len(ranked))] {
+			h.uids = append(h.uids, n.Uid)
+			h.scores[n.Uid] = float64(scores[n.Uid])
+		}
+		rankings = append(rankings, h)
+	}
+	var similarity map[string]float64
+	if vector != nil && vectorWeight > 0 {
+		q := &req.QueryRequest{Similar: r.Similar, Filters: r.Filters}
+		ranked, scores, _, err := db.rankSimilar(q, NODENODE, vector, depth, authz, 0)
+		if err != nil {
+			return res.CoggedResponseFromError(err.Error())
+		}
+		similarity = scores
+		rankings = append(rankings, hybridRanking{uids: ranked, scores: scores, weight: vectorWeight})
+	}
+	var distance map[string]float64
+	if geo != nil && geoWeight > 0 {
+		found, dist, _, _, err := db.rankNearest(&req.QueryRequest{Geo: geo, Filters: r.Filters}, depth, authz, 0)
+		if err != nil {
+			return res.CoggedResponseFromError(err.Error())
+		}
+		distance = dist
+		h := hybridRanking{scores: dist, weight: geoWeight, lowerBetter: true}
+		for _, n := range found[:min(depth, len(found))] {
+			h.uids = append(h.uids, n.Uid)
+		}
+		rankings = append(rankings, h)
+	}
+
+	method, k := req.FUSION_RRF, DEFAULT_RRF_K
+	if r.Fusion != nil {
+		if r.Fusion.Method != "" {
+			method = r.Fusion.Method
+		}
+		if r.Fusion.K > 0 {
+			k = r.Fusion.K
+		}
+	}
+	fused := fuseRankings(rankings, method, k)
+	ranked := []string{}
+	for u := range fused {
+		ranked = append(ranked, u)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		si, sj := fused[ranked[i]], fused[ranked[j]]
+		if si != sj {
+			return si > sj
+		}
+		return ranked[i] < ranked[j]
+	})
+	page := []string{}
+	if offset < len(ranked) {
+		page = ranked[offset:min(offset+first, len(ranked))]
+	}
+
+	result := []*cm.GraphNode{}
+	if len(page) > 0 {
+		nodes, err := db.queryReadableNodes(page, r.Select, authz)
+		if err != nil {
+			return res.CoggedResponseFromError("DB query failed")
+		}
+		for _, u := range page {
+			n, ok := nodes[u]
+			if !ok {
+				continue
+			}
+			score := fused[u]
+			n.Score = &score
+			if s, ok := similarity[u]; ok {
+				n.Similarity = &s
+			}
+			if d, ok := distance[u]; ok {
+				n.DistanceM = &d
+			}
+			result = append(result, n)
+		}
+	}
+	resp := res.CoggedResponseFromNodes(&result)
+	resp.HasMore = offset+first < len(ranked)
+	return resp
+}
+
+// fuseRankings combines the rankings of a hybrid search into a score for every node in any
+// of them. Under rrf a node scores weight / (k + rank) in each ranking it is in, its rank
+// counted from 1, which needs no agreement between the signals' scales. Under weighted it
+// scores weight times its score in each, scaled to between 0 and 1 across the ranking
+// (the best 1, the worst 0, all 1 when they are equal). Either way a ranking it is not in
+// adds nothing.
+func fuseRankings(rankings []hybridRanking, method string, k int) map[string]float64 {
+	fused := make(map[string]float64)
+	for _, h := range rankings {
+		if method != req.FUSION_WEIGHTED {
+			for i, u := range h.uids {
+				fused[u] += h.weight / float64(k+i+1)
+			}
+			continue
+		}
+		if len(h.uids) == 0 {
+			continue
+		}
+		lo, hi := h.scores[h.uids[0]], h.scores[h.uids[0]]
+		for _, u := range h.uids {
+			lo, hi = min(lo, h.scores[u]), max(hi, h.scores[u])
+		}
+		for _, u := range h.uids {
+			scaled := 1.0
+			if hi > lo {
+				scaled = (h.scores[u] - lo) / (hi - lo)
+				if h.lowerBetter {
+					scaled = 1 - scaled
+				}
+			}
+			fused[u] += h.weight * scaled
+		}
+	}
+	return fused
+}
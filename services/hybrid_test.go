@@ -0,0 +1,116 @@
+package services
+
+import (
+	req "cogged/requests"
+	sec "cogged/security"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestHybridSearchFusesRankings(t *testing.T) {
+	matches := []byte(`{"qr":[
+		{"uid":"0x1","m":"2024-01-01T00:00:00Z","s1":"oat milk"},
+		{"uid":"0x2","m":"2024-01-01T00:00:00Z","s1":"oat"}
+	]}`)
+	similar := []byte(`{"n":[{"total":3}],"qr":[
+		{"uid":"0x1","sv":[0,1]},
+		{"uid":"0x2","sv":[1,0]},
+		{"uid":"0x3","sv":[0.6,0.8]}
+	]}`)
+	nodes := []byte(`{"qr":[{"uid":"0x1"},{"uid":"0x2"},{"uid":"0x3"}]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{matches, similar, nodes}}
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+	r := &req.SearchRequest{Text: "oat milk", Similar: &req.QuerySimilarity{Vector: "[1, 0]"}}
+
+	resp := newFakeDB(fake).Search(r, reader, []string{"sg1"})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	// 0x2 is second for text and first for vector, 0x1 first and third, 0x3 only second
+	if len(resp.ResultNodes) != 3 || resp.ResultNodes[0].Uid != "0x2" || resp.ResultNodes[1].Uid != "0x1" || resp.ResultNodes[2].Uid != "0x3" {
+		t.Fatalf("expected 0x2, 0x1, 0x3, got %+v", resp.ResultNodes)
+	}
+	top := resp.ResultNodes[0]
+	if top.Score == nil || math.Abs(*top.Score-(1.0/62+1.0/61)) > 1e-12 {
+		t.Errorf("unexpected rrf score %v", top.Score)
+	}
+	if top.Similarity == nil || *top.Similarity != 1 || top.DistanceM != nil {
+		t.Errorf("expected 0x2's similarity and no distance, got %v %v", top.Similarity, top.DistanceM)
+	}
+	for i, want := range []string{
+		"qr(func: uid(S0, S1, S2), first: 1000) @filter((uid_in(own, 0x9) OR",
+		`C as var(func: similar_to(vec, 400, "[1,0]"))`,
+	} {
+		if !strings.Contains(fake.queries[i], want) {
+			t.Errorf("expected %q in query %d:\n%s", want, i, fake.queries[i])
+		}
+	}
+	if !strings.Contains(fake.queries[1], `qr(func: uid(C)) @filter((uid_in(own, 0x9) OR (eq(sgi, ["sg1"]) AND eq(r, true))))`) {
+		t.Errorf("vector candidates should be read-filtered:\n%s", fake.queries[1])
+	}
+}
+
+func TestHybridSearchWeighted(t *testing.T) {
+	matches := []byte(`{"qr":[
+		{"uid":"0x1","m":"2024-01-01T00:00:00Z","s1":"oat milk"},
+		{"uid":"0x2","m":"2024-01-01T00:00:00Z","s1":"oat"}
+	]}`)
+	near := []byte(`{"qr":[
+		{"uid":"0x1","g":{"type":"Point","coordinates":[151.2143,-33.8688]}},
+		{"uid":"0x2","g":{"type":"Point","coordinates":[151.2093,-33.8688]}},
+		{"uid":"0x3","g":{"type":"Point","coordinates":[151.2193,-33.8688]}}
+	]}`)
+	nodes := []byte(`{"qr":[{"uid":"0x1"},{"uid":"0x2"},{"uid":"0x3"}]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{matches, near, near, nodes}}
+	one := 1.0
+	r := &req.SearchRequest{Text: "oat milk", Geo: &req.QueryGeo{Point: sydney, Distance: 5000},
+		Fusion: &req.SearchFusion{Method: req.FUSION_WEIGHTED, Weights: &req.SearchWeights{Geo: &one}}}
+
+	resp := newFakeDB(fake).Search(r, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	// 0x1 is the best text match and half way out; 0x2 the worst text match and nearest
+	if len(resp.ResultNodes) != 3 || resp.ResultNodes[0].Uid != "0x1" || resp.ResultNodes[1].Uid != "0x2" {
+		t.Fatalf("expected 0x1 then 0x2, got %+v", resp.ResultNodes)
+	}
+	if s := resp.ResultNodes[0].Score; s == nil || math.Abs(*s-1.5) > 0.01 {
+		t.Errorf("expected 0x1 to score about 1.5, got %v", s)
+	}
+	if d := resp.ResultNodes[1].DistanceM; d == nil || *d != 0 {
+		t.Errorf("expected 0x2 to be 0 m away, got %v", d)
+	}
+	if !strings.Contains(fake.queries[2], ", 5000), first: 1001)") {
+		t.Errorf("the geo signal should look out to the distance given:\n%v", fake.queries)
+	}
+
+	// a weight of 0 leaves the text signal out altogether
+	zero := 0.0
+	fake = &fakeClient{queryJSONs: [][]byte{near, near, nodes}}
+	r.Fusion.Weights.Text = &zero
+	if resp := newFakeDB(fake).Search(r, nil, nil); resp.Error != "" || strings.Contains(fake.queries[0], "anyofterms") {
+		t.Errorf("expected no text query, got %q:\n%v", resp.Error, fake.queries)
+	}
+}
+
+func TestHybridSearchValidation(t *testing.T) {
+	for name, r := range map[string]*req.SearchRequest{
+		"zero vector":   {Text: "oat", Similar: &req.QuerySimilarity{Vector: "[0, 0]"}},
+		"bad vector":    {Similar: &req.QuerySimilarity{Vector: "[1;2]"}},
+		"no point":      {Geo: &req.QueryGeo{}},
+		"a shape":       {Text: "oat", Geo: &req.QueryGeo{Point: sydney, Shape: square(0, 0, 1)}},
+		"private field": {Similar: &req.QuerySimilarity{Vector: "[1]"}, Filters: &req.QueryRequestClause{Field: "p", Op: "eq", Val: "x"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+			reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+			if resp := newFakeDB(fake).Search(r, reader, nil); resp.Error == "" {
+				t.Error("expected the search to be rejected")
+			}
+			if fake.lastQuery != "" {
+				t.Errorf("no query should reach Dgraph, got:\n%s", fake.lastQuery)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	res "cogged/responses"
+	sec "cogged/security"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	DEFAULT_NEAREST_FIRST = 10
+
+	// MAX_NEAREST_CANDIDATES caps how many readable nodes are ranked by distance. A radius
+	// holding more than this is narrowed until it holds fewer, so a page can only reach
+	// this far down the ranking.
+	MAX_NEAREST_CANDIDATES = 1000
+
+	// A nearest search looks NEAREST_START_METRES out first and widens the radius
+	// NEAREST_GROWTH times over each round until it holds a page, giving up after
+	// MAX_NEAREST_ROUNDS rounds.
+	NEAREST_START_METRES float64 = 1000
+	NEAREST_GROWTH       float64 = 8
+	MAX_NEAREST_ROUNDS           = 12
+
+	// EARTH_RADIUS_METRES is the mean radius of the Earth, for haversine distances.
+	EARTH_RADIUS_METRES float64 = 6_371_008.8
+)
+
+// queryNearest answers a QueryRequest whose geo mode is nearest: the readable nodes
+// nearest to the point, nearest first, each with its distance_m. Dgraph can only say which
+// nodes lie within a radius, not how far away they are, so the radius is widened until it
+// holds the requested page (or narrowed when it holds too many to rank), and the
+// candidates in it are ranked here. Candidates are read through the same read-authz
+// filter as QueryWithOptions, and the query's Filters, so a node the caller cannot read
+// never takes a place in the ranking. Only the requested page is read back with the
+// selected fields.
+//
+// Every node within the final radius is a candidate, so the ranking is exact up to that
+// radius. The rounds are read at one snapshot, which later pages can pass back as for any
+// paginated query.
+func (d *DB) queryNearest(q *req.QueryRequest, et EdgeType, uad *sec.UserAuthData, allowedSgis []string) *res.CoggedResponse {
+	if et != NODENODE {
+		return res.CoggedResponseFromError("geo mode nearest is only supported when querying nodes")
+	}
+	if err := validateGeo(q.Geo); err != nil {
+		return res.CoggedResponseFromError(err.Error())
+	}
+	offset, first := 0, DEFAULT_NEAREST_FIRST
+	if q.Offset != nil {
+		offset = *q.Offset
+	}
+	if q.First != nil && *q.First > 0 {
+		first = *q.First
+	}
+	if offset < 0 {
+		return res.CoggedResponseFromError("offset must not be negative")
+	}
+	need := offset + first
+	if need >= MAX_NEAREST_CANDIDATES {
+		return res.CoggedResponseFromError(fmt.Sprintf("geo mode nearest ranks at most the nearest %d nodes; offset plus first must be less than that", MAX_NEAREST_CANDIDATES))
+	}
+
+	authz := renderReadAuthzFilter(et, uad, allowedSgis)
+	var ts uint64
+	if q.ReadSnapshot != nil {
+		ts = q.ReadSnapshot.Ts
+	}
+	found, dist, more, ts, err := d.rankNearest(q, need, authz, ts)
+	if err != nil {
+		return res.CoggedResponseFromError(err.Error())
+	}
+	page := []*cm.GraphNode{}
+	if offset < len(found) {
+		page = found[offset:min(need, len(found))]
+	}
+
+	result := []*cm.GraphNode{}
+	if len(page) > 0 {
+		uids := []string{}
+		for _, n := range page {
+			uids = append(uids, n.Uid)
+		}
+		nodes, err := d.queryReadableNodes(uids, q.Select, authz)
+		if err != nil {
+			return res.CoggedResponseFromError("DB query failed")
+		}
+		for _, u := range uids {
+			if n, ok := nodes[u]; ok {
+				m := dist[u]
+				n.DistanceM = &m
+				result = append(result, n)
+			}
+		}
+	}
+	snapshot := q.ReadSnapshot
+	if snapshot == nil && ts != 0 {
+		snapshot = &cm.ReadSnapshot{Ts: ts, Expires: time.Now().Unix() + d.SnapshotExpiry}
+	}
+	resp := res.CoggedResponseFromNodes(&result)
+	resp.HasMore, resp.ReadAt = more, snapshot
+	return resp
+}
+
+// rankNearest returns the readable nodes nearest to the query's point that pass its
+// Filters, nearest first, with their distances: every node within the radius the search
+// settled on, which holds more than need when there are that many. more is whether there
+// are nodes past need in the ranking, or beyond the radius when it was narrowed. The
+// rounds are read at ts, or at a new snapshot when it is 0, which is returned.
+func (d *DB) rankNearest(q *req.QueryRequest, need int, authz string, ts uint64) ([]*cm.GraphNode, map[string]float64, bool, uint64, error) {
+	maxR := q.Geo.Distance
+	if maxR == 0 {
+		maxR = MAX_GEO_DISTANCE_METRES
+	}
+	// lo is the widest radius that held few enough to rank, and hi the narrowest that held
+	// too many; found holds the candidates within lo
+	r, lo, hi := min(NEAREST_START_METRES, maxR), 0.0, 0.0
+	var found []*cm.GraphNode
+	ranked := false
+	for round := 0; round < MAX_NEAREST_ROUNDS; round++ {
+		cands, readTs, err := d.nearestCandidates(q, r, ts, authz)
+		if err != nil {
+			return nil, nil, false, 0, DBError{Info: "DB query failed"}
+		}
+		ts = readTs
+		if len(cands) > MAX_NEAREST_CANDIDATES {
+			hi = r
+		} else {
+			found, lo, ranked = cands, r, true
+			if len(found) > need || r >= maxR {
+				break
+			}
+		}
+		if hi > 0 {
+			r = (lo + hi) / 2
+		} else {
+			r = min(r*NEAREST_GROWTH, maxR)
+		}
+	}
+	if !ranked {
+		return nil, nil, false, 0, DBError{Info: "too many nodes near the point to rank; narrow the search with filters"}
+	}
+
+	dist := make(map[string]float64)
+	measured := []*cm.GraphNode{}
+	for _, n := range found {
+		// a g that cannot be measured (written before geometries were validated) is left out
+		if m := geoDistance(q.Geo.Point, n.Location); !math.IsInf(m, 0) {
+			dist[n.Uid] = m
+			measured = append(measured, n)
+		}
+	}
+	found = measured
+	sort.Slice(found, func(i, j int) bool {
+		di, dj := dist[found[i].Uid], dist[found[j].Uid]
+		if di != dj {
+			return di < dj
+		}
+		return found[i].Uid < found[j].Uid
+	})
+	// hi is set when a wider radius had more nodes than were ranked
+	return found, dist, len(found) > need || hi > 0, ts, nil
+}
+
+// nearestCandidates reads the uid and g of the readable nodes within r metres of the
+// query's point that pass its Filters, one more than MAX_NEAREST_CANDIDATES at most so that
+// a radius holding too many shows as such.
+func (d *DB) nearestCandidates(q *req.QueryRequest, r float64, ts uint64, authz string) ([]*cm.GraphNode, uint64, error) {
+	vars := make(map[string]string)
+	filter := renderRootFilter(authz, q.Filters, &vars)
+	near := renderGeoFunc(&req.QueryGeo{Mode: req.GEO_NEAR, Point: q.Geo.Point, Distance: r})
+	query := `query q(` + renderQueryParams(nil, &vars) + `) {
+		qr(func: ` + near + `, first: ` + fmt.Sprintf("%d", MAX_NEAREST_CANDIDATES+1) + `)` + filter + ` {
+			uid ` + GEO_FIELD + `
+		}
+	}`
+	sp, readTs, err := d.QueryAt(query, &vars, ts)
+	if err != nil {
+		return nil, 0, err
+	}
+	list := SliceFromResultJSON[cm.GraphNode](sp)
+	if list == nil {
+		return nil, 0, DBError{Info: "could not parse nearest candidates"}
+	}
+	return *list, readTs, nil
+}
+
+// haversine returns the great-circle distance in metres between two [longitude, latitude]
+// positions.
+func haversine(a, b []float64) float64 {
+	rad := math.Pi / 180
+	dLat := (b[1] - a[1]) * rad
+	dLon := (b[0] - a[0]) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(a[1]*rad)*math.Cos(b[1]*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EARTH_RADIUS_METRES * math.Asin(math.Sqrt(min(h, 1)))
+}
+
+// geoDistance returns how far g is from the point p in metres, to the centimetre: the
+// haversine distance to a Point, 0 for an area holding p, and otherwise the distance to the
+// nearest edge of a line or area. Edges are measured on a flat projection centred on p,
+// which is close enough for the short edges geometries are drawn with.
+func geoDistance(p []float64, g *cm.Geoloc) float64 {
+	if g == nil {
+		return math.Inf(1)
+	}
+	d := math.Inf(1)
+	switch g.Type {
+	case cm.GEO_POINT:
+		if len(g.Coords) == 2 {
+			d = haversine(p, g.Coords)
+		}
+	case cm.GEO_LINESTRING:
+		d = pathDistance(p, g.Line)
+	case cm.GEO_POLYGON:
+		d = polygonDistance(p, g.Polygon)
+	case cm.GEO_MULTIPOLYGON:
+		for _, poly := range g.MultiPolygon {
+			d = min(d, polygonDistance(p, poly))
+		}
+	}
+	return math.Round(d*100) / 100
+}
+
+func polygonDistance(p []float64, rings [][][]float64) float64 {
+	if len(rings) > 0 && ringHolds(rings[0], p) {
+		holed := false
+		for _, hole := range rings[1:] {
+			holed = holed || ringHolds(hole, p)
+		}
+		if !holed {
+			return 0
+		}
+	}
+	d := math.Inf(1)
+	for _, ring := range rings {
+		d = min(d, pathDistance(p, ring))
+	}
+	return d
+}
+
+// ringHolds reports whether p lies inside a ring, by counting the edges a ray from p
+// crosses.
+func ringHolds(ring [][]float64, p []float64) bool {
+	in := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if len(a) != 2 || len(b) != 2 {
+			continue
+		}
+		if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+			in = !in
+		}
+	}
+	return in
+}
+
+// pathDistance returns the distance in metres from p to the nearest point on a path of
+// positions.
+func pathDistance(p []float64, path [][]float64) float64 {
+	rad := math.Pi / 180
+	// metres east and north of p
+	project := func(q []float64) (float64, float64) {
+		dLon := math.Remainder(q[0]-p[0], 360)
+		return dLon * rad * math.Cos(p[1]*rad) * EARTH_RADIUS_METRES, (q[1] - p[1]) * rad * EARTH_RADIUS_METRES
+	}
+	d := math.Inf(1)
+	for i := range path {
+		if len(path[i]) != 2 {
+			continue
+		}
+		ax, ay := project(path[i])
+		d = min(d, math.Hypot(ax, ay))
+		if i == 0 || len(path[i-1]) != 2 {
+			continue
+		}
+		bx, by := project(path[i-1])
+		dx, dy := bx-ax, by-ay
+		if l := dx*dx + dy*dy; l > 0 {
+			t := max(0, min(1, -(ax*dx+ay*dy)/l))
+			d = min(d, math.Hypot(ax+t*dx, ay+t*dy))
+		}
+	}
+	return d
+}
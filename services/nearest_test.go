@@ -0,0 +1,163 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	sec "cogged/security"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+var sydney = []float64{151.2093, -33.8688}
+
+func TestQueryNearestRanksByDistance(t *testing.T) {
+	cands := []byte(`{"qr":[
+		{"uid":"0x1","g":{"type":"Point","coordinates":[151.2143,-33.8688]}},
+		{"uid":"0x2","g":{"type":"Point","coordinates":[151.2103,-33.8688]}},
+		{"uid":"0x3","g":{"type":"Point","coordinates":[151.2093,-33.8688]}}
+	]}`)
+	nodes := []byte(`{"qr":[{"uid":"0x2","s1":"b"},{"uid":"0x3","s1":"c"}]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{cands, nodes}, readTs: 700}
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+	first := 2
+	q := &req.QueryRequest{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST, Point: sydney}, First: &first, Select: []string{"s1"}}
+
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, reader, []string{"sg1"})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	if len(resp.ResultNodes) != 2 || resp.ResultNodes[0].Uid != "0x3" || resp.ResultNodes[1].Uid != "0x2" {
+		t.Fatalf("expected 0x3 then 0x2, got %+v", resp.ResultNodes)
+	}
+	if d := resp.ResultNodes[0].DistanceM; d == nil || *d != 0 {
+		t.Errorf("expected 0x3 to be 0 m away, got %v", d)
+	}
+	if d := resp.ResultNodes[1].DistanceM; d == nil || math.Abs(*d-92.3) > 0.5 {
+		t.Errorf("expected 0x2 to be about 92 m away, got %v", d)
+	}
+	if !resp.HasMore || resp.ReadAt == nil || resp.ReadAt.Ts != 700 {
+		t.Errorf("expected more to come and a snapshot at ts 700, got %v %+v", resp.HasMore, resp.ReadAt)
+	}
+	for _, want := range []string{
+		"qr(func: near(g, [151.2093, -33.8688], 1000), first: 1001) @filter(",
+		"(uid_in(own, 0x9) OR (eq(sgi, [\"sg1\"]) AND eq(r, true)))",
+		"uid g",
+	} {
+		if !strings.Contains(fake.queries[0], want) {
+			t.Errorf("expected %q in the candidate query:\n%s", want, fake.queries[0])
+		}
+	}
+	if fake.lastVars["$ids"] != "[0x3,0x2]" {
+		t.Errorf("only the page should be read back, got %v", fake.lastVars)
+	}
+}
+
+func TestQueryNearestAdjustsRadius(t *testing.T) {
+	crowd := []string{}
+	for i := 0; i <= MAX_NEAREST_CANDIDATES; i++ {
+		crowd = append(crowd, fmt.Sprintf(`{"uid":"0x%x","g":{"type":"Point","coordinates":[151.3,-33.8688]}}`, i+100))
+	}
+	two := []byte(`{"qr":[
+		{"uid":"0x1","g":{"type":"Point","coordinates":[151.25,-33.8688]}},
+		{"uid":"0x2","g":{"type":"Point","coordinates":[151.24,-33.8688]}}
+	]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{
+		[]byte(`{"qr":[]}`),
+		[]byte(`{"qr":[` + strings.Join(crowd, ",") + `]}`),
+		two,
+		[]byte(`{"qr":[{"uid":"0x2"}]}`),
+	}}
+	first := 1
+	q := &req.QueryRequest{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST, Point: sydney}, First: &first}
+
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	// nothing within 1 km, too many within 8 km, so half way between
+	for i, want := range []string{", 1000), first", ", 8000), first", ", 4500), first"} {
+		if !strings.Contains(fake.queries[i], want) {
+			t.Errorf("round %d should search %q:\n%s", i, want, fake.queries[i])
+		}
+	}
+	if len(resp.ResultNodes) != 1 || resp.ResultNodes[0].Uid != "0x2" || !resp.HasMore {
+		t.Errorf("expected 0x2 with more to come, got %+v", resp.ResultNodes)
+	}
+
+	// a point no radius can narrow down to a rankable number gives up
+	fake = &fakeClient{queryJSON: []byte(`{"qr":[` + strings.Join(crowd, ",") + `]}`)}
+	resp = newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if !strings.Contains(resp.Error, "too many nodes") || len(fake.queries) != MAX_NEAREST_ROUNDS {
+		t.Errorf("expected to give up after %d rounds, got %q after %d", MAX_NEAREST_ROUNDS, resp.Error, len(fake.queries))
+	}
+
+	// the search stops at the distance given, however few it found
+	fake = &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+	q.Geo.Distance = 500
+	resp = newFakeDB(fake).QueryWithOptions(q, NODENODE, nil, nil)
+	if resp.Error != "" || len(fake.queries) != 1 || !strings.Contains(fake.lastQuery, ", 500), first") || resp.HasMore {
+		t.Errorf("expected one search out to 500 m, got %q:\n%v", resp.Error, fake.queries)
+	}
+}
+
+func TestQueryNearestValidation(t *testing.T) {
+	admin := &sec.UserAuthData{Role: sec.SYS_ROLE}
+	point := []float64{0, 0}
+	big, negative := MAX_NEAREST_CANDIDATES, -1
+
+	cases := []struct {
+		name string
+		q    *req.QueryRequest
+		et   EdgeType
+	}{
+		{"no point", &req.QueryRequest{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST}}, NODENODE},
+		{"with a shape", &req.QueryRequest{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST, Point: point, Shape: square(0, 0, 1)}}, NODENODE},
+		{"negative distance", &req.QueryRequest{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST, Point: point, Distance: -1}}, NODENODE},
+		{"past the ranking", &req.QueryRequest{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST, Point: point}, First: &big}, NODENODE},
+		{"negative offset", &req.QueryRequest{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST, Point: point}, Offset: &negative}, NODENODE},
+		{"in a filter clause", &req.QueryRequest{RootIDs: []string{"0x5"},
+			Filters: &req.QueryRequestClause{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST, Point: point}}}, NODENODE},
+		{"on the user's nodes", &req.QueryRequest{Geo: &req.QueryGeo{Mode: req.GEO_NEAREST, Point: point}}, USERNODE},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+			if resp := newFakeDB(fake).QueryWithOptions(tc.q, tc.et, admin, nil); resp.Error == "" {
+				t.Error("expected the query to be rejected")
+			}
+			if fake.lastQuery != "" {
+				t.Errorf("no query should reach Dgraph, got:\n%s", fake.lastQuery)
+			}
+		})
+	}
+}
+
+func TestGeoDistance(t *testing.T) {
+	melbourne := &cm.Geoloc{Type: cm.GEO_POINT, Coords: []float64{144.9631, -37.8136}}
+	if d := geoDistance(sydney, melbourne); math.Abs(d-713_400) > 1000 {
+		t.Errorf("Sydney to Melbourne should be about 713 km, got %.0f m", d)
+	}
+	// a degree of latitude
+	degree := EARTH_RADIUS_METRES * math.Pi / 180
+	line := &cm.Geoloc{Type: cm.GEO_LINESTRING, Line: [][]float64{{-1, 0}, {1, 0}}}
+	if d := geoDistance([]float64{0, 1}, line); math.Abs(d-degree) > 1 {
+		t.Errorf("expected a degree to the middle of the line, got %.0f m", d)
+	}
+	if d := geoDistance([]float64{0.5, 0.5}, square(0, 0, 1)); d != 0 {
+		t.Errorf("a point inside an area is 0 m from it, got %v", d)
+	}
+	holed := square(0, 0, 4)
+	holed.Polygon = append(holed.Polygon, square(1, 1, 2).Polygon[0])
+	if d := geoDistance([]float64{2, 1.5}, holed); math.Abs(d-degree/2) > 1 {
+		t.Errorf("a point in a hole is measured to the hole's edge, got %.0f m", d)
+	}
+	multi := &cm.Geoloc{Type: cm.GEO_MULTIPOLYGON, MultiPolygon: [][][][]float64{square(0, 0, 1).Polygon, square(5, 5, 1).Polygon}}
+	if d := geoDistance([]float64{5.5, 5.5}, multi); d != 0 {
+		t.Errorf("a point inside any of the polygons is 0 m away, got %v", d)
+	}
+	if d := geoDistance(sydney, nil); !math.IsInf(d, 1) {
+		t.Errorf("a node without g cannot be measured, got %v", d)
+	}
+}
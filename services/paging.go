@@ -0,0 +1,208 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// orderKeys returns the keys a query is sorted by, with their field names normalised.
+// Fields that are not allowed are dropped, as are e and g, which hold edges and geo points
+// rather than sortable values.
+func orderKeys(q *req.QueryRequest) []req.OrderKey {
+	keys := []req.OrderKey{}
+	for _, k := range q.OrderKeys() {
+		if f := renderField(k.Field); f != "" && f != "e" && f != GEO_FIELD {
+			keys = append(keys, req.OrderKey{Field: f, Desc: k.Desc})
+		}
+	}
+	return keys
+}
+
+// cursorOrder renders sort keys the way a PageCursor records them.
+func cursorOrder(keys []req.OrderKey) []string {
+	order := []string{}
+	for _, k := range keys {
+		if k.Desc {
+			order = append(order, "-"+k.Field)
+		} else {
+			order = append(order, k.Field)
+		}
+	}
+	return order
+}
+
+func renderOrderArgs(keys []req.OrderKey) []string {
+	args := []string{}
+	for _, k := range keys {
+		if k.Desc {
+			args = append(args, "orderdesc: "+k.Field)
+		} else {
+			args = append(args, "orderasc: "+k.Field)
+		}
+	}
+	return args
+}
+
+// renderHasKeys renders the filter that leaves out nodes without a value for a sort key,
+// which would otherwise have no place in the order for a cursor to page from.
+func renderHasKeys(keys []req.OrderKey) string {
+	has := []string{}
+	for _, k := range keys {
+		has = append(has, "has("+k.Field+")")
+	}
+	return strings.Join(has, " AND ")
+}
+
+// renderOrderAliases renders the sort key values under the aliases ok0, ok1 and so on, so
+// that the last node's can go into the next cursor without being returned as fields the
+// caller did not select.
+func renderOrderAliases(keys []req.OrderKey) string {
+	aliases := ""
+	for i, k := range keys {
+		aliases += fmt.Sprintf(" ok%d: %s", i, k.Field)
+	}
+	return aliases
+}
+
+// pageFetchSize is how many nodes to ask Dgraph for to fill a page of first: one more, so
+// that its presence tells whether there are more to come.
+func pageFetchSize(first int) int {
+	if first > 0 {
+		return first + 1
+	}
+	return first
+}
+
+// renderCursorFilters builds the filters picking out what follows a sorted cursor: after,
+// for the nodes whose sort keys come after the cursor's values, and ties, for those equal
+// to them on every key.
+func renderCursorFilters(keys []req.OrderKey, c *cm.PageCursor, vars *map[string]string) (string, string) {
+	after := []string{}
+	eqs := []string{}
+	for i, k := range keys {
+		op := OP_GT
+		if k.Desc {
+			op = OP_LT
+		}
+		v := bindQueryVar(c.Vals[i], vars)
+		after = append(after, strings.Join(append(append([]string{}, eqs...), op+"("+k.Field+","+v+")"), " and "))
+		eqs = append(eqs, "eq("+k.Field+","+v+")")
+	}
+	return "(" + strings.Join(after, ") or (") + ")", strings.Join(eqs, " and ")
+}
+
+// renderCursorBlocks renders the blocks that read the page after a sorted cursor from PG,
+// the variable holding every match: tie reads the nodes that tie with the cursor from its
+// uid on with after, so in uid order (see cutPage), and qr the nodes beyond them.
+func renderCursorBlocks(q *req.QueryRequest, keys []req.OrderKey, body string, vars *map[string]string) string {
+	after, ties := renderCursorFilters(keys, q.PageCursor, vars)
+	first := ""
+	if q.First != nil {
+		first = fmt.Sprintf(", first: %d", pageFetchSize(*q.First))
+	}
+	return `
+			qr(func: uid(PG), ` + strings.Join(renderOrderArgs(keys), ", ") + first + `) @filter(` + after + `) {
+				` + body + `
+			}
+			tie(func: uid(PG)` + first + `, after: ` + SanitiseUID(q.PageCursor.Uid) + `) @filter(` + ties + `) {
+				` + body + `
+			}`
+}
+
+// pageNode is a node of a paged query result with its sort key values, which are nil
+// when they did not all come back.
+type pageNode struct {
+	node *cm.GraphNode
+	vals []string
+}
+
+// parsePage reads the nodes of a paged query result: those of the tie block, if any, and
+// those of qr.
+func parsePage(result *string, keys []req.OrderKey) ([]pageNode, []pageNode, error) {
+	var a struct {
+		QR  []json.RawMessage `json:"qr"`
+		Tie []json.RawMessage `json:"tie"`
+	}
+	if err := json.Unmarshal([]byte(*result), &a); err != nil {
+		return nil, nil, err
+	}
+	read := func(raws []json.RawMessage) ([]pageNode, error) {
+		nodes := []pageNode{}
+		for _, raw := range raws {
+			n := cm.GraphNode{}
+			aliases := map[string]json.RawMessage{}
+			if err := json.Unmarshal(raw, &n); err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(raw, &aliases); err != nil {
+				return nil, err
+			}
+			vals := []string{}
+			for i := range keys {
+				r, ok := aliases[fmt.Sprintf("ok%d", i)]
+				if !ok {
+					vals = nil
+					break
+				}
+				// strings and datetimes are bound as they are; numbers as their JSON text
+				var v string
+				if json.Unmarshal(r, &v) != nil {
+					v = string(r)
+				}
+				vals = append(vals, v)
+			}
+			nodes = append(nodes, pageNode{&n, vals})
+		}
+		return nodes, nil
+	}
+	ties, err := read(a.Tie)
+	if err != nil {
+		return nil, nil, err
+	}
+	rest, err := read(a.QR)
+	return ties, rest, err
+}
+
+func uidValue(uid string) uint64 {
+	v, _ := strconv.ParseUint(strings.TrimPrefix(uid, "0x"), 16, 64)
+	return v
+}
+
+// cutPage takes a page of first nodes from the ties and the rest that a sorted, paged query
+// returned, which between them hold one node more than first when there are more to come.
+// It reports whether there are, and whether the page can be continued from its last node.
+//
+// Dgraph orders nodes that tie on every sort key arbitrarily, so each run of ties in rest
+// is put in uid order, the order a cursor pages ties in, and a page only ends inside a run
+// that came back whole. When rest fills the fetch its last run may have been cut short, so
+// a page ending in it is cut back to before it; if that would leave nothing, the page is
+// returned uncut and cannot be continued.
+func cutPage(ties, rest []pageNode, first int) ([]pageNode, bool, bool) {
+	lastRun := 0
+	for i := 1; i <= len(rest); i++ {
+		if i == len(rest) || !slices.Equal(rest[i].vals, rest[i-1].vals) {
+			run := rest[lastRun:i]
+			sort.SliceStable(run, func(a, b int) bool { return uidValue(run[a].node.Uid) < uidValue(run[b].node.Uid) })
+			if i < len(rest) {
+				lastRun = i
+			}
+		}
+	}
+	all := append(append([]pageNode{}, ties...), rest...)
+	if len(all) <= first {
+		return all, false, true
+	}
+	if len(rest) == pageFetchSize(first) && first-len(ties) > lastRun {
+		if cut := len(ties) + lastRun; cut > 0 {
+			return all[:cut], true, true
+		}
+		return all[:first], true, false
+	}
+	return all[:first], true, true
+}
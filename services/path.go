@@ -0,0 +1,192 @@
+package services
+
+import (
+	"cogged/log"
+	cm "cogged/models"
+	req "cogged/requests"
+	res "cogged/responses"
+	sec "cogged/security"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// renderPathHopFilter builds the @filter applied to every hop of a shortest-path search.
+// A filter on an edge predicate inside shortest() restricts which nodes the search may
+// step onto, so a path can only pass through nodes the caller may read and, with types
+// set, only through nodes of those types (the destination itself is exempt from the type
+// list). Type names are bound as query variables.
+func renderPathHopFilter(to string, types []string, authz string, vars *map[string]string, params *[]string) string {
+	parts := []string{}
+	if len(types) > 0 {
+		tyClauses := []string{"uid(" + to + ")"}
+		for i, t := range types {
+			name := fmt.Sprintf("$ty%d", i)
+			(*vars)[name] = t
+			*params = append(*params, name+": string")
+			tyClauses = append(tyClauses, "eq(ty, "+name+")")
+		}
+		parts = append(parts, "("+strings.Join(tyClauses, " OR ")+")")
+	}
+	if authz != "" {
+		parts = append(parts, authz)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " @filter(" + strings.Join(parts, " AND ") + ")"
+}
+
+// pathUids flattens one entry of Dgraph's _path_ result, a chain of nested objects linked
+// by the edge predicate followed at each hop, into the ordered list of uids along it.
+func pathUids(hop map[string]json.RawMessage) []string {
+	uids := []string{}
+	for hop != nil {
+		var uid string
+		if err := json.Unmarshal(hop["uid"], &uid); err != nil || uid == "" {
+			return nil
+		}
+		uids = append(uids, uid)
+
+		var next map[string]json.RawMessage
+		for _, pred := range []string{"e", "~e"} {
+			raw, ok := hop[pred]
+			if !ok {
+				continue
+			}
+			// a uid list predicate comes back as a one-element list, depending on the
+			// Dgraph version
+			var list []map[string]json.RawMessage
+			if json.Unmarshal(raw, &list) == nil && len(list) > 0 {
+				next = list[0]
+			} else if json.Unmarshal(raw, &next) != nil {
+				return nil
+			}
+			break
+		}
+		hop = next
+	}
+	return uids
+}
+
+// QueryShortestPaths finds up to NumPaths shortest paths from r.UnpackedFrom to
+// r.UnpackedTo with Dgraph's shortest(). Every hop is filtered by the caller's read
+// permissions inside the search, so a route through a node the caller cannot read is never
+// considered, rather than found and then hidden. The nodes along the paths are read back
+// with the same filter and a path missing any of them is dropped.
+func (db *DB) QueryShortestPaths(r *req.PathRequest, uad *sec.UserAuthData, allowedSgis []string) *res.PathResponse {
+	preds, err := getTraversalPredicates(NODENODE, r.Direction)
+	if err != nil {
+		return res.PathResponseFromError(err.Error())
+	}
+	from, to := SanitiseUID(r.UnpackedFrom.Uid), SanitiseUID(r.UnpackedTo.Uid)
+
+	depth := r.MaxDepth
+	if depth == 0 || depth > MAX_QUERY_RECURSE_DEPTH {
+		depth = MAX_QUERY_RECURSE_DEPTH
+	}
+	numPaths := r.NumPaths
+	if numPaths == 0 {
+		numPaths = 1
+	}
+
+	authz := renderReadAuthzFilter(NODENODE, uad, allowedSgis)
+	vars := make(map[string]string)
+	params := []string{}
+	hopFilter := renderPathHopFilter(to, r.Types, authz, &vars, &params)
+	hops := []string{}
+	for _, p := range strings.Fields(preds) {
+		hops = append(hops, p+hopFilter)
+	}
+
+	header := "query q"
+	if len(params) > 0 {
+		header += "(" + strings.Join(params, ", ") + ")"
+	}
+	// the pn block only exists because Dgraph rejects a query that defines a variable
+	// without using it
+	query := header + ` {
+		path as shortest(from: ` + from + `, to: ` + to + `, numpaths: ` + fmt.Sprintf("%d", numPaths) + `, depth: ` + fmt.Sprintf("%d", depth) + `) {
+			` + strings.Join(hops, "\n\t\t\t") + `
+		}
+		pn(func: uid(path)) { uid }
+	}`
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return res.PathResponseFromError("DB query failed")
+	}
+	var a struct {
+		Paths []map[string]json.RawMessage `json:"_path_"`
+	}
+	if err := json.Unmarshal([]byte(*sp), &a); err != nil {
+		log.Error("unmarshal path result", err)
+		return res.PathResponseFromError("could not parse paths")
+	}
+
+	uidPaths := [][]string{}
+	seen := make(map[string]bool)
+	nodeUids := []string{}
+	for _, p := range a.Paths {
+		uids := pathUids(p)
+		if len(uids) == 0 {
+			continue
+		}
+		uidPaths = append(uidPaths, uids)
+		for _, u := range uids {
+			if !seen[u] {
+				seen[u] = true
+				nodeUids = append(nodeUids, u)
+			}
+		}
+	}
+	if len(uidPaths) == 0 {
+		return res.PathResponseFromPaths([]*res.NodePath{})
+	}
+
+	nodes, err := db.queryReadableNodes(nodeUids, r.Select, authz)
+	if err != nil {
+		return res.PathResponseFromError("DB query failed")
+	}
+	paths := []*res.NodePath{}
+	for _, uids := range uidPaths {
+		np := &res.NodePath{Nodes: []*cm.GraphNode{}, Hops: len(uids) - 1}
+		for _, u := range uids {
+			if n, ok := nodes[u]; ok {
+				np.Nodes = append(np.Nodes, n)
+			}
+		}
+		if len(np.Nodes) == len(uids) {
+			paths = append(paths, np)
+		}
+	}
+	return res.PathResponseFromPaths(paths)
+}
+
+// queryReadableNodes reads the given nodes that pass authz, keyed by uid.
+func (db *DB) queryReadableNodes(uids []string, sel []string, authz string) (map[string]*cm.GraphNode, error) {
+	vars := map[string]string{
+		"$ids": "[" + strings.Join(sanitiseListOfUids(uids), ",") + "]",
+	}
+	filter := ""
+	if authz != "" {
+		filter = " @filter(" + authz + ")"
+	}
+	query := `query q($ids: string) {
+		qr(func: uid($ids))` + filter + ` {
+			uid own {uid} sgi r w o i d s ` + renderFields(sel) + `
+		}
+	}`
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, err
+	}
+	list := SliceFromResultJSON[cm.GraphNode](sp)
+	if list == nil {
+		return nil, DBError{Info: "could not parse nodes"}
+	}
+	nodes := make(map[string]*cm.GraphNode)
+	for _, n := range *list {
+		nodes[n.Uid] = n
+	}
+	return nodes, nil
+}
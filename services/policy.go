@@ -0,0 +1,197 @@
+package services
+
+import (
+	cm "cogged/models"
+	"fmt"
+	"strings"
+)
+
+/*
+	Permission policies give nodes of a given `ty` server-side permission defaults and
+	limits, so clients no longer have to get r/w/o/i/d/s right on every node they create.
+	They are set in the flat config file, one key per setting:
+
+	{
+		"policy.perms.doc.default": "rw",
+		"policy.perms.doc.floor": "r",
+		"policy.perms.doc.ceiling": "rwos",
+		"policy.perms.doc.inherit": "true",
+		"policy.perms.*.default": "r"
+	}
+
+	default  bits set on a new node when the client leaves them out (null)
+	floor    bits a new node must end up with
+	ceiling  the only bits a new node may end up with ("" or missing: any)
+	inherit  "true" to take bits the client left out from the parent node instead of the
+	         default, when the node is created under one (PUT /graph/nodes/{ad})
+
+	The type "*" applies to nodes whose ty (including no ty at all) has no policy of its
+	own. Nodes with no applicable policy are created exactly as the client sent them.
+*/
+
+const POLICY_PERMS_PREFIX string = "policy.perms."
+const POLICY_ANY_TYPE string = "*"
+const PERMISSION_BITS string = "rwoids"
+
+type PolicyError struct {
+	Info string
+}
+
+func (e PolicyError) Error() string {
+	return e.Info
+}
+
+type PermissionPolicy struct {
+	Default string
+	Floor   string
+	Ceiling string
+	Inherit bool
+}
+
+// PermissionPolicies maps a node `ty` to its policy.
+type PermissionPolicies map[string]*PermissionPolicy
+
+func validatePermissionBits(bits string) bool {
+	for _, c := range bits {
+		if !strings.ContainsRune(PERMISSION_BITS, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewPermissionPolicies reads the policy.perms.* keys from conf. A malformed policy is an
+// error rather than being skipped, since a policy that silently fails to apply is exactly
+// the forgotten-flag problem policies exist to prevent.
+func NewPermissionPolicies(conf *Config) (PermissionPolicies, error) {
+	pp := make(PermissionPolicies)
+	if conf == nil {
+		return pp, nil
+	}
+	for key, val := range *conf {
+		if !strings.HasPrefix(key, POLICY_PERMS_PREFIX) {
+			continue
+		}
+		// the type name may itself contain dots, so the setting is whatever follows the last one
+		rest := strings.TrimPrefix(key, POLICY_PERMS_PREFIX)
+		i := strings.LastIndex(rest, ".")
+		if i < 1 {
+			return nil, PolicyError{Info: fmt.Sprintf("invalid permission policy key %q", key)}
+		}
+		ty, setting := rest[:i], rest[i+1:]
+		p, ok := pp[ty]
+		if !ok {
+			p = &PermissionPolicy{}
+			pp[ty] = p
+		}
+		switch setting {
+		case "default", "floor", "ceiling":
+			if !validatePermissionBits(val) {
+				return nil, PolicyError{Info: fmt.Sprintf("invalid permission bits %q for %q (allowed: %s)", val, key, PERMISSION_BITS)}
+			}
+			switch setting {
+			case "default":
+				p.Default = val
+			case "floor":
+				p.Floor = val
+			case "ceiling":
+				p.Ceiling = val
+			}
+		case "inherit":
+			if val != "true" && val != "false" {
+				return nil, PolicyError{Info: fmt.Sprintf("%q must be \"true\" or \"false\"", key)}
+			}
+			p.Inherit = val == "true"
+		default:
+			return nil, PolicyError{Info: fmt.Sprintf("unknown permission policy setting %q", key)}
+		}
+	}
+	for ty, p := range pp {
+		if p.Ceiling == "" {
+			continue
+		}
+		for _, c := range p.Floor + p.Default {
+			if !strings.ContainsRune(p.Ceiling, c) {
+				return nil, PolicyError{Info: fmt.Sprintf("permission policy for %q: '%c' is above its ceiling %q", ty, c, p.Ceiling)}
+			}
+		}
+	}
+	return pp, nil
+}
+
+// LoadPermissionPolicies is NewPermissionPolicies for server start-up, where (as with
+// LoadConfig) a bad config file is fatal.
+func LoadPermissionPolicies(conf *Config) PermissionPolicies {
+	pp, err := NewPermissionPolicies(conf)
+	if err != nil {
+		panic(err)
+	}
+	return pp
+}
+
+// For returns the policy that applies to a node of type ty, or nil if there is none.
+func (pp PermissionPolicies) For(ty *string) *PermissionPolicy {
+	if ty != nil {
+		if p, ok := pp[*ty]; ok {
+			return p
+		}
+	}
+	return pp[POLICY_ANY_TYPE]
+}
+
+func permBitPtrs(n *cm.GraphNode) map[rune]**bool {
+	return map[rune]**bool{
+		'r': &n.PermRead,
+		'w': &n.PermWrite,
+		'o': &n.PermOutEdge,
+		'i': &n.PermInEdge,
+		'd': &n.PermDelete,
+		's': &n.PermShare,
+	}
+}
+
+// ApplyToNewNode fills in and then checks the permission bits of a node about to be
+// created. Bits the client left unset come from parent when the policy inherits and there
+// is a parent, otherwise from the policy default, and anything still unset is false. The
+// result must include every floor bit and nothing above the ceiling.
+func (pp PermissionPolicies) ApplyToNewNode(n *cm.GraphNode, parent *cm.GraphNode) error {
+	p := pp.For(n.Type)
+	if p == nil {
+		return nil
+	}
+
+	var parentBits map[rune]**bool
+	if p.Inherit && parent != nil {
+		parentBits = permBitPtrs(parent)
+	}
+	for c, bit := range permBitPtrs(n) {
+		if *bit != nil {
+			continue
+		}
+		v := strings.ContainsRune(p.Default, c)
+		if parentBits != nil {
+			// AuthzData only carries the bits that are set, so an absent parent bit is false
+			v = *parentBits[c] != nil && **parentBits[c]
+		}
+		*bit = &v
+	}
+
+	ty := "(no type)"
+	if n.Type != nil {
+		ty = fmt.Sprintf("%q", *n.Type)
+	}
+	bits := permBitPtrs(n)
+	for _, c := range p.Floor {
+		if !**bits[c] {
+			return PolicyError{Info: fmt.Sprintf("node %s of type %s must have permission '%c'", n.Uid, ty, c)}
+		}
+	}
+	if p.Ceiling != "" {
+		for _, c := range PERMISSION_BITS {
+			if **bits[c] && !strings.ContainsRune(p.Ceiling, c) {
+				return PolicyError{Info: fmt.Sprintf("node %s of type %s may not have permission '%c' (allowed: %q)", n.Uid, ty, c, p.Ceiling)}
+			}
+		}
+	}
+	return nil
+}
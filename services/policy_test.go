@@ -0,0 +1,111 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	cm "cogged/models"
+)
+
+func newNode(ty string) *cm.GraphNode {
+	n := cm.NewGraphNodeJustUID("$n")
+	if ty != "" {
+		n.Type = &ty
+	}
+	return n
+}
+
+// perms lists the bits set on n, in PERMISSION_BITS order.
+func perms(n *cm.GraphNode) string {
+	bits := permBitPtrs(n)
+	out := ""
+	for _, c := range PERMISSION_BITS {
+		if *bits[c] != nil && **bits[c] {
+			out += string(c)
+		}
+	}
+	return out
+}
+
+func TestNewPermissionPolicies(t *testing.T) {
+	pp, err := NewPermissionPolicies(&Config{
+		"db.host":                       "ignored",
+		"policy.perms.doc.default":      "rw",
+		"policy.perms.doc.floor":        "r",
+		"policy.perms.doc.ceiling":      "rwos",
+		"policy.perms.doc.inherit":      "true",
+		"policy.perms.app.v1.msg.floor": "r",
+		"policy.perms.*.default":        "r",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p := pp["doc"]; p == nil || p.Default != "rw" || p.Floor != "r" || p.Ceiling != "rwos" || !p.Inherit {
+		t.Errorf("doc policy not parsed: %+v", p)
+	}
+	if pp["app.v1.msg"] == nil {
+		t.Error("type names containing dots should be kept whole")
+	}
+	other := "other"
+	if pp.For(&other) != pp["*"] || pp.For(nil) != pp["*"] {
+		t.Error("types without a policy of their own should fall back to *")
+	}
+
+	for _, bad := range []Config{
+		{"policy.perms.doc.default": "rx"},
+		{"policy.perms.doc.inherit": "yes"},
+		{"policy.perms.doc.colour": "r"},
+		{"policy.perms.doc": "r"},
+		{"policy.perms.doc.ceiling": "r", "policy.perms.doc.floor": "rw"},
+	} {
+		if _, err := NewPermissionPolicies(&bad); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestApplyToNewNode(t *testing.T) {
+	pp, _ := NewPermissionPolicies(&Config{
+		"policy.perms.doc.default":   "rw",
+		"policy.perms.doc.floor":     "r",
+		"policy.perms.doc.ceiling":   "rwos",
+		"policy.perms.child.inherit": "true",
+		"policy.perms.child.default": "r",
+	})
+	tr, f := true, false
+
+	n := newNode("doc")
+	n.PermShare = &tr
+	if err := pp.ApplyToNewNode(n, nil); err != nil || perms(n) != "rws" || n.PermDelete == nil || *n.PermDelete {
+		t.Errorf("defaults should fill only the unset bits, and the rest be explicitly false: %q %v", perms(n), err)
+	}
+
+	n = newNode("doc")
+	n.PermRead = &f
+	if err := pp.ApplyToNewNode(n, nil); err == nil || !strings.Contains(err.Error(), "must have permission 'r'") {
+		t.Errorf("floor violation should be rejected, got %v", err)
+	}
+
+	n = newNode("doc")
+	n.PermDelete = &tr
+	if err := pp.ApplyToNewNode(n, nil); err == nil || !strings.Contains(err.Error(), "may not have permission 'd'") {
+		t.Errorf("ceiling violation should be rejected, got %v", err)
+	}
+
+	// inheriting takes the parent's bits (as unpacked from AuthzData: only set bits present)
+	parent := cm.NewGraphNodeJustUID("0x1")
+	parent.PermWrite, parent.PermShare = &tr, &tr
+	n = newNode("child")
+	if err := pp.ApplyToNewNode(n, parent); err != nil || perms(n) != "ws" {
+		t.Errorf("child should inherit the parent's bits, got %q %v", perms(n), err)
+	}
+	n = newNode("child")
+	if err := pp.ApplyToNewNode(n, nil); err != nil || perms(n) != "r" {
+		t.Errorf("with no parent an inheriting policy falls back to its default, got %q %v", perms(n), err)
+	}
+
+	n = newNode("untyped-and-unpoliced")
+	if err := pp.ApplyToNewNode(n, nil); err != nil || n.PermRead != nil {
+		t.Error("a node with no applicable policy should be left as sent")
+	}
+}
@@ -0,0 +1,190 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	res "cogged/responses"
+	sec "cogged/security"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	DEFAULT_SEARCH_PAGE = 20
+
+	// MAX_SEARCH_CANDIDATES caps how many readable matches are ranked. Dgraph has no
+	// relevance scoring, so matches are ranked here and only the best of the first this
+	// many are paged through.
+	MAX_SEARCH_CANDIDATES = 1000
+)
+
+// searchModeOps maps a SearchRequest mode to the filter op it searches with, and so to the
+// fields that can be searched (see textOpFields).
+var searchModeOps = map[string]string{
+	"":                    OP_ANYOFTERMS,
+	req.SEARCH_MODE_TERMS: OP_ANYOFTERMS,
+	req.SEARCH_MODE_TEXT:  OP_ANYOFTEXT,
+	req.SEARCH_MODE_FUZZY: OP_MATCH,
+}
+
+// searchTokens splits text into lower-case words for ranking.
+func searchTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchScore ranks a match by how many of the distinct search words appear among the
+// words of its searched fields, with a bonus when the whole search text appears as is.
+func searchScore(n *cm.GraphNode, fields []string, words []string, text string) int {
+	values := []string{}
+	for _, f := range fields {
+		switch f {
+		case "id":
+			values = append(values, deref(n.Id))
+		case "s1":
+			values = append(values, deref(n.String1))
+		case "s2":
+			values = append(values, deref(n.String2))
+		}
+	}
+	all := strings.ToLower(strings.Join(values, "\n"))
+	have := make(map[string]bool)
+	for _, w := range searchTokens(all) {
+		have[w] = true
+	}
+	score := 0
+	for _, w := range words {
+		if have[w] {
+			score++
+		}
+	}
+	if strings.Contains(all, strings.ToLower(text)) {
+		score += len(words)
+	}
+	return score
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// Search finds the nodes the caller may read whose text fields match r.Text, best match
+// first. Each searched field gets a root function of its own, as a root function can only
+// name one predicate, and the union is filtered by the caller's read permissions (the
+// same clause QueryWithOptions uses) and r.Filters. The readable matches are then ranked,
+// and the selected fields read back for just the requested page. A request with a Similar
+// or Geo block is a hybrid search instead; see hybridSearch.
+func (db *DB) Search(r *req.SearchRequest, uad *sec.UserAuthData, allowedSgis []string) *res.CoggedResponse {
+	if denied := checkQueryFields(&req.QueryRequest{Filters: r.Filters}, uad); denied != nil {
+		return denied
+	}
+	if r.Similar != nil || r.Geo != nil {
+		return db.hybridSearch(r, uad, allowedSgis)
+	}
+	authz := renderReadAuthzFilter(NODENODE, uad, allowedSgis)
+	ranked, _, err := db.searchText(r, authz)
+	if err != nil {
+		return res.CoggedResponseFromError(err.Error())
+	}
+
+	offset, first := 0, DEFAULT_SEARCH_PAGE
+	if r.Offset != nil {
+		offset = *r.Offset
+	}
+	if r.First != nil {
+		first = *r.First
+	}
+	page := []*cm.GraphNode{}
+	if offset < len(ranked) {
+		page = ranked[offset:min(offset+first, len(ranked))]
+	}
+	if len(page) == 0 {
+		return res.CoggedResponseFromNodes(&page)
+	}
+
+	uids := []string{}
+	for _, n := range page {
+		uids = append(uids, n.Uid)
+	}
+	nodes, err := db.queryReadableNodes(uids, r.Select, authz)
+	if err != nil {
+		return res.CoggedResponseFromError("DB query failed")
+	}
+	result := []*cm.GraphNode{}
+	for _, u := range uids {
+		if n, ok := nodes[u]; ok {
+			result = append(result, n)
+		}
+	}
+	return res.CoggedResponseFromNodes(&result)
+}
+
+// searchText returns the matches for r.Text that pass authz and r.Filters, best first,
+// along with the score each was ranked by. At most MAX_SEARCH_CANDIDATES are ranked.
+func (db *DB) searchText(r *req.SearchRequest, authz string) ([]*cm.GraphNode, map[string]int, error) {
+	op := searchModeOps[r.Mode]
+	fields := []string{}
+	for _, f := range r.Fields {
+		if !slices.Contains(textOpFields[op], renderField(f)) {
+			return nil, nil, DBError{Info: "mode '" + r.Mode + "' can only search the fields " + strings.Join(textOpFields[op], ", ")}
+		}
+		if !slices.Contains(fields, renderField(f)) {
+			fields = append(fields, renderField(f))
+		}
+	}
+	if len(fields) == 0 {
+		fields = textOpFields[op]
+	}
+
+	vars := make(map[string]string)
+	blocks := []string{}
+	sets := []string{}
+	for i, f := range fields {
+		fn := constructQueryStringAndAddVars(req.QueryRequestClause{Field: f, Op: op, Val: r.Text}, &vars)
+		sets = append(sets, fmt.Sprintf("S%d", i))
+		blocks = append(blocks, fmt.Sprintf("S%d as var(func: %s)", i, fn))
+	}
+	filter := renderRootFilter(authz, r.Filters, &vars)
+	query := `query q(` + renderQueryParams(nil, &vars) + `) {
+		` + strings.Join(blocks, "\n\t\t") + `
+		qr(func: uid(` + strings.Join(sets, ", ") + `), first: ` + fmt.Sprintf("%d", MAX_SEARCH_CANDIDATES) + `)` + filter + ` {
+			uid m ` + strings.Join(fields, " ") + `
+		}
+	}`
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, nil, DBError{Info: "DB query failed"}
+	}
+	matches := SliceFromResultJSON[cm.GraphNode](sp)
+	if matches == nil {
+		return nil, nil, DBError{Info: "could not parse search results"}
+	}
+
+	words := []string{}
+	for _, w := range searchTokens(r.Text) {
+		if !slices.Contains(words, w) {
+			words = append(words, w)
+		}
+	}
+	scores := make(map[string]int)
+	for _, n := range *matches {
+		scores[n.Uid] = searchScore(n, fields, words, r.Text)
+	}
+	ranked := *matches
+	// ties go to the most recently modified
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if scores[ranked[i].Uid] != scores[ranked[j].Uid] {
+			return scores[ranked[i].Uid] > scores[ranked[j].Uid]
+		}
+		mi, mj := ranked[i].TimeModified, ranked[j].TimeModified
+		return mi != nil && (mj == nil || mi.After(*mj))
+	})
+	return ranked, scores, nil
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	req "cogged/requests"
+	sec "cogged/security"
+	"strings"
+	"testing"
+)
+
+func TestSearchRanksReadableMatches(t *testing.T) {
+	matches := []byte(`{"qr":[
+		{"uid":"0x1","m":"2024-01-01T00:00:00Z","s1":"march invoice"},
+		{"uid":"0x2","m":"2024-02-01T00:00:00Z","s2":"invoice"},
+		{"uid":"0x3","m":"2024-03-01T00:00:00Z","s1":"Invoice for March, paid"},
+		{"uid":"0x4","m":"2024-04-01T00:00:00Z","id":"invoice-draft"}
+	]}`)
+	nodes := []byte(`{"qr":[{"uid":"0x1","s1":"march invoice"},{"uid":"0x3","s1":"Invoice for March, paid"}]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{matches, nodes}}
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+	first := 2
+	r := &req.SearchRequest{Text: "March invoice", Select: []string{"s1"}, First: &first}
+
+	resp := newFakeDB(fake).Search(r, reader, []string{"sg1"})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %s", resp.Error)
+	}
+	// 0x1 holds the exact text; 0x3 has both words but not together; the others have one
+	if len(resp.ResultNodes) != 2 || resp.ResultNodes[0].Uid != "0x1" || resp.ResultNodes[1].Uid != "0x3" {
+		t.Fatalf("expected 0x1 then 0x3, got %+v", resp.ResultNodes)
+	}
+	if !strings.Contains(fake.lastQuery, "uid($ids)") || fake.lastVars["$ids"] != "[0x1,0x3]" {
+		t.Errorf("only the page should be read back, got %v", fake.lastVars)
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+	r := &req.SearchRequest{Text: "invoice", Filters: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "note"}}
+	resp := newFakeDB(fake).Search(r, reader, []string{"sg1"})
+	if resp.Error != "" || len(resp.ResultNodes) != 0 {
+		t.Fatalf("expected no matches, got %+v", resp)
+	}
+	for _, want := range []string{
+		"S0 as var(func: anyofterms(id,$vv",
+		"S2 as var(func: anyofterms(s2,$vv",
+		"qr(func: uid(S0, S1, S2), first: 1000) @filter((uid_in(own, 0x9) OR (eq(sgi, [\"sg1\"]) AND eq(r, true))) AND (eq(ty,",
+	} {
+		if !strings.Contains(fake.lastQuery, want) {
+			t.Errorf("expected %q in query:\n%s", want, fake.lastQuery)
+		}
+	}
+
+	fake = &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+	r = &req.SearchRequest{Text: "invoice", Mode: req.SEARCH_MODE_FUZZY}
+	newFakeDB(fake).Search(r, reader, nil)
+	if !strings.Contains(fake.lastQuery, "match(s1,$vv") || strings.Contains(fake.lastQuery, "s2") {
+		t.Errorf("fuzzy search should only match on id and s1:\n%s", fake.lastQuery)
+	}
+
+	for _, bad := range []*req.SearchRequest{
+		{Text: "x", Mode: req.SEARCH_MODE_TEXT, Fields: []string{"id"}},
+		{Text: "x", Filters: &req.QueryRequestClause{Field: "p", Op: "eq", Val: "guess"}},
+	} {
+		if resp := newFakeDB(&fakeClient{}).Search(bad, reader, nil); resp.Error == "" {
+			t.Errorf("%+v should be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package services
+
+import (
+	"cogged/log"
+	cm "cogged/models"
+	req "cogged/requests"
+	res "cogged/responses"
+	sec "cogged/security"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// A similarity search asks the vec index for SIMILAR_OVERFETCH times top_k neighbours,
+	// as some of them may be unreadable or fail the filters, and asks again for
+	// SIMILAR_OVERFETCH times as many until top_k are left, up to MAX_SIMILAR_CANDIDATES.
+	SIMILAR_OVERFETCH      = 4
+	MAX_SIMILAR_CANDIDATES = 10000
+
+	// MAX_SIMILAR_SCAN caps how many nodes of a root_ids subgraph are scored one by one. A
+	// subgraph with more is searched through the vec index instead.
+	MAX_SIMILAR_SCAN = 2000
+)
+
+// similarCandidate is a node that may be ranked by a similarity search: its uid and vec.
+type similarCandidate struct {
+	Uid string    `json:"uid"`
+	Vec embedding `json:"sv"`
+}
+
+// embedding is a vec as Dgraph returns it, either a float array or the string of one. One
+// that cannot be read is left nil rather than failing the whole result, so that the node
+// is simply not ranked.
+type embedding []float64
+
+func (e *embedding) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*e, _ = parseVector(s)
+		return nil
+	}
+	var f []float64
+	if json.Unmarshal(data, &f) == nil {
+		*e = f
+	}
+	return nil
+}
+
+// parseVector reads a string-encoded float array such as "[0.1, -2, 1e-3]".
+func parseVector(s string) ([]float64, error) {
+	s = strings.TrimSpace(s)
+	if !rgxVectorLiteral.MatchString(s) {
+		return nil, DBError{Info: "invalid similarity query vector"}
+	}
+	v := []float64{}
+	for _, part := range strings.Split(strings.Trim(s, "[] \t\r\n"), ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsInf(f, 0) {
+			return nil, DBError{Info: "invalid similarity query vector"}
+		}
+		v = append(v, f)
+	}
+	return v, nil
+}
+
+// parseQueryVector reads the vector of a similarity search, which must have a direction
+// for anything to be similar to it.
+func parseQueryVector(s string) ([]float64, error) {
+	v, err := parseVector(s)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := cosineSimilarity(v, v); !ok {
+		return nil, DBError{Info: "similarity query vector cannot be all zeros"}
+	}
+	return v, nil
+}
+
+// similarityVector returns the vector of a similarity search: its Vector, or its Text as
+// the Embedder embeds it.
+func (d *DB) similarityVector(s *req.QuerySimilarity) ([]float64, error) {
+	if s.Text != "" {
+		return d.embedQueryText(s.Text)
+	}
+	return parseQueryVector(s.Vector)
+}
+
+// cosineSimilarity returns the cosine of the angle between a and b, the measure the vec
+// index ranks by. It is false for vectors of different lengths or of zero length, which
+// cannot be compared.
+func cosineSimilarity(a, b []float64) (float64, bool) {
+	if len(a) != len(b) {
+		return 0, false
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot, na, nb = dot+a[i]*b[i], na+a[i]*a[i], nb+b[i]*b[i]
+	}
+	if na == 0 || nb == 0 {
+		return 0, false
+	}
+	return dot / math.Sqrt(na*nb), true
+}
+
+// querySimilar answers a QueryRequest with a Similar block: the top_k readable nodes most
+// similar to the query vector, most similar first, each with its similarity. With root_ids
+// the search is restricted to the subgraph a traversal from them reaches (pruned by
+// TraverseFilter and Direction as usual), whose nodes are scored one by one; without, or
+// for a subgraph of more than MAX_SIMILAR_SCAN nodes, Dgraph's vec index finds the nearest
+// neighbours. The index ranks before the read-authz filter and Filters apply, so it is
+// asked for more than top_k and asked again for more until top_k are left, or it has no
+// more to give.
+//
+// Candidates are read through the same read-authz filter as QueryWithOptions, at one
+// snapshot, and scored here. First and Offset page through the top_k; only the requested
+// page is read back with the selected fields.
+func (d *DB) querySimilar(q *req.QueryRequest, et EdgeType, uad *sec.UserAuthData, allowedSgis []string) *res.CoggedResponse {
+	vector, err := d.similarityVector(q.Similar)
+	if err != nil {
+		return res.CoggedResponseFromError(err.Error())
+	}
+	if _, derr := getTraversalPredicates(et, q.Direction); derr != nil {
+		return res.CoggedResponseFromError(derr.Error())
+	}
+	topK := int(DEFAULT_SIMILAR_TOPK)
+	if q.Similar.TopK > 0 {
+		topK = int(min(q.Similar.TopK, MAX_SIMILAR_TOPK))
+	}
+	offset, first := 0, topK
+	if q.Offset != nil {
+		offset = *q.Offset
+	}
+	if q.First != nil && *q.First > 0 {
+		first = *q.First
+	}
+	if offset < 0 {
+		return res.CoggedResponseFromError("offset must not be negative")
+	}
+
+	authz := renderReadAuthzFilter(et, uad, allowedSgis)
+	var ts uint64
+	if q.ReadSnapshot != nil {
+		ts = q.ReadSnapshot.Ts
+	}
+	ranked, scores, ts, err := d.rankSimilar(q, et, vector, topK, authz, ts)
+	if err != nil {
+		return res.CoggedResponseFromError(err.Error())
+	}
+	page := []string{}
+	if offset < len(ranked) {
+		page = ranked[offset:min(offset+first, len(ranked))]
+	}
+
+	result := []*cm.GraphNode{}
+	if len(page) > 0 {
+		nodes, err := d.queryReadableNodes(page, q.Select, authz)
+		if err != nil {
+			return res.CoggedResponseFromError("DB query failed")
+		}
+		for _, u := range page {
+			if n, ok := nodes[u]; ok {
+				s := scores[u]
+				n.Similarity = &s
+				result = append(result, n)
+			}
+		}
+	}
+	snapshot := q.ReadSnapshot
+	if snapshot == nil && ts != 0 {
+		snapshot = &cm.ReadSnapshot{Ts: ts, Expires: time.Now().Unix() + d.SnapshotExpiry}
+	}
+	resp := res.CoggedResponseFromNodes(&result)
+	resp.HasMore, resp.ReadAt = offset+first < len(ranked), snapshot
+	return resp
+}
+
+// rankSimilar returns the uids of the topK readable nodes most similar to vector that pass
+// the query's Filters and lie in its root_ids subgraph, if it has root_ids, most similar
+// first, with their similarities. The candidates are read at ts, or at a new snapshot when
+// it is 0, which is returned.
+func (d *DB) rankSimilar(q *req.QueryRequest, et EdgeType, vector []float64, topK int, authz string, ts uint64) ([]string, map[string]float64, uint64, error) {
+	score := func(cands []*similarCandidate) map[string]float64 {
+		scores := make(map[string]float64)
+		for _, c := range cands {
+			if s, ok := cosineSimilarity(vector, c.Vec); ok {
+				scores[c.Uid] = s
+			}
+		}
+		return scores
+	}
+	var scores map[string]float64
+	if len(q.RootIDs) > 0 {
+		cands, _, readTs, err := d.similarCandidates(q, et, vector, authz, 0, ts)
+		if err != nil {
+			return nil, nil, 0, DBError{Info: "DB query failed"}
+		}
+		ts = readTs
+		if len(cands) <= MAX_SIMILAR_SCAN {
+			scores = score(cands)
+		}
+	}
+	for k := topK * SIMILAR_OVERFETCH; scores == nil; k = min(k*SIMILAR_OVERFETCH, MAX_SIMILAR_CANDIDATES) {
+		cands, total, readTs, err := d.similarCandidates(q, et, vector, authz, k, ts)
+		if err != nil {
+			return nil, nil, 0, DBError{Info: "DB query failed"}
+		}
+		ts = readTs
+		// the index found fewer than asked for, so it has no more to give
+		if s := score(cands); len(s) >= topK || total < k || k >= MAX_SIMILAR_CANDIDATES {
+			scores = s
+		}
+	}
+
+	ranked := []string{}
+	for u := range scores {
+		ranked = append(ranked, u)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		si, sj := scores[ranked[i]], scores[ranked[j]]
+		if si != sj {
+			return si > sj
+		}
+		return ranked[i] < ranked[j]
+	})
+	return ranked[:min(topK, len(ranked))], scores, ts, nil
+}
+
+// similarCandidates reads the uid and vec of the readable nodes that pass the query's
+// Filters and lie in its root_ids subgraph, if it has root_ids. With k > 0 they are among
+// the k nearest neighbours the vec index finds, and how many it found before filtering is
+// returned too; with k == 0 they are every node in the subgraph with a vec, one more than
+// MAX_SIMILAR_SCAN at most so that a subgraph holding too many shows as such.
+func (d *DB) similarCandidates(q *req.QueryRequest, et EdgeType, vector []float64, authz string, k int, ts uint64) ([]*similarCandidate, int, uint64, error) {
+	vars := make(map[string]string)
+	params := []string{}
+	blocks := []string{}
+	scope := ""
+	if len(q.RootIDs) > 0 {
+		edgePreds, err := getTraversalPredicates(et, q.Direction)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		vars["$ids"] = "[" + strings.Join(sanitiseListOfUids(q.RootIDs), ",") + "]"
+		params = append(params, "$ids: string")
+		scope = "uid($ids)"
+		if depth := min(q.Depth, MAX_QUERY_RECURSE_DEPTH); depth > 0 {
+			params = append(params, "$rdepth: int")
+			blocks = append(blocks, renderRecurseVar(q, edgePreds, depth, &vars))
+			scope = "uid(NID)"
+		}
+	}
+	root := ""
+	clauses := []string{}
+	if k > 0 {
+		// formatVector writes only digits, signs, dots, exponents, commas and brackets, so
+		// the vector is safe to inline inside the quoted third argument
+		blocks = append(blocks,
+			`C as var(func: similar_to(vec, `+fmt.Sprintf("%d", k)+`, "`+formatVector(vector)+`"))`,
+			`n(func: uid(C)) { total: count(uid) }`)
+		root = "uid(C)"
+		if scope != "" {
+			clauses = append(clauses, scope)
+		}
+	} else {
+		root = scope + ", first: " + fmt.Sprintf("%d", MAX_SIMILAR_SCAN+1)
+		clauses = append(clauses, "has(vec)")
+	}
+	if authz != "" {
+		clauses = append(clauses, authz)
+	}
+	filter := renderRootFilter(strings.Join(clauses, " AND "), q.Filters, &vars)
+	query := `query q(` + renderQueryParams(params, &vars) + `) {
+		` + strings.Join(blocks, "\n\t\t") + `
+		qr(func: ` + root + `)` + filter + ` {
+			uid sv: vec
+		}
+	}`
+	sp, readTs, err := d.QueryAt(query, &vars, ts)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var result struct {
+		QR []*similarCandidate `json:"qr"`
+		N  []struct {
+			Total int `json:"total"`
+		} `json:"n"`
+	}
+	if err := json.Unmarshal([]byte(*sp), &result); err != nil {
+		log.Error("unmarshal similarity candidates", err)
+		return nil, 0, 0, DBError{Info: "could not parse similarity candidates"}
+	}
+	total := 0
+	if len(result.N) > 0 {
+		total = result.N[0].Total
+	}
+	return result.QR, total, readTs, nil
+}
@@ -0,0 +1,147 @@
+package services
+
+import (
+	req "cogged/requests"
+	sec "cogged/security"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestQuerySimilarRefillsToTopK(t *testing.T) {
+	// of the 8 nearest only one is readable, so the index is asked again for 32
+	sparse := []byte(`{"n":[{"total":8}],"qr":[{"uid":"0x1","sv":[1,0,0]}]}`)
+	refill := []byte(`{"n":[{"total":32}],"qr":[
+		{"uid":"0x1","sv":[1,0,0]},
+		{"uid":"0x2","sv":"[0.6, 0.8, 0]"},
+		{"uid":"0x3","sv":[0,1,0]},
+		{"uid":"0x4","sv":[1,0]}
+	]}`)
+	nodes := []byte(`{"qr":[{"uid":"0x1","s1":"a"},{"uid":"0x2","s1":"b"}]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{sparse, refill, nodes}, readTs: 300}
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+	q := &req.QueryRequest{Similar: &req.QuerySimilarity{Vector: "[1, 0, 0]", TopK: 2}, Select: []string{"s1"}}
+
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, reader, []string{"sg1"})
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	if len(resp.ResultNodes) != 2 || resp.ResultNodes[0].Uid != "0x1" || resp.ResultNodes[1].Uid != "0x2" {
+		t.Fatalf("expected 0x1 then 0x2, got %+v", resp.ResultNodes)
+	}
+	if s := resp.ResultNodes[1].Similarity; s == nil || math.Abs(*s-0.6) > 1e-9 {
+		t.Errorf("expected 0x2 to have similarity 0.6, got %v", s)
+	}
+	if resp.HasMore || resp.ReadAt == nil || resp.ReadAt.Ts != 300 {
+		t.Errorf("expected the whole top_k and a snapshot at ts 300, got %v %+v", resp.HasMore, resp.ReadAt)
+	}
+	for i, k := range []int{8, 32} {
+		if !strings.Contains(fake.queries[i], fmt.Sprintf(`C as var(func: similar_to(vec, %d, "[1,0,0]"))`, k)) {
+			t.Errorf("round %d should ask the index for %d:\n%s", i, k, fake.queries[i])
+		}
+	}
+	if !strings.Contains(fake.queries[0], `qr(func: uid(C)) @filter((uid_in(own, 0x9) OR (eq(sgi, ["sg1"]) AND eq(r, true))))`) {
+		t.Errorf("candidates should be read-filtered:\n%s", fake.queries[0])
+	}
+	if fake.lastVars["$ids"] != "[0x1,0x2]" {
+		t.Errorf("only the top_k should be read back, got %v", fake.lastVars)
+	}
+
+	// an index with fewer vectors than asked for is not asked again
+	fake = &fakeClient{queryJSONs: [][]byte{[]byte(`{"n":[{"total":3}],"qr":[]}`)}}
+	resp = newFakeDB(fake).QueryWithOptions(q, NODENODE, reader, nil)
+	if resp.Error != "" || len(fake.queries) != 1 || len(resp.ResultNodes) != 0 {
+		t.Errorf("expected one round and no results, got %q after %d", resp.Error, len(fake.queries))
+	}
+}
+
+func TestQuerySimilarWithinSubgraph(t *testing.T) {
+	scan := []byte(`{"qr":[{"uid":"0x5","sv":[0,1]},{"uid":"0x6","sv":[1,1]},{"uid":"0x7","sv":[1,0]}]}`)
+	nodes := []byte(`{"qr":[{"uid":"0x6"}]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{scan, nodes}}
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+	first, offset := 1, 1
+	q := &req.QueryRequest{Similar: &req.QuerySimilarity{Vector: "[1, 0]", TopK: 3}, RootIDs: []string{"0x4"}, Depth: 3,
+		First: &first, Offset: &offset, Filters: &req.QueryRequestClause{Field: "ty", Op: "eq", Val: "doc"}}
+
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, reader, nil)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	if len(resp.ResultNodes) != 1 || resp.ResultNodes[0].Uid != "0x6" || !resp.HasMore {
+		t.Fatalf("expected the second most similar with more to come, got %+v", resp.ResultNodes)
+	}
+	if s := resp.ResultNodes[0].Similarity; s == nil || math.Abs(*s-math.Sqrt2/2) > 1e-9 {
+		t.Errorf("unexpected similarity %v", s)
+	}
+	for _, want := range []string{
+		"var(func: uid($ids)) @recurse(depth: $rdepth)",
+		"qr(func: uid(NID), first: 2001) @filter(has(vec) AND uid_in(own, 0x9) AND (eq(ty,",
+		"uid sv: vec",
+	} {
+		if !strings.Contains(fake.queries[0], want) {
+			t.Errorf("expected %q in the subgraph query:\n%s", want, fake.queries[0])
+		}
+	}
+	if strings.Contains(fake.queries[0], "similar_to") {
+		t.Errorf("a small subgraph should be scored without the index:\n%s", fake.queries[0])
+	}
+
+	// a subgraph too big to score one by one goes through the index, still within it
+	big := []string{}
+	for i := 0; i <= MAX_SIMILAR_SCAN; i++ {
+		big = append(big, fmt.Sprintf(`{"uid":"0x%x","sv":[1,0]}`, i+100))
+	}
+	fake = &fakeClient{queryJSONs: [][]byte{
+		[]byte(`{"qr":[` + strings.Join(big, ",") + `]}`),
+		[]byte(`{"n":[{"total":12}],"qr":[{"uid":"0x64","sv":[1,0]}]}`),
+		[]byte(`{"qr":[]}`),
+	}}
+	newFakeDB(fake).QueryWithOptions(q, NODENODE, reader, nil)
+	if len(fake.queries) != 3 || !strings.Contains(fake.queries[1], "qr(func: uid(C)) @filter(uid(NID) AND uid_in(own, 0x9)") {
+		t.Errorf("expected an index search within the subgraph:\n%v", fake.queries)
+	}
+}
+
+func TestQuerySimilarValidation(t *testing.T) {
+	admin := &sec.UserAuthData{Role: sec.SYS_ROLE}
+	negative := -1
+	cases := []struct {
+		name string
+		q    *req.QueryRequest
+		et   EdgeType
+	}{
+		{"all zeros", &req.QueryRequest{Similar: &req.QuerySimilarity{Vector: "[0, 0.0]"}}, NODENODE},
+		{"out of range", &req.QueryRequest{Similar: &req.QuerySimilarity{Vector: "[1e999]"}}, NODENODE},
+		{"in along the user's edge", &req.QueryRequest{Similar: &req.QuerySimilarity{Vector: "[1]"},
+			RootIDs: []string{"0x1"}, Depth: 1, Direction: req.DIRECTION_IN}, USERNODE},
+		{"negative offset", &req.QueryRequest{Similar: &req.QuerySimilarity{Vector: "[1]"}, Offset: &negative}, NODENODE},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &fakeClient{queryJSON: []byte(`{"qr":[]}`)}
+			if resp := newFakeDB(fake).QueryWithOptions(tc.q, tc.et, admin, nil); resp.Error == "" {
+				t.Error("expected the query to be rejected")
+			}
+			if fake.lastQuery != "" {
+				t.Errorf("no query should reach Dgraph, got:\n%s", fake.lastQuery)
+			}
+		})
+	}
+}
+
+func TestCosineSimilarity(t *testing.T) {
+	if s, ok := cosineSimilarity([]float64{1, 2}, []float64{2, 4}); !ok || math.Abs(s-1) > 1e-12 {
+		t.Errorf("parallel vectors should have similarity 1, got %v", s)
+	}
+	if s, ok := cosineSimilarity([]float64{1, 0}, []float64{-1, 0}); !ok || s != -1 {
+		t.Errorf("opposite vectors should have similarity -1, got %v", s)
+	}
+	if _, ok := cosineSimilarity([]float64{1, 0}, []float64{1, 0, 0}); ok {
+		t.Error("vectors of different lengths cannot be compared")
+	}
+	if v, err := parseVector(" [0.5, -2, 1e-3] "); err != nil || len(v) != 3 || v[2] != 0.001 {
+		t.Errorf("unexpected parse %v %v", v, err)
+	}
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/dgo/v250"
+	"github.com/dgraph-io/dgo/v250/protos/api"
+	"google.golang.org/grpc/metadata"
+)
+
+const DEFAULT_SNAPSHOT_EXPIRY int64 = 300
+
+// getSnapshotExpiry parses the "db.snapshotexpiry" setting, in seconds. Dgraph only keeps
+// the versions a snapshot reads for a while after they are overwritten, so it is best kept
+// to minutes.
+func getSnapshotExpiry(confTime string) int64 {
+	expTime, convErr := strconv.ParseInt(confTime, 10, 64)
+	if convErr != nil || expTime <= 0 {
+		expTime = DEFAULT_SNAPSHOT_EXPIRY
+	}
+	return expTime
+}
+
+// snapshotTxn is a read-only transaction at a given start timestamp. A dgo Txn always
+// sends the start timestamp Dgraph gave it, so snapshotTxn sends its requests itself, the
+// way Txn.Do does.
+type snapshotTxn struct {
+	dg      *dgo.Dgraph
+	startTs uint64
+}
+
+func (t *snapshotTxn) Query(ctx context.Context, q string) (*api.Response, error) {
+	return t.QueryWithVars(ctx, q, nil)
+}
+
+func (t *snapshotTxn) QueryWithVars(ctx context.Context, q string, vars map[string]string) (*api.Response, error) {
+	clients := t.dg.GetAPIClients()
+	dc := clients[rand.Intn(len(clients))]
+	r := &api.Request{Query: q, Vars: vars, StartTs: t.startTs, ReadOnly: true, RespFormat: api.Request_JSON}
+	resp, err := dc.Query(t.withJwt(ctx), r)
+	if err != nil && strings.Contains(err.Error(), "Token is expired") {
+		if err := t.dg.Relogin(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = dc.Query(t.withJwt(ctx), r)
+	}
+	return resp, err
+}
+
+func (t *snapshotTxn) Mutate(ctx context.Context, mu *api.Mutation) (*api.Response, error) {
+	return nil, dgo.ErrReadOnly
+}
+
+func (t *snapshotTxn) Do(ctx context.Context, req *api.Request) (*api.Response, error) {
+	if len(req.Mutations) > 0 {
+		return nil, dgo.ErrReadOnly
+	}
+	return t.QueryWithVars(ctx, req.Query, req.Vars)
+}
+
+// withJwt adds the ACL access token the client logged in with, if any, as dgo does to its
+// own requests.
+func (t *snapshotTxn) withJwt(ctx context.Context) context.Context {
+	if jwt := t.dg.GetJwt(); jwt.AccessJwt != "" {
+		return metadata.AppendToOutgoingContext(ctx, "accessJwt", jwt.AccessJwt)
+	}
+	return ctx
+}
@@ -0,0 +1,368 @@
+package services
+
+import (
+	"cogged/log"
+	cm "cogged/models"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	Topology constraints restrict how nodes of a given `ty` may be linked by `e` edges. Like
+	permission policies (policy.go) they live in the flat config file, one key per rule:
+
+	{
+		"policy.edges.folder.children": "folder,file",
+		"policy.edges.folder.maxout": "500",
+		"policy.edges.folder.dag": "true",
+		"policy.edges.file.parents": "folder"
+	}
+
+	children  comma-separated types a node of this type may have out-edges to
+	parents   comma-separated types a node of this type may have in-edges from
+	maxout    the most out-edges a node of this type may have
+	dag       "true" to reject any new edge that would close a cycle through a node of this
+	          type, whether at either end of the edge or further round the cycle
+
+	An untyped node never matches a children/parents list. The rules constrain node to node
+	edges only: linking a new top-level node to its user (PUT /user/node) is always allowed.
+	They are checked when edges are added, not retroactively against existing data.
+*/
+
+const POLICY_EDGES_PREFIX string = "policy.edges."
+
+type TopologyConstraint struct {
+	Children map[string]bool
+	Parents  map[string]bool
+	MaxOut   *int
+	Dag      bool
+}
+
+// TopologyConstraints maps a node `ty` to its constraints.
+type TopologyConstraints map[string]*TopologyConstraint
+
+func typeSet(list string) map[string]bool {
+	s := make(map[string]bool)
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			s[t] = true
+		}
+	}
+	return s
+}
+
+func NewTopologyConstraints(conf *Config) (TopologyConstraints, error) {
+	tc := make(TopologyConstraints)
+	if conf == nil {
+		return tc, nil
+	}
+	for key, val := range *conf {
+		if !strings.HasPrefix(key, POLICY_EDGES_PREFIX) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, POLICY_EDGES_PREFIX)
+		i := strings.LastIndex(rest, ".")
+		if i < 1 {
+			return nil, PolicyError{Info: fmt.Sprintf("invalid topology constraint key %q", key)}
+		}
+		ty, setting := rest[:i], rest[i+1:]
+		c, ok := tc[ty]
+		if !ok {
+			c = &TopologyConstraint{}
+			tc[ty] = c
+		}
+		switch setting {
+		case "children":
+			c.Children = typeSet(val)
+		case "parents":
+			c.Parents = typeSet(val)
+		case "maxout":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return nil, PolicyError{Info: fmt.Sprintf("%q must be a non-negative integer", key)}
+			}
+			c.MaxOut = &n
+		case "dag":
+			if val != "true" && val != "false" {
+				return nil, PolicyError{Info: fmt.Sprintf("%q must be \"true\" or \"false\"", key)}
+			}
+			c.Dag = val == "true"
+		default:
+			return nil, PolicyError{Info: fmt.Sprintf("unknown topology constraint setting %q", key)}
+		}
+	}
+	return tc, nil
+}
+
+// LoadTopologyConstraints is NewTopologyConstraints for start-up, where a bad config is fatal.
+func LoadTopologyConstraints(conf *Config) TopologyConstraints {
+	tc, err := NewTopologyConstraints(conf)
+	if err != nil {
+		panic(err)
+	}
+	return tc
+}
+
+func (tc TopologyConstraints) For(ty string) *TopologyConstraint {
+	if ty == "" {
+		return nil
+	}
+	return tc[ty]
+}
+
+func typeList(s map[string]bool) string {
+	l := []string{}
+	for t := range s {
+		l = append(l, t)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ", ")
+}
+
+func describeType(ty string) string {
+	if ty == "" {
+		return "(no type)"
+	}
+	return fmt.Sprintf("%q", ty)
+}
+
+type edgeSpec struct {
+	src string
+	dst string
+}
+
+// topologyNode is what checkTopology needs to know about an existing node.
+type topologyNode struct {
+	Uid      string          `json:"uid"`
+	Type     *string         `json:"ty"`
+	OutCount int             `json:"oc"`
+	Existing []*cm.GraphNode `json:"ex"`
+}
+
+// queryTopology reads the type, out-degree and (among uids) existing out-edges of each of
+// uids, and when withReach is set the type and out-edges of every node reachable from them
+// within MAX_QUERY_RECURSE_DEPTH levels, for cycle checks.
+func (db *DB) queryTopology(uids []string, withReach bool) (map[string]*topologyNode, map[string][]string, map[string]string, error) {
+	safe := sanitiseListOfUids(uids)
+	vars := map[string]string{
+		"$ids": "[" + strings.Join(safe, ",") + "]",
+	}
+	reach := ""
+	params := "$ids: string"
+	if withReach {
+		vars["$rdepth"] = fmt.Sprintf("%d", MAX_QUERY_RECURSE_DEPTH)
+		params += ", $rdepth: int"
+		reach = `
+		var(func: uid($ids)) @recurse(depth: $rdepth) {
+			R as uid
+			e
+		}
+
+		reach(func: uid(R)) {
+			uid
+			ty
+			e { uid }
+		}`
+	}
+	query := `query q(` + params + `) {
+		qr(func: uid($ids)) {
+			uid
+			ty
+			oc: count(e)
+			ex: e @filter(uid(` + strings.Join(safe, ", ") + `)) { uid }
+		}` + reach + `
+	}`
+
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var a struct {
+		QR    []*topologyNode `json:"qr"`
+		Reach []*cm.GraphNode `json:"reach"`
+	}
+	if err := json.Unmarshal([]byte(*sp), &a); err != nil {
+		log.Error("unmarshal topology result", err)
+		return nil, nil, nil, DBError{Info: "could not parse topology"}
+	}
+
+	nodes := make(map[string]*topologyNode)
+	for _, n := range a.QR {
+		nodes[n.Uid] = n
+	}
+	edges := make(map[string][]string)
+	reachTypes := make(map[string]string)
+	for _, n := range a.Reach {
+		if n.Type != nil {
+			reachTypes[n.Uid] = *n.Type
+		}
+		if n.OutEdges != nil {
+			for _, e := range *n.OutEdges {
+				edges[n.Uid] = append(edges[n.Uid], e.Uid)
+			}
+		}
+	}
+	return nodes, edges, reachTypes, nil
+}
+
+// reachable returns every node that can be reached from from along edges, from included.
+func reachable(edges map[string][]string, from string) map[string]bool {
+	seen := map[string]bool{from: true}
+	queue := []string{from}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, next := range edges[n] {
+			if !seen[next] {
+				seen[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return seen
+}
+
+// onCycle returns the nodes on a cycle that the edge src -> dst closes, in edges (which
+// already holds it): those reachable from dst that can also reach src. It is empty if the
+// edge closes no cycle.
+func onCycle(edges map[string][]string, src, dst string) []string {
+	reverse := make(map[string][]string)
+	for from, tos := range edges {
+		for _, to := range tos {
+			reverse[to] = append(reverse[to], from)
+		}
+	}
+	forward, back := reachable(edges, dst), reachable(reverse, src)
+	if !forward[src] {
+		return nil
+	}
+	cycle := []string{}
+	for n := range forward {
+		if back[n] {
+			cycle = append(cycle, n)
+		}
+	}
+	sort.Strings(cycle)
+	return cycle
+}
+
+// checkTopology checks edges about to be added against the topology constraints of the node
+// types at either end, returning a PolicyError naming the first rule broken. types holds the
+// ty of nodes in the same request (new nodes, or existing nodes whose ty is being set); the
+// ty, out-degree and onward edges of any other node are read from the DB. Errors never name
+// a real uid, which the caller only knows by its AuthzData.
+func (db *DB) checkTopology(edges []edgeSpec, types map[string]*string) error {
+	if len(db.Constraints) == 0 || len(edges) == 0 {
+		return nil
+	}
+
+	realUids := []string{}
+	seenUid := make(map[string]bool)
+	for _, e := range edges {
+		for _, uid := range []string{e.src, e.dst} {
+			if ValidateUid(uid) && !seenUid[uid] {
+				seenUid[uid] = true
+				realUids = append(realUids, uid)
+			}
+		}
+	}
+
+	existing := make(map[string]*topologyNode)
+	dbEdges := make(map[string][]string)
+	reachTypes := make(map[string]string)
+	typeOf := func(uid string) string {
+		if t, ok := types[uid]; ok && t != nil {
+			return *t
+		}
+		if n, ok := existing[uid]; ok && n.Type != nil {
+			return *n.Type
+		}
+		return reachTypes[uid]
+	}
+
+	// existing nodes' types are not known until they have been read, so fetch the onward
+	// edges for a cycle check whenever any type is configured as a DAG
+	needReach := false
+	for _, c := range db.Constraints {
+		needReach = needReach || c.Dag
+	}
+
+	if len(realUids) > 0 {
+		var err error
+		if existing, dbEdges, reachTypes, err = db.queryTopology(realUids, needReach); err != nil {
+			return err
+		}
+	}
+
+	alreadyLinked := make(map[edgeSpec]bool)
+	for _, n := range existing {
+		for _, e := range n.Existing {
+			alreadyLinked[edgeSpec{n.Uid, e.Uid}] = true
+		}
+	}
+
+	newOut := make(map[string]int)
+	srcs := []string{}
+	graph := make(map[string][]string)
+	for src, dsts := range dbEdges {
+		graph[src] = append(graph[src], dsts...)
+	}
+	seenEdge := make(map[edgeSpec]bool)
+	added := []edgeSpec{}
+	for _, e := range edges {
+		if seenEdge[e] || alreadyLinked[e] {
+			continue
+		}
+		seenEdge[e] = true
+		added = append(added, e)
+		if newOut[e.src] == 0 {
+			srcs = append(srcs, e.src)
+		}
+		newOut[e.src]++
+		graph[e.src] = append(graph[e.src], e.dst)
+
+		srcTy, dstTy := typeOf(e.src), typeOf(e.dst)
+		if c := db.Constraints.For(srcTy); c != nil && c.Children != nil && !c.Children[dstTy] {
+			return PolicyError{Info: fmt.Sprintf("violates %s%s.children: a %s node may only link to nodes of type %s, not %s",
+				POLICY_EDGES_PREFIX, srcTy, describeType(srcTy), typeList(c.Children), describeType(dstTy))}
+		}
+		if c := db.Constraints.For(dstTy); c != nil && c.Parents != nil && !c.Parents[srcTy] {
+			return PolicyError{Info: fmt.Sprintf("violates %s%s.parents: a %s node may only be linked from nodes of type %s, not %s",
+				POLICY_EDGES_PREFIX, dstTy, describeType(dstTy), typeList(c.Parents), describeType(srcTy))}
+		}
+	}
+
+	for _, src := range srcs {
+		ty := typeOf(src)
+		c := db.Constraints.For(ty)
+		if c == nil || c.MaxOut == nil {
+			continue
+		}
+		total := newOut[src]
+		if n, ok := existing[src]; ok {
+			total += n.OutCount
+		}
+		if total > *c.MaxOut {
+			return PolicyError{Info: fmt.Sprintf("violates %s%s.maxout: a %s node may have at most %d out-edges, this would make %d",
+				POLICY_EDGES_PREFIX, ty, describeType(ty), *c.MaxOut, total)}
+		}
+	}
+
+	if !needReach {
+		return nil
+	}
+	// a DAG type may not be anywhere on a cycle, not just at the ends of the edge closing it
+	for _, e := range added {
+		for _, uid := range onCycle(graph, e.src, e.dst) {
+			ty := typeOf(uid)
+			if c := db.Constraints.For(ty); c != nil && c.Dag {
+				return PolicyError{Info: fmt.Sprintf("violates %s%s.dag: the new edge would create a cycle through a %s node",
+					POLICY_EDGES_PREFIX, ty, describeType(ty))}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func topologyDB(fake *fakeClient, conf Config) *DB {
+	return NewDBWithClient(&conf, fake)
+}
+
+func TestNewTopologyConstraints(t *testing.T) {
+	tc, err := NewTopologyConstraints(&Config{
+		"policy.edges.folder.children": "folder, file",
+		"policy.edges.folder.maxout":   "0",
+		"policy.edges.folder.dag":      "true",
+		"policy.edges.file.parents":    "folder",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f := tc["folder"]
+	if f == nil || !f.Children["file"] || !f.Children["folder"] || !f.Dag || f.MaxOut == nil || *f.MaxOut != 0 {
+		t.Errorf("folder constraints not parsed: %+v", f)
+	}
+	if tc["file"].MaxOut != nil {
+		t.Error("a type without maxout should have no out-degree limit")
+	}
+
+	for _, bad := range []Config{
+		{"policy.edges.folder.maxout": "-1"},
+		{"policy.edges.folder.dag": "1"},
+		{"policy.edges.folder.colour": "x"},
+	} {
+		if _, err := NewTopologyConstraints(&bad); err == nil {
+			t.Errorf("expected %v to be rejected", bad)
+		}
+	}
+}
+
+func TestCheckTopologyAllowedTypes(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[{"uid":"0x1","ty":"folder","oc":0}]}`)}
+	db := topologyDB(fake, Config{
+		"policy.edges.folder.children": "folder,file",
+		"policy.edges.file.parents":    "folder",
+	})
+	folder, file, doc := "folder", "file", "doc"
+
+	// new nodes only: nothing to read from the DB
+	err := db.checkTopology([]edgeSpec{{"$a", "$b"}}, map[string]*string{"$a": &folder, "$b": &doc})
+	if err == nil || !strings.Contains(err.Error(), "policy.edges.folder.children") {
+		t.Errorf("expected the children rule to be named, got %v", err)
+	}
+	if fake.lastQuery != "" {
+		t.Error("no query is needed when every node is in the request")
+	}
+
+	err = db.checkTopology([]edgeSpec{{"$a", "$b"}}, map[string]*string{"$a": &doc, "$b": &file})
+	if err == nil || !strings.Contains(err.Error(), "policy.edges.file.parents") {
+		t.Errorf("expected the parents rule to be named, got %v", err)
+	}
+	if _, ok := err.(PolicyError); !ok {
+		t.Errorf("violations should be PolicyErrors, got %T", err)
+	}
+
+	// an existing parent's type is read from the DB
+	if err := db.checkTopology([]edgeSpec{{"0x1", "$b"}}, map[string]*string{"$b": &file}); err != nil {
+		t.Errorf("folder -> file should be allowed, got %v", err)
+	}
+}
+
+func TestCheckTopologyMaxOut(t *testing.T) {
+	conf := Config{"policy.edges.folder.maxout": "2"}
+	file := "file"
+
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[{"uid":"0x1","ty":"folder","oc":2,"ex":[{"uid":"0x2"}]}]}`)}
+	err := topologyDB(fake, conf).checkTopology([]edgeSpec{{"0x1", "$new"}}, map[string]*string{"$new": &file})
+	if err == nil || !strings.Contains(err.Error(), "at most 2 out-edges, this would make 3") {
+		t.Errorf("expected the maxout rule to be broken, got %v", err)
+	}
+
+	// re-adding an edge that already exists does not count against the limit
+	fake = &fakeClient{queryJSON: []byte(`{"qr":[{"uid":"0x1","ty":"folder","oc":2,"ex":[{"uid":"0x2"}]},{"uid":"0x2","oc":0}]}`)}
+	if err := topologyDB(fake, conf).checkTopology([]edgeSpec{{"0x1", "0x2"}}, nil); err != nil {
+		t.Errorf("an existing edge should not count twice, got %v", err)
+	}
+	if strings.Contains(fake.lastQuery, "@recurse") {
+		t.Error("no cycle walk is needed when no type is a DAG")
+	}
+}
+
+func TestCheckTopologyDag(t *testing.T) {
+	conf := Config{"policy.edges.folder.dag": "true"}
+
+	// 0x2 -> 0x3 -> 0x1 exists; adding 0x1 -> 0x2 closes the loop
+	fake := &fakeClient{queryJSON: []byte(`{
+		"qr":[{"uid":"0x1","ty":"folder","oc":0},{"uid":"0x2","ty":"folder","oc":1}],
+		"reach":[{"uid":"0x1"},{"uid":"0x2","e":[{"uid":"0x3"}]},{"uid":"0x3","e":[{"uid":"0x1"}]}]}`)}
+	err := topologyDB(fake, conf).checkTopology([]edgeSpec{{"0x1", "0x2"}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "policy.edges.folder.dag") {
+		t.Errorf("expected a cycle to be rejected, got %v", err)
+	}
+	if !strings.Contains(fake.lastQuery, "@recurse(depth: $rdepth)") {
+		t.Errorf("the cycle check should walk the existing graph:\n%s", fake.lastQuery)
+	}
+
+	// two new edges in one request can form a cycle between themselves
+	folder := "folder"
+	err = topologyDB(&fakeClient{}, conf).checkTopology([]edgeSpec{{"$a", "$b"}, {"$b", "$a"}},
+		map[string]*string{"$a": &folder, "$b": &folder})
+	if err == nil {
+		t.Error("expected a cycle among new nodes to be rejected")
+	}
+
+	// neither end of the new edge is a DAG type, but the cycle it closes runs through one:
+	// 0x2 -> 0x3 (a folder) -> 0x1 exists, and 0x1 -> 0x2 closes the loop
+	fake = &fakeClient{queryJSON: []byte(`{
+		"qr":[{"uid":"0x1","ty":"file","oc":0},{"uid":"0x2","ty":"file","oc":1}],
+		"reach":[{"uid":"0x1","ty":"file"},{"uid":"0x2","ty":"file","e":[{"uid":"0x3"}]},{"uid":"0x3","ty":"folder","e":[{"uid":"0x1"}]}]}`)}
+	err = topologyDB(fake, conf).checkTopology([]edgeSpec{{"0x1", "0x2"}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "policy.edges.folder.dag") {
+		t.Errorf("expected a cycle through a folder further round the loop to be rejected, got %v", err)
+	}
+
+	// a DAG type reachable from the new edge but not on the cycle it closes is fine:
+	// 0x2 -> 0x1 and 0x2 -> 0x3 (a folder) exist
+	fake = &fakeClient{queryJSON: []byte(`{
+		"qr":[{"uid":"0x1","ty":"file","oc":0},{"uid":"0x2","ty":"file","oc":2}],
+		"reach":[{"uid":"0x1","ty":"file"},{"uid":"0x2","ty":"file","e":[{"uid":"0x1"},{"uid":"0x3"}]},{"uid":"0x3","ty":"folder"}]}`)}
+	if err := topologyDB(fake, conf).checkTopology([]edgeSpec{{"0x1", "0x2"}}, nil); err != nil {
+		t.Errorf("a cycle of files next to a folder is allowed, got %v", err)
+	}
+
+	// untyped nodes may form cycles
+	if err := topologyDB(&fakeClient{}, conf).checkTopology([]edgeSpec{{"$a", "$b"}, {"$b", "$a"}}, nil); err != nil {
+		t.Errorf("cycles outside DAG types are allowed, got %v", err)
+	}
+}
+
+func TestUpdateEdgesRejectsTopologyViolation(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[{"uid":"0x1","ty":"file","oc":0},{"uid":"0x2","ty":"file","oc":0}]}`)}
+	db := topologyDB(fake, Config{"policy.edges.file.maxout": "0"})
+
+	_, err := db.AddNodeEdges(&[]string{"0x1"}, nil, &[]string{"0x2"})
+	if _, ok := err.(PolicyError); !ok {
+		t.Fatalf("expected a PolicyError, got %v", err)
+	}
+	if fake.lastMutation != nil {
+		t.Error("nothing should be written when a constraint is broken")
+	}
+
+	// removing edges is never constrained
+	if _, err := db.RemoveNodeEdges(&[]string{"0x1"}, nil, &[]string{"0x2"}); err != nil {
+		t.Errorf("edge removal should not be checked, got %v", err)
+	}
+}
@@ -0,0 +1,330 @@
+package services
+
+import (
+	"cogged/log"
+	cm "cogged/models"
+	req "cogged/requests"
+	res "cogged/responses"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo/v250/protos/api"
+)
+
+// UNIQUE_ID_OWNER is the one value of the "db.uniqueid" setting, which makes the id of a
+// node unique among the nodes of its owner. Unset, ids may repeat.
+const UNIQUE_ID_OWNER = "owner"
+
+// The outcomes of each node in an upsert, in CoggedResponse.Upserted.
+const (
+	UPSERT_CREATED = "created"
+	UPSERT_UPDATED = "updated"
+)
+
+func NewUniqueID(conf *Config) (string, error) {
+	u := conf.Get("db.uniqueid")
+	if u != "" && u != UNIQUE_ID_OWNER {
+		return "", fmt.Errorf("db.uniqueid must be %q or empty, not %q", UNIQUE_ID_OWNER, u)
+	}
+	return u, nil
+}
+
+func LoadUniqueID(conf *Config) string {
+	u, err := NewUniqueID(conf)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// Upsert runs an upsert block: the query, then each of the mutations whose condition holds
+// over the query's variables, committed as one transaction.
+func (d *DB) Upsert(query string, vars map[string]string, mus []*api.Mutation) (*api.Response, error) {
+	log.Debug("DB Upsert:", query, vars)
+	r := &api.Request{Query: query, Vars: vars, Mutations: mus, CommitNow: true}
+	resp, err := d.client.NewTxn().Do(context.Background(), r)
+	if err != nil {
+		log.Error("upsert", err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// checkUniqueIDs rejects an upsert that would give a node an id that another node of the
+// same owner has, when db.uniqueid is "owner". It reads before UpsertNodes writes, so two
+// requests at once can still both pass; UpsertNodesByID checks in the same transaction.
+func (db *DB) checkUniqueIDs(nodeList *[]*cm.GraphNode) error {
+	if db.UniqueID != UNIQUE_ID_OWNER {
+		return nil
+	}
+	seen := make(map[[2]string]bool)
+	decl, blocks, ids := []string{}, []string{}, []string{}
+	vars := make(map[string]string)
+	for _, n := range *nodeList {
+		if n.Id == nil || n.Owner == nil {
+			continue
+		}
+		k := [2]string{n.Owner.Uid, *n.Id}
+		if seen[k] {
+			return PolicyError{Info: fmt.Sprintf("two nodes have id %q", *n.Id)}
+		}
+		seen[k] = true
+		i := len(ids)
+		filter := "uid_in(own, " + SanitiseUID(n.Owner.Uid) + ")"
+		if ValidateUid(n.Uid) {
+			filter += " AND NOT uid(" + SanitiseUID(n.Uid) + ")"
+		}
+		decl = append(decl, fmt.Sprintf("$id%d: string", i))
+		vars[fmt.Sprintf("$id%d", i)] = *n.Id
+		blocks = append(blocks, fmt.Sprintf("q%d(func: eq(id, $id%d), first: 1) @filter(%s) { uid }", i, i, filter))
+		ids = append(ids, *n.Id)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	query := "query q(" + strings.Join(decl, ", ") + ") {\n" + strings.Join(blocks, "\n") + "\n}"
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return DBError{Info: "DB query failed"}
+	}
+	found := make(map[string][]*cm.GraphNode)
+	if err := json.Unmarshal([]byte(*sp), &found); err != nil {
+		return DBError{Info: "could not parse query result"}
+	}
+	for i, id := range ids {
+		if len(found[fmt.Sprintf("q%d", i)]) > 0 {
+			return PolicyError{Info: fmt.Sprintf("id %q is already used by another node of the same owner", id)}
+		}
+	}
+	return nil
+}
+
+// UpsertNodesByID writes the new nodes of a PUT /graph/nodes upsert, and the edges to them
+// from the nodes the request links them to (its parent), in one upsert block. A new node
+// that is the same as an existing node, by the rule by names (see
+// requests.UPSERT_BY_PARENT), updates that node's payload and edges instead of being
+// created; its owner, share group and permissions are left as they are. Only the user's
+// own nodes are updated: if a node matches one of another user's, or more than one, or,
+// with db.uniqueid, would repeat the id of another of the user's nodes, nothing at all is
+// written, so a failed import can be fixed and run again. The matches are read before the
+// topology constraints are checked, so that a matched node is checked as it is stored.
+func (db *DB) UpsertNodesByID(nodeList *[]*cm.GraphNode, by, ownerUid string) (*res.CoggedResponse, error) {
+	if err := checkUpsertNodeList(nodeList); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+	if db.UniqueID == UNIQUE_ID_OWNER {
+		ids := make(map[string]bool)
+		for _, n := range *nodeList {
+			if n.Id == nil {
+				continue
+			}
+			if ids[*n.Id] {
+				err := PolicyError{Info: fmt.Sprintf("two nodes have id %q", *n.Id)}
+				return res.CoggedResponseFromError(err.Error()), err
+			}
+			ids[*n.Id] = true
+		}
+	}
+	// the new nodes, each matched by the query variable n<k>, and the existing nodes the
+	// request links to them
+	news, links := []*cm.GraphNode{}, []*cm.GraphNode{}
+	index := make(map[string]int)
+	for _, n := range *nodeList {
+		if ValidateUid(n.Uid) {
+			links = append(links, n)
+			continue
+		}
+		index[n.Uid] = len(news)
+		news = append(news, n)
+	}
+	ref := func(uid string) string {
+		if k, ok := index[uid]; ok {
+			return fmt.Sprintf("uid(n%d)", k)
+		}
+		return SanitiseUID(uid)
+	}
+	parents := []string{}
+	for _, l := range links {
+		parents = append(parents, SanitiseUID(l.Uid))
+	}
+
+	own := "uid_in(own, " + SanitiseUID(ownerUid) + ")"
+	decl, blocks, guard := []string{}, []string{}, []string{}
+	vars := make(map[string]string)
+	// the blocks are first run as a plain query, to see which nodes match
+	for k, n := range news {
+		decl = append(decl, fmt.Sprintf("$id%d: string, $ty%d: string", k, k))
+		vars[fmt.Sprintf("$id%d", k)], vars[fmt.Sprintf("$ty%d", k)] = *n.Id, *n.Type
+		if by == req.UPSERT_BY_PARENT {
+			blocks = append(blocks,
+				fmt.Sprintf("var(func: uid(%s)) { e @filter(eq(id, $id%d) AND eq(ty, $ty%d)) { n%d as uid } }", strings.Join(parents, ", "), k, k, k),
+				fmt.Sprintf("f%d as var(func: uid(n%d)) @filter(NOT %s)", k, k, own),
+				fmt.Sprintf("qf%d(func: uid(f%d)) { uid }", k, k))
+			guard = append(guard, fmt.Sprintf("eq(len(f%d), 0)", k))
+		} else {
+			blocks = append(blocks, fmt.Sprintf("n%d as var(func: eq(id, $id%d)) @filter(eq(ty, $ty%d) AND %s)", k, k, k, own))
+		}
+		blocks = append(blocks, fmt.Sprintf("qn%d(func: uid(n%d)) { uid own { uid } sgi r w o i d s }", k, k))
+		if db.UniqueID == UNIQUE_ID_OWNER {
+			blocks = append(blocks,
+				fmt.Sprintf("d%d as var(func: eq(id, $id%d)) @filter(%s AND NOT uid(n%d))", k, k, own, k),
+				fmt.Sprintf("qd%d(func: uid(d%d)) { uid }", k, k))
+			guard = append(guard, fmt.Sprintf("eq(len(d%d), 0)", k))
+		}
+	}
+	conflicts := func(found map[string][]*cm.GraphNode) error {
+		c := []string{}
+		for k, n := range news {
+			switch {
+			case len(found[fmt.Sprintf("qn%d", k)]) > 1:
+				c = append(c, fmt.Sprintf("%d nodes already have id %q and ty %q", len(found[fmt.Sprintf("qn%d", k)]), *n.Id, *n.Type))
+			case len(found[fmt.Sprintf("qf%d", k)]) > 0:
+				c = append(c, fmt.Sprintf("the node with id %q and ty %q belongs to another user", *n.Id, *n.Type))
+			case len(found[fmt.Sprintf("qd%d", k)]) > 0:
+				c = append(c, fmt.Sprintf("id %q is already used by another node of the same owner", *n.Id))
+			}
+		}
+		if len(c) > 0 {
+			return PolicyError{Info: "nothing was written: " + strings.Join(c, "; ")}
+		}
+		return nil
+	}
+
+	query := "query q(" + strings.Join(decl, ", ") + ") {\n" + strings.Join(blocks, "\n") + "\n}"
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return res.CoggedResponseFromError("DB query failed"), DBError{Info: "DB query failed"}
+	}
+	matches := make(map[string][]*cm.GraphNode)
+	if err := json.Unmarshal([]byte(*sp), &matches); err != nil {
+		return res.CoggedResponseFromError("could not parse query result"), DBError{Info: "could not parse query result"}
+	}
+	if err := conflicts(matches); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+
+	// The topology constraints are checked against the nodes that will actually be
+	// written, so a matched node's stored out-degree and edges count. The upsert block is
+	// then pinned to the same matches: if another request changes them in between, its
+	// guard fails and nothing is written.
+	matched := make(map[string]string)
+	for k, n := range news {
+		if m := matches[fmt.Sprintf("qn%d", k)]; len(m) == 1 {
+			matched[n.Uid] = m[0].Uid
+			blocks = append(blocks, fmt.Sprintf("p%d as var(func: uid(n%d)) @filter(uid(%s))", k, k, SanitiseUID(m[0].Uid)))
+			guard = append(guard, fmt.Sprintf("eq(len(n%d), 1) AND eq(len(p%d), 1)", k, k))
+		} else {
+			guard = append(guard, fmt.Sprintf("eq(len(n%d), 0)", k))
+		}
+	}
+	resolve := func(uid string) string {
+		if m, ok := matched[uid]; ok {
+			return m
+		}
+		return uid
+	}
+	edges, types := upsertEdges(nodeList)
+	resolved, resolvedTypes := []edgeSpec{}, make(map[string]*string)
+	for _, e := range edges {
+		resolved = append(resolved, edgeSpec{src: resolve(e.src), dst: resolve(e.dst)})
+	}
+	for uid, ty := range types {
+		resolvedTypes[resolve(uid)] = ty
+	}
+	if err := db.checkTopology(resolved, resolvedTypes); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+	if err := db.embedNodes(nodeList); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+	all := strings.Join(guard, " AND ")
+
+	tnow := time.Now().UTC()
+	mus := []*api.Mutation{}
+	for k, n := range news {
+		created := *n
+		created.Uid = fmt.Sprintf("uid(n%d)", k)
+		if n.OutEdges != nil && len(*n.OutEdges) > 0 {
+			edges := []*cm.GraphNode{}
+			for _, e := range *n.OutEdges {
+				edges = append(edges, cm.NewGraphNodeJustUID(ref(e.Uid)))
+			}
+			created.OutEdges = &edges
+		}
+		created.TimeCreated, created.TimeModified = &tnow, &tnow
+		created.DgraphType = []string{"N"}
+		created.ClearUnstoredFields()
+
+		updated := created
+		updated.Owner, updated.Sgi, updated.Type, updated.Id = nil, nil, nil, nil
+		updated.PermRead, updated.PermWrite, updated.PermOutEdge = nil, nil, nil
+		updated.PermInEdge, updated.PermDelete, updated.PermShare = nil, nil, nil
+		updated.TimeCreated, updated.DgraphType = nil, nil
+
+		cj, _ := json.Marshal(&created)
+		uj, _ := json.Marshal(&updated)
+		mus = append(mus,
+			&api.Mutation{SetJson: cj, Cond: fmt.Sprintf("@if(eq(len(n%d), 0) AND %s)", k, all)},
+			&api.Mutation{SetJson: uj, Cond: fmt.Sprintf("@if(eq(len(n%d), 1) AND %s)", k, all)})
+	}
+	if len(links) > 0 {
+		set := []*cm.GraphNode{}
+		for _, l := range links {
+			edges := []*cm.GraphNode{}
+			if l.OutEdges != nil {
+				for _, e := range *l.OutEdges {
+					edges = append(edges, cm.NewGraphNodeJustUID(ref(e.Uid)))
+				}
+			}
+			set = append(set, &cm.GraphNode{GraphBase: cm.GraphBase{Uid: SanitiseUID(l.Uid)}, OutEdges: &edges, TimeModified: &tnow})
+		}
+		lj, _ := json.Marshal(set)
+		mus = append(mus, &api.Mutation{SetJson: lj, Cond: "@if(" + all + ")"})
+	}
+
+	query = "query q(" + strings.Join(decl, ", ") + ") {\n" + strings.Join(blocks, "\n") + "\n}"
+	mr, err := db.Upsert(query, vars, mus)
+	if mr == nil || err != nil {
+		return res.CoggedResponseFromError("DB operation failed"), err
+	}
+	found := make(map[string][]*cm.GraphNode)
+	if err := json.Unmarshal(mr.Json, &found); err != nil {
+		return res.CoggedResponseFromError("could not parse upsert result"), DBError{Info: "could not parse upsert result"}
+	}
+	if err := conflicts(found); err != nil {
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+	for k, n := range news {
+		m := found[fmt.Sprintf("qn%d", k)]
+		if len(m) == 1 && m[0].Uid == matched[n.Uid] || len(m) == 0 && matched[n.Uid] == "" {
+			continue
+		}
+		err := PolicyError{Info: fmt.Sprintf("nothing was written: the node with id %q and ty %q was created or changed by another request meanwhile", *n.Id, *n.Type)}
+		return res.CoggedResponseFromError(err.Error()), err
+	}
+
+	nodes := make(cm.NodePtrDictionary)
+	upserted := make(map[string]string)
+	for k, n := range news {
+		if m := found[fmt.Sprintf("qn%d", k)]; len(m) == 1 {
+			nodes[n.Uid] = cm.NewGraphNodeJustOwnerAndPerms(m[0])
+			upserted[n.Uid] = UPSERT_UPDATED
+			continue
+		}
+		uid, ok := mr.Uids[fmt.Sprintf("uid(n%d)", k)]
+		if !ok {
+			log.Error("upsert created a node with no uid; skipping", n.Uid)
+			continue
+		}
+		created := cm.NewGraphNodeJustOwnerAndPerms(n)
+		created.Uid = uid
+		nodes[n.Uid] = created
+		upserted[n.Uid] = UPSERT_CREATED
+	}
+	cr := res.CoggedResponseFromNodesMap(&nodes)
+	cr.Upserted = upserted
+	return cr, nil
+}
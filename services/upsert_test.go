@@ -0,0 +1,175 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/dgo/v250/protos/api"
+)
+
+func TestNewUniqueID(t *testing.T) {
+	if u, err := NewUniqueID(&Config{"db.uniqueid": "owner"}); err != nil || u != UNIQUE_ID_OWNER {
+		t.Errorf("unexpected %q %v", u, err)
+	}
+	if u, err := NewUniqueID(&Config{}); err != nil || u != "" {
+		t.Errorf("ids should not be unique by default, got %q %v", u, err)
+	}
+	if _, err := NewUniqueID(&Config{"db.uniqueid": "owners"}); err == nil {
+		t.Error("expected an unknown scope to be rejected")
+	}
+}
+
+// upsertList is a PUT /graph/nodes upsert as the handler passes it on: the new nodes, owned
+// by 0x9, then the parent 0x1 linking to those not linked from another new node.
+func upsertList(nodes ...*cm.GraphNode) *[]*cm.GraphNode {
+	list := []*cm.GraphNode{}
+	edges := []*cm.GraphNode{}
+	for _, n := range nodes {
+		n.Owner = cm.NewGraphUser("0x9")
+		list = append(list, n)
+		edges = append(edges, cm.NewGraphNodeJustUID(n.Uid))
+	}
+	parent := cm.NewGraphNodeJustUID("0x1")
+	parent.OutEdges = &edges
+	list = append(list, parent)
+	return &list
+}
+
+func upsertNode(uid, id, ty string) *cm.GraphNode {
+	n := cm.NewGraphNodeJustUID(uid)
+	n.Id, n.Type = &id, &ty
+	s1 := "from " + id
+	n.String1 = &s1
+	return n
+}
+
+func TestUpsertNodesByID(t *testing.T) {
+	fake := &fakeClient{
+		queryJSON:  []byte(`{"qn0":[],"qn1":[{"uid":"0x5","own":{"uid":"0x9"},"sgi":"old","r":true}],"qf0":[],"qf1":[]}`),
+		mutateResp: &api.Response{Uids: map[string]string{"uid(n0)": "0x7"}},
+	}
+	// fields a client may echo back from a query result are never written
+	a, score := upsertNode("$a", "A-1", "task"), 0.5
+	a.Score, a.Similarity = &score, &score
+	cr, err := newFakeDB(fake).UpsertNodesByID(upsertList(a, upsertNode("$b", "B-1", "task")), req.UPSERT_BY_PARENT, "0x9")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cr.Upserted["$a"] != UPSERT_CREATED || cr.Upserted["$b"] != UPSERT_UPDATED {
+		t.Errorf("expected $a created and $b updated, got %v", cr.Upserted)
+	}
+	if cr.CreatedNodes["$a"].Uid != "0x7" || cr.CreatedNodes["$b"].Uid != "0x5" || *cr.CreatedNodes["$b"].Sgi != "old" {
+		t.Errorf("expected the created uid and the stored node's envelope, got %+v %+v", cr.CreatedNodes["$a"], cr.CreatedNodes["$b"])
+	}
+
+	r := fake.lastRequest
+	for _, want := range []string{
+		"var(func: uid(0x1)) { e @filter(eq(id, $id1) AND eq(ty, $ty1)) { n1 as uid } }",
+		"f1 as var(func: uid(n1)) @filter(NOT uid_in(own, 0x9))",
+		"p1 as var(func: uid(n1)) @filter(uid(0x5))",
+	} {
+		if !strings.Contains(r.Query, want) {
+			t.Errorf("expected %q in the query:\n%s", want, r.Query)
+		}
+	}
+	if r.Vars["$id1"] != "B-1" || r.Vars["$ty1"] != "task" || !r.CommitNow || len(r.Mutations) != 5 {
+		t.Errorf("unexpected request %+v", r)
+	}
+	guard := "eq(len(f1), 0) AND eq(len(n0), 0) AND eq(len(n1), 1) AND eq(len(p1), 1)"
+	if c := r.Mutations[2].Cond; !strings.HasPrefix(c, "@if(eq(len(n1), 0) AND ") || !strings.Contains(c, guard) {
+		t.Errorf("expected the create of $b to be guarded, got %q", c)
+	}
+	if created := string(r.Mutations[0].SetJson); strings.Contains(created, `"score"`) || strings.Contains(created, `"similarity"`) {
+		t.Errorf("request and response only fields should be cleared, got %s", created)
+	}
+	var updated map[string]interface{}
+	json.Unmarshal(r.Mutations[3].SetJson, &updated)
+	if updated["uid"] != "uid(n1)" || updated["s1"] != "from B-1" || updated["own"] != nil || updated["sgi"] != nil || updated["c"] != nil {
+		t.Errorf("an update should set the payload and leave the envelope, got %v", updated)
+	}
+	if link := string(r.Mutations[4].SetJson); !strings.Contains(link, `"e":[{"uid":"uid(n0)"},{"uid":"uid(n1)"}]`) {
+		t.Errorf("expected the parent linked to both, got %s", link)
+	}
+}
+
+func TestUpsertNodesByIDConflicts(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"qn0":[{"uid":"0x5"},{"uid":"0x6"}],"qn1":[],"qd1":[{"uid":"0x8"}]}`)}
+	db := newFakeDB(fake)
+	db.UniqueID = UNIQUE_ID_OWNER
+	cr, err := db.UpsertNodesByID(upsertList(upsertNode("$a", "A-1", "task"), upsertNode("$b", "B-1", "note")), req.UPSERT_BY_OWNER, "0x9")
+	if _, ok := err.(PolicyError); !ok || !strings.Contains(cr.Error, `2 nodes already have id "A-1"`) || !strings.Contains(cr.Error, `id "B-1" is already used`) {
+		t.Errorf("expected both conflicts reported, got %v %q", err, cr.Error)
+	}
+	if fake.lastRequest != nil {
+		t.Error("the conflicts should be found before the upsert block is sent")
+	}
+	q := fake.lastQuery
+	if !strings.Contains(q, "n0 as var(func: eq(id, $id0)) @filter(eq(ty, $ty0) AND uid_in(own, 0x9))") || !strings.Contains(q, "d1 as var(func: eq(id, $id1)) @filter(uid_in(own, 0x9) AND NOT uid(n1))") {
+		t.Errorf("unexpected query:\n%s", q)
+	}
+
+	fake.lastRequest = nil
+	_, err = db.UpsertNodesByID(upsertList(upsertNode("$a", "A-1", "task"), upsertNode("$b", "A-1", "note")), req.UPSERT_BY_OWNER, "0x9")
+	if err == nil || fake.lastRequest != nil {
+		t.Errorf("two new nodes with one id should be refused before anything is sent, got %v", err)
+	}
+}
+
+// A matched node is checked against the topology constraints as it is stored: 0x5 already
+// has its one allowed out-edge, so the upsert cannot link it to another new node.
+func TestUpsertNodesByIDChecksTopologyOfMatches(t *testing.T) {
+	fake := &fakeClient{queryJSONs: [][]byte{
+		[]byte(`{"qn0":[{"uid":"0x5"}],"qn1":[]}`),
+		[]byte(`{"qr":[{"uid":"0x1","oc":1,"ex":[{"uid":"0x5"}]},{"uid":"0x5","ty":"task","oc":1}]}`),
+	}}
+	db := topologyDB(fake, Config{"policy.edges.task.maxout": "1"})
+	a, b := upsertNode("$a", "A-1", "task"), upsertNode("$b", "B-1", "task")
+	a.OutEdges = &[]*cm.GraphNode{cm.NewGraphNodeJustUID("$b")}
+	list := upsertList(a)
+	b.Owner = cm.NewGraphUser("0x9")
+	*list = append(*list, b)
+
+	_, err := db.UpsertNodesByID(list, req.UPSERT_BY_PARENT, "0x9")
+	if err == nil || !strings.Contains(err.Error(), "policy.edges.task.maxout") {
+		t.Errorf("expected the stored out-edge of the match to count, got %v", err)
+	}
+	if fake.lastRequest != nil {
+		t.Error("nothing should be written when a constraint is broken")
+	}
+	if topo := fake.queries[1]; !strings.Contains(topo, "0x5") || strings.Contains(topo, "$a") {
+		t.Errorf("the topology should be read for the matched uid:\n%s", topo)
+	}
+}
+
+// If the matches change between the read and the upsert block, the block's guard fails
+// and the upsert reports that nothing was written.
+func TestUpsertNodesByIDMatchesChanged(t *testing.T) {
+	fake := &fakeClient{queryJSONs: [][]byte{
+		[]byte(`{"qn0":[{"uid":"0x5"}]}`),
+		[]byte(`{"qn0":[]}`),
+	}}
+	_, err := newFakeDB(fake).UpsertNodesByID(upsertList(upsertNode("$a", "A-1", "task")), req.UPSERT_BY_OWNER, "0x9")
+	if _, ok := err.(PolicyError); !ok || !strings.Contains(err.Error(), "changed by another request") {
+		t.Errorf("expected the changed match to be reported, got %v", err)
+	}
+	if c := fake.lastRequest.Mutations[0].Cond; !strings.Contains(c, "eq(len(n0), 1) AND eq(len(p0), 1)") {
+		t.Errorf("the block should be pinned to the match read first, got %q", c)
+	}
+}
+
+func TestUpsertNodesChecksUniqueIDs(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"q0":[{"uid":"0x8"}]}`)}
+	db := newFakeDB(fake)
+	db.UniqueID = UNIQUE_ID_OWNER
+	n := upsertNode("0x5", "A-1", "task")
+	n.Owner = cm.NewGraphUser("0x9")
+	if _, err := db.UpsertNodes(&[]*cm.GraphNode{n}); err == nil || fake.lastMutation != nil {
+		t.Errorf("expected the id in use to be refused, got %v", err)
+	}
+	if !strings.Contains(fake.lastQuery, "@filter(uid_in(own, 0x9) AND NOT uid(0x5))") {
+		t.Errorf("the node itself should not count, got:\n%s", fake.lastQuery)
+	}
+}
@@ -0,0 +1,179 @@
+package services
+
+import (
+	"cogged/log"
+	cm "cogged/models"
+	req "cogged/requests"
+	res "cogged/responses"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// CheckVectors reads the nodes with a vec VECTOR_CHECK_CHUNK at a time, lists the first
+	// MAX_VECTOR_CHECK_REPORT invalid ones, and re-embeds VECTOR_REEMBED_BATCH at a time.
+	VECTOR_CHECK_CHUNK      = 1000
+	MAX_VECTOR_CHECK_REPORT = 1000
+	VECTOR_REEMBED_BATCH    = 100
+)
+
+// vectorProblem says what is wrong with a node's vec, or "" if nothing is: it does not
+// parse, is all zeros, or has other than the vec_dim of the node's payload schema.
+func vectorProblem(n *cm.GraphNode) string {
+	if err := n.Vec.Validate(); err != nil {
+		return err.Error()
+	}
+	if s := cm.PayloadSchemaFor(n.Type); s != nil {
+		if err := s.ValidateVecDim(n.Vec); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// CheckVectors checks the vec of every node, or of every node of type ty, reading them a
+// chunk at a time at one Dgraph timestamp. It finds the vectors written before their
+// type's vec_dim was set or changed, and those of nodes whose type changed since. With
+// reembed, each invalid vec is replaced by the Embedder's embedding of the node's embed
+// fields, where it has any text in them; otherwise it is only reported.
+func (db *DB) CheckVectors(ty string, reembed bool) *res.VectorCheckResponse {
+	if reembed && (db.Embedder == nil || len(db.EmbedFields) == 0) {
+		return res.VectorCheckResponseFromError("reembed needs an embedder configured with embed.provider and embed.fields")
+	}
+	vars := make(map[string]string)
+	filter := ""
+	if ty != "" {
+		filter = renderRootFilter("", &req.QueryRequestClause{Field: "ty", Op: OP_EQ, Val: ty}, &vars)
+	}
+	tnow := time.Now().UTC()
+	resp := &res.VectorCheckResponse{Invalid: []*res.InvalidVector{}, ServerTime: &tnow}
+	invalid := []string{}
+	var ts uint64
+	after := ""
+	for {
+		page := ""
+		if after != "" {
+			page = ", after: " + SanitiseUID(after)
+		}
+		query := `query q(` + renderQueryParams(nil, &vars) + `) {
+		qr(func: has(` + VEC_FIELD + `), first: ` + fmt.Sprintf("%d", VECTOR_CHECK_CHUNK) + page + `)` + filter + ` {
+			uid ty ` + VEC_FIELD + `
+		}
+	}`
+		sp, readTs, err := db.QueryAt(query, &vars, ts)
+		if err != nil {
+			return res.VectorCheckResponseFromError("DB query failed")
+		}
+		ts = readTs
+		nodes := SliceFromResultJSON[cm.GraphNode](sp)
+		if nodes == nil {
+			return res.VectorCheckResponseFromError("could not parse query result")
+		}
+		for _, n := range *nodes {
+			resp.Checked++
+			problem := vectorProblem(n)
+			if problem == "" {
+				continue
+			}
+			resp.Found++
+			invalid = append(invalid, n.Uid)
+			if len(resp.Invalid) < MAX_VECTOR_CHECK_REPORT {
+				iv := &res.InvalidVector{Uid: n.Uid, Reason: problem}
+				if n.Type != nil {
+					iv.Type = *n.Type
+				}
+				if vals, err := n.Vec.Values(); err == nil {
+					iv.Dims = len(vals)
+				}
+				resp.Invalid = append(resp.Invalid, iv)
+			}
+		}
+		if len(*nodes) < VECTOR_CHECK_CHUNK {
+			break
+		}
+		after = (*nodes)[len(*nodes)-1].Uid
+	}
+
+	if reembed {
+		fixed := make(map[string]bool)
+		for i := 0; i < len(invalid); i += VECTOR_REEMBED_BATCH {
+			done, err := db.reembedNodes(invalid[i:min(i+VECTOR_REEMBED_BATCH, len(invalid))])
+			if err != nil {
+				resp.Error = err.Error()
+				break
+			}
+			for _, u := range done {
+				fixed[u] = true
+			}
+		}
+		resp.Reembedded = len(fixed)
+		for _, iv := range resp.Invalid {
+			iv.Reembedded = fixed[iv.Uid]
+		}
+	}
+	return resp
+}
+
+// reembedNodes writes a fresh vec, embedded from their embed fields, to each of uids that
+// has text in them, returning the uids it wrote.
+func (db *DB) reembedNodes(uids []string) ([]string, error) {
+	vars := map[string]string{
+		"$ids": "[" + strings.Join(sanitiseListOfUids(uids), ",") + "]",
+	}
+	query := `query q($ids: string) {
+		qr(func: uid($ids)) {
+			uid ty ` + strings.Join(db.EmbedFields, " ") + `
+		}
+	}`
+	sp, err := db.Query(query, &vars)
+	if err != nil {
+		return nil, DBError{Info: "DB query failed"}
+	}
+	nodes := SliceFromResultJSON[cm.GraphNode](sp)
+	if nodes == nil {
+		return nil, DBError{Info: "could not parse query result"}
+	}
+	texts := []string{}
+	targets := []*cm.GraphNode{}
+	for _, n := range *nodes {
+		if text := embedText(n, nil, db.EmbedFields); text != "" {
+			texts = append(texts, text)
+			targets = append(targets, n)
+		}
+	}
+	if len(texts) == 0 {
+		return nil, nil
+	}
+	vecs, err := db.Embedder.Embed(texts)
+	if err != nil {
+		return nil, err
+	}
+	if len(vecs) != len(texts) {
+		return nil, EmbedError{Info: "embedder returned the wrong number of embeddings"}
+	}
+	tnow := time.Now().UTC()
+	updates := []*cm.GraphNode{}
+	for i, v := range vecs {
+		vec := cm.Vector(formatVector(v))
+		n := &cm.GraphNode{GraphBase: cm.GraphBase{Uid: targets[i].Uid}, Type: targets[i].Type, Vec: &vec}
+		if vectorProblem(n) != "" {
+			log.Error("re-embedded vec is still invalid", map[string]string{"uid": n.Uid, "problem": vectorProblem(n)})
+			continue
+		}
+		// the type was only read to check the vec against; it is not written back
+		n.Type, n.TimeModified = nil, &tnow
+		updates = append(updates, n)
+	}
+	if len(updates) == 0 {
+		return nil, nil
+	}
+	if _, err := db.Mutate(&updates, ADD); err != nil {
+		return nil, DBError{Info: "DB operation failed"}
+	}
+	done := []string{}
+	for _, n := range updates {
+		done = append(done, n.Uid)
+	}
+	return done, nil
+}
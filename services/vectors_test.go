@@ -0,0 +1,91 @@
+package services
+
+import (
+	cm "cogged/models"
+	req "cogged/requests"
+	sec "cogged/security"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/dgraph-io/dgo/v250/protos/api"
+)
+
+func TestCheckVectors(t *testing.T) {
+	doc := &cm.PayloadSchema{Type: "doc", VecDim: 3}
+	cm.SetPayloadSchemas([]*cm.PayloadSchema{doc})
+	defer cm.SetPayloadSchemas(nil)
+	scan := []byte(`{"qr":[
+		{"uid":"0x1","ty":"doc","vec":[1,0,0]},
+		{"uid":"0x2","ty":"doc","vec":[1,0]},
+		{"uid":"0x3","ty":"note","vec":"[0,0]"},
+		{"uid":"0x4","vec":[1,2]}
+	]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{scan}, readTs: 7}
+
+	resp := newFakeDB(fake).CheckVectors("doc", false)
+	if resp.Error != "" {
+		t.Fatalf("unexpected error: %q", resp.Error)
+	}
+	if resp.Checked != 4 || resp.Found != 2 || len(resp.Invalid) != 2 || resp.Reembedded != 0 {
+		t.Fatalf("expected 2 of 4 invalid, got %+v", resp)
+	}
+	if iv := resp.Invalid[0]; iv.Uid != "0x2" || iv.Type != "doc" || iv.Dims != 2 || !strings.Contains(iv.Reason, "3 dimensions") {
+		t.Errorf("unexpected report %+v", iv)
+	}
+	if iv := resp.Invalid[1]; iv.Uid != "0x3" || !strings.Contains(iv.Reason, "zeros") {
+		t.Errorf("unexpected report %+v", iv)
+	}
+	if !strings.Contains(fake.queries[0], "qr(func: has(vec), first: 1000) @filter((eq(ty,$") || len(fake.lastVars) != 1 {
+		t.Errorf("expected a scan of one type:\n%s %v", fake.queries[0], fake.lastVars)
+	}
+
+	// without an embedder there is nothing to re-embed with
+	if resp := newFakeDB(&fakeClient{}).CheckVectors("", true); resp.Error == "" {
+		t.Error("expected reembed without an embedder to be rejected")
+	}
+}
+
+func TestCheckVectorsReembeds(t *testing.T) {
+	doc := &cm.PayloadSchema{Type: "doc", VecDim: 4}
+	cm.SetPayloadSchemas([]*cm.PayloadSchema{doc})
+	defer cm.SetPayloadSchemas(nil)
+	scan := []byte(`{"qr":[{"uid":"0x1","ty":"doc","vec":[1,0]},{"uid":"0x2","ty":"doc","vec":[0,1]}]}`)
+	text := []byte(`{"qr":[{"uid":"0x1","ty":"doc","s1":"oat milk"},{"uid":"0x2","ty":"doc"}]}`)
+	fake := &fakeClient{queryJSONs: [][]byte{scan, text}, mutateResp: &api.Response{}}
+	db := newFakeDB(fake)
+	db.Embedder, db.EmbedFields = &HashEmbedder{Dim: 4}, []string{"s1"}
+
+	resp := db.CheckVectors("", true)
+	if resp.Error != "" || resp.Found != 2 || resp.Reembedded != 1 {
+		t.Fatalf("expected the node with text re-embedded, got %+v", resp)
+	}
+	if !resp.Invalid[0].Reembedded || resp.Invalid[1].Reembedded {
+		t.Errorf("only 0x1 has text to embed, got %+v %+v", resp.Invalid[0], resp.Invalid[1])
+	}
+	var written []map[string]interface{}
+	if err := json.Unmarshal(fake.lastMutation.SetJson, &written); err != nil || len(written) != 1 {
+		t.Fatalf("expected one node written, got %s", fake.lastMutation.SetJson)
+	}
+	if written[0]["uid"] != "0x1" || written[0]["vec"] == nil || written[0]["m"] == nil || written[0]["ty"] != nil {
+		t.Errorf("expected only the vec and m of 0x1 written, got %v", written[0])
+	}
+}
+
+func TestVecSelectableNotFilterable(t *testing.T) {
+	fake := &fakeClient{queryJSON: []byte(`{"qr":[{"uid":"0x1","vec":[0.5,1]}]}`)}
+	reader := &sec.UserAuthData{Uid: "0x9", Role: "user"}
+	q := &req.QueryRequest{RootIDs: []string{"0x1"}, Select: []string{"vec"}}
+	resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, reader, []string{"sg1"})
+	if resp.Error != "" || len(resp.ResultNodes) != 1 || resp.ResultNodes[0].Vec == nil || *resp.ResultNodes[0].Vec != "[0.5,1]" {
+		t.Fatalf("expected vec read back, got %q %+v", resp.Error, resp.ResultNodes)
+	}
+	if !strings.Contains(fake.lastQuery, " vec") {
+		t.Errorf("vec should be selected:\n%s", fake.lastQuery)
+	}
+	fake = &fakeClient{}
+	q = &req.QueryRequest{RootIDs: []string{"0x1"}, Filters: &req.QueryRequestClause{Field: "vec", Op: "exists"}}
+	if resp := newFakeDB(fake).QueryWithOptions(q, NODENODE, reader, nil); resp.Error == "" || fake.lastQuery != "" {
+		t.Errorf("filtering on vec should be rejected, got %q", resp.Error)
+	}
+}
@@ -41,8 +41,8 @@ func read(t *testing.T, root, rel string) string {
 // codeRoutes returns the set of "METHOD /group/endpoint" derived from the handler
 // switch cases in api/<group>.go. The group is the file name (auth, graph, ...).
 func codeRoutes(t *testing.T, root string) map[string]bool {
-	caseRe := regexp.MustCompile(`case "(GET|POST|PUT|PATCH|DELETE) (\w+)":`)
-	groups := []string{"auth", "admin", "graph", "user"} // health is a catch-all, handled separately
+	caseRe := regexp.MustCompile(`case "(GET|POST|PUT|PATCH|DELETE) (\w+)"[,:]`)
+	groups := []string{"auth", "admin", "graph", "user", "blob"} // health is a catch-all, handled separately
 	routes := map[string]bool{}
 	for _, g := range groups {
 		src := read(t, root, filepath.Join("api", g+".go"))